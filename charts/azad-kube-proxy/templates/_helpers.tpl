@@ -86,3 +86,24 @@ Return the appropriate apiVersion for policy.
 {{- print "policy/v1" -}}
 {{- end -}}
 {{- end -}}
+
+{{/*
+Fail when graph notifications are enabled with the memory cache and more than one replica, since every replica only
+evicts the users of its own cache
+*/}}
+{{- define "azad-kube-proxy.validateGraphNotifications" -}}
+{{- $graphNotifications := false }}
+{{- $cacheEngine := "MEMORY" }}
+{{- range .Values.podEnv }}
+{{- if and (eq .name "GRAPH_NOTIFICATIONS_URL") (or .value .valueFrom) }}
+{{- $graphNotifications = true }}
+{{- end }}
+{{- if eq .name "CACHE_ENGINE" }}
+{{- $cacheEngine = .value | default "MEMORY" | upper }}
+{{- end }}
+{{- end }}
+{{- $multipleReplicas := or (gt (int .Values.replicaCount) 1) (and .Values.autoscaling.enabled (gt (int .Values.autoscaling.maxReplicas) 1)) }}
+{{- if and $graphNotifications $multipleReplicas (ne $cacheEngine "REDIS") }}
+{{- fail "GRAPH_NOTIFICATIONS_URL requires CACHE_ENGINE REDIS with more than one replica, since every replica only evicts the users of its own cache" }}
+{{- end }}
+{{- end -}}
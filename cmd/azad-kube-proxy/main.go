@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -22,6 +23,9 @@ var (
 	Created = ""
 )
 
+// errCheckFailed is returned by the check subcommand when the config is valid but one or more checks failed
+var errCheckFailed = errors.New("one or more checks failed")
+
 func main() {
 	// Initiate the logging
 	var log logr.Logger
@@ -37,7 +41,7 @@ func main() {
 	err = run(ctx)
 	if err != nil {
 		log.Error(err, "application returned an error")
-		os.Exit(1)
+		os.Exit(getExitCode(err))
 	}
 }
 
@@ -47,6 +51,20 @@ func run(ctx context.Context) error {
 		return err
 	}
 
+	// Run the preflight checks instead of starting the proxy
+	if cfg.Check != nil {
+		passed, err := proxy.Check(ctx, os.Stdout, cfg)
+		if err != nil {
+			return fmt.Errorf("unable to run checks: %w", err)
+		}
+
+		if !passed {
+			return errCheckFailed
+		}
+
+		return nil
+	}
+
 	// Start reverse proxy
 	server, err := proxy.New(ctx, cfg)
 	if err != nil {
@@ -61,3 +79,12 @@ func run(ctx context.Context) error {
 
 	return nil
 }
+
+// getExitCode returns 2 when checks failed, so that a failed check can be told apart from an invalid config (1)
+func getExitCode(err error) int {
+	if errors.Is(err, errCheckFailed) {
+		return 2
+	}
+
+	return 1
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"testing"
 
@@ -48,3 +50,9 @@ func testGetEnvOrSkip(t *testing.T, envVar string) string {
 
 	return v
 }
+
+func TestGetExitCode(t *testing.T) {
+	require.Equal(t, 1, getExitCode(errors.New("ze-error")))
+	require.Equal(t, 2, getExitCode(errCheckFailed))
+	require.Equal(t, 2, getExitCode(fmt.Errorf("wrapped: %w", errCheckFailed)))
+}
@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+const adminAPIPathPrefix = "/admin"
+
+// adminAPI is served on the metrics listener and is protected by a shared token, sent as a bearer token
+type adminAPI struct {
+	token            string
+	cache            Cache
+	user             User
+	azure            Azure
+	identityRewriter *identityRewriter
+	jit              *jit
+}
+
+// adminGroup is a group as returned by the admin api
+type adminGroup struct {
+	Name     string `json:"name"`
+	ObjectID string `json:"objectID"`
+}
+
+// adminCachedUser is a user in the cache, the key is the subject of the token the user was resolved from
+type adminCachedUser struct {
+	Key      string        `json:"key"`
+	Username string        `json:"username"`
+	ObjectID string        `json:"objectID"`
+	Type     userModelType `json:"type"`
+	Groups   []adminGroup  `json:"groups"`
+}
+
+// adminResolvedUser is the identity of a user as it would be impersonated by the proxy, resolved using Microsoft Graph
+type adminResolvedUser struct {
+	Username           string        `json:"username"`
+	ObjectID           string        `json:"objectID"`
+	Type               userModelType `json:"type"`
+	Groups             []adminGroup  `json:"groups"`
+	ImpersonatedUser   string        `json:"impersonatedUser"`
+	ImpersonatedGroups []string      `json:"impersonatedGroups"`
+	JITGrants          []grantModel  `json:"jitGrants,omitempty"`
+	CacheKeys          []string      `json:"cacheKeys"`
+}
+
+type adminEvictResponse struct {
+	Evicted int `json:"evicted"`
+}
+
+type adminSyncResponse struct {
+	Status string `json:"status"`
+}
+
+// newAdminAPI returns nil if no admin api token is configured
+func newAdminAPI(cfg *config, azureClient Azure, h *handler) *adminAPI {
+	if cfg.AdminAPIToken == "" {
+		return nil
+	}
+
+	return &adminAPI{
+		token:            cfg.AdminAPIToken,
+		cache:            h.cache,
+		user:             h.user,
+		azure:            azureClient,
+		identityRewriter: h.identityRewriter,
+		jit:              h.jit,
+	}
+}
+
+func (a *adminAPI) handler(ctx context.Context) http.Handler {
+	router := mux.NewRouter()
+	adminRouter := router.PathPrefix(adminAPIPathPrefix).Subrouter()
+
+	adminRouter.HandleFunc("/cache/users", a.listCachedUsers(ctx)).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/cache/users/{objectID}", a.evictUser(ctx)).Methods(http.MethodDelete)
+	adminRouter.HandleFunc("/cache/groups", a.listCachedGroups(ctx)).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/groups/sync", a.syncGroups(ctx)).Methods(http.MethodPost)
+	adminRouter.HandleFunc("/users/{objectID}", a.resolveUser(ctx)).Methods(http.MethodGet)
+
+	if a.jit != nil {
+		adminRouter.HandleFunc("/jit/grants", a.listGrants(ctx)).Methods(http.MethodGet)
+		adminRouter.HandleFunc("/jit/grants", a.createGrant(ctx)).Methods(http.MethodPost)
+		adminRouter.HandleFunc("/jit/grants/{id}", a.revokeGrant(ctx)).Methods(http.MethodDelete)
+	}
+
+	return a.authenticate(ctx, router)
+}
+
+func (a *adminAPI) authenticate(ctx context.Context, next http.Handler) http.Handler {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := getBearerToken(r)
+		if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			log.Info("Admin api request with invalid token", "path", r.URL.Path, "sourceIP", getClientIP(r))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		setAuditAuth(r.Context(), auditAuth{Method: adminTokenAuthMethod})
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminAPI) listCachedUsers(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := a.cache.listUsers(r.Context())
+		if err != nil {
+			log.Error(err, "Unable to list cached users")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		res := []adminCachedUser{}
+		for key, user := range users {
+			res = append(res, adminCachedUser{
+				Key:      key,
+				Username: user.Username,
+				ObjectID: user.ObjectID,
+				Type:     user.Type,
+				Groups:   toAdminGroups(user.Groups),
+			})
+		}
+
+		sort.Slice(res, func(i, j int) bool {
+			if res[i].Username == res[j].Username {
+				return res[i].Key < res[j].Key
+			}
+
+			return res[i].Username < res[j].Username
+		})
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, res)
+	}
+}
+
+func (a *adminAPI) listCachedGroups(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, err := a.cache.listGroups(r.Context())
+		if err != nil {
+			log.Error(err, "Unable to list cached groups")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, toAdminGroups(groups))
+	}
+}
+
+// evictUser removes every cached user with the object id, the user is resolved again on the next request
+func (a *adminAPI) evictUser(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		objectID := mux.Vars(r)["objectID"]
+
+		evicted, err := evictCachedUsers(r.Context(), a.cache, func(user userModel) bool {
+			return user.ObjectID == objectID
+		})
+		if err != nil {
+			log.Error(err, "Unable to evict cached user", "objectID", objectID)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditAdminAction(r.Context(), "evict-user", objectID)
+		log.Info("Cached user evicted", "objectID", objectID, "evicted", evicted)
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, adminEvictResponse{Evicted: evicted})
+	}
+}
+
+// syncGroups synchronizes the groups immediately, the server context is used to let the synchronization finish even
+// if the client disconnects
+func (a *adminAPI) syncGroups(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		setAuditAdminAction(r.Context(), "sync-groups", "")
+
+		err := a.azure.syncGroups(ctx, "admin")
+		if err != nil {
+			log.Error(err, "Unable to synchronize groups")
+			http.Error(w, "Unable to synchronize groups", http.StatusInternalServerError)
+			return
+		}
+
+		log.Info("Groups synchronized using the admin api")
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, adminSyncResponse{Status: "ok"})
+	}
+}
+
+// resolveUser resolves the user with the object id using Microsoft Graph, the same way as an uncached request. The
+// username is taken from the username query parameter or a cached user, without it the user is resolved as a
+// service principal.
+func (a *adminAPI) resolveUser(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		objectID := mux.Vars(r)["objectID"]
+
+		users, err := a.cache.listUsers(r.Context())
+		if err != nil {
+			log.Error(err, "Unable to list cached users")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		username := r.URL.Query().Get("username")
+		cacheKeys := []string{}
+		for key, user := range users {
+			if user.ObjectID != objectID {
+				continue
+			}
+
+			cacheKeys = append(cacheKeys, key)
+			if username == "" && user.Type == normalUserModelType {
+				username = user.Username
+			}
+		}
+		sort.Strings(cacheKeys)
+
+		// The request context cancels the Microsoft Graph requests together with the admin api request
+		user, err := a.user.getUser(logr.NewContext(r.Context(), log), username, objectID)
+		if err != nil {
+			log.Error(err, "Unable to resolve user", "objectID", objectID)
+			http.Error(w, "Unable to resolve user", http.StatusNotFound)
+			return
+		}
+
+		var grants []grantModel
+		if a.jit != nil {
+			user, grants, err = a.jit.applyGrants(r.Context(), user)
+			if err != nil {
+				log.Error(err, "Unable to get just-in-time grants", "objectID", objectID)
+				http.Error(w, "Unexpected error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		impersonatedUser, err := a.identityRewriter.username(user)
+		if err != nil {
+			log.Error(err, "Unable to render impersonation", "objectID", objectID)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		impersonatedGroups, err := a.identityRewriter.groups(user)
+		if err != nil {
+			log.Error(err, "Unable to render impersonation", "objectID", objectID)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, adminResolvedUser{
+			Username:           user.Username,
+			ObjectID:           user.ObjectID,
+			Type:               user.Type,
+			Groups:             toAdminGroups(user.Groups),
+			ImpersonatedUser:   impersonatedUser,
+			ImpersonatedGroups: impersonatedGroups,
+			JITGrants:          grants,
+			CacheKeys:          cacheKeys,
+		})
+	}
+}
+
+func (a *adminAPI) listGrants(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		grants, err := a.jit.list(r.Context(), r.URL.Query().Get("objectID"))
+		if err != nil {
+			log.Error(err, "Unable to list grants")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		writeAdminAPIResponse(ctx, w, http.StatusOK, grants)
+	}
+}
+
+func (a *adminAPI) createGrant(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req jitGrantRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&req)
+		if err != nil {
+			http.Error(w, "Unable to parse grant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		grant, err := a.jit.create(r.Context(), req)
+		var validationErr *jitValidationError
+		if errors.As(err, &validationErr) {
+			http.Error(w, validationErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Error(err, "Unable to create grant")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditGrant(r.Context(), "create", grant)
+		log.Info("Just-in-time grant created", "id", grant.ID, "objectID", grant.ObjectID, "group", grant.Group, "expiresAt", grant.ExpiresAt.Format(time.RFC3339), "reason", grant.Reason, "grantedBy", grant.GrantedBy)
+
+		writeAdminAPIResponse(ctx, w, http.StatusCreated, grant)
+	}
+}
+
+func (a *adminAPI) revokeGrant(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		grant, revoked, err := a.jit.revoke(r.Context(), id)
+		if err != nil {
+			log.Error(err, "Unable to revoke grant", "id", id)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+
+		if !revoked {
+			http.Error(w, "Grant not found", http.StatusNotFound)
+			return
+		}
+
+		setAuditGrant(r.Context(), "revoke", grant)
+		log.Info("Just-in-time grant revoked", "id", grant.ID, "objectID", grant.ObjectID, "group", grant.Group)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func toAdminGroups(groups []groupModel) []adminGroup {
+	res := []adminGroup{}
+	for _, group := range groups {
+		res = append(res, adminGroup{
+			Name:     group.Name,
+			ObjectID: group.ObjectID,
+		})
+	}
+
+	return res
+}
+
+func writeAdminAPIResponse(ctx context.Context, w http.ResponseWriter, statusCode int, v interface{}) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err, "Could not marshal response data")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(b); err != nil {
+		log.Error(err, "Could not write response data")
+	}
+}
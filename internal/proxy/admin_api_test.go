@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAdminAPI(t *testing.T) {
+	require.Nil(t, newAdminAPI(&config{}, nil, nil))
+
+	api, _ := testNewAdminAPI(t, nil, nil)
+	require.NotNil(t, api)
+	require.NotNil(t, api.jit)
+}
+
+func TestAdminAPIAuthentication(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	api, _ := testNewAdminAPI(t, nil, nil)
+	handler := api.handler(ctx)
+
+	cases := []struct {
+		authorization      string
+		expectedStatusCode int
+	}{
+		{
+			authorization:      "",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			authorization:      "Bearer wrong-token",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			authorization:      "Bearer ze-admin-token",
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/jit/grants", nil)
+		if c.authorization != "" {
+			req.Header.Set(authorizationHeader, c.authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, c.expectedStatusCode, rr.Code)
+	}
+}
+
+func TestAdminAPIJITGrants(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	now := time.Now().UTC()
+	api, _ := testNewAdminAPI(t, nil, nil)
+
+	sink := &testFakeAuditSink{}
+	auditClient := &audit{
+		workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+		backpressure: dropAuditBackpressure,
+	}
+	handler := auditClient.middleware(api.handler(ctx))
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		return testAdminAPIRequest(t, handler, method, path, body)
+	}
+
+	// Invalid grants are rejected
+	rr := do(http.MethodPost, "/admin/jit/grants", `{"objectID": "ze-object-id", "group": "cluster-admins"}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), "reason is required")
+
+	rr = do(http.MethodPost, "/admin/jit/grants", `{"unknown": true}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Only the allowed groups can be granted
+	rr = do(http.MethodPost, "/admin/jit/grants", fmt.Sprintf(`{"objectID": "ze-object-id", "group": "system:masters", "reason": "incident", "expiresAt": %q}`, now.Add(time.Hour).Format(time.RFC3339)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), `group "system:masters" isn't allowed to be granted`)
+
+	expiresAt := now.Add(time.Hour).Format(time.RFC3339)
+	rr = do(http.MethodPost, "/admin/jit/grants", fmt.Sprintf(`{"objectID": "ze-object-id", "group": "cluster-admins", "reason": "incident", "grantedBy": "ze-admin", "expiresAt": %q}`, expiresAt))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var grant grantModel
+	err := json.Unmarshal(rr.Body.Bytes(), &grant)
+	require.NoError(t, err)
+	require.Equal(t, "ze-object-id", grant.ObjectID)
+	require.Equal(t, "cluster-admins", grant.Group)
+
+	rr = do(http.MethodGet, "/admin/jit/grants?objectID=ze-object-id", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var grants []grantModel
+	err = json.Unmarshal(rr.Body.Bytes(), &grants)
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	require.Equal(t, grant.ID, grants[0].ID)
+
+	rr = do(http.MethodGet, "/admin/jit/grants?objectID=other-object-id", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, "[]", rr.Body.String())
+
+	rr = do(http.MethodDelete, "/admin/jit/grants/"+grant.ID, "")
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = do(http.MethodDelete, "/admin/jit/grants/"+grant.ID, "")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	require.NoError(t, auditClient.close(ctx))
+
+	// Every admin api request is audited, with the grant for the create and revoke
+	events := sink.getEvents()
+	require.Len(t, events, 8)
+	for _, event := range events {
+		require.Equal(t, &auditAuth{Method: adminTokenAuthMethod}, event.Auth)
+	}
+
+	require.Nil(t, events[2].Grant)
+	require.Equal(t, "create", events[3].Grant.Action)
+	require.Equal(t, grant.ID, events[3].Grant.Grant.ID)
+	require.Equal(t, "revoke", events[6].Grant.Action)
+	require.Equal(t, grant.ID, events[6].Grant.Grant.ID)
+	require.Nil(t, events[7].Grant)
+}
+
+func TestAdminAPICache(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", []groupModel{{Name: "developers", ObjectID: "ze-developers-id"}}, nil)
+	azureClient := &testFakeAzureClient{t: t}
+	api, memCacheClient := testNewAdminAPI(t, userClient, azureClient)
+
+	sink := &testFakeAuditSink{}
+	auditClient := &audit{
+		workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+		backpressure: dropAuditBackpressure,
+	}
+	handler := auditClient.middleware(api.handler(ctx))
+
+	groups := []groupModel{{Name: "developers", ObjectID: "ze-developers-id"}}
+	require.NoError(t, memCacheClient.setGroup(ctx, "ze-developers-id", groups[0]))
+	require.NoError(t, memCacheClient.setGroup(ctx, "ze-admins-id", groupModel{Name: "admins", ObjectID: "ze-admins-id"}))
+	require.NoError(t, memCacheClient.setUser(ctx, "ze-sub", userModel{Username: "ze-username", ObjectID: "ze-object-id", Groups: groups, Type: normalUserModelType}))
+	require.NoError(t, memCacheClient.setUser(ctx, "ze-other-sub", userModel{Username: "ze-username", ObjectID: "ze-object-id", Groups: groups, Type: normalUserModelType}))
+	require.NoError(t, memCacheClient.setUser(ctx, "other-sub", userModel{Username: "other", ObjectID: "other-object-id", Type: normalUserModelType}))
+
+	rr := testAdminAPIRequest(t, handler, http.MethodGet, "/admin/cache/groups", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `[{"name": "admins", "objectID": "ze-admins-id"}, {"name": "developers", "objectID": "ze-developers-id"}]`, rr.Body.String())
+
+	rr = testAdminAPIRequest(t, handler, http.MethodGet, "/admin/cache/users", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var users []adminCachedUser
+	err := json.Unmarshal(rr.Body.Bytes(), &users)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+	require.Equal(t, adminCachedUser{Key: "other-sub", Username: "other", ObjectID: "other-object-id", Type: normalUserModelType, Groups: []adminGroup{}}, users[0])
+	require.Equal(t, "ze-other-sub", users[1].Key)
+	require.Equal(t, "ze-sub", users[2].Key)
+
+	rr = testAdminAPIRequest(t, handler, http.MethodGet, "/admin/users/ze-object-id", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var resolved adminResolvedUser
+	err = json.Unmarshal(rr.Body.Bytes(), &resolved)
+	require.NoError(t, err)
+	require.Equal(t, "ze-username", resolved.ImpersonatedUser)
+	require.Equal(t, []string{"developers"}, resolved.ImpersonatedGroups)
+	require.Equal(t, []string{"ze-other-sub", "ze-sub"}, resolved.CacheKeys)
+	require.Equal(t, 1, userClient.getUserCalls)
+
+	rr = testAdminAPIRequest(t, handler, http.MethodDelete, "/admin/cache/users/ze-object-id", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"evicted": 2}`, rr.Body.String())
+
+	_, found, err := memCacheClient.getUser(ctx, "ze-sub")
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = memCacheClient.getUser(ctx, "other-sub")
+	require.NoError(t, err)
+	require.True(t, found)
+
+	rr = testAdminAPIRequest(t, handler, http.MethodPost, "/admin/groups/sync", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	azureClient.fakeError = errors.New("sync error")
+	rr = testAdminAPIRequest(t, handler, http.MethodPost, "/admin/groups/sync", "")
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	userClient.fakeError = errors.New("user error")
+	rr = testAdminAPIRequest(t, handler, http.MethodGet, "/admin/users/unknown-object-id", "")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	require.NoError(t, auditClient.close(ctx))
+
+	events := sink.getEvents()
+	require.Len(t, events, 7)
+	require.Nil(t, events[0].AdminAction)
+	require.Equal(t, &auditAdmin{Action: "evict-user", ObjectID: "ze-object-id"}, events[3].AdminAction)
+	require.Equal(t, &auditAdmin{Action: "sync-groups"}, events[4].AdminAction)
+	require.Equal(t, &auditAdmin{Action: "sync-groups"}, events[5].AdminAction)
+	require.Equal(t, http.StatusInternalServerError, events[5].ResponseCode)
+}
+
+func testNewAdminAPI(t *testing.T, userClient User, azureClient Azure) (*adminAPI, *memoryCache) {
+	t.Helper()
+
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cfg := &config{
+		AdminAPIToken:        "ze-admin-token",
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+		JITAllowedGroups:     []string{"cluster-admins"},
+		JITEnabled:           true,
+		JITMaxDuration:       60,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	return newAdminAPI(cfg, azureClient, proxyHandlers), memCacheClient
+}
+
+func testAdminAPIRequest(t *testing.T, handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(authorizationHeader, "Bearer ze-admin-token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
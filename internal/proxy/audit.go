@@ -0,0 +1,456 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	auditFlushInterval   = 1 * time.Second
+	auditWriterBatchSize = 100
+)
+
+type auditContextKey struct{}
+
+type Audit interface {
+	middleware(next http.Handler) http.Handler
+	close(ctx context.Context) error
+}
+
+// auditEvent is the record written to the audit sinks, one per request
+type auditEvent struct {
+	Timestamp    time.Time   `json:"timestamp"`
+	SourceIP     string      `json:"sourceIP"`
+	UserAgent    string      `json:"userAgent,omitempty"`
+	Method       string      `json:"method"`
+	RequestURI   string      `json:"requestURI"`
+	RequestInfo  requestInfo `json:"requestInfo"`
+	Upstream     string      `json:"upstream,omitempty"`
+	Auth         *auditAuth  `json:"auth,omitempty"`
+	User         *auditUser  `json:"user,omitempty"`
+	Grant        *auditGrant `json:"grant,omitempty"`
+	AdminAction  *auditAdmin `json:"adminAction,omitempty"`
+	ResponseCode int         `json:"responseCode"`
+	DurationMs   int64       `json:"durationMs"`
+	DenialReason string      `json:"denialReason,omitempty"`
+}
+
+// auditAuth is how the request was authenticated, the certificate fields are only set for client certificates and
+// the break-glass credential only for break-glass access
+type auditAuth struct {
+	Method                  authMethodModel `json:"method"`
+	CertificateAuthority    string          `json:"certificateAuthority,omitempty"`
+	CertificateSubject      string          `json:"certificateSubject,omitempty"`
+	CertificateSerialNumber string          `json:"certificateSerialNumber,omitempty"`
+	BreakGlassCredential    string          `json:"breakGlassCredential,omitempty"`
+}
+
+type auditUser struct {
+	Username           string        `json:"username"`
+	ObjectID           string        `json:"objectID"`
+	Type               userModelType `json:"type"`
+	ImpersonatedUser   string        `json:"impersonatedUser"`
+	ImpersonatedGroups []string      `json:"impersonatedGroups"`
+	JITGrants          []string      `json:"jitGrants,omitempty"`
+}
+
+// auditGrant is a just-in-time grant created or revoked using the admin api
+type auditGrant struct {
+	Action string     `json:"action"`
+	Grant  grantModel `json:"grant"`
+}
+
+// auditAdmin is an action taken using the admin api, like evicting a user from the cache
+type auditAdmin struct {
+	Action   string `json:"action"`
+	ObjectID string `json:"objectID,omitempty"`
+}
+
+type auditSink interface {
+	write(events []auditEvent) error
+	close() error
+}
+
+type audit struct {
+	workers      []*auditSinkWorker
+	backpressure auditBackpressureModel
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAuditClient(ctx context.Context, cfg *config) (*audit, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	backpressure, err := getAuditBackpressure(cfg.AuditBackpressure)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.AuditSinks) > 0 && cfg.AuditBufferSize < 1 {
+		return nil, fmt.Errorf("audit buffer size needs to be at least 1 but was: %d", cfg.AuditBufferSize)
+	}
+
+	workers := []*auditSinkWorker{}
+	for _, s := range cfg.AuditSinks {
+		sinkType, err := getAuditSink(s)
+		if err != nil {
+			return nil, err
+		}
+
+		var sink auditSink
+		batchSize := auditWriterBatchSize
+		switch sinkType {
+		case stdoutAuditSink:
+			sink = newStdoutAuditSink()
+		case fileAuditSink:
+			sink, err = newFileAuditSink(cfg)
+		case webhookAuditSink:
+			sink, err = newWebhookAuditSink(cfg)
+			batchSize = cfg.AuditWebhookBatchSize
+		default:
+			return nil, fmt.Errorf("Unexpected audit sink: %s", s)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if batchSize < 1 {
+			batchSize = 1
+		}
+
+		log.Info("Using audit sink", "sink", sinkType)
+		workers = append(workers, newAuditSinkWorker(ctx, string(sinkType), sink, cfg.AuditBufferSize, batchSize))
+	}
+
+	return &audit{
+		workers:      workers,
+		backpressure: backpressure,
+	}, nil
+}
+
+// middleware records an audit event for every request. Handlers further down the chain add the user and the denial
+// reason to the event using setAuditUser and setAuditDenialReason.
+func (a *audit) middleware(next http.Handler) http.Handler {
+	if len(a.workers) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		event := &auditEvent{
+			Timestamp:   start.UTC(),
+			SourceIP:    getClientIP(r),
+			UserAgent:   r.UserAgent(),
+			Method:      r.Method,
+			RequestURI:  r.RequestURI,
+			RequestInfo: parseRequestInfo(r),
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), auditContextKey{}, event)
+
+		next.ServeHTTP(aw, r.WithContext(ctx))
+
+		event.ResponseCode = aw.getStatusCode()
+		event.DurationMs = time.Since(start).Milliseconds()
+
+		if event.DenialReason == "" {
+			switch {
+			case event.ResponseCode == http.StatusUnauthorized && event.User == nil:
+				event.DenialReason = "unauthenticated"
+			case (event.ResponseCode == http.StatusUnauthorized || event.ResponseCode == http.StatusForbidden) && event.User != nil:
+				event.DenialReason = "denied by kubernetes api"
+			}
+		}
+
+		a.log(r.Context(), *event)
+	})
+}
+
+func (a *audit) log(ctx context.Context, event auditEvent) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return
+	}
+
+	// Break-glass events are never dropped, even if the buffer is full
+	backpressure := a.backpressure
+	if event.Auth != nil && event.Auth.Method == breakGlassAuthMethod {
+		backpressure = blockAuditBackpressure
+	}
+
+	for _, worker := range a.workers {
+		worker.enqueue(ctx, event, backpressure)
+	}
+}
+
+// close stops accepting new events and waits for the buffered events to be written to the sinks
+func (a *audit) close(ctx context.Context) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	var closeErr error
+	for _, worker := range a.workers {
+		err := worker.close(ctx)
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+func setAuditUser(ctx context.Context, user userModel, impersonatedUser string, impersonatedGroups []string) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.User = &auditUser{
+		Username:           user.Username,
+		ObjectID:           user.ObjectID,
+		Type:               user.Type,
+		ImpersonatedUser:   impersonatedUser,
+		ImpersonatedGroups: impersonatedGroups,
+	}
+}
+
+// setAuditJITGrants records the ids of the just-in-time grants that added groups to the user, it needs to be called
+// after setAuditUser
+func setAuditJITGrants(ctx context.Context, grants []grantModel) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok || event.User == nil {
+		return
+	}
+
+	for _, grant := range grants {
+		event.User.JITGrants = append(event.User.JITGrants, grant.ID)
+	}
+}
+
+// setAuditGrant records a just-in-time grant that was created or revoked
+func setAuditGrant(ctx context.Context, action string, grant grantModel) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.Grant = &auditGrant{
+		Action: action,
+		Grant:  grant,
+	}
+}
+
+// setAuditAdminAction records an action taken using the admin api, the object id is empty for actions that don't
+// target a user
+func setAuditAdminAction(ctx context.Context, action string, objectID string) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.AdminAction = &auditAdmin{
+		Action:   action,
+		ObjectID: objectID,
+	}
+}
+
+// setAuditUpstream records the selected upstream, the request info is parsed again since the path prefix of the
+// upstream has been removed from the request
+func setAuditUpstream(ctx context.Context, upstreamName string, r *http.Request) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.Upstream = upstreamName
+	event.RequestInfo = parseRequestInfo(r)
+}
+
+func setAuditAuth(ctx context.Context, auth auditAuth) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.Auth = &auth
+}
+
+func setAuditDenialReason(ctx context.Context, reason string) {
+	event, ok := ctx.Value(auditContextKey{}).(*auditEvent)
+	if !ok {
+		return
+	}
+
+	event.DenialReason = reason
+}
+
+// auditSinkWorker buffers the events of a sink and writes them in batches, either when the batch is full or when the
+// flush interval has passed
+type auditSinkWorker struct {
+	name          string
+	sink          auditSink
+	events        chan auditEvent
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+	log           logr.Logger
+	metrics       Metrics
+}
+
+func newAuditSinkWorker(ctx context.Context, name string, sink auditSink, bufferSize int, batchSize int) *auditSinkWorker {
+	worker := &auditSinkWorker{
+		name:          name,
+		sink:          sink,
+		events:        make(chan auditEvent, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: auditFlushInterval,
+		done:          make(chan struct{}),
+		log:           logr.FromContextOrDiscard(ctx),
+		metrics:       metricsFromContext(ctx),
+	}
+
+	go worker.run()
+
+	return worker
+}
+
+func (worker *auditSinkWorker) enqueue(ctx context.Context, event auditEvent, backpressure auditBackpressureModel) {
+	if backpressure == blockAuditBackpressure {
+		select {
+		case worker.events <- event:
+		case <-ctx.Done():
+			worker.drop()
+		}
+		return
+	}
+
+	select {
+	case worker.events <- event:
+	default:
+		worker.drop()
+	}
+}
+
+func (worker *auditSinkWorker) drop() {
+	worker.metrics.add(metricsAuditEventsDropped, 1, worker.name)
+	worker.log.Error(fmt.Errorf("audit buffer full"), "Dropping audit event", "sink", worker.name)
+}
+
+func (worker *auditSinkWorker) run() {
+	defer close(worker.done)
+
+	ticker := time.NewTicker(worker.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]auditEvent, 0, worker.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := worker.sink.write(batch)
+		if err != nil {
+			worker.metrics.add(metricsAuditSinkErrors, 1, worker.name)
+			worker.log.Error(err, "Unable to write audit events", "sink", worker.name, "eventCount", len(batch))
+		}
+
+		batch = make([]auditEvent, 0, worker.batchSize)
+	}
+
+	for {
+		select {
+		case event, ok := <-worker.events:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, event)
+			if len(batch) >= worker.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (worker *auditSinkWorker) close(ctx context.Context) error {
+	close(worker.events)
+
+	select {
+	case <-worker.done:
+	case <-ctx.Done():
+		return fmt.Errorf("timed out flushing audit sink %s: %w", worker.name, ctx.Err())
+	}
+
+	return worker.sink.close()
+}
+
+// auditResponseWriter captures the status code of the response. Flush and Hijack are passed through to support
+// watches, exec and port-forward.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *auditResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not implement http.Hijacker")
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *auditResponseWriter) getStatusCode() int {
+	if w.statusCode == 0 {
+		return http.StatusOK
+	}
+
+	return w.statusCode
+}
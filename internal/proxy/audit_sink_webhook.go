@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	auditWebhookMaxAttempts    = 3
+	auditWebhookInitialBackoff = 500 * time.Millisecond
+	auditWebhookTimeout        = 10 * time.Second
+)
+
+// auditWebhook sends the audit events as a JSON array to an HTTP endpoint. Failed requests are retried with an
+// exponential backoff, client errors (except 429) are not retried.
+type auditWebhook struct {
+	url            string
+	httpClient     *http.Client
+	initialBackoff time.Duration
+}
+
+func newWebhookAuditSink(cfg *config) (*auditWebhook, error) {
+	if cfg.AuditWebhookURL == "" {
+		return nil, fmt.Errorf("audit webhook url is required when using the WEBHOOK audit sink")
+	}
+
+	_, err := url.ParseRequestURI(cfg.AuditWebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse audit webhook url: %w", err)
+	}
+
+	return &auditWebhook{
+		url: cfg.AuditWebhookURL,
+		httpClient: &http.Client{
+			Timeout: auditWebhookTimeout,
+		},
+		initialBackoff: auditWebhookInitialBackoff,
+	}, nil
+}
+
+func (s *auditWebhook) write(events []auditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.initialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.send(body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= auditWebhookMaxAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *auditWebhook) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	// Drain the body to make it possible to reuse the connection
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status code from audit webhook: %d", res.StatusCode)
+}
+
+func (s *auditWebhook) close() error {
+	s.httpClient.CloseIdleConnections()
+	return nil
+}
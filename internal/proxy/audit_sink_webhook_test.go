@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookAuditSink(t *testing.T) {
+	cases := []struct {
+		responseCodes       []int
+		expectedRequests    int
+		expectedErrContains string
+	}{
+		{
+			responseCodes:    []int{http.StatusOK},
+			expectedRequests: 1,
+		},
+		{
+			responseCodes:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted},
+			expectedRequests: 3,
+		},
+		{
+			responseCodes:       []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			expectedRequests:    3,
+			expectedErrContains: "unexpected status code from audit webhook: 500",
+		},
+		{
+			responseCodes:       []int{http.StatusBadRequest},
+			expectedRequests:    1,
+			expectedErrContains: "unexpected status code from audit webhook: 400",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		var mu sync.Mutex
+		receivedEvents := [][]auditEvent{}
+		requestCount := 0
+
+		fakeWebhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			require.Equal(t, http.MethodPost, r.Method)
+			require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			var events []auditEvent
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&events))
+			receivedEvents = append(receivedEvents, events)
+
+			w.WriteHeader(c.responseCodes[requestCount])
+			requestCount++
+		}))
+
+		sink, err := newWebhookAuditSink(&config{
+			AuditWebhookURL: fakeWebhook.URL,
+		})
+		require.NoError(t, err)
+		sink.initialBackoff = 0
+
+		err = sink.write([]auditEvent{
+			{RequestURI: "/api/v1/pods"},
+			{RequestURI: "/api/v1/secrets"},
+		})
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+		} else {
+			require.NoError(t, err)
+		}
+		require.NoError(t, sink.close())
+		fakeWebhook.Close()
+
+		require.Equal(t, c.expectedRequests, requestCount)
+		for _, events := range receivedEvents {
+			require.Len(t, events, 2)
+			require.Equal(t, "/api/v1/secrets", events[1].RequestURI)
+		}
+	}
+}
+
+func TestNewWebhookAuditSink(t *testing.T) {
+	_, err := newWebhookAuditSink(&config{})
+	require.ErrorContains(t, err, "audit webhook url is required")
+
+	_, err = newWebhookAuditSink(&config{AuditWebhookURL: "not a url"})
+	require.ErrorContains(t, err, "unable to parse audit webhook url")
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// auditWriter writes the audit events as JSON lines
+type auditWriter struct {
+	writer io.WriteCloser
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newStdoutAuditSink() *auditWriter {
+	return &auditWriter{
+		writer: nopWriteCloser{os.Stdout},
+	}
+}
+
+// newFileAuditSink writes to a file that is rotated based on size, old files are removed based on count and age
+func newFileAuditSink(cfg *config) (*auditWriter, error) {
+	if cfg.AuditFilePath == "" {
+		return nil, fmt.Errorf("audit file path is required when using the FILE audit sink")
+	}
+
+	return &auditWriter{
+		writer: &lumberjack.Logger{
+			Filename:   cfg.AuditFilePath,
+			MaxSize:    cfg.AuditFileMaxSize,
+			MaxBackups: cfg.AuditFileMaxBackups,
+			MaxAge:     cfg.AuditFileMaxAge,
+		},
+	}, nil
+}
+
+func (s *auditWriter) write(events []auditEvent) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.writer.Write(buf.Bytes())
+	return err
+}
+
+func (s *auditWriter) close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	auditFilePath := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := newFileAuditSink(&config{
+		AuditFilePath:       auditFilePath,
+		AuditFileMaxSize:    1,
+		AuditFileMaxBackups: 1,
+		AuditFileMaxAge:     1,
+	})
+	require.NoError(t, err)
+
+	err = sink.write([]auditEvent{
+		{RequestURI: "/api/v1/pods", ResponseCode: 200},
+		{RequestURI: "/api/v1/secrets", ResponseCode: 403, DenialReason: "denied by kubernetes api"},
+	})
+	require.NoError(t, err)
+
+	err = sink.write([]auditEvent{
+		{RequestURI: "/version", ResponseCode: 200},
+	})
+	require.NoError(t, err)
+	require.NoError(t, sink.close())
+
+	f, err := os.Open(auditFilePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	events := []auditEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, events, 3)
+	require.Equal(t, "/api/v1/secrets", events[1].RequestURI)
+	require.Equal(t, "denied by kubernetes api", events[1].DenialReason)
+	require.Equal(t, "/version", events[2].RequestURI)
+}
+
+func TestFileAuditSinkWithoutPath(t *testing.T) {
+	_, err := newFileAuditSink(&config{})
+	require.ErrorContains(t, err, "audit file path is required")
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuditClient(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cases := []struct {
+		cfg                 *config
+		expectedWorkerCount int
+		expectedErrContains string
+	}{
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+			},
+			expectedWorkerCount: 0,
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+				AuditBufferSize:   10,
+				AuditSinks:        []string{"STDOUT", "FILE", "WEBHOOK"},
+				AuditFilePath:     t.TempDir() + "/audit.log",
+				AuditWebhookURL:   "http://127.0.0.1:1/audit",
+			},
+			expectedWorkerCount: 3,
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DUMMY",
+			},
+			expectedErrContains: "Unknown audit backpressure 'DUMMY'",
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+				AuditBufferSize:   10,
+				AuditSinks:        []string{"DUMMY"},
+			},
+			expectedErrContains: "Unknown audit sink 'DUMMY'",
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+				AuditBufferSize:   10,
+				AuditSinks:        []string{"FILE"},
+			},
+			expectedErrContains: "audit file path is required",
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+				AuditBufferSize:   10,
+				AuditSinks:        []string{"WEBHOOK"},
+			},
+			expectedErrContains: "audit webhook url is required",
+		},
+		{
+			cfg: &config{
+				AuditBackpressure: "DROP",
+				AuditBufferSize:   0,
+				AuditSinks:        []string{"STDOUT"},
+			},
+			expectedErrContains: "audit buffer size needs to be at least 1",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		auditClient, err := newAuditClient(ctx, c.cfg)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Len(t, auditClient.workers, c.expectedWorkerCount)
+		require.NoError(t, auditClient.close(ctx))
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cases := []struct {
+		handler              http.HandlerFunc
+		expectedResponseCode int
+		expectedDenialReason string
+		expectedUser         *auditUser
+	}{
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				setAuditUser(r.Context(), userModel{Username: "ze-username", ObjectID: "ze-object-id", Type: normalUserModelType}, "ze-username", []string{"ze-group"})
+				_, _ = w.Write([]byte("ok"))
+			},
+			expectedResponseCode: http.StatusOK,
+			expectedUser: &auditUser{
+				Username:           "ze-username",
+				ObjectID:           "ze-object-id",
+				Type:               normalUserModelType,
+				ImpersonatedUser:   "ze-username",
+				ImpersonatedGroups: []string{"ze-group"},
+			},
+		},
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				setAuditDenialReason(r.Context(), "too many groups")
+				http.Error(w, "Too many groups", http.StatusForbidden)
+			},
+			expectedResponseCode: http.StatusForbidden,
+			expectedDenialReason: "too many groups",
+		},
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			},
+			expectedResponseCode: http.StatusUnauthorized,
+			expectedDenialReason: "unauthenticated",
+		},
+		{
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				setAuditUser(r.Context(), userModel{Username: "ze-username"}, "ze-username", nil)
+				w.WriteHeader(http.StatusForbidden)
+			},
+			expectedResponseCode: http.StatusForbidden,
+			expectedDenialReason: "denied by kubernetes api",
+			expectedUser: &auditUser{
+				Username:         "ze-username",
+				ImpersonatedUser: "ze-username",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		sink := &testFakeAuditSink{}
+		auditClient := &audit{
+			workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+			backpressure: dropAuditBackpressure,
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/ze-pod", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		rr := httptest.NewRecorder()
+
+		auditClient.middleware(c.handler).ServeHTTP(rr, req)
+		require.Equal(t, c.expectedResponseCode, rr.Code)
+
+		require.NoError(t, auditClient.close(ctx))
+
+		events := sink.getEvents()
+		require.Len(t, events, 1)
+		require.Equal(t, c.expectedResponseCode, events[0].ResponseCode)
+		require.Equal(t, c.expectedDenialReason, events[0].DenialReason)
+		require.Equal(t, c.expectedUser, events[0].User)
+		require.Equal(t, "10.0.0.1", events[0].SourceIP)
+		require.Equal(t, requestInfo{
+			IsResourceRequest: true,
+			Path:              "/api/v1/namespaces/default/pods/ze-pod",
+			Verb:              "get",
+			APIVersion:        "v1",
+			Namespace:         "default",
+			Resource:          "pods",
+			Name:              "ze-pod",
+		}, events[0].RequestInfo)
+	}
+}
+
+func TestAuditMiddlewareDisabled(t *testing.T) {
+	auditClient := &audit{
+		backpressure: dropAuditBackpressure,
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Value(auditContextKey{}).(*auditEvent)
+		require.False(t, ok)
+	})
+
+	rr := httptest.NewRecorder()
+	auditClient.middleware(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestAuditSinkWorkerBackpressure(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	sink := &testFakeAuditSink{
+		block: make(chan struct{}),
+	}
+	worker := newAuditSinkWorker(ctx, "fake", sink, 1, 1)
+
+	// The first event is picked up by the worker (that blocks in the sink), the second fills the buffer and the third is dropped
+	worker.enqueue(ctx, auditEvent{RequestURI: "/1"}, dropAuditBackpressure)
+	require.Eventually(t, func() bool { return len(worker.events) == 0 }, time.Second, 10*time.Millisecond)
+	worker.enqueue(ctx, auditEvent{RequestURI: "/2"}, dropAuditBackpressure)
+	worker.enqueue(ctx, auditEvent{RequestURI: "/3"}, dropAuditBackpressure)
+
+	// With BLOCK the event is only dropped when the context is cancelled
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	worker.enqueue(cancelledCtx, auditEvent{RequestURI: "/4"}, blockAuditBackpressure)
+
+	close(sink.block)
+	require.NoError(t, worker.close(ctx))
+
+	events := sink.getEvents()
+	require.Len(t, events, 2)
+	require.Equal(t, "/1", events[0].RequestURI)
+	require.Equal(t, "/2", events[1].RequestURI)
+}
+
+func TestAuditSinkWorkerBatching(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	sink := &testFakeAuditSink{}
+	worker := newAuditSinkWorker(ctx, "fake", sink, 10, 2)
+
+	for i := 0; i < 5; i++ {
+		worker.enqueue(ctx, auditEvent{}, blockAuditBackpressure)
+	}
+
+	require.NoError(t, worker.close(ctx))
+	require.Len(t, sink.getEvents(), 5)
+
+	for _, batchSize := range sink.getBatchSizes() {
+		require.LessOrEqual(t, batchSize, 2)
+	}
+}
+
+func TestAuditResponseWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	aw := &auditResponseWriter{ResponseWriter: rr}
+	require.Equal(t, http.StatusOK, aw.getStatusCode())
+
+	aw.WriteHeader(http.StatusTeapot)
+	aw.WriteHeader(http.StatusOK)
+	require.Equal(t, http.StatusTeapot, aw.getStatusCode())
+
+	aw.Flush()
+	require.True(t, rr.Flushed)
+
+	_, _, err := aw.Hijack()
+	require.ErrorContains(t, err, "does not implement http.Hijacker")
+
+	require.Equal(t, rr, http.ResponseWriter(aw).(interface{ Unwrap() http.ResponseWriter }).Unwrap())
+}
+
+type testFakeAuditSink struct {
+	mu         sync.Mutex
+	events     []auditEvent
+	batchSizes []int
+	block      chan struct{}
+}
+
+func (s *testFakeAuditSink) write(events []auditEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, events...)
+	s.batchSizes = append(s.batchSizes, len(events))
+	return nil
+}
+
+func (s *testFakeAuditSink) close() error {
+	return nil
+}
+
+func (s *testFakeAuditSink) getEvents() []auditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]auditEvent{}, s.events...)
+}
+
+func (s *testFakeAuditSink) getBatchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int{}, s.batchSizes...)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"github.com/go-logr/logr"
+)
+
+type authIdentityContextKey struct{}
+
+// authIdentity is a user authenticated by the proxy itself (using a client certificate or a break-glass credential)
+// instead of with an Azure AD token
+type authIdentity struct {
+	method authMethodModel
+	user   userModel
+}
+
+// newAuthHandler authenticates requests using break-glass credentials and client certificates (if configured), all
+// other requests are authenticated using Azure AD tokens
+func newAuthHandler(ctx context.Context, certAuth *clientCertificateAuth, bg *breakGlass, h http.HandlerFunc, tenantID string, clientID string) http.Handler {
+	log := logr.FromContextOrDiscard(ctx)
+	oidcHandler := newOIDCHandler(h, tenantID, clientID)
+
+	serveIdentity := func(w http.ResponseWriter, r *http.Request, identity authIdentity) {
+		ctx := context.WithValue(r.Context(), authIdentityContextKey{}, identity)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var peerCertificate *x509.Certificate
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			peerCertificate = r.TLS.PeerCertificates[0]
+		}
+
+		if bg != nil {
+			credential, ok := bg.authenticateCertificate(peerCertificate)
+			if !ok {
+				token, err := getBearerToken(r)
+				if err == nil {
+					credential, ok = bg.authenticateToken(token)
+				}
+			}
+
+			if ok {
+				user := bg.user(credential)
+				setAuditAuth(r.Context(), auditAuth{Method: breakGlassAuthMethod, BreakGlassCredential: credential.name})
+				incrementBreakGlassRequests(ctx, credential.name)
+
+				if bg.expired(credential) {
+					log.Error(errors.New("break-glass credential expired"), "BREAK-GLASS: expired credential used", "credential", credential.name, "expiresAt", credential.expiresAt, "path", r.URL.Path)
+					setAuditDenialReason(r.Context(), "break-glass credential expired")
+					http.Error(w, "User unauthorized", http.StatusForbidden)
+					return
+				}
+
+				log.Info("BREAK-GLASS: emergency access used", "credential", credential.name, "username", user.Username, "emergencyGroup", bg.emergencyGroup, "method", r.Method, "path", r.URL.Path, "sourceIP", getClientIP(r))
+				serveIdentity(w, r, authIdentity{method: breakGlassAuthMethod, user: user})
+				return
+			}
+		}
+
+		if certAuth == nil || peerCertificate == nil {
+			setAuditAuth(r.Context(), auditAuth{Method: azureADAuthMethod})
+			oidcHandler.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := certAuth.authenticate(r.TLS.PeerCertificates)
+		if err != nil {
+			log.Error(err, "Client certificate not allowed")
+			setAuditAuth(r.Context(), auditAuth{Method: clientCertificateAuthMethod, CertificateSubject: peerCertificate.Subject.String()})
+			setAuditDenialReason(r.Context(), "client certificate not allowed")
+			http.Error(w, "User unauthorized", http.StatusForbidden)
+			return
+		}
+
+		setAuditAuth(r.Context(), auditAuth{
+			Method:                  clientCertificateAuthMethod,
+			CertificateAuthority:    identity.authority,
+			CertificateSubject:      identity.subject,
+			CertificateSerialNumber: identity.serial,
+		})
+
+		serveIdentity(w, r, authIdentity{method: clientCertificateAuthMethod, user: identity.user})
+	})
+}
+
+func getAuthIdentity(ctx context.Context) (authIdentity, bool) {
+	identity, ok := ctx.Value(authIdentityContextKey{}).(authIdentity)
+	return identity, ok
+}
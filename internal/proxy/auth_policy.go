@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	amrAuthPolicyRequirement      = "amr"
+	acrsAuthPolicyRequirement     = "acrs"
+	authTimeAuthPolicyRequirement = "auth_time"
+)
+
+// authPolicyDefaultVerbs are the verbs that require a compliant authentication when --auth-policy-verbs isn't set
+var authPolicyDefaultVerbs = []string{"create", "update", "patch", "delete", "deletecollection"}
+
+// authPolicy requires Azure AD tokens to have been issued with specific authentication methods (amr), authentication
+// context class references (acrs) or a recent authentication (auth_time) for the configured verbs and resources
+type authPolicy struct {
+	requiredAmr  map[string]struct{}
+	requiredAcrs map[string]struct{}
+	maxAuthAge   time.Duration
+	verbs        map[string]struct{}
+	resources    []string
+	// exemptAppOnly skips the policy for app-only tokens, since they never contain amr, acrs or auth_time
+	exemptAppOnly bool
+	now           func() time.Time
+}
+
+// authPolicyError is the requirement that wasn't fulfilled by the token
+type authPolicyError struct {
+	requirement string
+	message     string
+	acrs        []string
+}
+
+func (e *authPolicyError) Error() string {
+	return e.message
+}
+
+// newAuthPolicy returns nil if no authentication requirements are configured
+func newAuthPolicy(cfg *config) (*authPolicy, error) {
+	if cfg.AuthPolicyMaxAuthAge < 0 {
+		return nil, fmt.Errorf("auth policy max auth age can't be negative: %d", cfg.AuthPolicyMaxAuthAge)
+	}
+
+	if len(cfg.AuthPolicyRequiredAMR) == 0 && len(cfg.AuthPolicyRequiredACRS) == 0 && cfg.AuthPolicyMaxAuthAge == 0 {
+		return nil, nil
+	}
+
+	verbs := cfg.AuthPolicyVerbs
+	if len(verbs) == 0 {
+		verbs = authPolicyDefaultVerbs
+	}
+
+	return &authPolicy{
+		requiredAmr:   newAllowlist(cfg.AuthPolicyRequiredAMR),
+		requiredAcrs:  newAllowlist(cfg.AuthPolicyRequiredACRS),
+		maxAuthAge:    time.Duration(cfg.AuthPolicyMaxAuthAge) * time.Minute,
+		verbs:         newAllowlist(verbs),
+		resources:     cfg.AuthPolicyResources,
+		exemptAppOnly: cfg.AuthPolicyExemptAppOnly,
+		now:           time.Now,
+	}, nil
+}
+
+// applies returns true if the verb or the resource of the request is covered by the policy
+func (p *authPolicy) applies(info requestInfo) bool {
+	if allowlistContains(p.verbs, info.Verb) {
+		return true
+	}
+
+	return len(p.resources) > 0 && info.IsResourceRequest && resourceMatches(p.resources, info.Resource, info.Subresource)
+}
+
+// check returns an *authPolicyError if the token doesn't fulfill every requirement of the policy, app-only tokens
+// fulfill the policy when they are exempt
+func (p *authPolicy) check(externalClaims *externalAzureADClaims) error {
+	claims, err := toInternalAzureADClaims(externalClaims)
+	if err != nil {
+		return err
+	}
+
+	if p.exemptAppOnly && claims.appOnly {
+		return nil
+	}
+
+	if len(p.requiredAmr) > 0 && !containsAny(p.requiredAmr, claims.amr) {
+		return &authPolicyError{
+			requirement: amrAuthPolicyRequirement,
+			message:     fmt.Sprintf("this request requires signing in with one of the authentication methods %s, but the token was issued using %s", formatClaimValues(sortedKeys(p.requiredAmr)), formatClaimValues(claims.amr)),
+		}
+	}
+
+	if len(p.requiredAcrs) > 0 && !containsAny(p.requiredAcrs, claims.acrs) {
+		return &authPolicyError{
+			requirement: acrsAuthPolicyRequirement,
+			message:     fmt.Sprintf("this request requires the authentication context %s, but the token was issued with %s", formatClaimValues(sortedKeys(p.requiredAcrs)), formatClaimValues(claims.acrs)),
+			acrs:        sortedKeys(p.requiredAcrs),
+		}
+	}
+
+	if p.maxAuthAge > 0 {
+		if claims.authTime.IsZero() {
+			return &authPolicyError{
+				requirement: authTimeAuthPolicyRequirement,
+				message:     "this request requires a recent sign-in, but the token doesn't contain the auth_time claim",
+			}
+		}
+
+		authAge := p.now().Sub(claims.authTime)
+		if authAge > p.maxAuthAge {
+			return &authPolicyError{
+				requirement: authTimeAuthPolicyRequirement,
+				message:     fmt.Sprintf("this request requires signing in within the last %s, but the last sign-in was %s ago", p.maxAuthAge, authAge.Truncate(time.Second)),
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsAny(set map[string]struct{}, values []string) bool {
+	for _, value := range values {
+		if _, ok := set[value]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func formatClaimValues(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// writeAuthPolicyUnauthorized asks the user to re-authenticate. When an authentication context is required, a claims
+// challenge is added to the WWW-Authenticate header so that clients can request a new token with the acrs claim.
+func writeAuthPolicyUnauthorized(w http.ResponseWriter, policyErr *authPolicyError) error {
+	challenge := fmt.Sprintf("Bearer error=\"insufficient_claims\", error_description=%q", policyErr.message)
+	if len(policyErr.acrs) > 0 {
+		claims, err := json.Marshal(map[string]interface{}{
+			"access_token": map[string]interface{}{
+				"acrs": map[string]interface{}{
+					"essential": true,
+					"values":    policyErr.acrs,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		challenge = fmt.Sprintf("%s, claims=%q", challenge, base64.StdEncoding.EncodeToString(claims))
+	}
+
+	status := k8sapierrors.NewUnauthorized(fmt.Sprintf("Re-authentication required: %s. Please sign in again to get a new token.", policyErr.message)).ErrStatus
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	return writeKubernetesStatus(w, status)
+}
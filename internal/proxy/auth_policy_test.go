@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	k8sapimachinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewAuthPolicy(t *testing.T) {
+	// The auth policy is disabled by default
+	policy, err := newAuthPolicy(&config{})
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	// Verbs and resources without any requirement doesn't enable the policy
+	policy, err = newAuthPolicy(&config{AuthPolicyVerbs: []string{"get"}, AuthPolicyResources: []string{"secrets"}})
+	require.NoError(t, err)
+	require.Nil(t, policy)
+
+	_, err = newAuthPolicy(&config{AuthPolicyMaxAuthAge: -1})
+	require.ErrorContains(t, err, "auth policy max auth age can't be negative")
+
+	policy, err = newAuthPolicy(&config{AuthPolicyRequiredAMR: []string{"mfa"}, AuthPolicyMaxAuthAge: 60})
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, policy.maxAuthAge)
+	require.Equal(t, newAllowlist(authPolicyDefaultVerbs), policy.verbs)
+}
+
+func TestAuthPolicyApplies(t *testing.T) {
+	policy, err := newAuthPolicy(&config{
+		AuthPolicyRequiredAMR: []string{"mfa"},
+		AuthPolicyResources:   []string{"pods/exec", "secrets"},
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		method   string
+		target   string
+		expected bool
+	}{
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods",
+			expected: false,
+		},
+		{
+			method:   http.MethodPost,
+			target:   "/api/v1/namespaces/default/pods",
+			expected: true,
+		},
+		{
+			method:   http.MethodDelete,
+			target:   "/api/v1/namespaces/default/pods",
+			expected: true,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/secrets/ze-secret",
+			expected: true,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/exec?command=sh",
+			expected: true,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/log",
+			expected: false,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/version",
+			expected: false,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(c.method, c.target, nil)
+		require.Equal(t, c.expected, policy.applies(parseRequestInfo(req)))
+	}
+}
+
+func TestAuthPolicyCheck(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		cfg                 *config
+		payload             string
+		expectedRequirement string
+		expectedErrContains string
+	}{
+		{
+			cfg:     &config{AuthPolicyRequiredAMR: []string{"mfa"}},
+			payload: `{"sub":"ze-sub","oid":"ze-oid","amr":["pwd","mfa"]}`,
+		},
+		{
+			cfg:                 &config{AuthPolicyRequiredAMR: []string{"mfa"}},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid","amr":["pwd"]}`,
+			expectedRequirement: amrAuthPolicyRequirement,
+			expectedErrContains: "requires signing in with one of the authentication methods mfa, but the token was issued using pwd",
+		},
+		{
+			cfg:                 &config{AuthPolicyRequiredAMR: []string{"mfa", "fido"}},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid"}`,
+			expectedRequirement: amrAuthPolicyRequirement,
+			expectedErrContains: "one of the authentication methods fido, mfa, but the token was issued using none",
+		},
+		{
+			cfg:     &config{AuthPolicyRequiredACRS: []string{"c1"}},
+			payload: `{"sub":"ze-sub","oid":"ze-oid","acrs":["c1","c2"]}`,
+		},
+		{
+			cfg:                 &config{AuthPolicyRequiredACRS: []string{"c1"}},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid","acrs":["c2"]}`,
+			expectedRequirement: acrsAuthPolicyRequirement,
+			expectedErrContains: "requires the authentication context c1, but the token was issued with c2",
+		},
+		{
+			cfg:     &config{AuthPolicyMaxAuthAge: 60},
+			payload: fmt.Sprintf(`{"sub":"ze-sub","oid":"ze-oid","auth_time":%d}`, now.Add(-59*time.Minute).Unix()),
+		},
+		{
+			cfg:                 &config{AuthPolicyMaxAuthAge: 60},
+			payload:             fmt.Sprintf(`{"sub":"ze-sub","oid":"ze-oid","auth_time":%d}`, now.Add(-61*time.Minute).Unix()),
+			expectedRequirement: authTimeAuthPolicyRequirement,
+			expectedErrContains: "requires signing in within the last 1h0m0s, but the last sign-in was 1h1m0s ago",
+		},
+		{
+			cfg:                 &config{AuthPolicyMaxAuthAge: 60},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid"}`,
+			expectedRequirement: authTimeAuthPolicyRequirement,
+			expectedErrContains: "the token doesn't contain the auth_time claim",
+		},
+		{
+			cfg:     &config{AuthPolicyRequiredAMR: []string{"mfa"}, AuthPolicyRequiredACRS: []string{"c1"}, AuthPolicyMaxAuthAge: 60},
+			payload: fmt.Sprintf(`{"sub":"ze-sub","oid":"ze-oid","amr":["mfa"],"acrs":["c1"],"auth_time":%d}`, now.Unix()),
+		},
+		{
+			cfg:     &config{AuthPolicyRequiredAMR: []string{"mfa"}, AuthPolicyMaxAuthAge: 60, AuthPolicyExemptAppOnly: true},
+			payload: `{"sub":"ze-sub","oid":"ze-oid","idtyp":"app"}`,
+		},
+		{
+			cfg:     &config{AuthPolicyRequiredACRS: []string{"c1"}, AuthPolicyExemptAppOnly: true},
+			payload: `{"sub":"ze-sub","oid":"ze-oid"}`,
+		},
+		{
+			cfg:                 &config{AuthPolicyRequiredAMR: []string{"mfa"}, AuthPolicyExemptAppOnly: true},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid","scp":"user_impersonation","amr":["pwd"]}`,
+			expectedRequirement: amrAuthPolicyRequirement,
+			expectedErrContains: "requires signing in with one of the authentication methods mfa",
+		},
+		{
+			cfg:                 &config{AuthPolicyRequiredAMR: []string{"mfa"}, AuthPolicyExemptAppOnly: true},
+			payload:             `{"sub":"ze-sub","oid":"ze-oid","idtyp":"user"}`,
+			expectedRequirement: amrAuthPolicyRequirement,
+			expectedErrContains: "requires signing in with one of the authentication methods mfa",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		policy, err := newAuthPolicy(c.cfg)
+		require.NoError(t, err)
+		policy.now = func() time.Time { return now }
+
+		claims := testNewSyntheticTokenClaims(t, c.payload)
+		err = policy.check(&claims)
+		if c.expectedErrContains == "" {
+			require.NoError(t, err)
+			continue
+		}
+
+		var policyErr *authPolicyError
+		require.ErrorAs(t, err, &policyErr)
+		require.Equal(t, c.expectedRequirement, policyErr.requirement)
+		require.ErrorContains(t, err, c.expectedErrContains)
+	}
+}
+
+func TestWriteAuthPolicyUnauthorized(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := writeAuthPolicyUnauthorized(rr, &authPolicyError{
+		requirement: acrsAuthPolicyRequirement,
+		message:     "ze-message",
+		acrs:        []string{"c1"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	var status k8sapimachinerymetav1.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, k8sapimachinerymetav1.StatusReasonUnauthorized, status.Reason)
+	require.Equal(t, "Re-authentication required: ze-message. Please sign in again to get a new token.", status.Message)
+
+	challenge := rr.Header().Get("WWW-Authenticate")
+	require.True(t, strings.HasPrefix(challenge, `Bearer error="insufficient_claims", error_description="ze-message", claims="`))
+
+	_, encodedClaims, found := strings.Cut(challenge, `claims="`)
+	require.True(t, found)
+	claims, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(encodedClaims, `"`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"access_token":{"acrs":{"essential":true,"values":["c1"]}}}`, string(claims))
+}
+
+func TestProxyHandlerAuthPolicy(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	requestCount := 0
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	cfg := &config{
+		AzureADMaxGroupCount:  testFakeMaxGroups,
+		GroupIdentifier:       "NAME",
+		AuthPolicyRequiredAMR: []string{"mfa"},
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	up := testNewUpstream(t, fakeAPIServer.URL)
+	passwordClaims := testNewSyntheticTokenClaims(t, `{"sub":"ze-sub","oid":"ze-oid","preferred_username":"ze-username","amr":["pwd"]}`)
+	mfaClaims := testNewSyntheticTokenClaims(t, `{"sub":"ze-sub","oid":"ze-oid","preferred_username":"ze-username","amr":["pwd","mfa"]}`)
+
+	// Reading doesn't require MFA
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/namespaces/default/pods", passwordClaims))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodDelete, "/api/v1/namespaces/default/pods/ze-pod", passwordClaims))
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+	require.Contains(t, rr.Body.String(), "Re-authentication required")
+	require.Contains(t, rr.Header().Get("WWW-Authenticate"), "insufficient_claims")
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsAuthPolicyRejections, amrAuthPolicyRequirement))
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodDelete, "/api/v1/namespaces/default/pods/ze-pod", mfaClaims))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Equal(t, 2, requestCount)
+
+	// App-only tokens (service principals) are exempt from the auth policy, unless configured otherwise
+	appOnlyClaims := testNewSyntheticTokenClaims(t, `{"sub":"ze-sub","oid":"ze-oid","idtyp":"app"}`)
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodDelete, "/api/v1/namespaces/default/pods/ze-pod", appOnlyClaims))
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	cfg.AuthPolicyExemptAppOnly = true
+	proxyHandlers, err = newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodDelete, "/api/v1/namespaces/default/pods/ze-pod", appOnlyClaims))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Equal(t, 3, requestCount)
+}
+
+// testNewSyntheticTokenClaims returns the claims of a token with the payload, decoded the same way as the OIDC
+// middleware does (through a map of the token claims, where dates not registered in the JWT spec are numbers)
+func testNewSyntheticTokenClaims(t *testing.T, payload string) externalAzureADClaims {
+	t.Helper()
+
+	rawClaims := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(payload), &rawClaims))
+
+	b, err := json.Marshal(rawClaims)
+	require.NoError(t, err)
+
+	var claims externalAzureADClaims
+	require.NoError(t, json.Unmarshal(b, &claims))
+
+	return claims
+}
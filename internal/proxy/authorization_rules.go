@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8sapimachineryschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	authorizationRulesReloadInterval = 10 * time.Second
+	authorizationRuleMatchAll        = "*"
+)
+
+// authorizationRulesConfig is the format of the file configured with --authorization-rules-path
+type authorizationRulesConfig struct {
+	Rules []authorizationRuleConfig `json:"rules"`
+}
+
+// authorizationRuleConfig matches requests the same way as a RBAC policy rule, with the addition of the users and
+// groups the rule applies to. Empty fields (and "*") match everything.
+type authorizationRuleConfig struct {
+	Name            string   `json:"name"`
+	Effect          string   `json:"effect"`
+	Message         string   `json:"message"`
+	Users           []string `json:"users"`
+	Groups          []string `json:"groups"`
+	Verbs           []string `json:"verbs"`
+	APIGroups       []string `json:"apiGroups"`
+	Resources       []string `json:"resources"`
+	Namespaces      []string `json:"namespaces"`
+	ResourceNames   []string `json:"resourceNames"`
+	NonResourceURLs []string `json:"nonResourceURLs"`
+}
+
+type authorizationRule struct {
+	name            string
+	effect          authorizationRuleEffectModel
+	message         string
+	users           map[string]struct{}
+	groups          map[string]struct{}
+	verbs           map[string]struct{}
+	apiGroups       map[string]struct{}
+	resources       []string
+	namespaces      map[string]struct{}
+	resourceNames   map[string]struct{}
+	nonResourceURLs []string
+}
+
+// authorizationRules are evaluated before a request is proxied to the Kubernetes API. The rules are evaluated in
+// order and the first matching rule decides if the request is allowed or denied, requests not matching any rule are
+// allowed and left to RBAC. The rules are reloaded when the file changes.
+type authorizationRules struct {
+	path string
+	log  logr.Logger
+
+	mu    sync.RWMutex
+	rules []authorizationRule
+	raw   []byte
+}
+
+// newAuthorizationRules returns nil if no authorization rules are configured. The rules of the config file are reloaded
+// with the config, instead of being watched.
+func newAuthorizationRules(ctx context.Context, cfg *config) (*authorizationRules, error) {
+	if cfg.authorizationRules != nil {
+		parsedRules, err := newAuthorizationRuleList(cfg.authorizationRules)
+		if err != nil {
+			return nil, err
+		}
+
+		rules := &authorizationRules{
+			log:   logr.FromContextOrDiscard(ctx),
+			rules: parsedRules,
+		}
+
+		rules.log.Info("Using authorization rules from the config file", "ruleCount", len(rules.rules))
+
+		return rules, nil
+	}
+
+	if cfg.AuthorizationRulesPath == "" {
+		return nil, nil
+	}
+
+	rules := &authorizationRules{
+		path: cfg.AuthorizationRulesPath,
+		log:  logr.FromContextOrDiscard(ctx),
+	}
+
+	_, err := rules.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	rules.log.Info("Using authorization rules", "path", rules.path, "ruleCount", len(rules.rules))
+
+	return rules, nil
+}
+
+// reload reads the rules file and replaces the rules if it changed. The current rules are kept if the file can't be
+// parsed.
+func (rules *authorizationRules) reload() (bool, error) {
+	b, err := os.ReadFile(rules.path) // #nosec
+	if err != nil {
+		return false, fmt.Errorf("unable to read authorization rules: %w", err)
+	}
+
+	rules.mu.RLock()
+	unchanged := rules.raw != nil && bytes.Equal(b, rules.raw)
+	rules.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	parsedRules, err := parseAuthorizationRules(b)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse authorization rules %q: %w", rules.path, err)
+	}
+
+	rules.mu.Lock()
+	rules.rules = parsedRules
+	rules.raw = b
+	rules.mu.Unlock()
+
+	return true, nil
+}
+
+// run checks the rules file for changes until the context is cancelled
+func (rules *authorizationRules) run(ctx context.Context, interval time.Duration) {
+	if rules.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := rules.reload()
+			if err != nil {
+				rules.log.Error(err, "Unable to reload authorization rules, using the previous rules", "path", rules.path)
+				continue
+			}
+
+			if reloaded {
+				rules.mu.RLock()
+				ruleCount := len(rules.rules)
+				rules.mu.RUnlock()
+				rules.log.Info("Reloaded authorization rules", "path", rules.path, "ruleCount", ruleCount)
+			}
+		}
+	}
+}
+
+// evaluate returns the first rule matching the request and if the request is allowed
+func (rules *authorizationRules) evaluate(info requestInfo, username string, groups []string) (*authorizationRule, bool) {
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+
+	for i := range rules.rules {
+		rule := rules.rules[i]
+		if !rule.matchesSubject(username, groups) || !rule.matchesRequest(info) {
+			continue
+		}
+
+		return &rule, rule.effect == allowAuthorizationRuleEffect
+	}
+
+	return nil, true
+}
+
+func parseAuthorizationRules(b []byte) ([]authorizationRule, error) {
+	var rulesCfg authorizationRulesConfig
+	err := yaml.UnmarshalStrict(b, &rulesCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAuthorizationRuleList(rulesCfg.Rules)
+}
+
+func newAuthorizationRuleList(ruleCfgs []authorizationRuleConfig) ([]authorizationRule, error) {
+	rules := []authorizationRule{}
+	names := make(map[string]struct{})
+	for _, ruleCfg := range ruleCfgs {
+		if ruleCfg.Name == "" {
+			return nil, fmt.Errorf("authorization rule name is required")
+		}
+
+		if _, ok := names[ruleCfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate authorization rule name %q", ruleCfg.Name)
+		}
+		names[ruleCfg.Name] = struct{}{}
+
+		effect, err := getAuthorizationRuleEffect(ruleCfg.Effect)
+		if err != nil {
+			return nil, fmt.Errorf("authorization rule %q: %w", ruleCfg.Name, err)
+		}
+
+		hasResourceSelectors := len(ruleCfg.APIGroups) > 0 || len(ruleCfg.Resources) > 0 || len(ruleCfg.Namespaces) > 0 || len(ruleCfg.ResourceNames) > 0
+		if hasResourceSelectors && len(ruleCfg.NonResourceURLs) > 0 {
+			return nil, fmt.Errorf("authorization rule %q: nonResourceURLs can't be combined with apiGroups, resources, namespaces or resourceNames", ruleCfg.Name)
+		}
+
+		rules = append(rules, authorizationRule{
+			name:            ruleCfg.Name,
+			effect:          effect,
+			message:         ruleCfg.Message,
+			users:           newAllowlist(ruleCfg.Users),
+			groups:          newAllowlist(ruleCfg.Groups),
+			verbs:           newAllowlist(ruleCfg.Verbs),
+			apiGroups:       newAllowlist(ruleCfg.APIGroups),
+			resources:       ruleCfg.Resources,
+			namespaces:      newAllowlist(ruleCfg.Namespaces),
+			resourceNames:   newAllowlist(ruleCfg.ResourceNames),
+			nonResourceURLs: ruleCfg.NonResourceURLs,
+		})
+	}
+
+	return rules, nil
+}
+
+// matchesSubject returns true if the rule doesn't limit users or groups, or if the user or any of the groups are
+// listed in the rule
+func (rule *authorizationRule) matchesSubject(username string, groups []string) bool {
+	if len(rule.users) == 0 && len(rule.groups) == 0 {
+		return true
+	}
+
+	if len(rule.users) > 0 && allowlistContains(rule.users, username) {
+		return true
+	}
+
+	if len(rule.groups) == 0 {
+		return false
+	}
+
+	for _, group := range groups {
+		if allowlistContains(rule.groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *authorizationRule) matchesRequest(info requestInfo) bool {
+	if !ruleSetMatches(rule.verbs, info.Verb) {
+		return false
+	}
+
+	if !info.IsResourceRequest {
+		hasResourceSelectors := len(rule.apiGroups) > 0 || len(rule.resources) > 0 || len(rule.namespaces) > 0 || len(rule.resourceNames) > 0
+		if hasResourceSelectors {
+			return false
+		}
+
+		return len(rule.nonResourceURLs) == 0 || nonResourceURLMatches(rule.nonResourceURLs, info.Path)
+	}
+
+	if len(rule.nonResourceURLs) > 0 {
+		return false
+	}
+
+	return ruleSetMatches(rule.apiGroups, info.APIGroup) &&
+		resourceMatches(rule.resources, info.Resource, info.Subresource) &&
+		ruleSetMatches(rule.namespaces, info.Namespace) &&
+		ruleSetMatches(rule.resourceNames, info.Name)
+}
+
+// ruleSetMatches returns true if the set is empty or contains the value (or "*")
+func ruleSetMatches(set map[string]struct{}, value string) bool {
+	if len(set) == 0 {
+		return true
+	}
+
+	return allowlistContains(set, value)
+}
+
+// resourceMatches uses the same format as RBAC, "pods" only matches the resource and "pods/exec" the subresource.
+// Wildcards can be used for both the resource and subresource, like "pods/*" or "*/exec".
+func resourceMatches(resources []string, resource string, subresource string) bool {
+	if len(resources) == 0 {
+		return true
+	}
+
+	combined := resource
+	if subresource != "" {
+		combined = fmt.Sprintf("%s/%s", resource, subresource)
+	}
+
+	for _, r := range resources {
+		switch {
+		case r == authorizationRuleMatchAll, r == combined:
+			return true
+		case subresource != "" && r == fmt.Sprintf("%s/%s", resource, authorizationRuleMatchAll):
+			return true
+		case subresource != "" && r == fmt.Sprintf("%s/%s", authorizationRuleMatchAll, subresource):
+			return true
+		}
+	}
+
+	return false
+}
+
+// nonResourceURLMatches supports a trailing "*" as a prefix match, the same way as RBAC
+func nonResourceURLMatches(urls []string, path string) bool {
+	for _, url := range urls {
+		if url == authorizationRuleMatchAll || url == path {
+			return true
+		}
+
+		if strings.HasSuffix(url, authorizationRuleMatchAll) && strings.HasPrefix(path, strings.TrimSuffix(url, authorizationRuleMatchAll)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeAuthorizationRuleDenied writes a Forbidden Status the same way the Kubernetes API does when RBAC denies a request
+func writeAuthorizationRuleDenied(w http.ResponseWriter, info requestInfo, username string, rule *authorizationRule) error {
+	reason := fmt.Sprintf("User %q cannot %s path %q", username, info.Verb, info.Path)
+	if info.IsResourceRequest {
+		resource := info.Resource
+		if info.Subresource != "" {
+			resource = fmt.Sprintf("%s/%s", info.Resource, info.Subresource)
+		}
+
+		reason = fmt.Sprintf("User %q cannot %s resource %q in API group %q", username, info.Verb, resource, info.APIGroup)
+		if info.Namespace != "" {
+			reason = fmt.Sprintf("%s in the namespace %q", reason, info.Namespace)
+		}
+	}
+
+	reason = fmt.Sprintf("%s: denied by azad-kube-proxy rule %q", reason, rule.name)
+	if rule.message != "" {
+		reason = fmt.Sprintf("%s: %s", reason, rule.message)
+	}
+
+	groupResource := k8sapimachineryschema.GroupResource{Group: info.APIGroup, Resource: info.Resource}
+	status := k8sapierrors.NewForbidden(groupResource, info.Name, fmt.Errorf("%s", reason)).ErrStatus
+
+	return writeKubernetesStatus(w, status)
+}
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	k8sapimachinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testAuthorizationRules = `
+rules:
+  - name: allow-exec-kube-system-for-operators
+    effect: ALLOW
+    groups: ["operators"]
+    verbs: ["create", "get"]
+    resources: ["pods/exec", "pods/attach"]
+    namespaces: ["kube-system"]
+  - name: deny-exec-kube-system
+    effect: DENY
+    message: exec in kube-system requires the operators group
+    verbs: ["create", "get"]
+    resources: ["pods/exec", "pods/attach"]
+    namespaces: ["kube-system"]
+  - name: deny-delete-namespaces
+    effect: DENY
+    verbs: ["delete", "deletecollection"]
+    resources: ["namespaces"]
+  - name: deny-metrics
+    effect: DENY
+    users: ["ze-username"]
+    nonResourceURLs: ["/metrics", "/debug/*"]
+`
+
+func TestParseAuthorizationRules(t *testing.T) {
+	cases := []struct {
+		rules               string
+		expectedRules       []string
+		expectedErrContains string
+	}{
+		{
+			rules:         testAuthorizationRules,
+			expectedRules: []string{"allow-exec-kube-system-for-operators", "deny-exec-kube-system", "deny-delete-namespaces", "deny-metrics"},
+		},
+		{
+			rules:         "rules: []",
+			expectedRules: []string{},
+		},
+		{
+			rules: `
+rules:
+  - effect: DENY
+`,
+			expectedErrContains: "authorization rule name is required",
+		},
+		{
+			rules: `
+rules:
+  - name: ze-rule
+    effect: DENY
+  - name: ze-rule
+    effect: ALLOW
+`,
+			expectedErrContains: "duplicate authorization rule name \"ze-rule\"",
+		},
+		{
+			rules: `
+rules:
+  - name: ze-rule
+    effect: deny
+`,
+			expectedErrContains: "authorization rule \"ze-rule\": Unknown authorization rule effect 'deny'",
+		},
+		{
+			rules: `
+rules:
+  - name: ze-rule
+    effect: DENY
+    resources: ["pods"]
+    nonResourceURLs: ["/metrics"]
+`,
+			expectedErrContains: "nonResourceURLs can't be combined with apiGroups, resources, namespaces or resourceNames",
+		},
+		{
+			rules: `
+rules:
+  - name: ze-rule
+    effect: DENY
+    unknownField: true
+`,
+			expectedErrContains: "unknown field",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		rules, err := parseAuthorizationRules([]byte(c.rules))
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, rule := range rules {
+			names = append(names, rule.name)
+		}
+		require.Equal(t, c.expectedRules, names)
+	}
+}
+
+func TestAuthorizationRulesEvaluate(t *testing.T) {
+	parsedRules, err := parseAuthorizationRules([]byte(testAuthorizationRules))
+	require.NoError(t, err)
+
+	rules := &authorizationRules{
+		rules: parsedRules,
+	}
+
+	cases := []struct {
+		method          string
+		target          string
+		username        string
+		groups          []string
+		expectedRule    string
+		expectedAllowed bool
+	}{
+		{
+			method:          http.MethodPost,
+			target:          "/api/v1/namespaces/kube-system/pods/ze-pod/exec?command=sh",
+			username:        "ze-username",
+			groups:          []string{"developers"},
+			expectedRule:    "deny-exec-kube-system",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/api/v1/namespaces/kube-system/pods/ze-pod/attach",
+			username:        "ze-username",
+			groups:          []string{"developers"},
+			expectedRule:    "deny-exec-kube-system",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodPost,
+			target:          "/api/v1/namespaces/kube-system/pods/ze-pod/exec?command=sh",
+			username:        "ze-username",
+			groups:          []string{"developers", "operators"},
+			expectedRule:    "allow-exec-kube-system-for-operators",
+			expectedAllowed: true,
+		},
+		{
+			method:          http.MethodPost,
+			target:          "/api/v1/namespaces/default/pods/ze-pod/exec?command=sh",
+			username:        "ze-username",
+			groups:          []string{"developers"},
+			expectedAllowed: true,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/api/v1/namespaces/kube-system/pods/ze-pod",
+			username:        "ze-username",
+			groups:          []string{"developers"},
+			expectedAllowed: true,
+		},
+		{
+			method:          http.MethodDelete,
+			target:          "/api/v1/namespaces/ze-namespace",
+			username:        "ze-username",
+			groups:          []string{"operators"},
+			expectedRule:    "deny-delete-namespaces",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodDelete,
+			target:          "/api/v1/namespaces",
+			username:        "ze-username",
+			groups:          []string{"operators"},
+			expectedRule:    "deny-delete-namespaces",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodDelete,
+			target:          "/api/v1/namespaces/ze-namespace/pods/ze-pod",
+			username:        "ze-username",
+			groups:          []string{"operators"},
+			expectedAllowed: true,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/metrics",
+			username:        "ze-username",
+			expectedRule:    "deny-metrics",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/debug/pprof/profile",
+			username:        "ze-username",
+			expectedRule:    "deny-metrics",
+			expectedAllowed: false,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/metrics",
+			username:        "someone-else",
+			expectedAllowed: true,
+		},
+		{
+			method:          http.MethodGet,
+			target:          "/version",
+			username:        "ze-username",
+			expectedAllowed: true,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(c.method, c.target, nil)
+		rule, allowed := rules.evaluate(parseRequestInfo(req), c.username, c.groups)
+		require.Equal(t, c.expectedAllowed, allowed)
+
+		if c.expectedRule == "" {
+			require.Nil(t, rule)
+			continue
+		}
+
+		require.NotNil(t, rule)
+		require.Equal(t, c.expectedRule, rule.name)
+	}
+}
+
+func TestResourceMatches(t *testing.T) {
+	cases := []struct {
+		resources   []string
+		resource    string
+		subresource string
+		expected    bool
+	}{
+		{resources: nil, resource: "pods", subresource: "exec", expected: true},
+		{resources: []string{"*"}, resource: "pods", subresource: "exec", expected: true},
+		{resources: []string{"pods"}, resource: "pods", subresource: "", expected: true},
+		{resources: []string{"pods"}, resource: "pods", subresource: "exec", expected: false},
+		{resources: []string{"pods/exec"}, resource: "pods", subresource: "exec", expected: true},
+		{resources: []string{"pods/exec"}, resource: "pods", subresource: "", expected: false},
+		{resources: []string{"pods/*"}, resource: "pods", subresource: "log", expected: true},
+		{resources: []string{"pods/*"}, resource: "pods", subresource: "", expected: false},
+		{resources: []string{"*/status"}, resource: "deployments", subresource: "status", expected: true},
+		{resources: []string{"*/status"}, resource: "deployments", subresource: "scale", expected: false},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		require.Equal(t, c.expected, resourceMatches(c.resources, c.resource, c.subresource))
+	}
+}
+
+func TestAuthorizationRulesReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(logr.NewContext(context.Background(), logr.Discard()))
+	defer cancel()
+
+	rulesPath := filepath.Join(t.TempDir(), "rules.yaml")
+	testCreateTemporaryFile(t, rulesPath, testAuthorizationRules)
+
+	rules, err := newAuthorizationRules(ctx, &config{AuthorizationRulesPath: rulesPath})
+	require.NoError(t, err)
+
+	deleteNamespace := parseRequestInfo(httptest.NewRequest(http.MethodDelete, "/api/v1/namespaces/ze-namespace", nil))
+	_, allowed := rules.evaluate(deleteNamespace, "ze-username", nil)
+	require.False(t, allowed)
+
+	// Nothing is reloaded when the file hasn't changed
+	reloaded, err := rules.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	// The previous rules are kept when the file can't be parsed
+	testCreateTemporaryFile(t, rulesPath, "rules: [")
+	_, err = rules.reload()
+	require.ErrorContains(t, err, "unable to parse authorization rules")
+	_, allowed = rules.evaluate(deleteNamespace, "ze-username", nil)
+	require.False(t, allowed)
+
+	go rules.run(ctx, 10*time.Millisecond)
+
+	testCreateTemporaryFile(t, rulesPath, "rules: []")
+	require.Eventually(t, func() bool {
+		_, allowed := rules.evaluate(deleteNamespace, "ze-username", nil)
+		return allowed
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNewAuthorizationRules(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	// Authorization rules are disabled by default
+	rules, err := newAuthorizationRules(ctx, &config{})
+	require.NoError(t, err)
+	require.Nil(t, rules)
+
+	_, err = newAuthorizationRules(ctx, &config{AuthorizationRulesPath: filepath.Join(t.TempDir(), "does-not-exist.yaml")})
+	require.ErrorContains(t, err, "unable to read authorization rules")
+}
+
+func TestProxyHandlerAuthorizationRules(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	requestCount := 0
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	rulesPath := filepath.Join(t.TempDir(), "rules.yaml")
+	testCreateTemporaryFile(t, rulesPath, testAuthorizationRules)
+
+	cfg := &config{
+		AzureADMaxGroupCount:   testFakeMaxGroups,
+		GroupIdentifier:        "NAME",
+		AuthorizationRulesPath: rulesPath,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", []groupModel{{Name: "developers"}}, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	up := testNewUpstream(t, fakeAPIServer.URL)
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodPost, "/api/v1/namespaces/kube-system/pods/ze-pod/exec?command=sh", claims))
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var status k8sapimachinerymetav1.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, "Status", status.Kind)
+	require.Equal(t, k8sapimachinerymetav1.StatusFailure, status.Status)
+	require.Equal(t, k8sapimachinerymetav1.StatusReasonForbidden, status.Reason)
+	require.Equal(t, int32(http.StatusForbidden), status.Code)
+	require.Equal(t, "pods", status.Details.Kind)
+	require.Equal(t, "ze-pod", status.Details.Name)
+	require.Equal(t, `pods "ze-pod" is forbidden: User "ze-username" cannot create resource "pods/exec" in API group "" in the namespace "kube-system": denied by azad-kube-proxy rule "deny-exec-kube-system": exec in kube-system requires the operators group`, status.Message)
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsAuthorizationRuleDenials, "deny-exec-kube-system"))
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodPost, "/api/v1/namespaces/default/pods/ze-pod/exec?command=sh", claims))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodDelete, "/api/v1/namespaces/ze-namespace", claims))
+	require.Equal(t, http.StatusForbidden, rr.Code)
+
+	require.Equal(t, 1, requestCount)
+}
@@ -2,7 +2,10 @@ package proxy
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -18,14 +21,26 @@ type AzureUser interface {
 type Azure interface {
 	getUserGroups(ctx context.Context, objectID string, userType userModelType) ([]groupModel, error)
 	startSyncGroups(ctx context.Context, syncInterval time.Duration) (*time.Ticker, chan bool, error)
+	syncGroups(ctx context.Context, syncReason string) error
+	lastGroupSync() time.Time
 	valid(ctx context.Context) bool
+	validCredentials(ctx context.Context) error
+	validGraphPermissions(ctx context.Context) error
+	validGraphAccess(ctx context.Context) error
+}
+
+// graphPermissionSets are the Microsoft Graph application permissions (roles) that allow the proxy to read the groups of
+// users and service principals, one of the sets is required
+var graphPermissionSets = [][]string{
+	{"Directory.Read.All"},
+	{"Group.Read.All", "User.Read.All", "Application.Read.All"},
+	{"GroupMember.Read.All", "User.Read.All", "Application.Read.All"},
 }
 
 type azure struct {
 	clientID             string
 	clientSecret         string
 	tenantID             string
-	graphFilter          string
 	cache                Cache
 	groups               *azureGroups
 	user                 *azureUser
@@ -33,7 +48,7 @@ type azure struct {
 	authorizer           hamiltonAuth.Authorizer
 }
 
-func newAzureClient(ctx context.Context, clientID, clientSecret, tenantID, graphFilter string, cacheClient Cache) (*azure, error) {
+func newAzureClient(ctx context.Context, clientID, clientSecret, tenantID string, groupFilter *groupFilter, groupMembership groupMembershipModel, cacheClient Cache) (*azure, error) {
 	authConfig := &hamiltonAuth.Config{
 		Environment:            hamiltonEnvironments.Global,
 		TenantID:               tenantID,
@@ -59,19 +74,14 @@ func newAzureClient(ctx context.Context, clientID, clientSecret, tenantID, graph
 	groupsClient.BaseClient.Authorizer = authorizer
 	groupsClient.BaseClient.DisableRetries = true
 
-	if graphFilter != "" {
-		graphFilter = fmt.Sprintf("startswith(displayName,'%s')", graphFilter)
-	}
-
 	return &azure{
 		clientID:             clientID,
 		clientSecret:         clientSecret,
 		tenantID:             tenantID,
-		graphFilter:          graphFilter,
 		cache:                cacheClient,
-		user:                 newAzureUser(ctx, cacheClient, usersClient),
-		servicePrincipalUser: newServicePrincipalUser(ctx, cacheClient, servicePrincipalsClient),
-		groups:               newGroups(ctx, cacheClient, groupsClient, graphFilter),
+		user:                 newAzureUser(ctx, cacheClient, usersClient, groupMembership),
+		servicePrincipalUser: newServicePrincipalUser(ctx, cacheClient, servicePrincipalsClient, groupMembership),
+		groups:               newGroups(ctx, cacheClient, groupsClient, groupFilter),
 		authorizer:           authorizer,
 	}, nil
 }
@@ -98,6 +108,79 @@ func (a *azure) valid(ctx context.Context) bool {
 	return true
 }
 
+// validCredentials verifies that a Microsoft Graph token can be requested using the client id and secret
+func (a *azure) validCredentials(ctx context.Context) error {
+	_, err := a.authorizer.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token from authorizer: %w", err)
+	}
+
+	return nil
+}
+
+// validGraphAccess verifies that the groups and their members can be read from Microsoft Graph, the permissions of the
+// token can be granted without being effective (like before admin consent)
+func (a *azure) validGraphAccess(ctx context.Context) error {
+	return a.groups.checkAccess(ctx)
+}
+
+// validGraphPermissions verifies that the Microsoft Graph token has the application permissions needed by the proxy
+func (a *azure) validGraphPermissions(ctx context.Context) error {
+	token, err := a.authorizer.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token from authorizer: %w", err)
+	}
+
+	return validateGraphRoles(getTokenRoles(token.AccessToken))
+}
+
+func validateGraphRoles(roles []string) error {
+	for _, permissionSet := range graphPermissionSets {
+		missing := false
+		for _, permission := range permissionSet {
+			if !sliceContains(roles, permission) {
+				missing = true
+				break
+			}
+		}
+
+		if !missing {
+			return nil
+		}
+	}
+
+	requiredSets := []string{}
+	for _, permissionSet := range graphPermissionSets {
+		requiredSets = append(requiredSets, strings.Join(permissionSet, " + "))
+	}
+
+	return fmt.Errorf("Microsoft Graph application permissions missing, one of the following is required: %s. Token roles: %v", strings.Join(requiredSets, ", "), roles)
+}
+
+// getTokenRoles returns the roles claim of a JWT without validating it, or nil if the token isn't a JWT
+func getTokenRoles(token string) []string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	var claims struct {
+		Roles []string `json:"roles"`
+	}
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil
+	}
+
+	return claims.Roles
+}
+
 func (client *azure) getUserGroups(ctx context.Context, objectID string, userType userModelType) ([]groupModel, error) {
 	var user AzureUser
 
@@ -138,3 +221,13 @@ func (client *azure) startSyncGroups(ctx context.Context, syncInterval time.Dura
 
 	return ticker, syncChan, nil
 }
+
+// syncGroups synchronizes the groups immediately, without waiting for the next tick of the group sync
+func (client *azure) syncGroups(ctx context.Context, syncReason string) error {
+	return client.groups.syncAzureADGroupsCache(ctx, syncReason)
+}
+
+// lastGroupSync returns when the groups were last synchronized successfully
+func (client *azure) lastGroupSync() time.Time {
+	return client.groups.getLastSync()
+}
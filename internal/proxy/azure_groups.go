@@ -2,31 +2,66 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
 	hamiltonOdata "github.com/manicminer/hamilton/odata"
 )
 
+var errDeltaTokenExpired = errors.New("delta token expired")
+
 type azureGroups struct {
 	cache        Cache
 	groupsClient *hamiltonMsgraph.GroupsClient
-	graphFilter  string
+	groupFilter  *groupFilter
+
+	mu          sync.Mutex
+	deltaLink   string
+	knownGroups map[string]struct{}
+
+	// lastSync has its own lock, since mu is held during the whole synchronization
+	lastSyncMu sync.Mutex
+	lastSync   time.Time
+}
+
+type graphDeltaGroup struct {
+	ID          string  `json:"id"`
+	DisplayName *string `json:"displayName"`
+	Removed     *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed"`
 }
 
-func newGroups(ctx context.Context, cacheClient Cache, groupsClient *hamiltonMsgraph.GroupsClient, graphFilter string) *azureGroups {
+type graphDeltaResponse struct {
+	Value     []graphDeltaGroup `json:"value"`
+	NextLink  string            `json:"@odata.nextLink"`
+	DeltaLink string            `json:"@odata.deltaLink"`
+}
+
+func newGroups(ctx context.Context, cacheClient Cache, groupsClient *hamiltonMsgraph.GroupsClient, groupFilter *groupFilter) *azureGroups {
 	return &azureGroups{
 		cache:        cacheClient,
 		groupsClient: groupsClient,
-		graphFilter:  graphFilter,
+		groupFilter:  groupFilter,
+		knownGroups:  make(map[string]struct{}),
 	}
 }
 
-func (groups *azureGroups) getAllGroups(ctx context.Context) (*[]hamiltonMsgraph.Group, error) {
+func (groups *azureGroups) getAllGroups(ctx context.Context) (_ *[]hamiltonMsgraph.Group, err error) {
 	log := logr.FromContextOrDiscard(ctx)
+	ctx, end := startGraphRequest(ctx, "list_groups")
+	defer func() { end(err) }()
 
 	odataQuery := hamiltonOdata.Query{
-		Filter: groups.graphFilter,
+		Filter: groups.groupFilter.graphFilter(),
 	}
 
 	groupsResponse, responseCode, err := groups.groupsClient.List(ctx, odataQuery)
@@ -38,16 +73,146 @@ func (groups *azureGroups) getAllGroups(ctx context.Context) (*[]hamiltonMsgraph
 	return groupsResponse, nil
 }
 
+// checkAccess lists a single group and its members, to verify that both the groups and the group memberships can be
+// read
+func (groups *azureGroups) checkAccess(ctx context.Context) error {
+	groupIDs, err := groups.listIDs(ctx, "/groups")
+	if err != nil {
+		return fmt.Errorf("unable to list groups: %w", err)
+	}
+
+	if len(groupIDs) == 0 {
+		return fmt.Errorf("unable to read group memberships: no groups found")
+	}
+
+	_, err = groups.listIDs(ctx, fmt.Sprintf("/groups/%s/members", groupIDs[0]))
+	if err != nil {
+		return fmt.Errorf("unable to read the members of group %s: %w", groupIDs[0], err)
+	}
+
+	return nil
+}
+
+// listIDs returns the ids of the first page (of a single object) of a collection
+func (groups *azureGroups) listIDs(ctx context.Context, entity string) (_ []string, err error) {
+	ctx, end := startGraphRequest(ctx, "check_access")
+	defer func() { end(err) }()
+
+	resp, status, _, err := groups.groupsClient.BaseClient.Get(ctx, hamiltonMsgraph.GetHttpRequestInput{
+		DisablePaging: true,
+		OData: hamiltonOdata.Query{
+			Select: []string{"id"},
+			Top:    1,
+		},
+		ValidStatusCodes: []int{http.StatusOK},
+		Uri: hamiltonMsgraph.Uri{
+			Entity:      entity,
+			HasTenantId: true,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("status %d: %w", status, err)
+	}
+
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}
+	err = json.Unmarshal(respBody, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, v := range data.Value {
+		ids = append(ids, v.ID)
+	}
+
+	return ids, nil
+}
+
+// syncAzureADGroupsCache synchronizes the groups to the cache. The first synchronization (and every time the delta
+// token has expired) lists all groups, after that only the changes since the last synchronization are requested using
+// Microsoft Graph delta queries.
 func (groups *azureGroups) syncAzureADGroupsCache(ctx context.Context, syncReason string) error {
 	log := logr.FromContextOrDiscard(ctx)
 
-	groupsResponse, err := groups.getAllGroups(ctx)
+	groups.mu.Lock()
+	defer groups.mu.Unlock()
+
+	if groups.deltaLink != "" {
+		start := time.Now()
+		err := groups.incrementalSync(ctx, syncReason)
+		if err == nil {
+			observeGroupSync(ctx, "delta", start, len(groups.knownGroups))
+			groups.setLastSync(time.Now())
+			return nil
+		}
+
+		if !errors.Is(err, errDeltaTokenExpired) {
+			incrementGroupSyncErrors(ctx)
+			log.Error(err, "Unable to syncronize groups")
+			return err
+		}
+
+		log.Info("Delta token expired, falling back to full synchronization", "syncReason", syncReason)
+	}
+
+	start := time.Now()
+	err := groups.fullSync(ctx, syncReason)
 	if err != nil {
+		incrementGroupSyncErrors(ctx)
 		log.Error(err, "Unable to syncronize groups")
 		return err
 	}
+	observeGroupSync(ctx, "full", start, len(groups.knownGroups))
+	groups.setLastSync(time.Now())
+
+	return nil
+}
+
+func (groups *azureGroups) setLastSync(t time.Time) {
+	groups.lastSyncMu.Lock()
+	defer groups.lastSyncMu.Unlock()
+
+	groups.lastSync = t
+}
+
+// getLastSync returns when the groups were last synchronized successfully, or the zero time if they never were
+func (groups *azureGroups) getLastSync() time.Time {
+	groups.lastSyncMu.Lock()
+	defer groups.lastSyncMu.Unlock()
+
+	return groups.lastSync
+}
+
+func (groups *azureGroups) fullSync(ctx context.Context, syncReason string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	// The delta link is requested before listing the groups to make sure no changes are missed in between
+	deltaLink, err := groups.getLatestDeltaLink(ctx)
+	if err != nil {
+		return err
+	}
+
+	groupsResponse, err := groups.getAllGroups(ctx)
+	if err != nil {
+		return err
+	}
 
+	seenGroups := make(map[string]struct{})
 	for _, group := range *groupsResponse {
+		if !groups.groupFilter.matches(*group.ID(), *group.DisplayName) {
+			continue
+		}
+
 		err := groups.cache.setGroup(ctx, *group.ID(), groupModel{
 			Name:     *group.DisplayName,
 			ObjectID: *group.ID(),
@@ -55,9 +220,188 @@ func (groups *azureGroups) syncAzureADGroupsCache(ctx context.Context, syncReaso
 		if err != nil {
 			return err
 		}
+
+		seenGroups[*group.ID()] = struct{}{}
+	}
+
+	// The stale groups are listed from the cache instead of the groups known by this process, since a shared cache can
+	// contain groups cached by other replicas or before a restart
+	cachedGroups, err := groups.cache.listGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	deletedCount := 0
+	for _, group := range cachedGroups {
+		if _, ok := seenGroups[group.ObjectID]; ok {
+			continue
+		}
+
+		err := groups.cache.deleteGroup(ctx, group.ObjectID)
+		if err != nil {
+			return err
+		}
+		deletedCount++
 	}
 
-	log.Info("Synchronized Azure AD groups to cache", "groupCount", len(*groupsResponse), "syncReason", syncReason)
+	groups.knownGroups = seenGroups
+	groups.deltaLink = deltaLink
+
+	log.Info("Synchronized Azure AD groups to cache", "groupCount", len(seenGroups), "deletedCount", deletedCount, "syncReason", syncReason, "syncType", "full")
 
 	return nil
 }
+
+func (groups *azureGroups) incrementalSync(ctx context.Context, syncReason string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	nextLink := groups.deltaLink
+	updatedCount := 0
+	deletedCount := 0
+
+	for {
+		deltaResponse, err := groups.getDelta(ctx, nextLink)
+		if err != nil {
+			return err
+		}
+
+		for _, deltaGroup := range deltaResponse.Value {
+			updated, deleted, err := groups.applyDelta(ctx, deltaGroup)
+			if err != nil {
+				return err
+			}
+
+			if updated {
+				updatedCount++
+			}
+
+			if deleted {
+				deletedCount++
+			}
+		}
+
+		if deltaResponse.NextLink != "" {
+			nextLink = deltaResponse.NextLink
+			continue
+		}
+
+		if deltaResponse.DeltaLink == "" {
+			return fmt.Errorf("delta response is missing both @odata.nextLink and @odata.deltaLink")
+		}
+
+		groups.deltaLink = deltaResponse.DeltaLink
+		break
+	}
+
+	log.Info("Synchronized Azure AD groups to cache", "groupCount", len(groups.knownGroups), "updatedCount", updatedCount, "deletedCount", deletedCount, "syncReason", syncReason, "syncType", "delta")
+
+	return nil
+}
+
+// applyDelta updates the cache with a changed group. Groups that are removed, or renamed so that they no longer
+// match the group filter, are deleted from the cache.
+func (groups *azureGroups) applyDelta(ctx context.Context, deltaGroup graphDeltaGroup) (bool, bool, error) {
+	_, known := groups.knownGroups[deltaGroup.ID]
+
+	remove := deltaGroup.Removed != nil
+	if !remove && deltaGroup.DisplayName != nil && !groups.groupFilter.matches(deltaGroup.ID, *deltaGroup.DisplayName) {
+		remove = true
+	}
+
+	if remove {
+		if !known {
+			return false, false, nil
+		}
+
+		err := groups.cache.deleteGroup(ctx, deltaGroup.ID)
+		if err != nil {
+			return false, false, err
+		}
+
+		delete(groups.knownGroups, deltaGroup.ID)
+		return false, true, nil
+	}
+
+	// Only the changed properties are returned for updated groups, without a new displayName there is nothing to update
+	if deltaGroup.DisplayName == nil {
+		return false, false, nil
+	}
+
+	err := groups.cache.setGroup(ctx, deltaGroup.ID, groupModel{
+		Name:     *deltaGroup.DisplayName,
+		ObjectID: deltaGroup.ID,
+	})
+	if err != nil {
+		return false, false, err
+	}
+
+	groups.knownGroups[deltaGroup.ID] = struct{}{}
+	return true, false, nil
+}
+
+func (groups *azureGroups) getLatestDeltaLink(ctx context.Context) (string, error) {
+	baseClient := groups.groupsClient.BaseClient
+
+	query := url.Values{}
+	query.Set("$select", "id,displayName")
+	query.Set("$deltatoken", "latest")
+	deltaURL := fmt.Sprintf("%s/%s/%s/groups/delta?%s", baseClient.Endpoint, baseClient.ApiVersion, baseClient.TenantId, query.Encode())
+
+	deltaResponse, err := groups.getDelta(ctx, deltaURL)
+	if err != nil {
+		return "", err
+	}
+
+	if deltaResponse.DeltaLink == "" {
+		return "", fmt.Errorf("delta response is missing @odata.deltaLink")
+	}
+
+	return deltaResponse.DeltaLink, nil
+}
+
+func (groups *azureGroups) getDelta(ctx context.Context, deltaURL string) (_ *graphDeltaResponse, err error) {
+	ctx, end := startGraphRequest(ctx, "groups_delta")
+	defer func() { end(err) }()
+
+	baseClient := groups.groupsClient.BaseClient
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, deltaURL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseClient.Authorizer != nil {
+		token, err := baseClient.Authorizer.Token()
+		if err != nil {
+			return nil, err
+		}
+		token.SetAuthHeader(req)
+	}
+
+	res, err := baseClient.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusGone {
+		return nil, errDeltaTokenExpired
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from delta query: %s", res.StatusCode, body)
+	}
+
+	var deltaResponse graphDeltaResponse
+	err = json.Unmarshal(body, &deltaResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deltaResponse, nil
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncAzureADGroupsCache(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+	fakeGraph := newTestFakeGraphGroupsServer(t)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	testConfigureGraphClient(t, &groupsClient.BaseClient, fakeGraph.server.URL)
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	groups := newGroups(ctx, memCache, groupsClient, &groupFilter{includePrefixes: []string{"k8s-"}})
+
+	// A group cached by another replica (or before a restart) and deleted since is removed by the full synchronization
+	err = memCache.setGroup(ctx, "stale", groupModel{Name: "k8s-stale", ObjectID: "stale"})
+	require.NoError(t, err)
+
+	// Initial (full) synchronization
+	fakeGraph.setGroups(map[string]string{
+		"a": "k8s-a",
+		"b": "k8s-b",
+	})
+	fakeGraph.setLatestDeltaToken("token-1")
+
+	err = groups.syncAzureADGroupsCache(ctx, "initial")
+	require.NoError(t, err)
+	require.Equal(t, "startswith(displayName,'k8s-')", fakeGraph.getLastFilter())
+	testRequireCachedGroups(t, memCache, map[string]string{"a": "k8s-a", "b": "k8s-b"}, []string{"stale"})
+	require.Contains(t, groups.deltaLink, "token-1")
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGroupSyncDuration, "full"))
+	require.Equal(t, float64(2), testMetricValue(t, metricsClient, metricsGroupCount))
+	require.NotZero(t, testMetricValue(t, metricsClient, metricsGroupSyncLastSuccess))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequests, "list_groups"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequests, "groups_delta"))
+
+	// Incremental synchronization with additions, renames and deletions spread over two pages
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{
+		"token-1": {
+			Value: []graphDeltaGroup{
+				testNewDeltaGroup(t, "a", "", true),
+				testNewDeltaGroup(t, "b", "k8s-b-renamed", false),
+				testNewDeltaGroup(t, "c", "k8s-c", false),
+				testNewDeltaGroup(t, "d", "other-d", false),
+			},
+			NextLink: fakeGraph.deltaURL("token-1-page-2"),
+		},
+		"token-1-page-2": {
+			Value: []graphDeltaGroup{
+				testNewDeltaGroup(t, "e", "k8s-e", false),
+				testNewDeltaGroup(t, "f", "", true),
+			},
+			DeltaLink: fakeGraph.deltaURL("token-2"),
+		},
+	})
+
+	err = groups.syncAzureADGroupsCache(ctx, "ticker")
+	require.NoError(t, err)
+	testRequireCachedGroups(t, memCache, map[string]string{"b": "k8s-b-renamed", "c": "k8s-c", "e": "k8s-e"}, []string{"a", "d", "f"})
+	require.Contains(t, groups.deltaLink, "token-2")
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGroupSyncDuration, "delta"))
+	require.Equal(t, float64(3), testMetricValue(t, metricsClient, metricsGroupCount))
+	require.Equal(t, float64(3), testMetricValue(t, metricsClient, metricsGraphRequests, "groups_delta"))
+
+	// Renaming a group so it doesn't match the prefix anymore removes it
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{
+		"token-2": {
+			Value: []graphDeltaGroup{
+				testNewDeltaGroup(t, "c", "other-c", false),
+			},
+			DeltaLink: fakeGraph.deltaURL("token-3"),
+		},
+	})
+
+	err = groups.syncAzureADGroupsCache(ctx, "ticker")
+	require.NoError(t, err)
+	testRequireCachedGroups(t, memCache, map[string]string{"b": "k8s-b-renamed", "e": "k8s-e"}, []string{"c"})
+
+	// Expired delta token falls back to a full synchronization, removing groups deleted in between
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{})
+	fakeGraph.setGroups(map[string]string{
+		"b": "k8s-b-renamed",
+		"g": "k8s-g",
+	})
+	fakeGraph.setLatestDeltaToken("token-4")
+
+	err = groups.syncAzureADGroupsCache(ctx, "ticker")
+	require.NoError(t, err)
+	testRequireCachedGroups(t, memCache, map[string]string{"b": "k8s-b-renamed", "g": "k8s-g"}, []string{"e"})
+	require.Contains(t, groups.deltaLink, "token-4")
+}
+
+func TestSyncAzureADGroupsCacheError(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+	fakeGraph := newTestFakeGraphGroupsServer(t)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	testConfigureGraphClient(t, &groupsClient.BaseClient, fakeGraph.server.URL)
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	groups := newGroups(ctx, memCache, groupsClient, &groupFilter{})
+
+	err = groups.syncAzureADGroupsCache(ctx, "initial")
+	require.ErrorContains(t, err, "unexpected status 400 from delta query")
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGroupSyncErrors))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequestErrors, "groups_delta"))
+	require.Zero(t, testMetricValue(t, metricsClient, metricsGroupSyncLastSuccess))
+}
+
+func TestAzureGroupsCheckAccess(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+	fakeGraph := newTestFakeGraphGroupsServer(t)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	testConfigureGraphClient(t, &groupsClient.BaseClient, fakeGraph.server.URL)
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	groups := newGroups(ctx, memCache, groupsClient, &groupFilter{})
+
+	err = groups.checkAccess(ctx)
+	require.ErrorContains(t, err, "unable to read group memberships: no groups found")
+
+	fakeGraph.setGroups(map[string]string{"a": "k8s-a"})
+	err = groups.checkAccess(ctx)
+	require.NoError(t, err)
+	require.Equal(t, float64(3), testMetricValue(t, metricsClient, metricsGraphRequests, "check_access"))
+
+	fakeGraph.setMembersForbidden(true)
+	err = groups.checkAccess(ctx)
+	require.ErrorContains(t, err, "unable to read the members of group a: status 403")
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequestErrors, "check_access"))
+}
+
+type testFakeGraphGroupsServer struct {
+	server *httptest.Server
+
+	mu               sync.Mutex
+	groups           map[string]string
+	latestDeltaToken string
+	deltaPages       map[string]graphDeltaResponse
+	lastGroupsFilter string
+	membersForbidden bool
+}
+
+func newTestFakeGraphGroupsServer(t *testing.T) *testFakeGraphGroupsServer {
+	t.Helper()
+
+	fakeGraph := &testFakeGraphGroupsServer{
+		groups:     map[string]string{},
+		deltaPages: map[string]graphDeltaResponse{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/beta/ze-tenant/groups", func(w http.ResponseWriter, r *http.Request) {
+		fakeGraph.mu.Lock()
+		defer fakeGraph.mu.Unlock()
+
+		fakeGraph.lastGroupsFilter = r.URL.Query().Get("$filter")
+
+		value := []map[string]string{}
+		for id, displayName := range fakeGraph.groups {
+			value = append(value, map[string]string{"id": id, "displayName": displayName})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+		require.NoError(t, err)
+	})
+	mux.HandleFunc("/beta/ze-tenant/groups/delta", func(w http.ResponseWriter, r *http.Request) {
+		fakeGraph.mu.Lock()
+		defer fakeGraph.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		token := r.URL.Query().Get("$deltatoken")
+		if token == "latest" {
+			if fakeGraph.latestDeltaToken == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			err := json.NewEncoder(w).Encode(graphDeltaResponse{DeltaLink: fakeGraph.deltaURL(fakeGraph.latestDeltaToken)})
+			require.NoError(t, err)
+			return
+		}
+
+		page, ok := fakeGraph.deltaPages[token]
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			_, _ = w.Write([]byte(`{"error": {"code": "syncStateNotFound"}}`))
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(page)
+		require.NoError(t, err)
+	})
+
+	mux.HandleFunc("/beta/ze-tenant/groups/", func(w http.ResponseWriter, r *http.Request) {
+		fakeGraph.mu.Lock()
+		defer fakeGraph.mu.Unlock()
+
+		if !strings.HasSuffix(r.URL.Path, "/members") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if fakeGraph.membersForbidden {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error": {"code": "Authorization_RequestDenied"}}`))
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(map[string]interface{}{"value": []map[string]string{{"id": "ze-member"}}})
+		require.NoError(t, err)
+	})
+
+	fakeGraph.server = httptest.NewServer(mux)
+	t.Cleanup(fakeGraph.server.Close)
+
+	return fakeGraph
+}
+
+func (s *testFakeGraphGroupsServer) deltaURL(token string) string {
+	return fmt.Sprintf("%s/beta/ze-tenant/groups/delta?$deltatoken=%s", s.server.URL, token)
+}
+
+func (s *testFakeGraphGroupsServer) setGroups(groups map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = groups
+}
+
+func (s *testFakeGraphGroupsServer) setLatestDeltaToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latestDeltaToken = token
+}
+
+func (s *testFakeGraphGroupsServer) setDeltaPages(pages map[string]graphDeltaResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deltaPages = pages
+}
+
+func (s *testFakeGraphGroupsServer) setMembersForbidden(forbidden bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.membersForbidden = forbidden
+}
+
+func (s *testFakeGraphGroupsServer) getLastFilter() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastGroupsFilter
+}
+
+func testNewDeltaGroup(t *testing.T, id string, displayName string, removed bool) graphDeltaGroup {
+	t.Helper()
+
+	deltaGroup := graphDeltaGroup{ID: id}
+	if displayName != "" {
+		deltaGroup.DisplayName = testToPtr(t, displayName)
+	}
+
+	if removed {
+		deltaGroup.Removed = &struct {
+			Reason string `json:"reason"`
+		}{Reason: "changed"}
+	}
+
+	return deltaGroup
+}
+
+func testRequireCachedGroups(t *testing.T, cache Cache, expectedGroups map[string]string, expectedMissing []string) {
+	t.Helper()
+
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	for id, name := range expectedGroups {
+		group, found, err := cache.getGroup(ctx, id)
+		require.NoError(t, err)
+		require.True(t, found, "expected group %q to be cached", id)
+		require.Equal(t, groupModel{Name: name, ObjectID: id}, group)
+	}
+
+	for _, id := range expectedMissing {
+		_, found, err := cache.getGroup(ctx, id)
+		require.NoError(t, err)
+		require.False(t, found, "expected group %q not to be cached", id)
+	}
+}
@@ -1,12 +1,24 @@
 package proxy
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type internalAzureADClaims struct {
 	sub      string
 	username string
 	objectID string
 	groups   []string
+	// groupsOverage is true when the token doesn't contain every group of the user (distributed claims)
+	groupsOverage bool
+	amr           []string
+	acrs          []string
+	// authTime is zero if the token doesn't contain the auth_time claim
+	authTime time.Time
+	// appOnly is true for tokens issued to an application (like a service principal) instead of a user, identified by
+	// the idtyp claim (an optional claim) or the missing scp claim
+	appOnly bool
 }
 
 func toInternalAzureADClaims(externalClaims *externalAzureADClaims) (internalAzureADClaims, error) {
@@ -34,10 +46,44 @@ func toInternalAzureADClaims(externalClaims *externalAzureADClaims) (internalAzu
 		groups = *externalClaims.Groups
 	}
 
+	groupsOverage := false
+	if externalClaims.ClaimNames != nil {
+		_, groupsOverage = (*externalClaims.ClaimNames)["groups"]
+	}
+
+	if externalClaims.HasGroups != nil && *externalClaims.HasGroups {
+		groupsOverage = true
+	}
+
+	amr := []string{}
+	if externalClaims.Amr != nil {
+		amr = *externalClaims.Amr
+	}
+
+	acrs := []string{}
+	if externalClaims.Acrs != nil {
+		acrs = *externalClaims.Acrs
+	}
+
+	authTime := time.Time{}
+	if externalClaims.AuthTime != nil {
+		authTime = time.Time(*externalClaims.AuthTime)
+	}
+
+	appOnly := externalClaims.Scope == nil
+	if externalClaims.Idtyp != nil {
+		appOnly = *externalClaims.Idtyp == "app"
+	}
+
 	return internalAzureADClaims{
-		sub:      subject,
-		username: username,
-		objectID: objectId,
-		groups:   groups,
+		sub:           subject,
+		username:      username,
+		objectID:      objectId,
+		groups:        groups,
+		groupsOverage: groupsOverage,
+		amr:           amr,
+		acrs:          acrs,
+		authTime:      authTime,
+		appOnly:       appOnly,
 	}, nil
 }
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -62,4 +63,62 @@ func TestToInternalAzureADClaims(t *testing.T) {
 		require.Equal(t, "ze-username", internalClaims.username)
 		require.Equal(t, []string{"ze-group"}, internalClaims.groups)
 	})
+
+	t.Run("groups overage using _claim_names", func(t *testing.T) {
+		internalClaims, err := toInternalAzureADClaims(&externalAzureADClaims{
+			Subject:    testToPtr(t, "ze-subject"),
+			ObjectId:   testToPtr(t, "ze-object-id"),
+			ClaimNames: testToPtr(t, map[string]string{"groups": "src1"}),
+		})
+		require.NoError(t, err)
+		require.True(t, internalClaims.groupsOverage)
+	})
+
+	t.Run("groups overage using hasgroups", func(t *testing.T) {
+		internalClaims, err := toInternalAzureADClaims(&externalAzureADClaims{
+			Subject:   testToPtr(t, "ze-subject"),
+			ObjectId:  testToPtr(t, "ze-object-id"),
+			HasGroups: testToPtr(t, true),
+		})
+		require.NoError(t, err)
+		require.True(t, internalClaims.groupsOverage)
+	})
+
+	t.Run("no groups overage", func(t *testing.T) {
+		internalClaims, err := toInternalAzureADClaims(&externalAzureADClaims{
+			Subject:    testToPtr(t, "ze-subject"),
+			ObjectId:   testToPtr(t, "ze-object-id"),
+			Groups:     testToPtr(t, []string{"ze-group"}),
+			ClaimNames: testToPtr(t, map[string]string{"other": "src1"}),
+			HasGroups:  testToPtr(t, false),
+		})
+		require.NoError(t, err)
+		require.False(t, internalClaims.groupsOverage)
+	})
+
+	t.Run("authentication claims", func(t *testing.T) {
+		authTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+		internalClaims, err := toInternalAzureADClaims(&externalAzureADClaims{
+			Subject:  testToPtr(t, "ze-subject"),
+			ObjectId: testToPtr(t, "ze-object-id"),
+			Amr:      testToPtr(t, []string{"pwd", "mfa"}),
+			Acrs:     testToPtr(t, []string{"c1"}),
+			AuthTime: testToPtr(t, numericDate(authTime)),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"pwd", "mfa"}, internalClaims.amr)
+		require.Equal(t, []string{"c1"}, internalClaims.acrs)
+		require.Equal(t, authTime, internalClaims.authTime)
+	})
+
+	t.Run("no authentication claims", func(t *testing.T) {
+		internalClaims, err := toInternalAzureADClaims(&externalAzureADClaims{
+			Subject:  testToPtr(t, "ze-subject"),
+			ObjectId: testToPtr(t, "ze-object-id"),
+		})
+		require.NoError(t, err)
+		require.Empty(t, internalClaims.amr)
+		require.Empty(t, internalClaims.acrs)
+		require.True(t, internalClaims.authTime.IsZero())
+	})
 }
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+	hamiltonOdata "github.com/manicminer/hamilton/odata"
+)
+
+// listGroupMemberships returns the groups an object (users or servicePrincipals collection) is member of,
+// either only the direct memberships (memberOf) or including nested groups (transitiveMemberOf)
+func listGroupMemberships(ctx context.Context, client hamiltonMsgraph.Client, collection string, objectID string, groupMembership groupMembershipModel) (_ []hamiltonMsgraph.Group, _ int, err error) {
+	ctx, end := startGraphRequest(ctx, fmt.Sprintf("%s_memberships", collection))
+	defer func() { end(err) }()
+
+	resp, status, _, err := client.Get(ctx, hamiltonMsgraph.GetHttpRequestInput{
+		ConsistencyFailureFunc: hamiltonMsgraph.RetryOn404ConsistencyFailureFunc,
+		OData:                  hamiltonOdata.Query{},
+		ValidStatusCodes:       []int{http.StatusOK},
+		Uri: hamiltonMsgraph.Uri{
+			Entity:      fmt.Sprintf("/%s/%s/%s/microsoft.graph.group", collection, objectID, groupMembership.graphSegment()),
+			HasTenantId: true,
+		},
+	})
+	if err != nil {
+		return nil, status, fmt.Errorf("unable to list group memberships: %w", err)
+	}
+
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, status, err
+	}
+
+	var data struct {
+		Groups []hamiltonMsgraph.Group `json:"value"`
+	}
+	err = json.Unmarshal(respBody, &data)
+	if err != nil {
+		return nil, status, err
+	}
+
+	return data.Groups, status, nil
+}
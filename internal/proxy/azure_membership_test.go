@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hamiltonEnvironments "github.com/manicminer/hamilton/environments"
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestListGroupMemberships(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	fakeGraph := testNewFakeGraphMembershipServer(t)
+
+	usersClient := hamiltonMsgraph.NewUsersClient("ze-tenant")
+	testConfigureGraphClient(t, &usersClient.BaseClient, fakeGraph.URL)
+
+	cases := []struct {
+		groupMembership     groupMembershipModel
+		objectID            string
+		expectedGroupIDs    []string
+		expectedErrContains string
+	}{
+		{
+			groupMembership:  directGroupMembership,
+			objectID:         "ze-user",
+			expectedGroupIDs: []string{"k8s-team"},
+		},
+		{
+			groupMembership:  transitiveGroupMembership,
+			objectID:         "ze-user",
+			expectedGroupIDs: []string{"k8s-team", "k8s-platform", "other-parent"},
+		},
+		{
+			groupMembership:     transitiveGroupMembership,
+			objectID:            "does-not-exist",
+			expectedErrContains: "unexpected status 404",
+		},
+	}
+
+	for _, c := range cases {
+		groups, _, err := listGroupMemberships(ctx, usersClient.BaseClient, "users", c.objectID, c.groupMembership)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		groupIDs := []string{}
+		for _, group := range groups {
+			groupIDs = append(groupIDs, *group.ID())
+		}
+		require.Equal(t, c.expectedGroupIDs, groupIDs)
+	}
+}
+
+func TestAzureUserGetGroups(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	fakeGraph := testNewFakeGraphMembershipServer(t)
+	memCache := testNewMembershipCache(t)
+
+	usersClient := hamiltonMsgraph.NewUsersClient("ze-tenant")
+	testConfigureGraphClient(t, &usersClient.BaseClient, fakeGraph.URL)
+
+	servicePrincipalsClient := hamiltonMsgraph.NewServicePrincipalsClient("ze-tenant")
+	testConfigureGraphClient(t, &servicePrincipalsClient.BaseClient, fakeGraph.URL)
+
+	cases := []struct {
+		testDescription    string
+		azureUser          AzureUser
+		objectID           string
+		expectedGroupNames []string
+	}{
+		{
+			testDescription:    "user with direct memberships",
+			azureUser:          newAzureUser(ctx, memCache, usersClient, directGroupMembership),
+			objectID:           "ze-user",
+			expectedGroupNames: []string{"k8s-team"},
+		},
+		{
+			testDescription:    "user with transitive memberships (only cached groups are returned)",
+			azureUser:          newAzureUser(ctx, memCache, usersClient, transitiveGroupMembership),
+			objectID:           "ze-user",
+			expectedGroupNames: []string{"k8s-team", "k8s-platform"},
+		},
+		{
+			testDescription:    "service principal with direct memberships",
+			azureUser:          newServicePrincipalUser(ctx, memCache, servicePrincipalsClient, directGroupMembership),
+			objectID:           "ze-sp",
+			expectedGroupNames: []string{"k8s-team"},
+		},
+		{
+			testDescription:    "service principal with transitive memberships (only cached groups are returned)",
+			azureUser:          newServicePrincipalUser(ctx, memCache, servicePrincipalsClient, transitiveGroupMembership),
+			objectID:           "ze-sp",
+			expectedGroupNames: []string{"k8s-team", "k8s-platform"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			groups, err := c.azureUser.getGroups(ctx, c.objectID)
+			require.NoError(t, err)
+
+			groupNames := []string{}
+			for _, group := range groups {
+				groupNames = append(groupNames, group.Name)
+			}
+			require.Equal(t, c.expectedGroupNames, groupNames)
+		})
+	}
+}
+
+func TestProxyHandlerTransitiveMaxGroupCount(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	fakeGraph := testNewFakeGraphMembershipServer(t)
+	memCache := testNewMembershipCache(t)
+
+	usersClient := hamiltonMsgraph.NewUsersClient("ze-tenant")
+	testConfigureGraphClient(t, &usersClient.BaseClient, fakeGraph.URL)
+
+	fakeBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeBackend.Close()
+
+	kubernetesAPITokenPath, cleanupFn := testGetKubernetesAPITokenPath(t)
+	defer cleanupFn()
+
+	cases := []struct {
+		groupMembership groupMembershipModel
+		expectedResCode int
+	}{
+		{
+			groupMembership: directGroupMembership,
+			expectedResCode: http.StatusOK,
+		},
+		{
+			groupMembership: transitiveGroupMembership,
+			expectedResCode: http.StatusForbidden,
+		},
+	}
+
+	for _, c := range cases {
+		azureClient := &azure{
+			cache: memCache,
+			user:  newAzureUser(ctx, memCache, usersClient, c.groupMembership),
+		}
+		cfg := &config{
+			AzureADMaxGroupCount:   2,
+			GroupIdentifier:        "NAME",
+			KubernetesAPITokenPath: kubernetesAPITokenPath,
+		}
+
+		proxyHandlers, err := newHandlers(ctx, cfg, memCache, newUser(cfg, azureClient, memCache), newTestFakeHealthClient(t, true, nil, true, nil))
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		claims := testNewExternalClaims(t, fmt.Sprintf("sub-%s", c.groupMembership), "ze-username", nil)
+		claims.ObjectId = testToPtr(t, "ze-user")
+		proxyHandlers.proxy(ctx, testNewUpstream(t, fakeBackend.URL))(rr, testNewClaimsRequest(t, http.MethodGet, "/", claims))
+		require.Equal(t, c.expectedResCode, rr.Code)
+	}
+}
+
+func testNewMembershipCache(t *testing.T) Cache {
+	t.Helper()
+
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	// other-parent isn't matching the group prefix and is therefore not synchronized to the cache
+	for _, groupID := range []string{"k8s-team", "k8s-platform"} {
+		err := memCache.setGroup(ctx, groupID, groupModel{Name: groupID, ObjectID: groupID})
+		require.NoError(t, err)
+	}
+
+	return memCache
+}
+
+func testNewFakeGraphMembershipServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	memberships := map[string][]string{
+		"memberOf":           {"k8s-team"},
+		"transitiveMemberOf": {"k8s-team", "k8s-platform", "other-parent"},
+	}
+
+	mux := http.NewServeMux()
+	for _, collection := range []string{"users/ze-user", "servicePrincipals/ze-sp"} {
+		for segment, groupIDs := range memberships {
+			groupIDs := groupIDs
+			mux.HandleFunc(fmt.Sprintf("/beta/ze-tenant/%s/%s/microsoft.graph.group", collection, segment), func(w http.ResponseWriter, r *http.Request) {
+				testWriteGraphGroups(t, w, groupIDs)
+			})
+		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": "Request_ResourceNotFound", "message": "not found"}}`))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func testWriteGraphGroups(t *testing.T, w http.ResponseWriter, groupIDs []string) {
+	t.Helper()
+
+	value := []map[string]string{}
+	for _, groupID := range groupIDs {
+		value = append(value, map[string]string{
+			"@odata.type": "#microsoft.graph.group",
+			"id":          groupID,
+			"displayName": groupID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+	require.NoError(t, err)
+}
+
+func testConfigureGraphClient(t *testing.T, client *hamiltonMsgraph.Client, endpoint string) {
+	t.Helper()
+
+	client.Endpoint = hamiltonEnvironments.ApiEndpoint(endpoint)
+	client.Authorizer = &testFakeAuthorizer{}
+	client.DisableRetries = true
+}
+
+type testFakeAuthorizer struct{}
+
+func (a *testFakeAuthorizer) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{
+		AccessToken: "fake-token",
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	}, nil
+}
+
+func (a *testFakeAuthorizer) AuxiliaryTokens() ([]*oauth2.Token, error) {
+	return nil, nil
+}
@@ -5,34 +5,33 @@ import (
 
 	"github.com/go-logr/logr"
 	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
-	hamiltonOdata "github.com/manicminer/hamilton/odata"
 )
 
 type azureServicePrincipalUser struct {
 	cache                   Cache
 	servicePrincipalsClient *hamiltonMsgraph.ServicePrincipalsClient
+	groupMembership         groupMembershipModel
 }
 
-func newServicePrincipalUser(ctx context.Context, cacheClient Cache, servicePrincipalsClient *hamiltonMsgraph.ServicePrincipalsClient) *azureServicePrincipalUser {
+func newServicePrincipalUser(ctx context.Context, cacheClient Cache, servicePrincipalsClient *hamiltonMsgraph.ServicePrincipalsClient, groupMembership groupMembershipModel) *azureServicePrincipalUser {
 	return &azureServicePrincipalUser{
 		cache:                   cacheClient,
 		servicePrincipalsClient: servicePrincipalsClient,
+		groupMembership:         groupMembership,
 	}
 }
 
 func (user *azureServicePrincipalUser) getGroups(ctx context.Context, objectID string) ([]groupModel, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
-	odataQuery := hamiltonOdata.Query{}
-
-	groupsResponse, responseCode, err := user.servicePrincipalsClient.ListGroupMemberships(ctx, objectID, odataQuery)
+	groupsResponse, responseCode, err := listGroupMemberships(ctx, user.servicePrincipalsClient.BaseClient, "servicePrincipals", objectID, user.groupMembership)
 	if err != nil {
 		log.Error(err, "Unable to get Azure AD groups for service principal", "objectID", objectID, "responseCode", responseCode)
 		return nil, err
 	}
 
 	var groups []groupModel
-	for _, group := range *groupsResponse {
+	for _, group := range groupsResponse {
 		group, found, err := user.cache.getGroup(ctx, *group.ID())
 		if err != nil {
 			return nil, err
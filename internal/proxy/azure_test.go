@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"testing"
 	"time"
 
@@ -22,7 +24,7 @@ func TestNewAzureClient(t *testing.T) {
 		clientID            string
 		clientSecret        string
 		tenantID            string
-		graphFilter         string
+		groupFilter         *groupFilter
 		cacheClient         Cache
 		expectedErrContains string
 	}{
@@ -30,7 +32,7 @@ func TestNewAzureClient(t *testing.T) {
 			clientID:            clientID,
 			clientSecret:        clientSecret,
 			tenantID:            tenantID,
-			graphFilter:         "",
+			groupFilter:         &groupFilter{},
 			cacheClient:         memCache,
 			expectedErrContains: "",
 		},
@@ -38,7 +40,7 @@ func TestNewAzureClient(t *testing.T) {
 			clientID:            clientID,
 			clientSecret:        clientSecret,
 			tenantID:            tenantID,
-			graphFilter:         "prefix",
+			groupFilter:         &groupFilter{includePrefixes: []string{"prefix"}},
 			cacheClient:         memCache,
 			expectedErrContains: "",
 		},
@@ -46,7 +48,7 @@ func TestNewAzureClient(t *testing.T) {
 			clientID:            clientID,
 			clientSecret:        clientSecret,
 			tenantID:            "",
-			graphFilter:         "",
+			groupFilter:         &groupFilter{},
 			cacheClient:         memCache,
 			expectedErrContains: "no Authorizer could be configured, please check your configuration",
 		},
@@ -54,14 +56,14 @@ func TestNewAzureClient(t *testing.T) {
 			clientID:            "",
 			clientSecret:        "",
 			tenantID:            tenantID,
-			graphFilter:         "",
+			groupFilter:         &groupFilter{},
 			cacheClient:         memCache,
 			expectedErrContains: "no Authorizer could be configured, please check your configuration",
 		},
 	}
 
 	for _, c := range cases {
-		_, err := newAzureClient(ctx, c.clientID, c.clientSecret, c.tenantID, c.graphFilter, c.cacheClient)
+		_, err := newAzureClient(ctx, c.clientID, c.clientSecret, c.tenantID, c.groupFilter, transitiveGroupMembership, c.cacheClient)
 		if c.expectedErrContains != "" {
 			require.ErrorContains(t, err, c.expectedErrContains)
 			continue
@@ -74,13 +76,13 @@ func TestValid(t *testing.T) {
 	clientID := testGetEnvOrSkip(t, "CLIENT_ID")
 	clientSecret := testGetEnvOrSkip(t, "CLIENT_SECRET")
 	tenantID := testGetEnvOrSkip(t, "TENANT_ID")
-	graphFilter := ""
+	groupFilter := &groupFilter{}
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
 	memCache, err := newMemoryCache(5 * time.Minute)
 	require.NoError(t, err)
 
-	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, graphFilter, memCache)
+	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, groupFilter, transitiveGroupMembership, memCache)
 	require.NoError(t, err)
 
 	cases := []struct {
@@ -105,13 +107,13 @@ func TestGetUserGroups(t *testing.T) {
 	tenantID := testGetEnvOrSkip(t, "TENANT_ID")
 	userObjectID := testGetEnvOrSkip(t, "TEST_USER_OBJECT_ID")
 	spObjectID := testGetEnvOrSkip(t, "TEST_USER_SP_OBJECT_ID")
-	graphFilter := ""
+	groupFilter := &groupFilter{}
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
 	memCache, err := newMemoryCache(5 * time.Minute)
 	require.NoError(t, err)
 
-	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, graphFilter, memCache)
+	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, groupFilter, transitiveGroupMembership, memCache)
 	require.NoError(t, err)
 
 	cases := []struct {
@@ -159,13 +161,13 @@ func TestStartSyncGroups(t *testing.T) {
 	clientID := testGetEnvOrSkip(t, "CLIENT_ID")
 	clientSecret := testGetEnvOrSkip(t, "CLIENT_SECRET")
 	tenantID := testGetEnvOrSkip(t, "TENANT_ID")
-	graphFilter := ""
+	groupFilter := &groupFilter{}
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
 	memCache, err := newMemoryCache(5 * time.Minute)
 	require.NoError(t, err)
 
-	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, graphFilter, memCache)
+	azureClient, err := newAzureClient(ctx, clientID, clientSecret, tenantID, groupFilter, transitiveGroupMembership, memCache)
 	require.NoError(t, err)
 
 	groupSyncTicker, groupSyncChan, err := azureClient.startSyncGroups(ctx, 1*time.Second)
@@ -177,3 +179,50 @@ func TestStartSyncGroups(t *testing.T) {
 	}
 	defer stopGroupSync()
 }
+
+func TestValidateGraphRoles(t *testing.T) {
+	cases := []struct {
+		testDescription     string
+		roles               []string
+		expectedErrContains string
+	}{
+		{
+			testDescription: "directory read",
+			roles:           []string{"Directory.Read.All"},
+		},
+		{
+			testDescription: "group member, user and application read",
+			roles:           []string{"GroupMember.Read.All", "User.Read.All", "Application.Read.All"},
+		},
+		{
+			testDescription:     "application read missing",
+			roles:               []string{"Group.Read.All", "User.Read.All"},
+			expectedErrContains: "Microsoft Graph application permissions missing, one of the following is required: Directory.Read.All, Group.Read.All + User.Read.All + Application.Read.All",
+		},
+		{
+			testDescription:     "no roles",
+			roles:               nil,
+			expectedErrContains: "Microsoft Graph application permissions missing",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			err := validateGraphRoles(c.roles)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestGetTokenRoles(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte("{\"roles\":[\"Directory.Read.All\"]}"))
+
+	require.Equal(t, []string{"Directory.Read.All"}, getTokenRoles(fmt.Sprintf("e30.%s.c", payload)))
+	require.Nil(t, getTokenRoles("not-a-jwt"))
+	require.Nil(t, getTokenRoles("e30.!.c"))
+}
@@ -5,34 +5,33 @@ import (
 
 	"github.com/go-logr/logr"
 	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
-	hamiltonOdata "github.com/manicminer/hamilton/odata"
 )
 
 type azureUser struct {
-	cache       Cache
-	usersClient *hamiltonMsgraph.UsersClient
+	cache           Cache
+	usersClient     *hamiltonMsgraph.UsersClient
+	groupMembership groupMembershipModel
 }
 
-func newAzureUser(ctx context.Context, cacheClient Cache, usersClient *hamiltonMsgraph.UsersClient) *azureUser {
+func newAzureUser(ctx context.Context, cacheClient Cache, usersClient *hamiltonMsgraph.UsersClient, groupMembership groupMembershipModel) *azureUser {
 	return &azureUser{
-		cache:       cacheClient,
-		usersClient: usersClient,
+		cache:           cacheClient,
+		usersClient:     usersClient,
+		groupMembership: groupMembership,
 	}
 }
 
 func (user *azureUser) getGroups(ctx context.Context, objectID string) ([]groupModel, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
-	odataQuery := hamiltonOdata.Query{}
-
-	groupsResponse, responseCode, err := user.usersClient.ListGroupMemberships(ctx, objectID, odataQuery)
+	groupsResponse, responseCode, err := listGroupMemberships(ctx, user.usersClient.BaseClient, "users", objectID, user.groupMembership)
 	if err != nil {
 		log.Error(err, "Unable to get Azure AD groups for user", "objectID", objectID, "responseCode", responseCode)
 		return nil, err
 	}
 
 	var groups []groupModel
-	for _, group := range *groupsResponse {
+	for _, group := range groupsResponse {
 		group, found, err := user.cache.getGroup(ctx, *group.ID())
 		if err != nil {
 			return nil, err
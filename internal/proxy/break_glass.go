@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+)
+
+const breakGlassUsernamePrefix = "break-glass:"
+
+// breakGlassConfig is the format of the file configured with --break-glass-config-path
+type breakGlassConfig struct {
+	EmergencyGroup string                       `json:"emergencyGroup"`
+	ExpiresAt      *time.Time                   `json:"expiresAt"`
+	Credentials    []breakGlassCredentialConfig `json:"credentials"`
+}
+
+// breakGlassCredentialConfig is either the hex encoded sha256 hash of a static token or the path to a client
+// certificate. Client certificates are pinned and should be self-signed, since clients only send a certificate if its
+// issuer is one of the trusted client CAs.
+type breakGlassCredentialConfig struct {
+	Name            string     `json:"name"`
+	TokenSHA256     string     `json:"tokenSHA256"`
+	CertificatePath string     `json:"certificatePath"`
+	ExpiresAt       *time.Time `json:"expiresAt"`
+}
+
+// breakGlass gives emergency access to the cluster when Azure AD or Microsoft Graph is unavailable. The credentials are
+// configured locally, either as the sha256 hash of a static token or as a client certificate, and impersonate the
+// emergency group without looking up the user in Azure AD.
+type breakGlass struct {
+	emergencyGroup string
+	credentials    []breakGlassCredential
+	now            func() time.Time
+}
+
+type breakGlassCredential struct {
+	name        string
+	tokenHash   []byte
+	certificate *x509.Certificate
+	expiresAt   time.Time
+}
+
+// newBreakGlass returns nil if break-glass is not configured, which is the default
+func newBreakGlass(ctx context.Context, cfg *config) (*breakGlass, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if cfg.BreakGlassConfigPath == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(cfg.BreakGlassConfigPath) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("unable to read break-glass config: %w", err)
+	}
+
+	var breakGlassCfg breakGlassConfig
+	err = yaml.UnmarshalStrict(b, &breakGlassCfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse break-glass config %q: %w", cfg.BreakGlassConfigPath, err)
+	}
+
+	if breakGlassCfg.EmergencyGroup == "" {
+		return nil, fmt.Errorf("break-glass emergencyGroup is required")
+	}
+
+	if len(breakGlassCfg.Credentials) == 0 {
+		return nil, fmt.Errorf("no break-glass credentials configured in %q", cfg.BreakGlassConfigPath)
+	}
+
+	bg := &breakGlass{
+		emergencyGroup: breakGlassCfg.EmergencyGroup,
+		now:            time.Now,
+	}
+
+	names := make(map[string]struct{})
+	for _, credentialCfg := range breakGlassCfg.Credentials {
+		credential, err := newBreakGlassCredential(credentialCfg, breakGlassCfg.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := names[credential.name]; ok {
+			return nil, fmt.Errorf("duplicate break-glass credential name %q", credential.name)
+		}
+		names[credential.name] = struct{}{}
+
+		if credential.certificate != nil && !cfg.ListenerTLSConfigEnabled {
+			return nil, fmt.Errorf("break-glass credential %q: TLS needs to be enabled on the listener to use client certificates", credential.name)
+		}
+
+		log.Info("Break-glass credential configured", "name", credential.name, "expiresAt", credential.expiresAt, "emergencyGroup", bg.emergencyGroup)
+		bg.credentials = append(bg.credentials, credential)
+	}
+
+	return bg, nil
+}
+
+func newBreakGlassCredential(credentialCfg breakGlassCredentialConfig, defaultExpiresAt *time.Time) (breakGlassCredential, error) {
+	if credentialCfg.Name == "" {
+		return breakGlassCredential{}, fmt.Errorf("break-glass credential name is required")
+	}
+
+	if (credentialCfg.TokenSHA256 == "") == (credentialCfg.CertificatePath == "") {
+		return breakGlassCredential{}, fmt.Errorf("break-glass credential %q: one of tokenSHA256 or certificatePath is required", credentialCfg.Name)
+	}
+
+	credential := breakGlassCredential{
+		name: credentialCfg.Name,
+	}
+
+	switch {
+	case credentialCfg.ExpiresAt != nil:
+		credential.expiresAt = *credentialCfg.ExpiresAt
+	case defaultExpiresAt != nil:
+		credential.expiresAt = *defaultExpiresAt
+	}
+
+	if credentialCfg.TokenSHA256 != "" {
+		tokenHash, err := hex.DecodeString(strings.ToLower(credentialCfg.TokenSHA256))
+		if err != nil || len(tokenHash) != sha256.Size {
+			return breakGlassCredential{}, fmt.Errorf("break-glass credential %q: tokenSHA256 needs to be a hex encoded sha256 hash", credentialCfg.Name)
+		}
+
+		credential.tokenHash = tokenHash
+		return credential, nil
+	}
+
+	b, err := os.ReadFile(credentialCfg.CertificatePath) // #nosec
+	if err != nil {
+		return breakGlassCredential{}, fmt.Errorf("break-glass credential %q: unable to read certificate: %w", credentialCfg.Name, err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return breakGlassCredential{}, fmt.Errorf("break-glass credential %q: no certificate found in %q", credentialCfg.Name, credentialCfg.CertificatePath)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return breakGlassCredential{}, fmt.Errorf("break-glass credential %q: unable to parse certificate: %w", credentialCfg.Name, err)
+	}
+
+	credential.certificate = certificate
+	return credential, nil
+}
+
+// authenticateToken returns the credential matching the token, if any
+func (bg *breakGlass) authenticateToken(token string) (breakGlassCredential, bool) {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	for _, credential := range bg.credentials {
+		if credential.tokenHash == nil {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(tokenHash[:], credential.tokenHash) == 1 {
+			return credential, true
+		}
+	}
+
+	return breakGlassCredential{}, false
+}
+
+// authenticateCertificate returns the credential matching the client certificate, if any. The certificate has already
+// been verified in the TLS handshake, where the break-glass certificates are trusted as client CAs.
+func (bg *breakGlass) authenticateCertificate(certificate *x509.Certificate) (breakGlassCredential, bool) {
+	if certificate == nil {
+		return breakGlassCredential{}, false
+	}
+
+	for _, credential := range bg.credentials {
+		if credential.certificate == nil {
+			continue
+		}
+
+		if bytes.Equal(certificate.Raw, credential.certificate.Raw) {
+			return credential, true
+		}
+	}
+
+	return breakGlassCredential{}, false
+}
+
+func (bg *breakGlass) expired(credential breakGlassCredential) bool {
+	return !credential.expiresAt.IsZero() && !bg.now().Before(credential.expiresAt)
+}
+
+func (bg *breakGlass) user(credential breakGlassCredential) userModel {
+	return userModel{
+		Username: fmt.Sprintf("%s%s", breakGlassUsernamePrefix, credential.name),
+		Groups: []groupModel{
+			{
+				Name:     bg.emergencyGroup,
+				ObjectID: bg.emergencyGroup,
+			},
+		},
+		Type: breakGlassUserModelType,
+	}
+}
@@ -0,0 +1,454 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBreakGlass(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tmpDir := t.TempDir()
+	ca := testNewCertificateAuthority(t, "break-glass-ca")
+	certificatePath := filepath.Join(tmpDir, "break-glass.crt")
+	certificate := ca.issueKeyPair(t, "break-glass", nil)
+	testCreateTemporaryFile(t, certificatePath, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})))
+	notCertificatePath := filepath.Join(tmpDir, "not-a-certificate.crt")
+	testCreateTemporaryFile(t, notCertificatePath, "not a certificate")
+
+	tokenHash := testBreakGlassTokenHash("ze-break-glass-token")
+
+	cases := []struct {
+		breakGlassConfig    string
+		tlsDisabled         bool
+		expectedCredentials []string
+		expectedExpiresAt   []time.Time
+		expectedErrContains string
+	}{
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+expiresAt: 2030-01-01T00:00:00Z
+credentials:
+  - name: token
+    tokenSHA256: %s
+  - name: certificate
+    certificatePath: %s
+    expiresAt: 2029-01-01T00:00:00Z
+`, tokenHash, certificatePath),
+			expectedCredentials: []string{"token", "certificate"},
+			expectedExpiresAt: []time.Time{
+				time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: token
+    tokenSHA256: %s
+`, tokenHash),
+			tlsDisabled:         true,
+			expectedCredentials: []string{"token"},
+			expectedExpiresAt:   []time.Time{{}},
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: certificate
+    certificatePath: %s
+`, certificatePath),
+			tlsDisabled:         true,
+			expectedErrContains: "TLS needs to be enabled on the listener to use client certificates",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+credentials:
+  - name: token
+    tokenSHA256: %s
+`, tokenHash),
+			expectedErrContains: "break-glass emergencyGroup is required",
+		},
+		{
+			breakGlassConfig: `
+emergencyGroup: emergency-admins
+credentials: []
+`,
+			expectedErrContains: "no break-glass credentials configured",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - tokenSHA256: %s
+`, tokenHash),
+			expectedErrContains: "break-glass credential name is required",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: token
+    tokenSHA256: %s
+  - name: token
+    tokenSHA256: %s
+`, tokenHash, tokenHash),
+			expectedErrContains: "duplicate break-glass credential name \"token\"",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: both
+    tokenSHA256: %s
+    certificatePath: %s
+`, tokenHash, certificatePath),
+			expectedErrContains: "one of tokenSHA256 or certificatePath is required",
+		},
+		{
+			breakGlassConfig: `
+emergencyGroup: emergency-admins
+credentials:
+  - name: none
+`,
+			expectedErrContains: "one of tokenSHA256 or certificatePath is required",
+		},
+		{
+			breakGlassConfig: `
+emergencyGroup: emergency-admins
+credentials:
+  - name: token
+    tokenSHA256: ze-plaintext-token
+`,
+			expectedErrContains: "tokenSHA256 needs to be a hex encoded sha256 hash",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: certificate
+    certificatePath: %s
+`, notCertificatePath),
+			expectedErrContains: "no certificate found",
+		},
+		{
+			breakGlassConfig: fmt.Sprintf(`
+emergencyGroup: emergency-admins
+credentials:
+  - name: certificate
+    certificatePath: %s
+`, filepath.Join(tmpDir, "does-not-exist.crt")),
+			expectedErrContains: "unable to read certificate",
+		},
+		{
+			breakGlassConfig: `
+emergencyGroup: emergency-admins
+unknownField: true
+`,
+			expectedErrContains: "unable to parse break-glass config",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		breakGlassConfigPath := filepath.Join(tmpDir, "break-glass.yaml")
+		testCreateTemporaryFile(t, breakGlassConfigPath, c.breakGlassConfig)
+
+		bg, err := newBreakGlass(ctx, &config{
+			BreakGlassConfigPath:     breakGlassConfigPath,
+			ListenerTLSConfigEnabled: !c.tlsDisabled,
+		})
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, "emergency-admins", bg.emergencyGroup)
+
+		credentials := []string{}
+		expiresAt := []time.Time{}
+		for _, credential := range bg.credentials {
+			credentials = append(credentials, credential.name)
+			expiresAt = append(expiresAt, credential.expiresAt)
+		}
+		require.Equal(t, c.expectedCredentials, credentials)
+		require.Equal(t, c.expectedExpiresAt, expiresAt)
+	}
+
+	// Break-glass is disabled by default
+	bg, err := newBreakGlass(ctx, &config{})
+	require.NoError(t, err)
+	require.Nil(t, bg)
+
+	_, err = newBreakGlass(ctx, &config{BreakGlassConfigPath: filepath.Join(tmpDir, "does-not-exist.yaml")})
+	require.ErrorContains(t, err, "unable to read break-glass config")
+}
+
+func TestBreakGlassAuthenticate(t *testing.T) {
+	ca := testNewCertificateAuthority(t, "break-glass-ca")
+	certificate := ca.issue(t, "break-glass", nil, x509.ExtKeyUsageClientAuth)
+	otherCertificate := ca.issue(t, "break-glass", nil, x509.ExtKeyUsageClientAuth)
+
+	tokenHash, err := hex.DecodeString(testBreakGlassTokenHash("ze-break-glass-token"))
+	require.NoError(t, err)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bg := &breakGlass{
+		emergencyGroup: "emergency-admins",
+		credentials: []breakGlassCredential{
+			{
+				name:      "token",
+				tokenHash: tokenHash,
+			},
+			{
+				name:        "certificate",
+				certificate: certificate,
+				expiresAt:   now.Add(time.Hour),
+			},
+		},
+		now: func() time.Time { return now },
+	}
+
+	credential, ok := bg.authenticateToken("ze-break-glass-token")
+	require.True(t, ok)
+	require.Equal(t, "token", credential.name)
+	require.False(t, bg.expired(credential))
+
+	_, ok = bg.authenticateToken("ze-other-token")
+	require.False(t, ok)
+
+	_, ok = bg.authenticateToken("")
+	require.False(t, ok)
+
+	credential, ok = bg.authenticateCertificate(certificate)
+	require.True(t, ok)
+	require.Equal(t, "certificate", credential.name)
+	require.False(t, bg.expired(credential))
+
+	// Another certificate from the same certificate authority isn't a break-glass credential
+	_, ok = bg.authenticateCertificate(otherCertificate)
+	require.False(t, ok)
+
+	_, ok = bg.authenticateCertificate(nil)
+	require.False(t, ok)
+
+	now = now.Add(time.Hour)
+	require.True(t, bg.expired(credential))
+
+	require.Equal(t, userModel{
+		Username: "break-glass:certificate",
+		Groups: []groupModel{
+			{
+				Name:     "emergency-admins",
+				ObjectID: "emergency-admins",
+			},
+		},
+		Type: breakGlassUserModelType,
+	}, bg.user(credential))
+}
+
+func TestProxyHandlerBreakGlass(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	var receivedHeaders http.Header
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	certificate := testNewSelfSignedClientCertificate(t, "break-glass")
+
+	tokenHash, err := hex.DecodeString(testBreakGlassTokenHash("ze-break-glass-token"))
+	require.NoError(t, err)
+	expiredTokenHash, err := hex.DecodeString(testBreakGlassTokenHash("ze-expired-token"))
+	require.NoError(t, err)
+
+	now := time.Now()
+	bg := &breakGlass{
+		emergencyGroup: "emergency-admins",
+		credentials: []breakGlassCredential{
+			{
+				name:      "bg-token",
+				tokenHash: tokenHash,
+				expiresAt: now.Add(time.Hour),
+			},
+			{
+				name:      "bg-expired-token",
+				tokenHash: expiredTokenHash,
+				expiresAt: now.Add(-time.Hour),
+			},
+			{
+				name:        "bg-certificate",
+				certificate: certificate.Leaf,
+			},
+		},
+		now: time.Now,
+	}
+
+	// The group identifier and prefix would rewrite Azure AD users, but never the emergency group
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "OBJECTID",
+		ImpersonateUID:       true,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	sink := &testFakeAuditSink{}
+	auditClient := &audit{
+		workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+		backpressure: dropAuditBackpressure,
+	}
+
+	up := testNewUpstream(t, fakeAPIServer.URL)
+	handler := auditClient.middleware(newAuthHandler(ctx, nil, bg, proxyHandlers.proxy(ctx, up), "ze-tenant-id", "ze-client-id"))
+
+	p := &proxy{breakGlass: bg}
+	proxyServer := httptest.NewUnstartedServer(handler)
+	proxyServer.TLS = &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  p.getClientCAs(),
+		MinVersion: tls.VersionTLS12,
+	}
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	cases := []struct {
+		clientCertificate    *tls.Certificate
+		token                string
+		expectedResCode      int
+		expectedUser         []string
+		expectedAuth         *auditAuth
+		expectedDenialReason string
+	}{
+		{
+			token:           "ze-break-glass-token",
+			expectedResCode: http.StatusOK,
+			expectedUser:    []string{"break-glass:bg-token"},
+			expectedAuth:    &auditAuth{Method: breakGlassAuthMethod, BreakGlassCredential: "bg-token"},
+		},
+		{
+			clientCertificate: certificate,
+			expectedResCode:   http.StatusOK,
+			expectedUser:      []string{"break-glass:bg-certificate"},
+			expectedAuth:      &auditAuth{Method: breakGlassAuthMethod, BreakGlassCredential: "bg-certificate"},
+		},
+		{
+			token:                "ze-expired-token",
+			expectedResCode:      http.StatusForbidden,
+			expectedAuth:         &auditAuth{Method: breakGlassAuthMethod, BreakGlassCredential: "bg-expired-token"},
+			expectedDenialReason: "break-glass credential expired",
+		},
+		{
+			token:                "ze-other-token",
+			expectedResCode:      http.StatusUnauthorized,
+			expectedAuth:         &auditAuth{Method: azureADAuthMethod},
+			expectedDenialReason: "unauthenticated",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+		receivedHeaders = nil
+
+		transport := proxyServer.Client().Transport.(*http.Transport).Clone()
+		if c.clientCertificate != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*c.clientCertificate}
+		}
+		client := &http.Client{Transport: transport}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/pods", proxyServer.URL), nil)
+		require.NoError(t, err)
+		if c.token != "" {
+			req.Header.Set(authorizationHeader, fmt.Sprintf("Bearer %s", c.token))
+		}
+
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, c.expectedResCode, res.StatusCode)
+
+		if c.expectedResCode == http.StatusOK {
+			require.Equal(t, c.expectedUser, receivedHeaders.Values(impersonateUserHeader))
+			require.Equal(t, []string{"emergency-admins"}, receivedHeaders.Values(impersonateGroupHeader))
+			require.Empty(t, receivedHeaders.Values(impersonateUIDHeader))
+			require.Equal(t, "Bearer fake-token", receivedHeaders.Get(authorizationHeader))
+		} else {
+			require.Nil(t, receivedHeaders)
+		}
+	}
+
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsBreakGlassRequests, "bg-token"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsBreakGlassRequests, "bg-certificate"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsBreakGlassRequests, "bg-expired-token"))
+
+	require.NoError(t, auditClient.close(ctx))
+
+	events := sink.getEvents()
+	require.Len(t, events, len(cases))
+	for i, c := range cases {
+		require.Equal(t, c.expectedAuth, events[i].Auth)
+		require.Equal(t, c.expectedDenialReason, events[i].DenialReason)
+	}
+}
+
+func testNewSelfSignedClientCertificate(t *testing.T, commonName string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(certBytes)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certBytes},
+		PrivateKey:  key,
+		Leaf:        certificate,
+	}
+}
+
+func testBreakGlassTokenHash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(tokenHash[:])
+}
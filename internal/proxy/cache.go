@@ -2,11 +2,87 @@ package proxy
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"time"
 )
 
 type Cache interface {
 	getUser(ctx context.Context, s string) (userModel, bool, error)
 	setUser(ctx context.Context, s string, u userModel) error
+	deleteUser(ctx context.Context, s string) error
+	listUsers(ctx context.Context) (map[string]userModel, error)
 	getGroup(ctx context.Context, s string) (groupModel, bool, error)
 	setGroup(ctx context.Context, s string, g groupModel) error
+	deleteGroup(ctx context.Context, s string) error
+	listGroups(ctx context.Context) ([]groupModel, error)
+	getGrants(ctx context.Context, objectID string) ([]grantModel, error)
+	listGrants(ctx context.Context) ([]grantModel, error)
+	setGrant(ctx context.Context, g grantModel) error
+	deleteGrant(ctx context.Context, id string) (bool, error)
+	ping(ctx context.Context) error
+}
+
+func newCacheClient(ctx context.Context, cfg *config) (Cache, error) {
+	cacheEngine, err := getCacheEngine(cfg.CacheEngine)
+	if err != nil {
+		return nil, err
+	}
+
+	expirationInterval := time.Duration(cfg.GroupSyncInterval) * time.Minute
+
+	switch cacheEngine {
+	case memoryCacheEngine:
+		return newMemoryCache(expirationInterval)
+	case redisCacheEngine:
+		return newRedisCache(ctx, cfg, expirationInterval)
+	default:
+		return nil, fmt.Errorf("Unexpected cache engine: %s", cfg.CacheEngine)
+	}
+}
+
+// evictCachedUsers deletes the cached users matching the function and returns how many were deleted, the users are
+// resolved again on their next request
+func evictCachedUsers(ctx context.Context, cacheClient Cache, matches func(user userModel) bool) (int, error) {
+	users, err := cacheClient.listUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	evicted := 0
+	for key, user := range users {
+		if !matches(user) {
+			continue
+		}
+
+		err := cacheClient.deleteUser(ctx, key)
+		if err != nil {
+			return evicted, err
+		}
+		evicted++
+	}
+
+	return evicted, nil
+}
+
+// sortGroups orders groups by name
+func sortGroups(groups []groupModel) {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name == groups[j].Name {
+			return groups[i].ObjectID < groups[j].ObjectID
+		}
+
+		return groups[i].Name < groups[j].Name
+	})
+}
+
+// sortGrants orders grants by expiry, the grants expiring first are listed first
+func sortGrants(grants []grantModel) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].ExpiresAt.Equal(grants[j].ExpiresAt) {
+			return grants[i].ID < grants[j].ID
+		}
+
+		return grants[i].ExpiresAt.Before(grants[j].ExpiresAt)
+	})
 }
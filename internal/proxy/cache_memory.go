@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	gocache "github.com/patrickmn/go-cache"
@@ -9,11 +11,18 @@ import (
 
 type memoryCache struct {
 	CacheClient *gocache.Cache
+
+	// grants are indexed by the object id of the user (and then the grant id), since they are read on every request
+	grantsMu sync.Mutex
+	grants   map[string]map[string]grantModel
+	now      func() time.Time
 }
 
 func newMemoryCache(expirationInterval time.Duration) (*memoryCache, error) {
 	return &memoryCache{
 		CacheClient: gocache.New(expirationInterval, 2*expirationInterval),
+		grants:      make(map[string]map[string]grantModel),
+		now:         time.Now,
 	}, nil
 }
 
@@ -32,6 +41,27 @@ func (c *memoryCache) setUser(ctx context.Context, s string, u userModel) error
 	return nil
 }
 
+func (c *memoryCache) deleteUser(ctx context.Context, s string) error {
+	c.CacheClient.Delete(s)
+
+	return nil
+}
+
+// listUsers returns the cached users by key, users and groups share the cache and are told apart by their type
+func (c *memoryCache) listUsers(ctx context.Context) (map[string]userModel, error) {
+	users := make(map[string]userModel)
+	for key, item := range c.CacheClient.Items() {
+		u, ok := item.Object.(userModel)
+		if !ok {
+			continue
+		}
+
+		users[key] = u
+	}
+
+	return users, nil
+}
+
 // GetGroup ...
 func (c *memoryCache) getGroup(ctx context.Context, s string) (groupModel, bool, error) {
 	g, f := c.CacheClient.Get(s)
@@ -43,7 +73,126 @@ func (c *memoryCache) getGroup(ctx context.Context, s string) (groupModel, bool,
 
 // SetGroup ...
 func (c *memoryCache) setGroup(ctx context.Context, s string, g groupModel) error {
-	c.CacheClient.Set(s, g, 0)
+	// Groups are kept up to date by the group sync and removed by it when deleted in Azure AD
+	c.CacheClient.Set(s, g, gocache.NoExpiration)
+
+	return nil
+}
+
+// DeleteGroup ...
+func (c *memoryCache) deleteGroup(ctx context.Context, s string) error {
+	c.CacheClient.Delete(s)
+
+	return nil
+}
+
+func (c *memoryCache) listGroups(ctx context.Context) ([]groupModel, error) {
+	groups := []groupModel{}
+	for _, item := range c.CacheClient.Items() {
+		g, ok := item.Object.(groupModel)
+		if !ok {
+			continue
+		}
+
+		groups = append(groups, g)
+	}
+
+	sortGroups(groups)
+
+	return groups, nil
+}
+
+func (c *memoryCache) getGrants(ctx context.Context, objectID string) ([]grantModel, error) {
+	c.grantsMu.Lock()
+	defer c.grantsMu.Unlock()
+
+	c.deleteExpiredGrants(objectID, c.now())
+
+	grants := []grantModel{}
+	for _, g := range c.grants[objectID] {
+		grants = append(grants, g)
+	}
+
+	sortGrants(grants)
+
+	return grants, nil
+}
+
+func (c *memoryCache) listGrants(ctx context.Context) ([]grantModel, error) {
+	c.grantsMu.Lock()
+	defer c.grantsMu.Unlock()
+
+	now := c.now()
+	grants := []grantModel{}
+	for objectID := range c.grants {
+		c.deleteExpiredGrants(objectID, now)
+		for _, g := range c.grants[objectID] {
+			grants = append(grants, g)
+		}
+	}
+
+	sortGrants(grants)
+
+	return grants, nil
+}
+
+func (c *memoryCache) setGrant(ctx context.Context, g grantModel) error {
+	now := c.now()
+	if !g.ExpiresAt.After(now) {
+		return fmt.Errorf("grant %q has already expired", g.ID)
+	}
+
+	c.grantsMu.Lock()
+	defer c.grantsMu.Unlock()
+
+	// The expired grants of every user are removed, to not keep the grants of users that don't send any requests
+	for objectID := range c.grants {
+		c.deleteExpiredGrants(objectID, now)
+	}
+
+	if c.grants[g.ObjectID] == nil {
+		c.grants[g.ObjectID] = make(map[string]grantModel)
+	}
+	c.grants[g.ObjectID][g.ID] = g
+
+	return nil
+}
+
+func (c *memoryCache) deleteGrant(ctx context.Context, id string) (bool, error) {
+	c.grantsMu.Lock()
+	defer c.grantsMu.Unlock()
+
+	for objectID, userGrants := range c.grants {
+		if _, ok := userGrants[id]; !ok {
+			continue
+		}
+
+		delete(userGrants, id)
+		if len(userGrants) == 0 {
+			delete(c.grants, objectID)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// deleteExpiredGrants needs to be called with the grants lock held
+func (c *memoryCache) deleteExpiredGrants(objectID string, now time.Time) {
+	userGrants := c.grants[objectID]
+	for id, g := range userGrants {
+		if !g.ExpiresAt.After(now) {
+			delete(userGrants, id)
+		}
+	}
+
+	if len(userGrants) == 0 {
+		delete(c.grants, objectID)
+	}
+}
 
+// ping always succeeds, the memory cache is in the same process
+func (c *memoryCache) ping(ctx context.Context) error {
 	return nil
 }
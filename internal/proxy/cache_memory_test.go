@@ -100,6 +100,28 @@ func TestMemorySetGroup(t *testing.T) {
 	}
 }
 
+func TestMemoryDeleteGroup(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	_, cases := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		err := cache.setGroup(ctx, c.Key, c.Group)
+		require.NoError(t, err)
+
+		err = cache.deleteGroup(ctx, c.Key)
+		require.NoError(t, err)
+
+		_, found := cache.CacheClient.Get(c.Key)
+		require.False(t, found)
+	}
+
+	err = cache.deleteGroup(ctx, "does-not-exist")
+	require.NoError(t, err)
+}
+
 type testMemoryUserCase struct {
 	User userModel
 	Key  string
@@ -178,3 +200,90 @@ func testGetMemoryCases(t *testing.T) ([]testMemoryUserCase, []testMemoryGroupCa
 
 	return userCases, groupCases
 }
+
+func TestMemoryGrants(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	cache.now = func() time.Time { return now }
+	grants := []grantModel{
+		{ID: "grant-2", ObjectID: "user-1", Group: "cluster-admins", ExpiresAt: now.Add(2 * time.Hour)},
+		{ID: "grant-1", ObjectID: "user-1", Group: "developers", ExpiresAt: now.Add(time.Hour)},
+		{ID: "grant-3", ObjectID: "user-2", Group: "cluster-admins", ExpiresAt: now.Add(time.Hour)},
+	}
+
+	for _, g := range grants {
+		err := cache.setGrant(ctx, g)
+		require.NoError(t, err)
+	}
+
+	err = cache.setGrant(ctx, grantModel{ID: "expired", ObjectID: "user-1", ExpiresAt: now.Add(-time.Minute)})
+	require.ErrorContains(t, err, "has already expired")
+
+	// Cached users aren't listed as grants
+	err = cache.setUser(ctx, "user-1", userModel{Username: "user-1"})
+	require.NoError(t, err)
+
+	allGrants, err := cache.listGrants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[1], grants[2], grants[0]}, allGrants)
+
+	userGrants, err := cache.getGrants(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[1], grants[0]}, userGrants)
+
+	deleted, err := cache.deleteGrant(ctx, "grant-1")
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	deleted, err = cache.deleteGrant(ctx, "grant-1")
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	userGrants, err = cache.getGrants(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[0]}, userGrants)
+
+	// Expired grants aren't returned and are removed
+	now = now.Add(61 * time.Minute)
+
+	allGrants, err = cache.listGrants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[0]}, allGrants)
+	require.NotContains(t, cache.grants, "user-2")
+
+	now = now.Add(time.Hour)
+
+	userGrants, err = cache.getGrants(ctx, "user-1")
+	require.NoError(t, err)
+	require.Empty(t, userGrants)
+	require.Empty(t, cache.grants)
+}
+
+func TestMemoryListUsersAndGroups(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	user := userModel{Username: "ze-username", ObjectID: "ze-object-id"}
+	require.NoError(t, cache.setUser(ctx, "ze-sub", user))
+	require.NoError(t, cache.setGroup(ctx, "group-b", groupModel{Name: "b", ObjectID: "group-b"}))
+	require.NoError(t, cache.setGroup(ctx, "group-a", groupModel{Name: "a", ObjectID: "group-a"}))
+	require.NoError(t, cache.setGrant(ctx, grantModel{ID: "grant", ObjectID: "ze-object-id", ExpiresAt: time.Now().Add(time.Hour)}))
+
+	users, err := cache.listUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]userModel{"ze-sub": user}, users)
+
+	groups, err := cache.listGroups(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []groupModel{{Name: "a", ObjectID: "group-a"}, {Name: "b", ObjectID: "group-b"}}, groups)
+
+	require.NoError(t, cache.deleteUser(ctx, "ze-sub"))
+
+	users, err = cache.listUsers(ctx)
+	require.NoError(t, err)
+	require.Empty(t, users)
+}
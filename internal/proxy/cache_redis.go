@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisUserKeyPrefix  = "azad-kube-proxy:user:"
+	redisGroupKeyPrefix = "azad-kube-proxy:group:"
+	// The grants of a user are stored in the hash azad-kube-proxy:grants:<object id> with the grant id as the field,
+	// the hash azad-kube-proxy:grant-ids maps the grant ids to the object ids
+	redisGrantKeyPrefix = "azad-kube-proxy:grants:"
+	redisGrantIDsKey    = "azad-kube-proxy:grant-ids"
+)
+
+type redisCache struct {
+	CacheClient        *redis.Client
+	expirationInterval time.Duration
+	now                func() time.Time
+}
+
+func newRedisCache(ctx context.Context, cfg *config, expirationInterval time.Duration) (*redisCache, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	redisOptions := &redis.Options{
+		Addr:     cfg.RedisAddress,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDatabase,
+	}
+
+	if cfg.RedisTLSEnabled {
+		host, _, err := net.SplitHostPort(cfg.RedisAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		redisOptions.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: host,
+		}
+
+		if cfg.RedisCACertificatePath != "" {
+			rootCAs, err := getCertificate(ctx, cfg.RedisCACertificatePath)
+			if err != nil {
+				return nil, err
+			}
+			redisOptions.TLSConfig.RootCAs = rootCAs
+		}
+	}
+
+	client := redis.NewClient(redisOptions)
+
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		log.Error(err, "Unable to connect to Redis", "address", cfg.RedisAddress)
+		return nil, err
+	}
+
+	log.Info("Using cache engine: redis", "address", cfg.RedisAddress, "database", cfg.RedisDatabase, "tls", cfg.RedisTLSEnabled)
+
+	return &redisCache{
+		CacheClient:        client,
+		expirationInterval: expirationInterval,
+		now:                time.Now,
+	}, nil
+}
+
+func (c *redisCache) getUser(ctx context.Context, s string) (userModel, bool, error) {
+	var u userModel
+	err := c.CacheClient.Get(ctx, redisUserKeyPrefix+s).Scan(&u)
+	if errors.Is(err, redis.Nil) {
+		return userModel{}, false, nil
+	}
+	if err != nil {
+		return userModel{}, false, err
+	}
+
+	return u, true, nil
+}
+
+func (c *redisCache) setUser(ctx context.Context, s string, u userModel) error {
+	return c.CacheClient.Set(ctx, redisUserKeyPrefix+s, u, c.expirationInterval).Err()
+}
+
+func (c *redisCache) deleteUser(ctx context.Context, s string) error {
+	return c.CacheClient.Del(ctx, redisUserKeyPrefix+s).Err()
+}
+
+func (c *redisCache) listUsers(ctx context.Context) (map[string]userModel, error) {
+	keys, err := c.scanKeys(ctx, redisUserKeyPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]userModel)
+	for _, key := range keys {
+		s := strings.TrimPrefix(key, redisUserKeyPrefix)
+		u, found, err := c.getUser(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			users[s] = u
+		}
+	}
+
+	return users, nil
+}
+
+func (c *redisCache) getGroup(ctx context.Context, s string) (groupModel, bool, error) {
+	var g groupModel
+	err := c.CacheClient.Get(ctx, redisGroupKeyPrefix+s).Scan(&g)
+	if errors.Is(err, redis.Nil) {
+		return groupModel{}, false, nil
+	}
+	if err != nil {
+		return groupModel{}, false, err
+	}
+
+	return g, true, nil
+}
+
+func (c *redisCache) setGroup(ctx context.Context, s string, g groupModel) error {
+	// Groups are kept up to date by the group sync and removed by it when deleted in Azure AD
+	return c.CacheClient.Set(ctx, redisGroupKeyPrefix+s, g, 0).Err()
+}
+
+func (c *redisCache) deleteGroup(ctx context.Context, s string) error {
+	return c.CacheClient.Del(ctx, redisGroupKeyPrefix+s).Err()
+}
+
+func (c *redisCache) listGroups(ctx context.Context) ([]groupModel, error) {
+	keys, err := c.scanKeys(ctx, redisGroupKeyPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []groupModel{}
+	for _, key := range keys {
+		g, found, err := c.getGroup(ctx, strings.TrimPrefix(key, redisGroupKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			groups = append(groups, g)
+		}
+	}
+
+	sortGroups(groups)
+
+	return groups, nil
+}
+
+func (c *redisCache) getGrants(ctx context.Context, objectID string) ([]grantModel, error) {
+	values, err := c.CacheClient.HGetAll(ctx, redisGrantKeyPrefix+objectID).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	grants, expiredIDs, err := parseRedisGrants(values, c.now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.deleteRedisGrants(ctx, objectID, expiredIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	sortGrants(grants)
+
+	return grants, nil
+}
+
+func (c *redisCache) listGrants(ctx context.Context) ([]grantModel, error) {
+	grantIDs, err := c.CacheClient.HGetAll(ctx, redisGrantIDsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	objectIDs := make(map[string]struct{})
+	for _, objectID := range grantIDs {
+		objectIDs[objectID] = struct{}{}
+	}
+
+	grants := []grantModel{}
+	for objectID := range objectIDs {
+		userGrants, err := c.getGrants(ctx, objectID)
+		if err != nil {
+			return nil, err
+		}
+
+		grants = append(grants, userGrants...)
+	}
+
+	// Remove the grant ids of the grants that expired together with the hash of the user
+	listed := make(map[string]struct{})
+	for _, g := range grants {
+		listed[g.ID] = struct{}{}
+	}
+
+	staleIDs := []string{}
+	for id := range grantIDs {
+		if _, ok := listed[id]; !ok {
+			staleIDs = append(staleIDs, id)
+		}
+	}
+
+	if len(staleIDs) > 0 {
+		err := c.CacheClient.HDel(ctx, redisGrantIDsKey, staleIDs...).Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortGrants(grants)
+
+	return grants, nil
+}
+
+// setGrant adds the grant to the hash of the user, the hashes expire together with the last grant. Grants that
+// expired before that are removed when the grants are read.
+func (c *redisCache) setGrant(ctx context.Context, g grantModel) error {
+	expiration := g.ExpiresAt.Sub(c.now())
+	if expiration <= 0 {
+		return fmt.Errorf("grant %q has already expired", g.ID)
+	}
+
+	b, err := g.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	userKey := redisGrantKeyPrefix + g.ObjectID
+	err = c.CacheClient.HSet(ctx, userKey, g.ID, b).Err()
+	if err != nil {
+		return err
+	}
+
+	err = c.CacheClient.HSet(ctx, redisGrantIDsKey, g.ID, g.ObjectID).Err()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []string{userKey, redisGrantIDsKey} {
+		err := c.extendExpiration(ctx, key, expiration)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *redisCache) deleteGrant(ctx context.Context, id string) (bool, error) {
+	objectID, err := c.CacheClient.HGet(ctx, redisGrantIDsKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := c.CacheClient.HDel(ctx, redisGrantKeyPrefix+objectID, id).Result()
+	if err != nil {
+		return false, err
+	}
+
+	err = c.CacheClient.HDel(ctx, redisGrantIDsKey, id).Err()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (c *redisCache) ping(ctx context.Context) error {
+	return c.CacheClient.Ping(ctx).Err()
+}
+
+// deleteRedisGrants removes the grants from the hash of the user and the grant ids
+func (c *redisCache) deleteRedisGrants(ctx context.Context, objectID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := c.CacheClient.HDel(ctx, redisGrantKeyPrefix+objectID, ids...).Err()
+	if err != nil {
+		return err
+	}
+
+	return c.CacheClient.HDel(ctx, redisGrantIDsKey, ids...).Err()
+}
+
+// extendExpiration sets the expiration of the key, unless it already expires later
+func (c *redisCache) extendExpiration(ctx context.Context, key string, expiration time.Duration) error {
+	ttl, err := c.CacheClient.PTTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	// The ttl is negative if the key doesn't expire
+	if ttl >= expiration {
+		return nil
+	}
+
+	return c.CacheClient.PExpire(ctx, key, expiration).Err()
+}
+
+// parseRedisGrants returns the active grants of the hash values and the ids of the expired grants
+func parseRedisGrants(values map[string]string, now time.Time) ([]grantModel, []string, error) {
+	grants := []grantModel{}
+	expiredIDs := []string{}
+	for id, value := range values {
+		var g grantModel
+		err := g.UnmarshalBinary([]byte(value))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse grant %q: %w", id, err)
+		}
+
+		if !g.ExpiresAt.After(now) {
+			expiredIDs = append(expiredIDs, id)
+			continue
+		}
+
+		grants = append(grants, g)
+	}
+
+	return grants, expiredIDs, nil
+}
+
+func (c *redisCache) scanKeys(ctx context.Context, match string) ([]string, error) {
+	keys := []string{}
+	iter := c.CacheClient.Scan(ctx, 0, match, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRedisCache(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	redisServer := miniredis.RunT(t)
+	redisServer.RequireAuth("ze-password")
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	tlsRedisServer, err := miniredis.RunTLS(&tls.Config{Certificates: tlsServer.TLS.Certificates})
+	require.NoError(t, err)
+	defer tlsRedisServer.Close()
+
+	caCertificatePath := filepath.Join(t.TempDir(), "ca.crt")
+	testCreateTemporaryFile(t, caCertificatePath, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})))
+
+	cases := []struct {
+		config              *config
+		expectedErrContains string
+	}{
+		{
+			config: &config{
+				RedisAddress:  redisServer.Addr(),
+				RedisPassword: "ze-password",
+			},
+			expectedErrContains: "",
+		},
+		{
+			config: &config{
+				RedisAddress:  redisServer.Addr(),
+				RedisPassword: "wrong-password",
+			},
+			expectedErrContains: "WRONGPASS",
+		},
+		{
+			config: &config{
+				RedisAddress:    "no-port",
+				RedisTLSEnabled: true,
+			},
+			expectedErrContains: "missing port in address",
+		},
+		{
+			config: &config{
+				RedisAddress:           tlsRedisServer.Addr(),
+				RedisCACertificatePath: caCertificatePath,
+				RedisTLSEnabled:        true,
+			},
+			expectedErrContains: "",
+		},
+		{
+			config: &config{
+				RedisAddress:    tlsRedisServer.Addr(),
+				RedisTLSEnabled: true,
+			},
+			expectedErrContains: "certificate signed by unknown authority",
+		},
+		{
+			config: &config{
+				RedisAddress:           tlsRedisServer.Addr(),
+				RedisCACertificatePath: filepath.Join(t.TempDir(), "missing.crt"),
+				RedisTLSEnabled:        true,
+			},
+			expectedErrContains: "no such file or directory",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := newRedisCache(ctx, c.config, 5*time.Minute)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+	}
+}
+
+func TestRedisGetUser(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	cases, _ := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		data, err := c.User.MarshalBinary()
+		require.NoError(t, err)
+		err = redisServer.Set(redisUserKeyPrefix+c.Key, string(data))
+		require.NoError(t, err)
+
+		cacheRes, found, err := cache.getUser(ctx, c.Key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, c.User, cacheRes)
+	}
+
+	_, found, err := cache.getUser(ctx, "does-not-exist")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	err = redisServer.Set(redisUserKeyPrefix+"invalid", "not-json")
+	require.NoError(t, err)
+	_, _, err = cache.getUser(ctx, "invalid")
+	require.Error(t, err)
+}
+
+func TestRedisSetUser(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	cases, _ := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		err := cache.setUser(ctx, c.Key, c.User)
+		require.NoError(t, err)
+
+		data, err := redisServer.Get(redisUserKeyPrefix + c.Key)
+		require.NoError(t, err)
+
+		var cacheRes userModel
+		err = cacheRes.UnmarshalBinary([]byte(data))
+		require.NoError(t, err)
+		require.Equal(t, c.User, cacheRes)
+		require.Equal(t, 5*time.Minute, redisServer.TTL(redisUserKeyPrefix+c.Key))
+	}
+}
+
+func TestRedisGetGroup(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	_, cases := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		data, err := c.Group.MarshalBinary()
+		require.NoError(t, err)
+		err = redisServer.Set(redisGroupKeyPrefix+c.Key, string(data))
+		require.NoError(t, err)
+
+		cacheRes, found, err := cache.getGroup(ctx, c.Key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, c.Group, cacheRes)
+	}
+
+	_, found, err := cache.getGroup(ctx, "does-not-exist")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestRedisSetGroup(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	_, cases := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		err := cache.setGroup(ctx, c.Key, c.Group)
+		require.NoError(t, err)
+
+		data, err := redisServer.Get(redisGroupKeyPrefix + c.Key)
+		require.NoError(t, err)
+
+		var cacheRes groupModel
+		err = cacheRes.UnmarshalBinary([]byte(data))
+		require.NoError(t, err)
+		require.Equal(t, c.Group, cacheRes)
+		require.Equal(t, time.Duration(0), redisServer.TTL(redisGroupKeyPrefix+c.Key))
+	}
+}
+
+func TestRedisDeleteGroup(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	_, cases := testGetMemoryCases(t)
+
+	for _, c := range cases {
+		err := cache.setGroup(ctx, c.Key, c.Group)
+		require.NoError(t, err)
+
+		err = cache.deleteGroup(ctx, c.Key)
+		require.NoError(t, err)
+		require.False(t, redisServer.Exists(redisGroupKeyPrefix+c.Key))
+	}
+
+	err := cache.deleteGroup(ctx, "does-not-exist")
+	require.NoError(t, err)
+}
+
+func TestRedisExpiration(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	err := cache.setUser(ctx, "expiring-user", userModel{Username: "user"})
+	require.NoError(t, err)
+
+	redisServer.FastForward(6 * time.Minute)
+
+	_, found, err := cache.getUser(ctx, "expiring-user")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func testNewRedisCache(t *testing.T) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	redisServer := miniredis.RunT(t)
+
+	cache, err := newRedisCache(ctx, &config{RedisAddress: redisServer.Addr()}, 5*time.Minute)
+	require.NoError(t, err)
+	t.Cleanup(func() { cache.CacheClient.Close() })
+
+	return cache, redisServer
+}
+
+func TestRedisGrants(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, redisServer := testNewRedisCache(t)
+
+	now := time.Now().UTC()
+	cache.now = func() time.Time { return now }
+	grants := []grantModel{
+		{ID: "grant-2", ObjectID: "user-1", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(2 * time.Hour)},
+		{ID: "grant-1", ObjectID: "user-1", Group: "developers", Reason: "debugging", ExpiresAt: now.Add(time.Hour)},
+		{ID: "grant-3", ObjectID: "user-2", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(time.Hour)},
+	}
+
+	for _, g := range grants {
+		err := cache.setGrant(ctx, g)
+		require.NoError(t, err)
+	}
+
+	err := cache.setGrant(ctx, grantModel{ID: "expired", ObjectID: "user-1", ExpiresAt: now.Add(-time.Minute)})
+	require.ErrorContains(t, err, "has already expired")
+
+	// The hash of the user expires together with the last grant
+	require.Equal(t, 2*time.Hour, redisServer.TTL(redisGrantKeyPrefix+"user-1"))
+	require.Equal(t, time.Hour, redisServer.TTL(redisGrantKeyPrefix+"user-2"))
+
+	err = cache.setUser(ctx, "user-1", userModel{Username: "user-1"})
+	require.NoError(t, err)
+
+	allGrants, err := cache.listGrants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[1], grants[2], grants[0]}, allGrants)
+
+	userGrants, err := cache.getGrants(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{grants[1], grants[0]}, userGrants)
+
+	deleted, err := cache.deleteGrant(ctx, "grant-2")
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	deleted, err = cache.deleteGrant(ctx, "grant-2")
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	// Expired grants aren't returned and are removed, Redis removes the hashes of users without active grants
+	now = now.Add(61 * time.Minute)
+	redisServer.FastForward(61 * time.Minute)
+	require.True(t, redisServer.Exists(redisGrantKeyPrefix+"user-1"))
+	require.False(t, redisServer.Exists(redisGrantKeyPrefix+"user-2"))
+
+	allGrants, err = cache.listGrants(ctx)
+	require.NoError(t, err)
+	require.Empty(t, allGrants)
+	require.False(t, redisServer.Exists(redisGrantKeyPrefix+"user-1"))
+	require.False(t, redisServer.Exists(redisGrantIDsKey))
+}
+
+func TestRedisListUsersAndGroups(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cache, _ := testNewRedisCache(t)
+
+	user := userModel{Username: "ze-username", ObjectID: "ze-object-id", Groups: []groupModel{{Name: "a", ObjectID: "group-a"}}}
+	require.NoError(t, cache.setUser(ctx, "ze-sub", user))
+	require.NoError(t, cache.setGroup(ctx, "group-b", groupModel{Name: "b", ObjectID: "group-b"}))
+	require.NoError(t, cache.setGroup(ctx, "group-a", groupModel{Name: "a", ObjectID: "group-a"}))
+
+	users, err := cache.listUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]userModel{"ze-sub": user}, users)
+
+	groups, err := cache.listGroups(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []groupModel{{Name: "a", ObjectID: "group-a"}, {Name: "b", ObjectID: "group-b"}}, groups)
+
+	require.NoError(t, cache.deleteUser(ctx, "ze-sub"))
+
+	_, found, err := cache.getUser(ctx, "ze-sub")
+	require.NoError(t, err)
+	require.False(t, found)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCacheClient(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	redisServer := miniredis.RunT(t)
+
+	cases := []struct {
+		config              *config
+		expectedErrContains string
+	}{
+		{
+			config:              &config{},
+			expectedErrContains: "Unknown cache engine type",
+		},
+		{
+			config: &config{
+				CacheEngine:       "MEMORY",
+				GroupSyncInterval: 5,
+			},
+			expectedErrContains: "",
+		},
+		{
+			config: &config{
+				CacheEngine:       "REDIS",
+				GroupSyncInterval: 5,
+				RedisAddress:      redisServer.Addr(),
+			},
+			expectedErrContains: "",
+		},
+		{
+			config: &config{
+				CacheEngine:       "REDIS",
+				GroupSyncInterval: 5,
+				RedisAddress:      "127.0.0.1:1",
+			},
+			expectedErrContains: "connection refused",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := newCacheClient(ctx, c.config)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Check validates the config, runs the preflight checks of the check subcommand and writes the report. It returns true
+// if every check passed. The other checks depend on the config, so only the config check is reported when the config
+// is invalid and the validation error is returned.
+func Check(ctx context.Context, w io.Writer, cfg *config) (bool, error) {
+	output, err := getCheckOutput(cfg.Check.Output)
+	if err != nil {
+		return false, err
+	}
+
+	configErr := cfg.validate()
+	checks := []healthCheck{
+		{name: "config", check: func(_ context.Context) error { return configErr }},
+	}
+
+	if configErr == nil {
+		preflightChecks, err := newPreflightChecks(ctx, cfg)
+		if err != nil {
+			return false, err
+		}
+		checks = append(checks, preflightChecks...)
+	}
+
+	report := runHealthChecks(ctx, checks, func(_ healthCheck) bool {
+		return true
+	})
+
+	err = writeCheckReport(w, output, report)
+	if err != nil {
+		return false, err
+	}
+
+	if configErr != nil {
+		return false, configErr
+	}
+
+	return report.ok(), nil
+}
+
+// newPreflightChecks returns the checks of the components the proxy needs to start and serve requests. A component
+// that can't be created is reported as a failed check, instead of stopping the other checks.
+func newPreflightChecks(ctx context.Context, cfg *config) ([]healthCheck, error) {
+	checks := []healthCheck{}
+
+	azureChecks, err := newAzurePreflightChecks(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	checks = append(checks, azureChecks...)
+
+	upstreamChecks, err := newUpstreamPreflightChecks(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	checks = append(checks, upstreamChecks...)
+
+	if cfg.ListenerTLSConfigEnabled {
+		checks = append(checks, healthCheck{
+			name: "listener_certificate",
+			check: func(_ context.Context) error {
+				return checkListenerCertificate(cfg.ListenerTLSConfigCertificatePath, cfg.ListenerTLSConfigKeyPath, time.Now())
+			},
+		})
+	}
+
+	return checks, nil
+}
+
+// newAzurePreflightChecks verifies the credentials, the Microsoft Graph application permissions of the token and that
+// the groups and memberships can be read. The cache isn't used by the checks, so the memory cache is always used.
+func newAzurePreflightChecks(ctx context.Context, cfg *config) ([]healthCheck, error) {
+	cacheClient, err := newMemoryCache(time.Duration(cfg.GroupSyncInterval) * time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	groupMembership, err := getGroupMembership(cfg.AzureADGroupMembership)
+	if err != nil {
+		return nil, err
+	}
+
+	groupFilter, err := newGroupFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	azureClient, err := newAzureClient(ctx, cfg.AzureClientID, cfg.AzureClientSecret, cfg.AzureTenantID, groupFilter, groupMembership, cacheClient)
+	if err != nil {
+		return []healthCheck{newFailedPreflightCheck("azure_ad_credentials", err)}, nil
+	}
+
+	return newAzureClientPreflightChecks(azureClient), nil
+}
+
+func newAzureClientPreflightChecks(azureClient Azure) []healthCheck {
+	return []healthCheck{
+		{name: "azure_ad_credentials", check: azureClient.validCredentials},
+		{name: "graph_permissions", check: azureClient.validGraphPermissions},
+		{name: "graph_access", check: azureClient.validGraphAccess},
+	}
+}
+
+// newUpstreamPreflightChecks verifies the connectivity (and the CA trust when the certificate is validated) and the
+// impersonation rights of every upstream
+func newUpstreamPreflightChecks(ctx context.Context, cfg *config) ([]healthCheck, error) {
+	impersonateResources, err := getImpersonateResources(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams, err := newUpstreams(ctx, cfg)
+	if err != nil {
+		return []healthCheck{newFailedPreflightCheck("upstreams", err)}, nil
+	}
+
+	checks := []healthCheck{}
+	for _, up := range upstreams {
+		k8sClient, err := newUpstreamKubernetesClient(up)
+		if err != nil {
+			checks = append(checks, newFailedPreflightCheck(fmt.Sprintf("%s/%s", getHealthCheckName(upstreamHealthCheck), up.name), err))
+			continue
+		}
+
+		checks = append(checks, newUpstreamHealthChecks(up.name, k8sClient, impersonateResources)...)
+	}
+
+	return checks, nil
+}
+
+func newFailedPreflightCheck(name string, err error) healthCheck {
+	return healthCheck{
+		name: name,
+		check: func(_ context.Context) error {
+			return err
+		},
+	}
+}
+
+// checkListenerCertificate verifies that the listener certificate matches the key and is valid now
+func checkListenerCertificate(certificatePath string, keyPath string, now time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate and key: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("unable to parse TLS certificate: %w", err)
+	}
+
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("TLS certificate not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func writeCheckReport(w io.Writer, output checkOutputModel, report healthReport) error {
+	switch output {
+	case tableCheckOutput:
+		table := tablewriter.NewWriter(w)
+		table.SetHeader([]string{"Check", "Status", "Error"})
+		table.SetAutoWrapText(false)
+
+		for _, result := range report.Checks {
+			table.Append([]string{result.Name, strings.ToUpper(result.Status), result.Error})
+		}
+
+		table.Render()
+
+		return nil
+	case jsonCheckOutput:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(report)
+	default:
+		return fmt.Errorf("Unexpected check output: %s", output)
+	}
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckListenerCertificate(t *testing.T) {
+	tmpDir := t.TempDir()
+	certificatePath := filepath.Join(tmpDir, "tls.crt")
+	keyPath := filepath.Join(tmpDir, "tls.key")
+
+	notAfter := time.Now().Add(24 * time.Hour)
+	testWriteCertificateFiles(t, certificatePath, keyPath, "ze-proxy", notAfter)
+
+	otherCertificatePath := filepath.Join(tmpDir, "other.crt")
+	otherCertificatePEM, _ := testGenerateCertificate(t, "ze-other", notAfter)
+	testCreateTemporaryFile(t, otherCertificatePath, string(otherCertificatePEM))
+
+	cases := []struct {
+		testDescription     string
+		certificatePath     string
+		keyPath             string
+		now                 time.Time
+		expectedErrContains string
+	}{
+		{
+			testDescription: "valid",
+			certificatePath: certificatePath,
+			keyPath:         keyPath,
+			now:             time.Now(),
+		},
+		{
+			testDescription:     "expired",
+			certificatePath:     certificatePath,
+			keyPath:             keyPath,
+			now:                 notAfter.Add(time.Hour),
+			expectedErrContains: "TLS certificate expired at",
+		},
+		{
+			testDescription:     "not yet valid",
+			certificatePath:     certificatePath,
+			keyPath:             keyPath,
+			now:                 time.Now().Add(-time.Hour),
+			expectedErrContains: "TLS certificate not valid before",
+		},
+		{
+			testDescription:     "key mismatch",
+			certificatePath:     otherCertificatePath,
+			keyPath:             keyPath,
+			now:                 time.Now(),
+			expectedErrContains: "private key does not match public key",
+		},
+		{
+			testDescription:     "missing file",
+			certificatePath:     filepath.Join(tmpDir, "missing.crt"),
+			keyPath:             keyPath,
+			now:                 time.Now(),
+			expectedErrContains: "no such file or directory",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			err := checkListenerCertificate(c.certificatePath, c.keyPath, c.now)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestAzureClientPreflightChecks(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	checks := newAzureClientPreflightChecks(&testFakeAzureClient{t: t})
+	report := runHealthChecks(ctx, checks, func(_ healthCheck) bool { return true })
+	require.True(t, report.ok())
+	require.Equal(t, []string{"azure_ad_credentials", "graph_permissions", "graph_access"}, testHealthCheckNames(t, report))
+
+	checks = newAzureClientPreflightChecks(&testFakeAzureClient{t: t, fakeError: fmt.Errorf("ze-error")})
+	report = runHealthChecks(ctx, checks, func(_ healthCheck) bool { return true })
+	require.False(t, report.ok())
+	for _, result := range report.Checks {
+		require.Equal(t, "ze-error", result.Error)
+	}
+}
+
+func TestUpstreamPreflightChecks(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	impersonateAllowed := true
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer ze-token", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"major": "1", "minor": "27", "gitVersion": "v1.27.2"}`))
+		case "/apis/authorization.k8s.io/v1/selfsubjectrulesreviews":
+			rules := []map[string]interface{}{}
+			if impersonateAllowed {
+				rules = append(rules, map[string]interface{}{
+					"verbs":     []string{"impersonate"},
+					"apiGroups": []string{""},
+					"resources": []string{"users", "groups", "serviceaccounts"},
+				})
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"apiVersion": "authorization.k8s.io/v1",
+				"kind":       "SelfSubjectRulesReview",
+				"status": map[string]interface{}{
+					"resourceRules":    rules,
+					"nonResourceRules": []interface{}{},
+					"incomplete":       false,
+				},
+			})
+			require.NoError(t, err)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer fakeAPIServer.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	testCreateTemporaryFile(t, tokenPath, "ze-token")
+
+	host, port := testSplitServerHostPort(t, fakeAPIServer)
+	cfg := &config{
+		KubernetesAPIHost:         host,
+		KubernetesAPIPort:         port,
+		KubernetesAPITLS:          false,
+		KubernetesAPIValidateCert: false,
+		KubernetesAPITokenPath:    tokenPath,
+	}
+
+	checks, err := newUpstreamPreflightChecks(ctx, cfg)
+	require.NoError(t, err)
+
+	report := runHealthChecks(ctx, checks, func(_ healthCheck) bool { return true })
+	require.True(t, report.ok(), report)
+	require.Equal(t, []string{"upstream/default", "impersonation/default"}, testHealthCheckNames(t, report))
+
+	impersonateAllowed = false
+	report = runHealthChecks(ctx, checks, func(_ healthCheck) bool { return true })
+	require.False(t, report.ok())
+	require.Equal(t, "Impersonate rule not found for: users, groups, serviceaccounts", report.Checks[1].Error)
+
+	// An upstream that can't be created is reported as a failed check
+	checks, err = newUpstreamPreflightChecks(ctx, &config{UpstreamsConfigPath: filepath.Join(t.TempDir(), "missing.yaml")})
+	require.NoError(t, err)
+
+	report = runHealthChecks(ctx, checks, func(_ healthCheck) bool { return true })
+	require.False(t, report.ok())
+	require.Equal(t, []string{"upstreams"}, testHealthCheckNames(t, report))
+	require.Contains(t, report.Checks[0].Error, "unable to read upstreams config")
+}
+
+func TestWriteCheckReport(t *testing.T) {
+	report := healthReport{
+		Status: "error",
+		Checks: []healthCheckResult{
+			{Name: "config", Status: "ok", Gating: true},
+			{Name: "graph_permissions", Status: "error", Gating: true, Error: "ze-error"},
+		},
+	}
+
+	t.Run("table", func(t *testing.T) {
+		var b bytes.Buffer
+		err := writeCheckReport(&b, tableCheckOutput, report)
+		require.NoError(t, err)
+		require.Contains(t, b.String(), "| config            | OK     |          |")
+		require.Contains(t, b.String(), "| graph_permissions | ERROR  | ze-error |")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		err := writeCheckReport(&b, jsonCheckOutput, report)
+		require.NoError(t, err)
+
+		var resReport healthReport
+		require.NoError(t, json.Unmarshal(b.Bytes(), &resReport))
+		require.Equal(t, report, resReport)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		err := writeCheckReport(&bytes.Buffer{}, checkOutputModel("DUMMY"), report)
+		require.ErrorContains(t, err, "Unexpected check output: DUMMY")
+	})
+}
+
+func TestNewConfigCheck(t *testing.T) {
+	testUnsetConfigEnv(t)
+
+	args := []string{"--client-id=ze-client-id", "--client-secret=ze-client-secret", "--tenant-id=ze-tenant-id"}
+
+	cfg, err := NewConfig(args, "", "", "")
+	require.NoError(t, err)
+	require.Nil(t, cfg.Check)
+
+	cfg, err = NewConfig(append([]string{"check"}, args...), "", "", "")
+	require.NoError(t, err)
+	require.Equal(t, &checkConfig{Output: "TABLE"}, cfg.Check)
+
+	cfg, err = NewConfig(append([]string{"check", "--output", "JSON"}, args...), "", "", "")
+	require.NoError(t, err)
+	require.Equal(t, &checkConfig{Output: "JSON"}, cfg.Check)
+
+	_, err = NewConfig(append([]string{"check", "--output", "DUMMY"}, args...), "", "", "")
+	require.ErrorContains(t, err, "Unknown check output 'DUMMY'")
+
+	// An invalid config is reported by the check subcommand
+	cfg, err = NewConfig([]string{"check", "--cache-engine", "DUMMY"}, "", "", "")
+	require.NoError(t, err)
+	require.Equal(t, "DUMMY", cfg.CacheEngine)
+}
+
+func TestCheckInvalidConfig(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cfg := &config{
+		AzureClientID: "ze-client-id",
+		CacheEngine:   "DUMMY",
+		Check:         &checkConfig{Output: "JSON"},
+	}
+
+	var b bytes.Buffer
+	passed, err := Check(ctx, &b, cfg)
+	require.False(t, passed)
+	require.ErrorContains(t, err, "invalid configuration")
+
+	var report healthReport
+	require.NoError(t, json.Unmarshal(b.Bytes(), &report))
+	require.Equal(t, "error", report.Status)
+	require.Equal(t, []string{"config"}, testHealthCheckNames(t, report))
+	require.Contains(t, report.Checks[0].Error, "--client-secret is required")
+	require.Contains(t, report.Checks[0].Error, "Unknown cache engine type 'DUMMY'")
+}
+
+func testHealthCheckNames(t *testing.T, report healthReport) []string {
+	t.Helper()
+
+	names := []string{}
+	for _, result := range report.Checks {
+		names = append(names, result.Name)
+	}
+
+	return names
+}
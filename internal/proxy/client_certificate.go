@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+)
+
+const clientCertificateAllowAll = "*"
+
+// clientCertificateConfig is the format of the file configured with --client-certificate-config-path
+type clientCertificateConfig struct {
+	CertificateAuthorities []clientCertificateAuthorityConfig `json:"certificateAuthorities"`
+}
+
+type clientCertificateAuthorityConfig struct {
+	Name                 string   `json:"name"`
+	CACertPath           string   `json:"caCertPath"`
+	AllowedCommonNames   []string `json:"allowedCommonNames"`
+	AllowedOrganizations []string `json:"allowedOrganizations"`
+}
+
+// clientCertificateAuth authenticates requests using client certificates issued by one of the configured certificate
+// authorities. The common name (CN) of the certificate is the username and the organizations (O) are the groups.
+type clientCertificateAuth struct {
+	authorities []clientCertificateAuthority
+	clientCAs   *x509.CertPool
+}
+
+type clientCertificateAuthority struct {
+	name                 string
+	roots                *x509.CertPool
+	allowedCommonNames   map[string]struct{}
+	allowedOrganizations map[string]struct{}
+}
+
+type clientCertificateIdentity struct {
+	authority string
+	subject   string
+	serial    string
+	user      userModel
+}
+
+// newClientCertificateAuth returns nil if no client certificate config is configured
+func newClientCertificateAuth(ctx context.Context, cfg *config) (*clientCertificateAuth, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if cfg.ClientCertificateConfigPath == "" {
+		return nil, nil
+	}
+
+	if !cfg.ListenerTLSConfigEnabled {
+		return nil, fmt.Errorf("TLS needs to be enabled on the listener to use client certificate authentication")
+	}
+
+	b, err := os.ReadFile(cfg.ClientCertificateConfigPath) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client certificate config: %w", err)
+	}
+
+	var certCfg clientCertificateConfig
+	err = yaml.UnmarshalStrict(b, &certCfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client certificate config %q: %w", cfg.ClientCertificateConfigPath, err)
+	}
+
+	if len(certCfg.CertificateAuthorities) == 0 {
+		return nil, fmt.Errorf("no certificate authorities configured in %q", cfg.ClientCertificateConfigPath)
+	}
+
+	auth := &clientCertificateAuth{
+		clientCAs: x509.NewCertPool(),
+	}
+
+	names := make(map[string]struct{})
+	for _, authorityCfg := range certCfg.CertificateAuthorities {
+		if authorityCfg.Name == "" {
+			return nil, fmt.Errorf("certificate authority name is required")
+		}
+
+		if _, ok := names[authorityCfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate certificate authority name %q", authorityCfg.Name)
+		}
+		names[authorityCfg.Name] = struct{}{}
+
+		if len(authorityCfg.AllowedCommonNames) == 0 {
+			return nil, fmt.Errorf("certificate authority %q: allowedCommonNames is required, use %q to allow all common names", authorityCfg.Name, clientCertificateAllowAll)
+		}
+
+		caPEM, err := os.ReadFile(authorityCfg.CACertPath) // #nosec
+		if err != nil {
+			return nil, fmt.Errorf("certificate authority %q: unable to read ca certificate: %w", authorityCfg.Name, err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("certificate authority %q: no certificates found in %q", authorityCfg.Name, authorityCfg.CACertPath)
+		}
+		auth.clientCAs.AppendCertsFromPEM(caPEM)
+
+		log.Info("Using client certificate authority", "name", authorityCfg.Name, "ca-cert-path", authorityCfg.CACertPath)
+		auth.authorities = append(auth.authorities, clientCertificateAuthority{
+			name:                 authorityCfg.Name,
+			roots:                roots,
+			allowedCommonNames:   newAllowlist(authorityCfg.AllowedCommonNames),
+			allowedOrganizations: newAllowlist(authorityCfg.AllowedOrganizations),
+		})
+	}
+
+	return auth, nil
+}
+
+// authenticate verifies the certificate chain against every certificate authority, the first certificate authority
+// that issued the certificate decides if the common name and organizations are allowed
+func (auth *clientCertificateAuth) authenticate(certs []*x509.Certificate) (clientCertificateIdentity, error) {
+	if len(certs) == 0 {
+		return clientCertificateIdentity{}, fmt.Errorf("no client certificate")
+	}
+
+	leaf := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	for _, authority := range auth.authorities {
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         authority.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			continue
+		}
+
+		commonName := leaf.Subject.CommonName
+		if commonName == "" {
+			return clientCertificateIdentity{}, fmt.Errorf("client certificate issued by %q has no common name", authority.name)
+		}
+
+		if !allowlistContains(authority.allowedCommonNames, commonName) {
+			return clientCertificateIdentity{}, fmt.Errorf("common name %q is not allowed for certificate authority %q", commonName, authority.name)
+		}
+
+		groups := []groupModel{}
+		for _, organization := range leaf.Subject.Organization {
+			if !allowlistContains(authority.allowedOrganizations, organization) {
+				continue
+			}
+
+			groups = append(groups, groupModel{
+				Name:     organization,
+				ObjectID: organization,
+			})
+		}
+
+		return clientCertificateIdentity{
+			authority: authority.name,
+			subject:   leaf.Subject.String(),
+			serial:    leaf.SerialNumber.String(),
+			user: userModel{
+				Username: commonName,
+				Groups:   groups,
+				Type:     clientCertificateUserModelType,
+			},
+		}, nil
+	}
+
+	return clientCertificateIdentity{}, fmt.Errorf("client certificate %q is not issued by any of the configured certificate authorities", leaf.Subject.String())
+}
+
+func newAllowlist(values []string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+
+	return set
+}
+
+func allowlistContains(set map[string]struct{}, value string) bool {
+	if _, ok := set[clientCertificateAllowAll]; ok {
+		return true
+	}
+
+	_, ok := set[value]
+	return ok
+}
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClientCertificateAuth(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tmpDir := t.TempDir()
+	ca := testNewCertificateAuthority(t, "ze-ca")
+	caPath := filepath.Join(tmpDir, "ca.crt")
+	testCreateTemporaryFile(t, caPath, string(ca.certificatePEM))
+
+	cases := []struct {
+		clientCertificateConfig string
+		tlsDisabled             bool
+		expectedAuthorities     []string
+		expectedErrContains     string
+	}{
+		{
+			clientCertificateConfig: fmt.Sprintf(`
+certificateAuthorities:
+- name: automation
+  caCertPath: %[1]s
+  allowedCommonNames: ["ci-runner"]
+  allowedOrganizations: ["ci"]
+- name: other
+  caCertPath: %[1]s
+  allowedCommonNames: ["*"]
+`, caPath),
+			expectedAuthorities: []string{"automation", "other"},
+		},
+		{
+			clientCertificateConfig: fmt.Sprintf(`
+certificateAuthorities:
+- name: automation
+  caCertPath: %[1]s
+  allowedCommonNames: ["ci-runner"]
+`, caPath),
+			tlsDisabled:         true,
+			expectedErrContains: "TLS needs to be enabled",
+		},
+		{
+			clientCertificateConfig: "certificateAuthorities: []",
+			expectedErrContains:     "no certificate authorities configured",
+		},
+		{
+			clientCertificateConfig: "certificateAuthorities:\n- name: automation\n  fake: true",
+			expectedErrContains:     "unable to parse client certificate config",
+		},
+		{
+			clientCertificateConfig: fmt.Sprintf(`
+certificateAuthorities:
+- name: automation
+  caCertPath: %[1]s
+`, caPath),
+			expectedErrContains: "allowedCommonNames is required",
+		},
+		{
+			clientCertificateConfig: fmt.Sprintf(`
+certificateAuthorities:
+- name: automation
+  caCertPath: %[1]s
+  allowedCommonNames: ["*"]
+- name: automation
+  caCertPath: %[1]s
+  allowedCommonNames: ["*"]
+`, caPath),
+			expectedErrContains: "duplicate certificate authority name \"automation\"",
+		},
+		{
+			clientCertificateConfig: fmt.Sprintf(`
+certificateAuthorities:
+- name: automation
+  caCertPath: %s
+  allowedCommonNames: ["*"]
+`, filepath.Join(tmpDir, "does-not-exist")),
+			expectedErrContains: "unable to read ca certificate",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		cfg := &config{
+			ClientCertificateConfigPath: filepath.Join(tmpDir, fmt.Sprintf("client-certificates-%d.yaml", i)),
+			ListenerTLSConfigEnabled:    !c.tlsDisabled,
+		}
+		testCreateTemporaryFile(t, cfg.ClientCertificateConfigPath, c.clientCertificateConfig)
+
+		auth, err := newClientCertificateAuth(ctx, cfg)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, authority := range auth.authorities {
+			names = append(names, authority.name)
+		}
+		require.Equal(t, c.expectedAuthorities, names)
+	}
+
+	auth, err := newClientCertificateAuth(ctx, &config{})
+	require.NoError(t, err)
+	require.Nil(t, auth)
+}
+
+func TestClientCertificateAuthAuthenticate(t *testing.T) {
+	automationCA := testNewCertificateAuthority(t, "automation-ca")
+	partnerCA := testNewCertificateAuthority(t, "partner-ca")
+	unknownCA := testNewCertificateAuthority(t, "unknown-ca")
+
+	auth := &clientCertificateAuth{
+		authorities: []clientCertificateAuthority{
+			{
+				name:                 "automation",
+				roots:                automationCA.pool(t),
+				allowedCommonNames:   newAllowlist([]string{"ci-runner", "deployer"}),
+				allowedOrganizations: newAllowlist([]string{"ci", "deploy"}),
+			},
+			{
+				name:                 "partner",
+				roots:                partnerCA.pool(t),
+				allowedCommonNames:   newAllowlist([]string{clientCertificateAllowAll}),
+				allowedOrganizations: newAllowlist(nil),
+			},
+		},
+	}
+
+	cases := []struct {
+		certificate         *x509.Certificate
+		expectedAuthority   string
+		expectedUser        userModel
+		expectedErrContains string
+	}{
+		{
+			certificate:       automationCA.issue(t, "ci-runner", []string{"ci", "admins"}, x509.ExtKeyUsageClientAuth),
+			expectedAuthority: "automation",
+			expectedUser: userModel{
+				Username: "ci-runner",
+				Groups:   []groupModel{{Name: "ci", ObjectID: "ci"}},
+				Type:     clientCertificateUserModelType,
+			},
+		},
+		{
+			certificate:       partnerCA.issue(t, "partner-bot", []string{"partners"}, x509.ExtKeyUsageClientAuth),
+			expectedAuthority: "partner",
+			expectedUser: userModel{
+				Username: "partner-bot",
+				Groups:   []groupModel{},
+				Type:     clientCertificateUserModelType,
+			},
+		},
+		{
+			certificate:         automationCA.issue(t, "someone-else", []string{"ci"}, x509.ExtKeyUsageClientAuth),
+			expectedErrContains: "common name \"someone-else\" is not allowed for certificate authority \"automation\"",
+		},
+		{
+			certificate:         automationCA.issue(t, "", []string{"ci"}, x509.ExtKeyUsageClientAuth),
+			expectedErrContains: "has no common name",
+		},
+		{
+			certificate:         automationCA.issue(t, "ci-runner", nil, x509.ExtKeyUsageServerAuth),
+			expectedErrContains: "is not issued by any of the configured certificate authorities",
+		},
+		{
+			certificate:         unknownCA.issue(t, "ci-runner", nil, x509.ExtKeyUsageClientAuth),
+			expectedErrContains: "is not issued by any of the configured certificate authorities",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		identity, err := auth.authenticate([]*x509.Certificate{c.certificate})
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedAuthority, identity.authority)
+		require.Equal(t, c.expectedUser, identity.user)
+	}
+}
+
+func TestProxyHandlerClientCertificate(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var receivedHeaders http.Header
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	ca := testNewCertificateAuthority(t, "automation-ca")
+	certAuth := &clientCertificateAuth{
+		authorities: []clientCertificateAuthority{
+			{
+				name:                 "automation",
+				roots:                ca.pool(t),
+				allowedCommonNames:   newAllowlist([]string{"ci-runner"}),
+				allowedOrganizations: newAllowlist([]string{"ci"}),
+			},
+		},
+		clientCAs: ca.pool(t),
+	}
+
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+		ImpersonateUID:       true,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	sink := &testFakeAuditSink{}
+	auditClient := &audit{
+		workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+		backpressure: dropAuditBackpressure,
+	}
+
+	up := testNewUpstream(t, fakeAPIServer.URL)
+	handler := auditClient.middleware(newAuthHandler(ctx, certAuth, nil, proxyHandlers.proxy(ctx, up), "ze-tenant-id", "ze-client-id"))
+
+	proxyServer := httptest.NewUnstartedServer(handler)
+	proxyServer.TLS = &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  certAuth.clientCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	cases := []struct {
+		clientCertificate    *tls.Certificate
+		expectedResCode      int
+		expectedUser         []string
+		expectedGroups       []string
+		expectedAuth         *auditAuth
+		expectedDenialReason string
+	}{
+		{
+			clientCertificate: ca.issueKeyPair(t, "ci-runner", []string{"ci", "admins"}),
+			expectedResCode:   http.StatusOK,
+			expectedUser:      []string{"ci-runner"},
+			expectedGroups:    []string{"ci"},
+			expectedAuth: &auditAuth{
+				Method:               clientCertificateAuthMethod,
+				CertificateAuthority: "automation",
+				CertificateSubject:   "CN=ci-runner,O=ci+O=admins",
+			},
+		},
+		{
+			clientCertificate:    ca.issueKeyPair(t, "someone-else", []string{"ci"}),
+			expectedResCode:      http.StatusForbidden,
+			expectedAuth:         &auditAuth{Method: clientCertificateAuthMethod, CertificateSubject: "CN=someone-else,O=ci"},
+			expectedDenialReason: "client certificate not allowed",
+		},
+		{
+			clientCertificate: nil,
+			expectedResCode:   http.StatusBadRequest,
+			expectedAuth:      &auditAuth{Method: azureADAuthMethod},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+		receivedHeaders = nil
+
+		transport := proxyServer.Client().Transport.(*http.Transport).Clone()
+		if c.clientCertificate != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*c.clientCertificate}
+		}
+		client := &http.Client{Transport: transport}
+
+		res, err := client.Get(fmt.Sprintf("%s/api/v1/pods", proxyServer.URL))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, c.expectedResCode, res.StatusCode)
+
+		if c.expectedResCode == http.StatusOK {
+			require.Equal(t, c.expectedUser, receivedHeaders.Values(impersonateUserHeader))
+			require.Equal(t, c.expectedGroups, receivedHeaders.Values(impersonateGroupHeader))
+			require.Empty(t, receivedHeaders.Values(impersonateUIDHeader))
+			require.Equal(t, "Bearer fake-token", receivedHeaders.Get(authorizationHeader))
+		} else {
+			require.Nil(t, receivedHeaders)
+		}
+	}
+
+	require.NoError(t, auditClient.close(ctx))
+
+	events := sink.getEvents()
+	require.Len(t, events, len(cases))
+	for i, c := range cases {
+		require.NotNil(t, events[i].Auth)
+		events[i].Auth.CertificateSerialNumber = ""
+		require.Equal(t, c.expectedAuth, events[i].Auth)
+		require.Equal(t, c.expectedDenialReason, events[i].DenialReason)
+	}
+}
+
+type testCertificateAuthority struct {
+	certificate    *x509.Certificate
+	certificatePEM []byte
+	key            *ecdsa.PrivateKey
+}
+
+func testNewCertificateAuthority(t *testing.T, commonName string) *testCertificateAuthority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(certBytes)
+	require.NoError(t, err)
+
+	return &testCertificateAuthority{
+		certificate:    certificate,
+		certificatePEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}),
+		key:            key,
+	}
+}
+
+func (ca *testCertificateAuthority) pool(t *testing.T) *x509.CertPool {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+
+	return pool
+}
+
+func (ca *testCertificateAuthority) issue(t *testing.T, commonName string, organizations []string, extKeyUsage x509.ExtKeyUsage) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	certificate, _ := ca.sign(t, key, commonName, organizations, extKeyUsage)
+
+	return certificate
+}
+
+func (ca *testCertificateAuthority) issueKeyPair(t *testing.T, commonName string, organizations []string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	certificate, certBytes := ca.sign(t, key, commonName, organizations, x509.ExtKeyUsageClientAuth)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certBytes},
+		PrivateKey:  key,
+		Leaf:        certificate,
+	}
+}
+
+func (ca *testCertificateAuthority) sign(t *testing.T, key *ecdsa.PrivateKey, commonName string, organizations []string, extKeyUsage x509.ExtKeyUsage) (*x509.Certificate, []byte) {
+	t.Helper()
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: organizations,
+		},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{extKeyUsage},
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(certBytes)
+	require.NoError(t, err)
+
+	return certificate, certBytes
+}
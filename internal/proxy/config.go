@@ -1,39 +1,116 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/alexflint/go-arg"
 )
 
+// checkConfig is the config of the check subcommand, that uses the same options as the proxy
+type checkConfig struct {
+	Output string `arg:"--output,env:CHECK_OUTPUT" default:"TABLE" help:"How to output the report (TABLE or JSON)"`
+}
+
 type config struct {
-	AzureADGroupPrefix               string   `arg:"--azure-ad-group-prefix,env:AZURE_AD_GROUP_PREFIX" help:"The prefix of the Azure AD groups to be passed to the Kubernetes API"`
-	AzureADMaxGroupCount             int      `arg:"--azure-ad-max-group-count,env:AZURE_AD_MAX_GROUP_COUNT" default:"50" help:"The maximum of groups allowed to be passed to the Kubernetes API before the proxy will return unauthorized"`
-	AzureClientID                    string   `arg:"--client-id,env:CLIENT_ID,required" help:"Azure AD Application Client ID"`
-	AzureClientSecret                string   `arg:"--client-secret,env:CLIENT_SECRET,required" help:"Azure AD Application Client Secret"`
-	AzureTenantID                    string   `arg:"--tenant-id,env:TENANT_ID,required" help:"Azure AD Tenant ID"`
-	CorsAllowedHeaders               []string `arg:"--cors-allowed-headers,env:CORS_ALLOWED_HEADERS" help:"The allowed headers for CORS (Access-Control-Allow-Headers). Defaults to: *"`
-	CorsAllowedMethods               []string `arg:"--cors-allowed-methods,env:CORS_ALLOWED_METHODS" help:"The allowed methods for CORS (Access-Control-Allow-Methods). Defaults to: GET, HEAD, PUT, PATCH, POST, DELETE, OPTIONS"`
-	CorsAllowedOrigins               []string `arg:"--cors-allowed-origins,env:CORS_ALLOWED_ORIGINS" help:"The allowed origins for CORS (Access-Control-Allow-Origin). Defaults to the current host (based on host header - https://<host>)."`
-	CorsAllowedOriginsDefaultScheme  string   `arg:"--cors-allowed-origins-default-scheme,env:CORS_ALLOWED_ORIGINS_DEFAULT_SCHEME" default:"https" help:"If cors-allowed-origins is left to default, what scheme should be used? (https for https://<host>)"`
-	CorsEnabled                      bool     `arg:"--cors-enabled,env:CORS_ENABLED" default:"true" help:"Should CORS be enabled for the proxy?"`
-	GroupIdentifier                  string   `arg:"--group-identifier,env:GROUP_IDENTIFIER" default:"NAME" help:"What group identifier to use"`
-	GroupSyncInterval                int      `arg:"--group-sync-interval,env:GROUP_SYNC_INTERVAL" default:"5" help:"The interval groups will be synchronized (in minutes)"`
-	KubernetesAPICACertPath          string   `arg:"--kubernetes-api-ca-cert-path,env:KUBERNETES_API_CA_CERT_PATH" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt" help:"The ca certificate path for communication to the Kubernetes API"`
-	KubernetesAPIHost                string   `arg:"--kubernetes-api-host,env:KUBERNETES_API_HOST,env:KUBERNETES_SERVICE_HOST" default:"kubernetes.default" help:"The host for the Kubernetes API"`
-	KubernetesAPIPort                int      `arg:"--kubernetes-api-port,env:KUBERNETES_API_PORT,env:KUBERNETES_SERVICE_PORT" default:"443" help:"The port for the Kubernetes API"`
-	KubernetesAPITLS                 bool     `arg:"--kubernetes-api-tls,env:KUBERNETES_API_TLS" default:"true" help:"Use TLS to communicate with the Kubernetes API?"`
-	KubernetesAPITokenPath           string   `arg:"--kubernetes-api-token-path,env:KUBERNETES_API_TOKEN_PATH" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" help:"The token for communication to the Kubernetes API"`
-	KubernetesAPIValidateCert        bool     `arg:"--kubernetes-api-validate-cert,env:KUBERNETES_API_VALIDATE_CERT" default:"true" help:"Should the Kubernetes API Certificate be validated?"`
-	ListenerAddress                  string   `arg:"--address,env:ADDRESS" default:"0.0.0.0" help:"Address to listen on"`
-	ListenerPort                     int      `arg:"--port,env:PORT" default:"8080" help:"Port number to listen on"`
-	ListenerTLSConfigCertificatePath string   `arg:"--tls-certificate-path,env:TLS_CERTIFICATE_PATH" help:"Path for the TLS Certificate"`
-	ListenerTLSConfigEnabled         bool     `arg:"--tls-enabled,env:TLS_ENABLED" default:"false" help:"Should TLS be enabled for the listner?"`
-	ListenerTLSConfigKeyPath         string   `arg:"--tls-key-path,env:TLS_KEY_PATH" help:"Path for the TLS KEY"`
-	Metrics                          string   `arg:"--metrics,env:METRICS" default:"PROMETHEUS" help:"What metrics library to use"`
-	MetricsListenerAddress           string   `arg:"--metrics-address,env:METRICS_ADDRESS" default:"0.0.0.0" help:"Address to listen on"`
-	MetricsListenerPort              int      `arg:"--metrics-port,env:METRICS_PORT" default:"8081" help:"Port number for metrics and health checks to listen on"`
+	Check *checkConfig `arg:"subcommand:check" help:"Validate the config and verify the access to Azure AD, Microsoft Graph, the upstreams and the listener certificate, then exit with 0 if every check passed, 1 if the config is invalid and 2 if a check failed"`
+
+	AdminAPIToken                          string   `arg:"--admin-api-token,env:ADMIN_API_TOKEN" help:"The shared token (sent as a bearer token) protecting the admin api on the metrics listener. The admin api is disabled when empty"`
+	AuditBackpressure                      string   `arg:"--audit-backpressure,env:AUDIT_BACKPRESSURE" default:"DROP" help:"What to do when the buffer of an audit sink is full (DROP or BLOCK)"`
+	AuditBufferSize                        int      `arg:"--audit-buffer-size,env:AUDIT_BUFFER_SIZE" default:"10000" help:"The number of audit events buffered per sink"`
+	AuditFileMaxAge                        int      `arg:"--audit-file-max-age,env:AUDIT_FILE_MAX_AGE" default:"7" help:"The maximum number of days to keep rotated audit files"`
+	AuditFileMaxBackups                    int      `arg:"--audit-file-max-backups,env:AUDIT_FILE_MAX_BACKUPS" default:"10" help:"The maximum number of rotated audit files to keep"`
+	AuditFileMaxSize                       int      `arg:"--audit-file-max-size,env:AUDIT_FILE_MAX_SIZE" default:"100" help:"The size (in megabytes) before the audit file is rotated"`
+	AuditFilePath                          string   `arg:"--audit-file-path,env:AUDIT_FILE_PATH" help:"Path of the JSON lines file used by the FILE audit sink"`
+	AuditSinks                             []string `arg:"--audit-sinks,env:AUDIT_SINKS" help:"Where audit events should be sent (STDOUT, FILE and/or WEBHOOK). Audit is disabled when empty"`
+	AuditWebhookBatchSize                  int      `arg:"--audit-webhook-batch-size,env:AUDIT_WEBHOOK_BATCH_SIZE" default:"100" help:"The maximum number of audit events sent per request to the audit webhook"`
+	AuditWebhookURL                        string   `arg:"--audit-webhook-url,env:AUDIT_WEBHOOK_URL" help:"URL the WEBHOOK audit sink sends events to (as a JSON array)"`
+	AuthPolicyExemptAppOnly                bool     `arg:"--auth-policy-exempt-app-only,env:AUTH_POLICY_EXEMPT_APP_ONLY" default:"false" help:"Should app-only tokens (service principals, identified by idtyp=app or a missing scp claim) be exempt from the auth policy? App-only tokens never contain amr, acrs or auth_time, so every request of a service principal covered by the auth policy is rejected unless they are exempt"`
+	AuthPolicyMaxAuthAge                   int      `arg:"--auth-policy-max-auth-age,env:AUTH_POLICY_MAX_AUTH_AGE" default:"0" help:"The maximum time (in minutes) since the user signed in (auth_time claim) for requests covered by the auth policy. 0 disables the requirement"`
+	AuthPolicyRequiredACRS                 []string `arg:"--auth-policy-required-acrs,env:AUTH_POLICY_REQUIRED_ACRS" help:"Authentication context class references (acrs claim), one of which is required for requests covered by the auth policy"`
+	AuthPolicyRequiredAMR                  []string `arg:"--auth-policy-required-amr,env:AUTH_POLICY_REQUIRED_AMR" help:"Authentication methods (amr claim, like mfa), one of which is required for requests covered by the auth policy"`
+	AuthPolicyResources                    []string `arg:"--auth-policy-resources,env:AUTH_POLICY_RESOURCES" help:"Resources (like pods/exec or secrets) covered by the auth policy for every verb, in addition to the auth policy verbs"`
+	AuthPolicyVerbs                        []string `arg:"--auth-policy-verbs,env:AUTH_POLICY_VERBS" help:"The verbs covered by the auth policy. Defaults to the write verbs (create, update, patch, delete and deletecollection) when empty"`
+	AuthorizationRulesPath                 string   `arg:"--authorization-rules-path,env:AUTHORIZATION_RULES_PATH" help:"Path to a YAML file with ordered ALLOW and DENY rules evaluated before requests are proxied to the Kubernetes API, the file is reloaded when it changes. Disabled when empty"`
+	AzureADGroupExcludeObjectIDs           []string `arg:"--azure-ad-group-exclude-object-ids,env:AZURE_AD_GROUP_EXCLUDE_OBJECT_IDS" help:"Object IDs of Azure AD groups that should never be passed to the Kubernetes API"`
+	AzureADGroupExcludePrefixes            []string `arg:"--azure-ad-group-exclude-prefixes,env:AZURE_AD_GROUP_EXCLUDE_PREFIXES" help:"Prefixes of Azure AD group names that should never be passed to the Kubernetes API"`
+	AzureADGroupExcludeRegexes             []string `arg:"--azure-ad-group-exclude-regexes,env:AZURE_AD_GROUP_EXCLUDE_REGEXES" help:"Regular expressions matching Azure AD group names that should never be passed to the Kubernetes API"`
+	AzureADGroupIncludeObjectIDs           []string `arg:"--azure-ad-group-include-object-ids,env:AZURE_AD_GROUP_INCLUDE_OBJECT_IDS" help:"Object IDs of Azure AD groups to be passed to the Kubernetes API"`
+	AzureADGroupIncludePrefixes            []string `arg:"--azure-ad-group-include-prefixes,env:AZURE_AD_GROUP_INCLUDE_PREFIXES" help:"Prefixes of Azure AD group names to be passed to the Kubernetes API (combined with azure-ad-group-prefix)"`
+	AzureADGroupIncludeRegexes             []string `arg:"--azure-ad-group-include-regexes,env:AZURE_AD_GROUP_INCLUDE_REGEXES" help:"Regular expressions matching Azure AD group names to be passed to the Kubernetes API"`
+	AzureADGroupMembership                 string   `arg:"--azure-ad-group-membership,env:AZURE_AD_GROUP_MEMBERSHIP" default:"DIRECT" help:"What group memberships to resolve using Microsoft Graph (DIRECT or TRANSITIVE). TRANSITIVE also includes the nested groups, which count against --azure-ad-max-group-count"`
+	AzureADGroupPrefix                     string   `arg:"--azure-ad-group-prefix,env:AZURE_AD_GROUP_PREFIX" help:"The prefix of the Azure AD groups to be passed to the Kubernetes API"`
+	AzureADGroupsFromToken                 bool     `arg:"--azure-ad-groups-from-token,env:AZURE_AD_GROUPS_FROM_TOKEN" default:"false" help:"Resolve the groups from the groups claim in the token and only call Microsoft Graph on group overage"`
+	AzureADMaxGroupCount                   int      `arg:"--azure-ad-max-group-count,env:AZURE_AD_MAX_GROUP_COUNT" default:"50" help:"The maximum of groups allowed to be passed to the Kubernetes API before the proxy will return unauthorized"`
+	AzureClientID                          string   `arg:"--client-id,env:CLIENT_ID" help:"Azure AD Application Client ID (required)"`
+	AzureClientSecret                      string   `arg:"--client-secret,env:CLIENT_SECRET" help:"Azure AD Application Client Secret (required)"`
+	AzureTenantID                          string   `arg:"--tenant-id,env:TENANT_ID" help:"Azure AD Tenant ID (required)"`
+	BreakGlassConfigPath                   string   `arg:"--break-glass-config-path,env:BREAK_GLASS_CONFIG_PATH" help:"Path to a YAML file with break-glass credentials (sha256 hashed static tokens or client certificates) that impersonate the emergency group without Azure AD. Disabled when empty"`
+	CacheEngine                            string   `arg:"--cache-engine,env:CACHE_ENGINE" default:"MEMORY" help:"What cache engine to use (MEMORY or REDIS)"`
+	ClientCertificateConfigPath            string   `arg:"--client-certificate-config-path,env:CLIENT_CERTIFICATE_CONFIG_PATH" help:"Path to a YAML file with the certificate authorities allowed to issue client certificates. Requests with a verified client certificate use the common name as the user and the organizations as groups, other requests use Azure AD tokens. Requires tls-enabled"`
+	ConfigPath                             string   `arg:"--config-path,env:CONFIG_PATH" help:"Path to a YAML config file (apiVersion: azad-kube-proxy/v1) with the options as the flag names in camel case (like groupSyncInterval for --group-sync-interval), and the structured groupFilter and authorizationRules. Flags and environment variables take precedence. The options not used by the listeners are reloaded on SIGHUP or when the file changes"`
+	CorsAllowedHeaders                     []string `arg:"--cors-allowed-headers,env:CORS_ALLOWED_HEADERS" help:"The allowed headers for CORS (Access-Control-Allow-Headers). Defaults to: *"`
+	CorsAllowedMethods                     []string `arg:"--cors-allowed-methods,env:CORS_ALLOWED_METHODS" help:"The allowed methods for CORS (Access-Control-Allow-Methods). Defaults to: GET, HEAD, PUT, PATCH, POST, DELETE, OPTIONS"`
+	CorsAllowedOrigins                     []string `arg:"--cors-allowed-origins,env:CORS_ALLOWED_ORIGINS" help:"The allowed origins for CORS (Access-Control-Allow-Origin). Defaults to the current host (based on host header - https://<host>)."`
+	CorsAllowedOriginsDefaultScheme        string   `arg:"--cors-allowed-origins-default-scheme,env:CORS_ALLOWED_ORIGINS_DEFAULT_SCHEME" default:"https" help:"If cors-allowed-origins is left to default, what scheme should be used? (https for https://<host>)"`
+	CorsEnabled                            bool     `arg:"--cors-enabled,env:CORS_ENABLED" default:"true" help:"Should CORS be enabled for the proxy?"`
+	GraphNotificationsClientState          string   `arg:"--graph-notifications-client-state,env:GRAPH_NOTIFICATIONS_CLIENT_STATE" help:"The secret sent by Microsoft Graph with every change notification, used to verify the notifications"`
+	GraphNotificationsSubscriptionDuration int      `arg:"--graph-notifications-subscription-duration,env:GRAPH_NOTIFICATIONS_SUBSCRIPTION_DURATION" default:"4320" help:"How long (in minutes) the Microsoft Graph subscription is valid, it is renewed when half of the duration has passed. Maximum 41760 (29 days)"`
+	GraphNotificationsURL                  string   `arg:"--graph-notifications-url,env:GRAPH_NOTIFICATIONS_URL" help:"The public https URL Microsoft Graph sends change notifications for groups and memberships to, served by the listener on the path of the URL. Changed groups are synchronized and the affected cached users evicted immediately. Every replica only evicts the users of its own cache, so the REDIS cache engine is required with more than one replica. Disabled when empty"`
+	GroupIdentifier                        string   `arg:"--group-identifier,env:GROUP_IDENTIFIER" default:"NAME" help:"What group identifier to use"`
+	GroupSyncInterval                      int      `arg:"--group-sync-interval,env:GROUP_SYNC_INTERVAL" default:"5" help:"The interval groups will be synchronized (in minutes)"`
+	ImpersonateExtraClaims                 []string `arg:"--impersonate-extra-claims,env:IMPERSONATE_EXTRA_CLAIMS" help:"Token claims to forward as Impersonate-Extra-<key> headers, formatted as <key>=<claim> or <claim> (key equals the claim). The claim is the json name (like tid, oid, scp, amr or azp), client-ip or forwarded-for"`
+	ImpersonateGroupTemplates              []string `arg:"--impersonate-group-templates,env:IMPERSONATE_GROUP_TEMPLATES" help:"Go templates rendering the Impersonate-Group values, executed once per group with .Name and .ObjectID (one header per template and group). Defaults to the group-identifier"`
+	ImpersonateUID                         bool     `arg:"--impersonate-uid,env:IMPERSONATE_UID" default:"false" help:"Should the Impersonate-Uid header be set to the object ID of the user? Requires the impersonate verb for the uids resource in the authentication.k8s.io API group"`
+	ImpersonateUserTemplate                string   `arg:"--impersonate-user-template,env:IMPERSONATE_USER_TEMPLATE" help:"Go template rendering the Impersonate-User value, executed with .Username, .ObjectID and .Type. Defaults to: {{ .Username }}"`
+	JITAllowedGroups                       []string `arg:"--jit-allowed-groups,env:JIT_ALLOWED_GROUPS" help:"The groups (as passed to the Kubernetes API) that just-in-time grants can add, grants of other groups are rejected. Required when jit-enabled is true"`
+	JITEnabled                             bool     `arg:"--jit-enabled,env:JIT_ENABLED" default:"false" help:"Should just-in-time grants, managed using the admin api, be able to add groups to users until they expire? Requires admin-api-token and jit-allowed-groups"`
+	JITMaxDuration                         int      `arg:"--jit-max-duration,env:JIT_MAX_DURATION" default:"480" help:"The maximum time (in minutes) a just-in-time grant can be active"`
+	KubernetesAPICACertPath                string   `arg:"--kubernetes-api-ca-cert-path,env:KUBERNETES_API_CA_CERT_PATH" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt" help:"The ca certificate path for communication to the Kubernetes API"`
+	KubernetesAPIHost                      string   `arg:"--kubernetes-api-host,env:KUBERNETES_API_HOST,env:KUBERNETES_SERVICE_HOST" default:"kubernetes.default" help:"The host for the Kubernetes API"`
+	KubernetesAPIPort                      int      `arg:"--kubernetes-api-port,env:KUBERNETES_API_PORT,env:KUBERNETES_SERVICE_PORT" default:"443" help:"The port for the Kubernetes API"`
+	KubernetesAPITLS                       bool     `arg:"--kubernetes-api-tls,env:KUBERNETES_API_TLS" default:"true" help:"Use TLS to communicate with the Kubernetes API?"`
+	KubernetesAPITokenPath                 string   `arg:"--kubernetes-api-token-path,env:KUBERNETES_API_TOKEN_PATH" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" help:"The token for communication to the Kubernetes API"`
+	KubernetesAPIValidateCert              bool     `arg:"--kubernetes-api-validate-cert,env:KUBERNETES_API_VALIDATE_CERT" default:"true" help:"Should the Kubernetes API Certificate be validated?"`
+	ListenerAddress                        string   `arg:"--address,env:ADDRESS" default:"0.0.0.0" help:"Address to listen on"`
+	ListenerPort                           int      `arg:"--port,env:PORT" default:"8080" help:"Port number to listen on"`
+	ListenerTLSConfigCertificatePath       string   `arg:"--tls-certificate-path,env:TLS_CERTIFICATE_PATH" help:"Path for the TLS Certificate"`
+	ListenerTLSConfigCipherSuites          []string `arg:"--tls-cipher-suites,env:TLS_CIPHER_SUITES" help:"The cipher suites allowed for TLS 1.0-1.2 on the listeners, using the Go names (like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Defaults to the Go defaults"`
+	ListenerTLSConfigCurvePreferences      []string `arg:"--tls-curve-preferences,env:TLS_CURVE_PREFERENCES" help:"The elliptic curves used in the TLS handshake on the listeners, in order of preference: X25519, P256, P384 or P521. Defaults to the Go defaults"`
+	ListenerTLSConfigEnabled               bool     `arg:"--tls-enabled,env:TLS_ENABLED" default:"false" help:"Should TLS be enabled for the listner?"`
+	ListenerTLSConfigKeyPath               string   `arg:"--tls-key-path,env:TLS_KEY_PATH" help:"Path for the TLS KEY"`
+	ListenerTLSConfigMinVersion            string   `arg:"--tls-min-version,env:TLS_MIN_VERSION" default:"1.2" help:"The minimum TLS version of the listeners: 1.0, 1.1, 1.2 or 1.3"`
+	MaxLongRunningRequests                 int      `arg:"--max-long-running-requests,env:MAX_LONG_RUNNING_REQUESTS" default:"0" help:"The maximum number of concurrent long-running requests (watch, exec, attach, port-forward and proxy). 0 means no limit"`
+	MaxLongRunningRequestsPerUser          int      `arg:"--max-long-running-requests-per-user,env:MAX_LONG_RUNNING_REQUESTS_PER_USER" default:"0" help:"The maximum number of concurrent long-running requests per user. 0 means no limit"`
+	Metrics                                string   `arg:"--metrics,env:METRICS" default:"PROMETHEUS" help:"What metrics library to use (NONE, PROMETHEUS or OTLP)"`
+	MetricsListenerAddress                 string   `arg:"--metrics-address,env:METRICS_ADDRESS" default:"0.0.0.0" help:"Address to listen on"`
+	MetricsListenerPort                    int      `arg:"--metrics-port,env:METRICS_PORT" default:"8081" help:"Port number for metrics and health checks to listen on"`
+	MetricsOTLPCACertificatePath           string   `arg:"--metrics-otlp-ca-certificate-path,env:METRICS_OTLP_CA_CERTIFICATE_PATH" help:"Path to the CA certificate used to verify the OTLP collector, when the endpoint uses https. Defaults to the system certificates"`
+	MetricsOTLPEndpoint                    string   `arg:"--metrics-otlp-endpoint,env:METRICS_OTLP_ENDPOINT" help:"The URL of the OTLP collector metrics are exported to when metrics is OTLP (like http://otel-collector:4317 for GRPC or https://otel-collector:4318/v1/metrics for HTTP). TLS is used for https"`
+	MetricsOTLPHeaders                     []string `arg:"--metrics-otlp-headers,env:METRICS_OTLP_HEADERS" help:"Headers sent to the OTLP collector, formatted as <key>=<value>"`
+	MetricsOTLPInterval                    int      `arg:"--metrics-otlp-interval,env:METRICS_OTLP_INTERVAL" default:"60" help:"The interval (in seconds) metrics are exported to the OTLP collector"`
+	MetricsOTLPProtocol                    string   `arg:"--metrics-otlp-protocol,env:METRICS_OTLP_PROTOCOL" default:"GRPC" help:"The protocol used to export metrics to the OTLP collector (GRPC or HTTP)"`
+	RateLimitGlobalBurst                   int      `arg:"--rate-limit-global-burst,env:RATE_LIMIT_GLOBAL_BURST" default:"500" help:"The burst of the global rate limit"`
+	RateLimitGlobalQPS                     float64  `arg:"--rate-limit-global-qps,env:RATE_LIMIT_GLOBAL_QPS" default:"0" help:"The number of requests per second allowed through the proxy in total. 0 disables the global rate limit"`
+	RateLimitGroupBurst                    int      `arg:"--rate-limit-group-burst,env:RATE_LIMIT_GROUP_BURST" default:"100" help:"The burst of the per group rate limit"`
+	RateLimitGroupQPS                      float64  `arg:"--rate-limit-group-qps,env:RATE_LIMIT_GROUP_QPS" default:"0" help:"The number of requests per second allowed for the members of a group combined. 0 disables the per group rate limit"`
+	RateLimitUserBurst                     int      `arg:"--rate-limit-user-burst,env:RATE_LIMIT_USER_BURST" default:"50" help:"The burst of the per user rate limit"`
+	RateLimitUserQPS                       float64  `arg:"--rate-limit-user-qps,env:RATE_LIMIT_USER_QPS" default:"0" help:"The number of requests per second allowed per user. 0 disables the per user rate limit"`
+	ReadinessChecks                        []string `arg:"--readiness-checks,env:READINESS_CHECKS" help:"The health checks (UPSTREAM, IMPERSONATION, GRAPH, GROUP_SYNC, JWKS and/or CACHE) that need to pass for the proxy to be ready, the other checks are only run and reported by /readyz?verbose. Defaults to: UPSTREAM, IMPERSONATION and CACHE"`
+	RedisAddress                           string   `arg:"--redis-address,env:REDIS_ADDRESS" default:"127.0.0.1:6379" help:"The address (host:port) of the Redis server, used when cache-engine is REDIS"`
+	RedisCACertificatePath                 string   `arg:"--redis-ca-certificate-path,env:REDIS_CA_CERTIFICATE_PATH" help:"Path to the CA certificate used to verify Redis, when redis-tls-enabled is true. Defaults to the system certificates"`
+	RedisDatabase                          int      `arg:"--redis-database,env:REDIS_DATABASE" default:"0" help:"The Redis database to use"`
+	RedisPassword                          string   `arg:"--redis-password,env:REDIS_PASSWORD" help:"The password used to authenticate to Redis"`
+	RedisTLSEnabled                        bool     `arg:"--redis-tls-enabled,env:REDIS_TLS_ENABLED" default:"false" help:"Should TLS be used to communicate with Redis?"`
+	TracingOTLPEndpoint                    string   `arg:"--tracing-otlp-endpoint,env:TRACING_OTLP_ENDPOINT" help:"The OTLP/HTTP endpoint spans are exported to (like http://otel-collector:4318/v1/traces). The trace context is propagated to the Kubernetes API using the traceparent header. Tracing is disabled when empty"`
+	TracingOTLPHeaders                     []string `arg:"--tracing-otlp-headers,env:TRACING_OTLP_HEADERS" help:"Headers sent to the OTLP endpoint, formatted as <key>=<value>"`
+	TracingSampleRatio                     float64  `arg:"--tracing-sample-ratio,env:TRACING_SAMPLE_RATIO" default:"1" help:"The ratio (0 to 1) of requests that are traced, requests with a sampled traceparent are always traced"`
+	UpstreamsConfigPath                    string   `arg:"--upstreams-config-path,env:UPSTREAMS_CONFIG_PATH" help:"Path to a YAML file with the Kubernetes clusters to proxy to, selected by host and/or path prefix. When empty, the kubernetes-api-* flags are used"`
+
+	// authorizationRules are set using the authorizationRules of the config file
+	authorizationRules []authorizationRuleConfig
 
+	args     []string
 	version  string
 	revision string
 	created  string
@@ -45,6 +122,7 @@ func (cfg config) Version() string {
 
 func NewConfig(args []string, version, revision, created string) (*config, error) {
 	cfg := &config{
+		args:     args,
 		version:  version,
 		revision: revision,
 		created:  created,
@@ -62,5 +140,135 @@ func NewConfig(args []string, version, revision, created string) (*config, error
 		return &config{}, err
 	}
 
-	return cfg, err
+	if cfg.ConfigPath != "" {
+		err = loadConfigFile(cfg, args)
+		if err != nil {
+			return &config{}, err
+		}
+	}
+
+	// An invalid config is reported by the check subcommand, only the options of the subcommand need to be valid
+	if cfg.Check != nil {
+		_, err = getCheckOutput(cfg.Check.Output)
+		if err != nil {
+			return &config{}, err
+		}
+
+		return cfg, nil
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return &config{}, err
+	}
+
+	return cfg, nil
+}
+
+// reload reads the config again using the same flags and environment variables, to apply changes to the config file
+func (cfg *config) reload() (*config, error) {
+	return NewConfig(cfg.args, cfg.version, cfg.revision, cfg.created)
+}
+
+// validate checks the options depending on each other and the option values, every error is returned. The options
+// are validated further when the components are created.
+func (cfg *config) validate() error {
+	errs := []error{}
+
+	required := []struct {
+		value string
+		flag  string
+	}{
+		{value: cfg.AzureClientID, flag: "--client-id"},
+		{value: cfg.AzureClientSecret, flag: "--client-secret"},
+		{value: cfg.AzureTenantID, flag: "--tenant-id"},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", r.flag))
+		}
+	}
+
+	if cfg.ListenerTLSConfigEnabled && (cfg.ListenerTLSConfigCertificatePath == "" || cfg.ListenerTLSConfigKeyPath == "") {
+		errs = append(errs, fmt.Errorf("--tls-certificate-path and --tls-key-path are required when --tls-enabled is true"))
+	}
+
+	if cfg.JITEnabled && cfg.AdminAPIToken == "" {
+		errs = append(errs, fmt.Errorf("--admin-api-token is required when --jit-enabled is true"))
+	}
+
+	if cfg.JITEnabled && len(cfg.JITAllowedGroups) == 0 {
+		errs = append(errs, fmt.Errorf("--jit-allowed-groups is required when --jit-enabled is true"))
+	}
+
+	if cfg.GraphNotificationsURL != "" && cfg.GraphNotificationsClientState == "" {
+		errs = append(errs, fmt.Errorf("--graph-notifications-client-state is required when --graph-notifications-url is set"))
+	}
+
+	if cfg.GraphNotificationsURL != "" && (cfg.GraphNotificationsSubscriptionDuration < 1 || cfg.GraphNotificationsSubscriptionDuration > graphSubscriptionMaxDuration) {
+		errs = append(errs, fmt.Errorf("--graph-notifications-subscription-duration needs to be between 1 and %d but was: %d", graphSubscriptionMaxDuration, cfg.GraphNotificationsSubscriptionDuration))
+	}
+
+	if cfg.AuthorizationRulesPath != "" && cfg.authorizationRules != nil {
+		errs = append(errs, fmt.Errorf("--authorization-rules-path can't be combined with authorizationRules in the config file"))
+	}
+
+	for _, s := range cfg.AuditSinks {
+		sink, err := getAuditSink(s)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case sink == fileAuditSink && cfg.AuditFilePath == "":
+			errs = append(errs, fmt.Errorf("--audit-file-path is required when --audit-sinks contains FILE"))
+		case sink == webhookAuditSink && cfg.AuditWebhookURL == "":
+			errs = append(errs, fmt.Errorf("--audit-webhook-url is required when --audit-sinks contains WEBHOOK"))
+		}
+	}
+
+	metrics, err := getMetrics(cfg.Metrics)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if metrics == otlpMetrics {
+		if cfg.MetricsOTLPEndpoint == "" {
+			errs = append(errs, fmt.Errorf("--metrics-otlp-endpoint is required when --metrics is OTLP"))
+		}
+
+		_, err := getOTLPProtocol(cfg.MetricsOTLPProtocol)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.TracingSampleRatio < 0 || cfg.TracingSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("--tracing-sample-ratio needs to be between 0 and 1 but was: %v", cfg.TracingSampleRatio))
+	}
+
+	for _, s := range cfg.ReadinessChecks {
+		_, err := getHealthCheck(s)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	enums := []func() error{
+		func() error { _, err := getAuditBackpressure(cfg.AuditBackpressure); return err },
+		func() error { _, err := getCacheEngine(cfg.CacheEngine); return err },
+		func() error { _, err := getGroupIdentifier(cfg.GroupIdentifier); return err },
+		func() error { _, err := getGroupMembership(cfg.AzureADGroupMembership); return err },
+		func() error { _, err := getTLSVersion(cfg.ListenerTLSConfigMinVersion); return err },
+	}
+	for _, enum := range enums {
+		err := enum()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+
+	return nil
 }
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const configFileAPIVersion = "azad-kube-proxy/v1"
+
+// configFileGroupFilterOptions maps the keys of the groupFilter section of the config file to the options
+var configFileGroupFilterOptions = map[string]string{
+	"prefix":           "AzureADGroupPrefix",
+	"includePrefixes":  "AzureADGroupIncludePrefixes",
+	"includeRegexes":   "AzureADGroupIncludeRegexes",
+	"includeObjectIDs": "AzureADGroupIncludeObjectIDs",
+	"excludePrefixes":  "AzureADGroupExcludePrefixes",
+	"excludeRegexes":   "AzureADGroupExcludeRegexes",
+	"excludeObjectIDs": "AzureADGroupExcludeObjectIDs",
+}
+
+// kubeletEnvironmentVariables are set by the kubelet in every pod, they are defaults of the options and don't take
+// precedence over the config file
+var kubeletEnvironmentVariables = map[string]struct{}{
+	"KUBERNETES_SERVICE_HOST": {},
+	"KUBERNETES_SERVICE_PORT": {},
+}
+
+// configOption is an option of the config, set using a flag, an environment variable or the config file. The key in the
+// config file is the flag name in camel case, like groupSyncInterval for --group-sync-interval.
+type configOption struct {
+	fieldIndex int
+	fieldName  string
+	flag       string
+	envs       []string
+	fileKey    string
+}
+
+func getConfigOptions() []configOption {
+	options := []configOption{}
+
+	cfgType := reflect.TypeOf(config{})
+	for i := 0; i < cfgType.NumField(); i++ {
+		field := cfgType.Field(i)
+		tag, ok := field.Tag.Lookup("arg")
+		if !ok {
+			continue
+		}
+
+		option := configOption{
+			fieldIndex: i,
+			fieldName:  field.Name,
+		}
+
+		for _, part := range strings.Split(tag, ",") {
+			switch {
+			case strings.HasPrefix(part, "--"):
+				option.flag = strings.TrimPrefix(part, "--")
+			case strings.HasPrefix(part, "env:"):
+				option.envs = append(option.envs, strings.TrimPrefix(part, "env:"))
+			}
+		}
+
+		// Subcommands aren't options
+		if option.flag == "" {
+			continue
+		}
+
+		option.fileKey = getConfigFileKey(option.flag)
+		options = append(options, option)
+	}
+
+	return options
+}
+
+// getConfigFileKey converts a flag name to camel case, like group-sync-interval to groupSyncInterval
+func getConfigFileKey(flag string) string {
+	parts := strings.Split(flag, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+
+	return strings.Join(parts, "")
+}
+
+// isSet returns true if the option was set using a flag or an environment variable, which take precedence over the
+// config file. The environment variables set by the kubelet aren't counted.
+func (option configOption) isSet(args []string) bool {
+	for _, arg := range args {
+		if arg == fmt.Sprintf("--%s", option.flag) || strings.HasPrefix(arg, fmt.Sprintf("--%s=", option.flag)) {
+			return true
+		}
+	}
+
+	for _, env := range option.envs {
+		if _, ok := kubeletEnvironmentVariables[env]; ok {
+			continue
+		}
+
+		if _, ok := os.LookupEnv(env); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadConfigFile sets the options from the config file that weren't set using flags or environment variables. Unknown
+// keys and values of the wrong type are errors, every error of the file is returned.
+func loadConfigFile(cfg *config, args []string) error {
+	b, err := os.ReadFile(cfg.ConfigPath) // #nosec
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	jsonBytes, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %q: %w", cfg.ConfigPath, err)
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(jsonBytes, &raw)
+	if err != nil || raw == nil {
+		return fmt.Errorf("unable to parse config file %q: expected a YAML object with apiVersion %s", cfg.ConfigPath, configFileAPIVersion)
+	}
+
+	err = setConfigFileOptions(cfg, args, raw)
+	if err != nil {
+		return fmt.Errorf("invalid config file %q: %w", cfg.ConfigPath, err)
+	}
+
+	return nil
+}
+
+func setConfigFileOptions(cfg *config, args []string, raw map[string]json.RawMessage) error {
+	if _, ok := raw["apiVersion"]; !ok {
+		return fmt.Errorf("apiVersion is required, the supported version is: %s", configFileAPIVersion)
+	}
+
+	var apiVersion string
+	err := decodeConfigFileValue(raw["apiVersion"], &apiVersion)
+	if err != nil || apiVersion != configFileAPIVersion {
+		return fmt.Errorf("unsupported apiVersion %s, the supported version is: %s", string(raw["apiVersion"]), configFileAPIVersion)
+	}
+
+	optionsByFileKey := make(map[string]configOption)
+	optionsByFieldName := make(map[string]configOption)
+	for _, option := range getConfigOptions() {
+		optionsByFileKey[option.fileKey] = option
+		optionsByFieldName[option.fieldName] = option
+	}
+
+	keys := []string{}
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := []error{}
+	for _, key := range keys {
+		switch key {
+		case "apiVersion":
+			continue
+		case "groupFilter":
+			errs = append(errs, setConfigFileGroupFilter(cfg, args, raw, optionsByFieldName)...)
+			continue
+		case "authorizationRules":
+			err := setConfigFileAuthorizationRules(cfg, raw[key])
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		option, ok := optionsByFileKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown option %q", key))
+			continue
+		}
+
+		if option.fieldName == "ConfigPath" {
+			errs = append(errs, fmt.Errorf("option %q can only be set using a flag or an environment variable", key))
+			continue
+		}
+
+		err := setConfigFileOption(cfg, args, option, key, raw[key])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func setConfigFileOption(cfg *config, args []string, option configOption, key string, raw json.RawMessage) error {
+	field := reflect.ValueOf(cfg).Elem().Field(option.fieldIndex)
+	value := reflect.New(field.Type())
+
+	err := decodeConfigFileValue(raw, value.Interface())
+	if err != nil {
+		return fmt.Errorf("option %q: %w", key, err)
+	}
+
+	if option.isSet(args) {
+		return nil
+	}
+
+	field.Set(value.Elem())
+
+	return nil
+}
+
+// setConfigFileGroupFilter sets the group filter options using the structured groupFilter section
+func setConfigFileGroupFilter(cfg *config, args []string, raw map[string]json.RawMessage, optionsByFieldName map[string]configOption) []error {
+	var groupFilter map[string]json.RawMessage
+	err := decodeConfigFileValue(raw["groupFilter"], &groupFilter)
+	if err != nil {
+		return []error{fmt.Errorf("option \"groupFilter\": %w", err)}
+	}
+
+	keys := []string{}
+	for key := range groupFilter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := []error{}
+	for _, key := range keys {
+		fieldName, ok := configFileGroupFilterOptions[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown option \"groupFilter.%s\"", key))
+			continue
+		}
+
+		option := optionsByFieldName[fieldName]
+		if _, ok := raw[option.fileKey]; ok {
+			errs = append(errs, fmt.Errorf("options \"groupFilter.%s\" and %q can't both be set", key, option.fileKey))
+			continue
+		}
+
+		err := setConfigFileOption(cfg, args, option, fmt.Sprintf("groupFilter.%s", key), groupFilter[key])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// setConfigFileAuthorizationRules sets the authorization rules of the structured authorizationRules section, using the
+// same format as the rules of the authorization rules file
+func setConfigFileAuthorizationRules(cfg *config, raw json.RawMessage) error {
+	rules := []authorizationRuleConfig{}
+	err := decodeConfigFileValue(raw, &rules)
+	if err != nil {
+		return fmt.Errorf("option \"authorizationRules\": %w", err)
+	}
+
+	_, err = newAuthorizationRuleList(rules)
+	if err != nil {
+		return fmt.Errorf("option \"authorizationRules\": %w", err)
+	}
+
+	cfg.authorizationRules = rules
+
+	return nil
+}
+
+// decodeConfigFileValue decodes a value of the config file strictly, unknown fields and null are errors
+func decodeConfigFileValue(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return fmt.Errorf("expected %s but got null", reflect.TypeOf(v).Elem())
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field != "" {
+			return fmt.Errorf("field %q expected %s but got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+
+		return fmt.Errorf("expected %s but got %s", typeErr.Type, typeErr.Value)
+	}
+
+	return err
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConfigFileKey(t *testing.T) {
+	cases := []struct {
+		flag        string
+		expectedKey string
+	}{
+		{flag: "port", expectedKey: "port"},
+		{flag: "group-sync-interval", expectedKey: "groupSyncInterval"},
+		{flag: "azure-ad-group-include-object-ids", expectedKey: "azureAdGroupIncludeObjectIds"},
+		{flag: "tls-enabled", expectedKey: "tlsEnabled"},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expectedKey, getConfigFileKey(c.flag))
+	}
+}
+
+func TestGetConfigOptions(t *testing.T) {
+	options := getConfigOptions()
+
+	fileKeys := make(map[string]struct{})
+	for _, option := range options {
+		require.NotEmpty(t, option.flag, option.fieldName)
+		require.NotContains(t, fileKeys, option.fileKey, "duplicate config file key")
+		fileKeys[option.fileKey] = struct{}{}
+	}
+
+	for _, fieldName := range configFileGroupFilterOptions {
+		found := false
+		for _, option := range options {
+			if option.fieldName == fieldName {
+				found = true
+			}
+		}
+		require.True(t, found, fieldName)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	testUnsetConfigEnv(t)
+
+	cases := []struct {
+		testDescription     string
+		content             string
+		args                []string
+		env                 map[string]string
+		expectedErrContains []string
+		verify              func(t *testing.T, cfg *config)
+	}{
+		{
+			testDescription: "options",
+			content: `apiVersion: azad-kube-proxy/v1
+clientId: ze-client-id
+groupSyncInterval: 10
+corsEnabled: false
+corsAllowedOrigins:
+  - https://ze-origin
+tracingSampleRatio: 0.5
+groupFilter:
+  prefix: ze-prefix
+  excludeRegexes:
+    - ^ze-
+authorizationRules:
+  - name: deny-secrets
+    effect: DENY
+    resources:
+      - secrets
+`,
+			verify: func(t *testing.T, cfg *config) {
+				require.Equal(t, "ze-client-id", cfg.AzureClientID)
+				require.Equal(t, 10, cfg.GroupSyncInterval)
+				require.False(t, cfg.CorsEnabled)
+				require.Equal(t, []string{"https://ze-origin"}, cfg.CorsAllowedOrigins)
+				require.Equal(t, 0.5, cfg.TracingSampleRatio)
+				require.Equal(t, "ze-prefix", cfg.AzureADGroupPrefix)
+				require.Equal(t, []string{"^ze-"}, cfg.AzureADGroupExcludeRegexes)
+				require.Len(t, cfg.authorizationRules, 1)
+				require.Equal(t, "deny-secrets", cfg.authorizationRules[0].Name)
+			},
+		},
+		{
+			testDescription: "flags and environment variables take precedence",
+			content: `apiVersion: azad-kube-proxy/v1
+groupSyncInterval: 10
+port: 9090
+tenantId: ze-file-tenant-id
+`,
+			args: []string{"--group-sync-interval=15", "--port", "9091"},
+			env:  map[string]string{"TENANT_ID": "ze-env-tenant-id"},
+			verify: func(t *testing.T, cfg *config) {
+				require.Equal(t, 5, cfg.GroupSyncInterval)
+				require.Equal(t, 8080, cfg.ListenerPort)
+				require.Equal(t, "", cfg.AzureTenantID)
+			},
+		},
+		{
+			testDescription: "the environment variables set by the kubelet don't take precedence",
+			content: `apiVersion: azad-kube-proxy/v1
+kubernetesApiHost: ze-file-host
+kubernetesApiPort: 6443
+`,
+			env: map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1", "KUBERNETES_SERVICE_PORT": "443"},
+			verify: func(t *testing.T, cfg *config) {
+				require.Equal(t, "ze-file-host", cfg.KubernetesAPIHost)
+				require.Equal(t, 6443, cfg.KubernetesAPIPort)
+			},
+		},
+		{
+			testDescription: "kubernetes api environment variables take precedence",
+			content: `apiVersion: azad-kube-proxy/v1
+kubernetesApiHost: ze-file-host
+`,
+			env: map[string]string{"KUBERNETES_API_HOST": "ze-env-host", "KUBERNETES_SERVICE_HOST": "10.0.0.1"},
+			verify: func(t *testing.T, cfg *config) {
+				require.Equal(t, "", cfg.KubernetesAPIHost)
+			},
+		},
+		{
+			testDescription:     "wrong api version",
+			content:             "apiVersion: azad-kube-proxy/v2\n",
+			expectedErrContains: []string{`unsupported apiVersion "azad-kube-proxy/v2", the supported version is: azad-kube-proxy/v1`},
+		},
+		{
+			testDescription:     "missing api version",
+			content:             "clientId: ze-client-id\n",
+			expectedErrContains: []string{"apiVersion is required, the supported version is: azad-kube-proxy/v1"},
+		},
+		{
+			testDescription:     "not an object",
+			content:             "- ze-item\n",
+			expectedErrContains: []string{"expected a YAML object with apiVersion azad-kube-proxy/v1"},
+		},
+		{
+			testDescription:     "invalid yaml",
+			content:             "apiVersion: [\n",
+			expectedErrContains: []string{"unable to parse config file"},
+		},
+		{
+			testDescription: "every error is returned",
+			content: `apiVersion: azad-kube-proxy/v1
+groupSyncIntervall: 10
+port: ze-port
+corsEnabled: null
+configPath: /ze/config.yaml
+`,
+			expectedErrContains: []string{
+				`unknown option "groupSyncIntervall"`,
+				`option "port": expected int but got string`,
+				`option "corsEnabled": expected bool but got null`,
+				`option "configPath" can only be set using a flag or an environment variable`,
+			},
+		},
+		{
+			testDescription: "group filter set twice",
+			content: `apiVersion: azad-kube-proxy/v1
+azureAdGroupPrefix: ze-prefix
+groupFilter:
+  prefix: ze-other-prefix
+  includeObjectIds:
+    - ze-object-id
+`,
+			expectedErrContains: []string{
+				`options "groupFilter.prefix" and "azureAdGroupPrefix" can't both be set`,
+				`unknown option "groupFilter.includeObjectIds"`,
+			},
+		},
+		{
+			testDescription: "invalid authorization rules",
+			content: `apiVersion: azad-kube-proxy/v1
+authorizationRules:
+  - effect: DENY
+`,
+			expectedErrContains: []string{`option "authorizationRules": authorization rule name is required`},
+		},
+		{
+			testDescription: "unknown authorization rule field",
+			content: `apiVersion: azad-kube-proxy/v1
+authorizationRules:
+  - name: ze-rule
+    effect: DENY
+    verb: get
+`,
+			expectedErrContains: []string{`option "authorizationRules": json: unknown field "verb"`},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			for key, value := range c.env {
+				t.Setenv(key, value)
+			}
+
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			testCreateTemporaryFile(t, configPath, c.content)
+
+			cfg := &config{
+				ConfigPath:        configPath,
+				CorsEnabled:       true,
+				GroupSyncInterval: 5,
+				ListenerPort:      8080,
+			}
+
+			err := loadConfigFile(cfg, c.args)
+			if len(c.expectedErrContains) > 0 {
+				require.ErrorContains(t, err, configPath)
+				for _, expectedErr := range c.expectedErrContains {
+					require.ErrorContains(t, err, expectedErr)
+				}
+				return
+			}
+
+			require.NoError(t, err)
+			c.verify(t, cfg)
+		})
+	}
+}
+
+func TestNewConfigWithConfigFile(t *testing.T) {
+	testUnsetConfigEnv(t)
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	testCreateTemporaryFile(t, configPath, `apiVersion: azad-kube-proxy/v1
+clientId: ze-client-id
+clientSecret: ze-client-secret
+tenantId: ze-tenant-id
+groupSyncInterval: 10
+`)
+
+	t.Run("file", func(t *testing.T) {
+		cfg, err := NewConfig([]string{"--config-path", configPath}, "", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "ze-client-id", cfg.AzureClientID)
+		require.Equal(t, 10, cfg.GroupSyncInterval)
+		require.Equal(t, 8080, cfg.ListenerPort)
+	})
+
+	t.Run("flag precedence", func(t *testing.T) {
+		cfg, err := NewConfig([]string{"--config-path", configPath, "--group-sync-interval=15"}, "", "", "")
+		require.NoError(t, err)
+		require.Equal(t, 15, cfg.GroupSyncInterval)
+	})
+
+	t.Run("environment variable", func(t *testing.T) {
+		t.Setenv("CONFIG_PATH", configPath)
+		t.Setenv("GROUP_SYNC_INTERVAL", "20")
+
+		cfg, err := NewConfig([]string{}, "", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "ze-client-id", cfg.AzureClientID)
+		require.Equal(t, 20, cfg.GroupSyncInterval)
+	})
+
+	t.Run("kubelet environment variables", func(t *testing.T) {
+		t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+
+		kubernetesConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+		testCreateTemporaryFile(t, kubernetesConfigPath, `apiVersion: azad-kube-proxy/v1
+clientId: ze-client-id
+clientSecret: ze-client-secret
+tenantId: ze-tenant-id
+kubernetesApiHost: ze-file-host
+`)
+
+		cfg, err := NewConfig([]string{"--config-path", kubernetesConfigPath}, "", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "ze-file-host", cfg.KubernetesAPIHost)
+	})
+
+	t.Run("validated after loading the file", func(t *testing.T) {
+		invalidConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+		testCreateTemporaryFile(t, invalidConfigPath, `apiVersion: azad-kube-proxy/v1
+clientId: ze-client-id
+cacheEngine: ze-engine
+`)
+
+		_, err := NewConfig([]string{"--config-path", invalidConfigPath}, "", "", "")
+		require.ErrorContains(t, err, "--client-secret is required")
+		require.ErrorContains(t, err, "--tenant-id is required")
+		require.ErrorContains(t, err, "Unknown cache engine")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewConfig([]string{"--config-path", filepath.Join(t.TempDir(), "missing.yaml")}, "", "", "")
+		require.ErrorContains(t, err, "unable to read config file")
+	})
+}
+
+// testUnsetConfigEnv unsets the environment variables of every option during the test
+func testUnsetConfigEnv(t *testing.T) {
+	t.Helper()
+
+	for _, option := range getConfigOptions() {
+		for _, env := range option.envs {
+			t.Setenv(env, "")
+			os.Unsetenv(env)
+		}
+	}
+}
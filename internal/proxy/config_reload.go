@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const configReloadInterval = 10 * time.Second
+
+// reloadableConfigOptions are the options only used by the request handlers, they are applied when the config is
+// reloaded. The other options are used by the listeners or the clients created at startup and require a restart.
+var reloadableConfigOptions = map[string]struct{}{
+	"AdminAPIToken":                   {},
+	"AuthPolicyExemptAppOnly":         {},
+	"AuthPolicyMaxAuthAge":            {},
+	"AuthPolicyRequiredACRS":          {},
+	"AuthPolicyRequiredAMR":           {},
+	"AuthPolicyResources":             {},
+	"AuthPolicyVerbs":                 {},
+	"AuthorizationRulesPath":          {},
+	"AzureADGroupsFromToken":          {},
+	"AzureADMaxGroupCount":            {},
+	"CorsAllowedHeaders":              {},
+	"CorsAllowedMethods":              {},
+	"CorsAllowedOrigins":              {},
+	"CorsAllowedOriginsDefaultScheme": {},
+	"CorsEnabled":                     {},
+	"GroupIdentifier":                 {},
+	"ImpersonateExtraClaims":          {},
+	"ImpersonateGroupTemplates":       {},
+	"ImpersonateUID":                  {},
+	"ImpersonateUserTemplate":         {},
+	"JITAllowedGroups":                {},
+	"JITEnabled":                      {},
+	"JITMaxDuration":                  {},
+	"MaxLongRunningRequests":          {},
+	"MaxLongRunningRequestsPerUser":   {},
+	"RateLimitGlobalBurst":            {},
+	"RateLimitGlobalQPS":              {},
+	"RateLimitGroupBurst":             {},
+	"RateLimitGroupQPS":               {},
+	"RateLimitUserBurst":              {},
+	"RateLimitUserQPS":                {},
+	"ReadinessChecks":                 {},
+}
+
+// mergeReloadableConfig returns a copy of the current config with the reloadable options of the next config, and the
+// flags of the changed options that are only applied after a restart
+func mergeReloadableConfig(current *config, next *config) (*config, []string) {
+	merged := *current
+	merged.authorizationRules = next.authorizationRules
+
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+
+	restartRequired := []string{}
+	for _, option := range getConfigOptions() {
+		nextField := nextValue.Field(option.fieldIndex)
+		if _, ok := reloadableConfigOptions[option.fieldName]; ok {
+			mergedValue.Field(option.fieldIndex).Set(nextField)
+			continue
+		}
+
+		if !reflect.DeepEqual(mergedValue.Field(option.fieldIndex).Interface(), nextField.Interface()) {
+			restartRequired = append(restartRequired, fmt.Sprintf("--%s", option.flag))
+		}
+	}
+
+	return &merged, restartRequired
+}
+
+// configReloader reloads the config when the config file changes or when SIGHUP is received, the reloadable options
+// are applied using the apply function. The current config is kept if the new config is invalid.
+type configReloader struct {
+	path  string
+	log   logr.Logger
+	apply func(ctx context.Context, cfg *config) error
+
+	mu  sync.Mutex
+	cfg *config
+	raw []byte
+}
+
+// newConfigReloader returns nil if no config file is configured
+func newConfigReloader(ctx context.Context, cfg *config, apply func(ctx context.Context, cfg *config) error) (*configReloader, error) {
+	if cfg.ConfigPath == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(cfg.ConfigPath) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	return &configReloader{
+		path:  cfg.ConfigPath,
+		log:   logr.FromContextOrDiscard(ctx),
+		apply: apply,
+		cfg:   cfg,
+		raw:   b,
+	}, nil
+}
+
+// reload reads the config again if the config file changed, or always when force is true (since the flags and
+// environment variables are the same, only the config file can change the config). The reloadable options are only
+// applied if any of them changed.
+func (reloader *configReloader) reload(ctx context.Context, force bool) (bool, error) {
+	b, err := os.ReadFile(reloader.path) // #nosec
+	if err != nil {
+		return false, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if !force && bytes.Equal(b, reloader.raw) {
+		return false, nil
+	}
+
+	next, err := reloader.cfg.reload()
+	if err != nil {
+		return false, err
+	}
+
+	merged, restartRequired := mergeReloadableConfig(reloader.cfg, next)
+	if len(restartRequired) > 0 {
+		reloader.log.Info("Config options changed that are only applied after a restart", "options", restartRequired)
+	}
+
+	// The handlers aren't replaced when none of the reloadable options changed
+	if reflect.DeepEqual(merged, reloader.cfg) {
+		reloader.raw = b
+		return false, nil
+	}
+
+	err = reloader.apply(ctx, merged)
+	if err != nil {
+		return false, fmt.Errorf("unable to apply config: %w", err)
+	}
+
+	reloader.cfg = merged
+	reloader.raw = b
+
+	return true, nil
+}
+
+// run reloads the config on SIGHUP and checks the config file for changes until the context is cancelled
+func (reloader *configReloader) run(ctx context.Context, interval time.Duration) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			reloader.reloadAndLog(ctx, true, "SIGHUP")
+		case <-ticker.C:
+			reloader.reloadAndLog(ctx, false, "file")
+		}
+	}
+}
+
+func (reloader *configReloader) reloadAndLog(ctx context.Context, force bool, trigger string) {
+	reloaded, err := reloader.reload(ctx, force)
+	if err != nil {
+		incrementConfigReloads(ctx, "error")
+		reloader.log.Error(err, "Unable to reload config, using the previous config", "path", reloader.path, "trigger", trigger)
+		return
+	}
+
+	if reloaded {
+		incrementConfigReloads(ctx, "success")
+		reloader.log.Info("Reloaded config", "path", reloader.path, "trigger", trigger)
+	}
+}
+
+// reloadableHandlers serves the requests using the handlers of the current config. The handlers are replaced when the
+// config is reloaded, the listeners and open connections are kept. The rate limiter and the jit client keep state (the
+// token buckets, the open long-running requests) and are kept across reloads, only their limits are updated.
+type reloadableHandlers struct {
+	cache Cache
+	user  User
+	azure Azure
+
+	upstreams []*upstream
+
+	mu       sync.RWMutex
+	handlers *handler
+	cors     Cors
+	adminAPI http.Handler
+	cancel   context.CancelFunc
+}
+
+func newReloadableHandlers(ctx context.Context, cfg *config, cacheClient Cache, userClient User, azureClient Azure, upstreams []*upstream) (*reloadableHandlers, error) {
+	r := &reloadableHandlers{
+		cache:     cacheClient,
+		user:      userClient,
+		azure:     azureClient,
+		upstreams: upstreams,
+	}
+
+	err := r.apply(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// apply creates the handlers using the config and replaces the current handlers, the current handlers are kept if the
+// config can't be applied. The authorization rules file is watched until the handlers are replaced.
+func (r *reloadableHandlers) apply(ctx context.Context, cfg *config) error {
+	healthClient, err := newHealthClient(ctx, cfg, r.upstreams, r.azure, r.cache)
+	if err != nil {
+		return err
+	}
+
+	proxyHandlers, err := newHandlers(ctx, cfg, r.cache, r.user, healthClient)
+	if err != nil {
+		return err
+	}
+
+	previous, _, _ := r.current()
+	if previous != nil {
+		keepHandlersState(previous, proxyHandlers)
+	}
+
+	var adminAPIHandler http.Handler
+	adminAPI := newAdminAPI(cfg, r.azure, proxyHandlers)
+	if adminAPI != nil {
+		logr.FromContextOrDiscard(ctx).Info("Serving admin api on the metrics listener", "pathPrefix", adminAPIPathPrefix, "jitEnabled", proxyHandlers.jit != nil)
+		adminAPIHandler = adminAPI.handler(ctx)
+	}
+
+	rulesCtx, cancel := context.WithCancel(ctx)
+	if proxyHandlers.authorizationRules != nil {
+		go proxyHandlers.authorizationRules.run(rulesCtx, authorizationRulesReloadInterval)
+	}
+
+	r.mu.Lock()
+	previousCancel := r.cancel
+	r.handlers = proxyHandlers
+	r.cors = newCors(cfg)
+	r.adminAPI = adminAPIHandler
+	r.cancel = cancel
+	r.mu.Unlock()
+
+	if previousCancel != nil {
+		previousCancel()
+	}
+
+	return nil
+}
+
+// keepHandlersState updates the stateful components of the previous handlers with the limits of the next handlers and
+// uses them in the next handlers. It's called after the next handlers have been created, since the limits of the
+// previous handlers can't be restored if the config can't be applied.
+func keepHandlersState(previous *handler, next *handler) {
+	previous.rateLimiter.update(next.rateLimiter)
+	next.rateLimiter = previous.rateLimiter
+
+	if previous.jit != nil && next.jit != nil {
+		previous.jit.update(next.jit)
+		next.jit = previous.jit
+	}
+}
+
+func (r *reloadableHandlers) current() (*handler, Cors, http.Handler) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.handlers, r.cors, r.adminAPI
+}
+
+func (r *reloadableHandlers) proxy(ctx context.Context, up *upstream) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		h, _, _ := r.current()
+		h.proxy(ctx, up)(w, req)
+	}
+}
+
+func (r *reloadableHandlers) readiness(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		h, _, _ := r.current()
+		h.readiness(ctx)(w, req)
+	}
+}
+
+func (r *reloadableHandlers) liveness(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		h, _, _ := r.current()
+		h.liveness(ctx)(w, req)
+	}
+}
+
+func (r *reloadableHandlers) error(ctx context.Context, upstreamName string) func(w http.ResponseWriter, req *http.Request, err error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		h, _, _ := r.current()
+		h.error(ctx, upstreamName)(w, req, err)
+	}
+}
+
+func (r *reloadableHandlers) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, c, _ := r.current()
+		c.middleware(next).ServeHTTP(w, req)
+	})
+}
+
+// adminAPIHandler serves the admin api, the admin api is disabled (not found) when no admin api token is configured
+func (r *reloadableHandlers) adminAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _, adminAPI := r.current()
+		if adminAPI == nil {
+			http.NotFound(w, req)
+			return
+		}
+
+		adminAPI.ServeHTTP(w, req)
+	})
+}
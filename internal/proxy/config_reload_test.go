@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeReloadableConfig(t *testing.T) {
+	current := &config{
+		CorsEnabled:       true,
+		GroupSyncInterval: 5,
+		ListenerPort:      8080,
+		RateLimitUserQPS:  10,
+	}
+
+	next := &config{
+		CorsEnabled:        false,
+		GroupSyncInterval:  10,
+		ListenerPort:       9090,
+		RateLimitUserQPS:   20,
+		authorizationRules: []authorizationRuleConfig{{Name: "ze-rule", Effect: "DENY"}},
+	}
+
+	merged, restartRequired := mergeReloadableConfig(current, next)
+	require.False(t, merged.CorsEnabled)
+	require.Equal(t, float64(20), merged.RateLimitUserQPS)
+	require.Equal(t, next.authorizationRules, merged.authorizationRules)
+	require.Equal(t, 5, merged.GroupSyncInterval)
+	require.Equal(t, 8080, merged.ListenerPort)
+	require.Equal(t, []string{"--group-sync-interval", "--port"}, restartRequired)
+
+	// The current config isn't changed
+	require.True(t, current.CorsEnabled)
+	require.Equal(t, float64(10), current.RateLimitUserQPS)
+
+	_, restartRequired = mergeReloadableConfig(current, current)
+	require.Empty(t, restartRequired)
+}
+
+func TestConfigReloader(t *testing.T) {
+	testUnsetConfigEnv(t)
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	testWriteReloadConfigFile(t, configPath, 10, 8080)
+
+	cfg, err := NewConfig([]string{"--config-path", configPath}, "", "", "")
+	require.NoError(t, err)
+
+	reloader, err := newConfigReloader(ctx, &config{}, nil)
+	require.NoError(t, err)
+	require.Nil(t, reloader)
+
+	applied := []*config{}
+	applyErr := error(nil)
+	reloader, err = newConfigReloader(ctx, cfg, func(_ context.Context, cfg *config) error {
+		if applyErr != nil {
+			return applyErr
+		}
+
+		applied = append(applied, cfg)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Nothing is reloaded when the file hasn't changed
+	reloaded, err := reloader.reload(ctx, false)
+	require.NoError(t, err)
+	require.False(t, reloaded)
+	require.Empty(t, applied)
+
+	// The reloadable options are applied, the listener port requires a restart
+	testWriteReloadConfigFile(t, configPath, 20, 9090)
+	reloader.reloadAndLog(ctx, false, "file")
+	require.Len(t, applied, 1)
+	require.Equal(t, float64(20), applied[0].RateLimitUserQPS)
+	require.Equal(t, 8080, applied[0].ListenerPort)
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsConfigReloads, "success"))
+
+	// The previous config is kept when the file is invalid
+	testCreateTemporaryFile(t, configPath, "apiVersion: azad-kube-proxy/v1\nrateLimitUserQps: ze-qps\n")
+	reloader.reloadAndLog(ctx, false, "file")
+	require.Len(t, applied, 1)
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsConfigReloads, "error"))
+
+	// The previous config is kept when it can't be applied
+	testWriteReloadConfigFile(t, configPath, 30, 8080)
+	applyErr = fmt.Errorf("ze-apply-error")
+	_, err = reloader.reload(ctx, false)
+	require.ErrorContains(t, err, "unable to apply config: ze-apply-error")
+	require.Len(t, applied, 1)
+	require.Equal(t, float64(20), reloader.cfg.RateLimitUserQPS)
+
+	applyErr = nil
+	reloaded, err = reloader.reload(ctx, false)
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, float64(30), applied[1].RateLimitUserQPS)
+
+	// The config isn't applied when none of the reloadable options changed, even when forced (SIGHUP)
+	reloaded, err = reloader.reload(ctx, true)
+	require.NoError(t, err)
+	require.False(t, reloaded)
+	require.Len(t, applied, 2)
+
+	testWriteReloadConfigFile(t, configPath, 30, 9090)
+	reloaded, err = reloader.reload(ctx, false)
+	require.NoError(t, err)
+	require.False(t, reloaded)
+	require.Len(t, applied, 2)
+
+	testWriteReloadConfigFile(t, configPath, 40, 9090)
+	reloaded, err = reloader.reload(ctx, true)
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Len(t, applied, 3)
+	require.Equal(t, float64(40), applied[2].RateLimitUserQPS)
+}
+
+func TestReloadableHandlers(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	azureClient := &testFakeAzureClient{t: t}
+	userClient := newUser(&config{}, azureClient, memCacheClient)
+
+	cfg := &config{
+		CorsEnabled:     true,
+		GroupIdentifier: "NAME",
+	}
+
+	r, err := newReloadableHandlers(ctx, cfg, memCacheClient, userClient, azureClient, nil)
+	require.NoError(t, err)
+
+	// The admin api is disabled until an admin api token is configured
+	rr := testAdminAPIRequest(t, r.adminAPIHandler(), http.MethodGet, "/admin/cache/users", "")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	handlers, _, _ := r.current()
+
+	// The current handlers are kept when the config can't be applied
+	err = r.apply(ctx, &config{GroupIdentifier: "NAME", ReadinessChecks: []string{"DUMMY"}})
+	require.ErrorContains(t, err, "Unknown health check 'DUMMY'")
+	currentHandlers, _, _ := r.current()
+	require.Same(t, handlers, currentHandlers)
+
+	err = r.apply(ctx, &config{AdminAPIToken: "ze-admin-token", CorsEnabled: false, GroupIdentifier: "NAME"})
+	require.NoError(t, err)
+	currentHandlers, _, _ = r.current()
+	require.NotSame(t, handlers, currentHandlers)
+
+	rr = testAdminAPIRequest(t, r.adminAPIHandler(), http.MethodGet, "/admin/cache/users", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// CORS is disabled by the new config
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://ze-origin")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rr = httptest.NewRecorder()
+	r.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	require.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	// The rate limiter and the jit client are kept, only their limits are updated
+	jitCfg := &config{
+		AdminAPIToken:          "ze-admin-token",
+		GroupIdentifier:        "NAME",
+		JITAllowedGroups:       []string{"ze-group"},
+		JITEnabled:             true,
+		JITMaxDuration:         60,
+		MaxLongRunningRequests: 1,
+	}
+	require.NoError(t, r.apply(ctx, jitCfg))
+	handlers, _, _ = r.current()
+	require.NotNil(t, handlers.jit)
+
+	release, ok, _ := handlers.rateLimiter.acquireLongRunning(userModel{ObjectID: "ze-object-id"})
+	require.True(t, ok)
+	defer release()
+
+	jitCfg.JITAllowedGroups = []string{"ze-other-group"}
+	jitCfg.JITMaxDuration = 120
+	require.NoError(t, r.apply(ctx, jitCfg))
+	currentHandlers, _, _ = r.current()
+	require.NotSame(t, handlers, currentHandlers)
+	require.Same(t, handlers.rateLimiter, currentHandlers.rateLimiter)
+	require.Same(t, handlers.jit, currentHandlers.jit)
+	require.Equal(t, newAllowlist([]string{"ze-other-group"}), currentHandlers.jit.allowedGroups)
+	require.Equal(t, 2*time.Hour, currentHandlers.jit.maxDuration)
+
+	_, ok, tier := currentHandlers.rateLimiter.acquireLongRunning(userModel{ObjectID: "ze-other-object-id"})
+	require.False(t, ok)
+	require.Equal(t, longRunningRateLimitTier, tier)
+}
+
+func testWriteReloadConfigFile(t *testing.T, path string, rateLimitUserQPS int, port int) {
+	t.Helper()
+
+	testCreateTemporaryFile(t, path, fmt.Sprintf(`apiVersion: azad-kube-proxy/v1
+clientId: ze-client-id
+clientSecret: ze-client-secret
+tenantId: ze-tenant-id
+rateLimitUserQps: %d
+port: %d
+`, rateLimitUserQPS, port))
+}
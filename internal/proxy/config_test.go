@@ -9,18 +9,57 @@ import (
 
 func TestNewConfig(t *testing.T) {
 	envVarsToClear := []string{
+		"ADMIN_API_TOKEN",
+		"AUDIT_BACKPRESSURE",
+		"AUDIT_BUFFER_SIZE",
+		"AUDIT_FILE_MAX_AGE",
+		"AUDIT_FILE_MAX_BACKUPS",
+		"AUDIT_FILE_MAX_SIZE",
+		"AUDIT_FILE_PATH",
+		"AUDIT_SINKS",
+		"AUDIT_WEBHOOK_BATCH_SIZE",
+		"AUDIT_WEBHOOK_URL",
+		"AUTH_POLICY_EXEMPT_APP_ONLY",
+		"AUTH_POLICY_MAX_AUTH_AGE",
+		"AUTH_POLICY_REQUIRED_ACRS",
+		"AUTH_POLICY_REQUIRED_AMR",
+		"AUTH_POLICY_RESOURCES",
+		"AUTH_POLICY_VERBS",
+		"AUTHORIZATION_RULES_PATH",
+		"AZURE_AD_GROUP_EXCLUDE_OBJECT_IDS",
+		"AZURE_AD_GROUP_EXCLUDE_PREFIXES",
+		"AZURE_AD_GROUP_EXCLUDE_REGEXES",
+		"AZURE_AD_GROUP_INCLUDE_OBJECT_IDS",
+		"AZURE_AD_GROUP_INCLUDE_PREFIXES",
+		"AZURE_AD_GROUP_INCLUDE_REGEXES",
+		"AZURE_AD_GROUP_MEMBERSHIP",
 		"AZURE_AD_GROUP_PREFIX",
+		"AZURE_AD_GROUPS_FROM_TOKEN",
 		"AZURE_AD_MAX_GROUP_COUNT",
 		"CLIENT_ID",
 		"CLIENT_SECRET",
 		"TENANT_ID",
+		"BREAK_GLASS_CONFIG_PATH",
+		"CACHE_ENGINE",
+		"CLIENT_CERTIFICATE_CONFIG_PATH",
+		"CONFIG_PATH",
 		"CORS_ALLOWED_HEADERS",
 		"CORS_ALLOWED_METHODS",
 		"CORS_ALLOWED_ORIGINS",
 		"CORS_ALLOWED_ORIGINS_DEFAULT_SCHEME",
 		"CORS_ENABLED",
+		"GRAPH_NOTIFICATIONS_CLIENT_STATE",
+		"GRAPH_NOTIFICATIONS_SUBSCRIPTION_DURATION",
+		"GRAPH_NOTIFICATIONS_URL",
 		"GROUP_IDENTIFIER",
 		"GROUP_SYNC_INTERVAL",
+		"IMPERSONATE_EXTRA_CLAIMS",
+		"IMPERSONATE_GROUP_TEMPLATES",
+		"IMPERSONATE_UID",
+		"IMPERSONATE_USER_TEMPLATE",
+		"JIT_ALLOWED_GROUPS",
+		"JIT_ENABLED",
+		"JIT_MAX_DURATION",
 		"KUBERNETES_API_CA_CERT_PATH",
 		"KUBERNETES_API_HOST",
 		"KUBERNETES_SERVICE_HOST",
@@ -34,9 +73,27 @@ func TestNewConfig(t *testing.T) {
 		"TLS_CERTIFICATE_PATH",
 		"TLS_ENABLED",
 		"TLS_KEY_PATH",
+		"MAX_LONG_RUNNING_REQUESTS",
+		"MAX_LONG_RUNNING_REQUESTS_PER_USER",
 		"METRICS",
 		"METRICS_ADDRESS",
 		"METRICS_PORT",
+		"RATE_LIMIT_GLOBAL_BURST",
+		"RATE_LIMIT_GLOBAL_QPS",
+		"RATE_LIMIT_GROUP_BURST",
+		"RATE_LIMIT_GROUP_QPS",
+		"RATE_LIMIT_USER_BURST",
+		"RATE_LIMIT_USER_QPS",
+		"READINESS_CHECKS",
+		"REDIS_ADDRESS",
+		"REDIS_CA_CERTIFICATE_PATH",
+		"REDIS_DATABASE",
+		"REDIS_PASSWORD",
+		"REDIS_TLS_ENABLED",
+		"TLS_CIPHER_SUITES",
+		"TLS_CURVE_PREFERENCES",
+		"TLS_MIN_VERSION",
+		"UPSTREAMS_CONFIG_PATH",
 	}
 
 	for _, envVar := range envVarsToClear {
@@ -62,25 +119,44 @@ func TestNewConfig(t *testing.T) {
 		cfg, err := NewConfig(args[1:], "", "", "")
 		require.NoError(t, err)
 		expectedCfg := &config{
-			AzureADMaxGroupCount:            50,
-			AzureClientID:                   "ze-client-id",
-			AzureClientSecret:               "ze-client-secret",
-			AzureTenantID:                   "ze-tenant-id",
-			CorsAllowedOriginsDefaultScheme: "https",
-			CorsEnabled:                     true,
-			GroupIdentifier:                 "NAME",
-			GroupSyncInterval:               5,
-			KubernetesAPICACertPath:         "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
-			KubernetesAPIHost:               "kubernetes.default",
-			KubernetesAPIPort:               443,
-			KubernetesAPITLS:                true,
-			KubernetesAPITokenPath:          "/var/run/secrets/kubernetes.io/serviceaccount/token",
-			KubernetesAPIValidateCert:       true,
-			ListenerAddress:                 "0.0.0.0",
-			ListenerPort:                    8080,
-			Metrics:                         "PROMETHEUS",
-			MetricsListenerAddress:          "0.0.0.0",
-			MetricsListenerPort:             8081,
+			AuditBackpressure:                      "DROP",
+			AuditBufferSize:                        10000,
+			AuditFileMaxAge:                        7,
+			AuditFileMaxBackups:                    10,
+			AuditFileMaxSize:                       100,
+			AuditWebhookBatchSize:                  100,
+			AzureADGroupMembership:                 "DIRECT",
+			AzureADMaxGroupCount:                   50,
+			AzureClientID:                          "ze-client-id",
+			AzureClientSecret:                      "ze-client-secret",
+			AzureTenantID:                          "ze-tenant-id",
+			CacheEngine:                            "MEMORY",
+			CorsAllowedOriginsDefaultScheme:        "https",
+			CorsEnabled:                            true,
+			GraphNotificationsSubscriptionDuration: 4320,
+			GroupIdentifier:                        "NAME",
+			GroupSyncInterval:                      5,
+			JITMaxDuration:                         480,
+			KubernetesAPICACertPath:                "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+			KubernetesAPIHost:                      "kubernetes.default",
+			KubernetesAPIPort:                      443,
+			KubernetesAPITLS:                       true,
+			KubernetesAPITokenPath:                 "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			KubernetesAPIValidateCert:              true,
+			ListenerAddress:                        "0.0.0.0",
+			ListenerPort:                           8080,
+			ListenerTLSConfigMinVersion:            "1.2",
+			Metrics:                                "PROMETHEUS",
+			MetricsListenerAddress:                 "0.0.0.0",
+			MetricsListenerPort:                    8081,
+			MetricsOTLPInterval:                    60,
+			MetricsOTLPProtocol:                    "GRPC",
+			RateLimitGlobalBurst:                   500,
+			RateLimitGroupBurst:                    100,
+			RateLimitUserBurst:                     50,
+			RedisAddress:                           "127.0.0.1:6379",
+			TracingSampleRatio:                     1,
+			args:                                   args[1:],
 		}
 		require.Equal(t, expectedCfg, cfg)
 	})
@@ -93,3 +169,117 @@ func testTempUnsetEnv(t *testing.T, key string) func() {
 	os.Unsetenv(key)
 	return func() { os.Setenv(key, oldEnv) }
 }
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		testDescription     string
+		modify              func(cfg *config)
+		expectedErrContains []string
+	}{
+		{
+			testDescription: "valid",
+			modify:          func(cfg *config) {},
+		},
+		{
+			testDescription: "required",
+			modify: func(cfg *config) {
+				cfg.AzureClientID = ""
+				cfg.AzureClientSecret = ""
+				cfg.AzureTenantID = ""
+			},
+			expectedErrContains: []string{"--client-id is required", "--client-secret is required", "--tenant-id is required"},
+		},
+		{
+			testDescription: "tls without certificate",
+			modify: func(cfg *config) {
+				cfg.ListenerTLSConfigEnabled = true
+				cfg.ListenerTLSConfigCertificatePath = "/ze/tls.crt"
+			},
+			expectedErrContains: []string{"--tls-certificate-path and --tls-key-path are required when --tls-enabled is true"},
+		},
+		{
+			testDescription:     "jit without admin api token",
+			modify:              func(cfg *config) { cfg.JITEnabled = true },
+			expectedErrContains: []string{"--admin-api-token is required when --jit-enabled is true", "--jit-allowed-groups is required when --jit-enabled is true"},
+		},
+		{
+			testDescription:     "graph notifications without client state",
+			modify:              func(cfg *config) { cfg.GraphNotificationsURL = "https://ze-proxy" },
+			expectedErrContains: []string{"--graph-notifications-client-state is required"},
+		},
+		{
+			testDescription: "graph notifications subscription duration",
+			modify: func(cfg *config) {
+				cfg.GraphNotificationsURL = "https://ze-proxy"
+				cfg.GraphNotificationsClientState = "ze-client-state"
+				cfg.GraphNotificationsSubscriptionDuration = 41761
+			},
+			expectedErrContains: []string{"--graph-notifications-subscription-duration needs to be between 1 and 41760 but was: 41761"},
+		},
+		{
+			testDescription: "authorization rules path and config file rules",
+			modify: func(cfg *config) {
+				cfg.AuthorizationRulesPath = "/ze/rules.yaml"
+				cfg.authorizationRules = []authorizationRuleConfig{}
+			},
+			expectedErrContains: []string{"--authorization-rules-path can't be combined with authorizationRules"},
+		},
+		{
+			testDescription:     "audit sinks",
+			modify:              func(cfg *config) { cfg.AuditSinks = []string{"FILE", "WEBHOOK", "DUMMY"} },
+			expectedErrContains: []string{"--audit-file-path is required", "--audit-webhook-url is required", "DUMMY"},
+		},
+		{
+			testDescription: "otlp metrics",
+			modify: func(cfg *config) {
+				cfg.Metrics = "OTLP"
+				cfg.MetricsOTLPProtocol = "DUMMY"
+			},
+			expectedErrContains: []string{"--metrics-otlp-endpoint is required when --metrics is OTLP", "Unknown OTLP protocol 'DUMMY'"},
+		},
+		{
+			testDescription:     "tracing sample ratio",
+			modify:              func(cfg *config) { cfg.TracingSampleRatio = 2 },
+			expectedErrContains: []string{"--tracing-sample-ratio needs to be between 0 and 1"},
+		},
+		{
+			testDescription: "enums",
+			modify: func(cfg *config) {
+				cfg.CacheEngine = "DUMMY"
+				cfg.GroupIdentifier = "DUMMY"
+				cfg.ReadinessChecks = []string{"DUMMY"}
+				cfg.Metrics = "DUMMY"
+			},
+			expectedErrContains: []string{"Unknown cache engine type 'DUMMY'", "Unknown group identifier 'DUMMY'", "Unknown health check 'DUMMY'", "Unknown metrics 'DUMMY'"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			cfg := &config{
+				AuditBackpressure:           "DROP",
+				AzureADGroupMembership:      "DIRECT",
+				AzureClientID:               "ze-client-id",
+				AzureClientSecret:           "ze-client-secret",
+				AzureTenantID:               "ze-tenant-id",
+				CacheEngine:                 "MEMORY",
+				GroupIdentifier:             "NAME",
+				ListenerTLSConfigMinVersion: "1.2",
+				Metrics:                     "PROMETHEUS",
+				MetricsOTLPProtocol:         "GRPC",
+				TracingSampleRatio:          1,
+			}
+			c.modify(cfg)
+
+			err := cfg.validate()
+			if len(c.expectedErrContains) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			for _, expectedErr := range c.expectedErrContains {
+				require.ErrorContains(t, err, expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+)
+
+const (
+	graphSubscriptionCheckInterval = 1 * time.Minute
+	graphSubscriptionResource      = "groups"
+	graphSubscriptionChangeTypes   = "created,updated,deleted"
+	graphNotificationsMaxBodySize  = 1 << 20
+	// graphSubscriptionMaxDuration is the maximum duration (in minutes) of a Microsoft Graph subscription for groups
+	graphSubscriptionMaxDuration = 41760
+)
+
+type graphSubscription struct {
+	ID                       string    `json:"id,omitempty"`
+	ChangeType               string    `json:"changeType,omitempty"`
+	NotificationURL          string    `json:"notificationUrl,omitempty"`
+	LifecycleNotificationURL string    `json:"lifecycleNotificationUrl,omitempty"`
+	Resource                 string    `json:"resource,omitempty"`
+	ExpirationDateTime       time.Time `json:"expirationDateTime"`
+	ClientState              string    `json:"clientState,omitempty"`
+}
+
+type graphNotificationResourceData struct {
+	ID           string `json:"id"`
+	MembersDelta []struct {
+		ID string `json:"id"`
+	} `json:"members@delta"`
+}
+
+type graphNotification struct {
+	SubscriptionID string                        `json:"subscriptionId"`
+	ClientState    string                        `json:"clientState"`
+	ChangeType     string                        `json:"changeType"`
+	Resource       string                        `json:"resource"`
+	ResourceData   graphNotificationResourceData `json:"resourceData"`
+	LifecycleEvent string                        `json:"lifecycleEvent"`
+}
+
+type graphNotificationsRequest struct {
+	Value []graphNotification `json:"value"`
+}
+
+// graphNotifications receives Microsoft Graph change notifications for groups and their memberships. Changed groups
+// are synchronized in the background and the cached users affected by the change are evicted, to be resolved again on
+// their next request. The subscription is created when the proxy starts and renewed before it expires.
+type graphNotifications struct {
+	cache           Cache
+	groups          *azureGroups
+	baseClient      hamiltonMsgraph.Client
+	notificationURL string
+	clientState     string
+	duration        time.Duration
+	now             func() time.Time
+
+	mu           sync.Mutex
+	subscription *graphSubscription
+
+	// The notifications received while the previous ones are processed are queued and processed together
+	pendingMu sync.Mutex
+	pending   []graphNotification
+	queued    chan struct{}
+}
+
+// newGraphNotifications returns nil if no notification url is configured
+func newGraphNotifications(cfg *config, cacheClient Cache, azureClient *azure) (*graphNotifications, error) {
+	if cfg.GraphNotificationsURL == "" {
+		return nil, nil
+	}
+
+	notificationURL, err := url.Parse(cfg.GraphNotificationsURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse graph notifications url: %w", err)
+	}
+
+	if notificationURL.Scheme != "https" {
+		return nil, fmt.Errorf("graph notifications url needs to use https but was: %s", cfg.GraphNotificationsURL)
+	}
+
+	if strings.Trim(notificationURL.Path, "/") == "" {
+		return nil, fmt.Errorf("graph notifications url needs a path but was: %s", cfg.GraphNotificationsURL)
+	}
+
+	if cfg.GraphNotificationsClientState == "" {
+		return nil, fmt.Errorf("graph notifications client state is required when graph notifications are enabled")
+	}
+
+	if cfg.GraphNotificationsSubscriptionDuration < 2*int(graphSubscriptionCheckInterval.Minutes()) {
+		return nil, fmt.Errorf("graph notifications subscription duration needs to be at least %d minutes but was: %d", 2*int(graphSubscriptionCheckInterval.Minutes()), cfg.GraphNotificationsSubscriptionDuration)
+	}
+
+	return &graphNotifications{
+		cache:           cacheClient,
+		groups:          azureClient.groups,
+		baseClient:      azureClient.groups.groupsClient.BaseClient,
+		notificationURL: cfg.GraphNotificationsURL,
+		clientState:     cfg.GraphNotificationsClientState,
+		duration:        time.Duration(cfg.GraphNotificationsSubscriptionDuration) * time.Minute,
+		now:             time.Now,
+		queued:          make(chan struct{}, 1),
+	}, nil
+}
+
+// path is where the notifications are received on the listener, the path of the notification url
+func (n *graphNotifications) path() string {
+	notificationURL, _ := url.Parse(n.notificationURL)
+	return notificationURL.Path
+}
+
+// handler answers the validation request sent by Microsoft Graph when the subscription is created and queues the
+// change and lifecycle notifications. Microsoft Graph expects the notifications to be acknowledged within a few
+// seconds, so they are processed by processQueue after the response is sent.
+func (n *graphNotifications) handler(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		validationToken := r.URL.Query().Get("validationToken")
+		if validationToken != "" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write([]byte(validationToken)); err != nil {
+				log.Error(err, "Could not write response data")
+			}
+			return
+		}
+
+		var req graphNotificationsRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, graphNotificationsMaxBodySize)).Decode(&req)
+		if err != nil {
+			http.Error(w, "Unable to parse notifications", http.StatusBadRequest)
+			return
+		}
+
+		notifications := []graphNotification{}
+		for _, notification := range req.Value {
+			if subtle.ConstantTimeCompare([]byte(notification.ClientState), []byte(n.clientState)) != 1 {
+				incrementGraphNotifications(ctx, "invalid_client_state")
+				log.Info("Ignoring graph notification with invalid client state", "subscriptionID", notification.SubscriptionID, "sourceIP", getClientIP(r))
+				continue
+			}
+
+			notifications = append(notifications, notification)
+		}
+
+		if len(req.Value) > 0 && len(notifications) == 0 {
+			setAuditDenialReason(r.Context(), "invalid graph notification client state")
+			http.Error(w, "Invalid client state", http.StatusForbidden)
+			return
+		}
+
+		n.enqueue(notifications)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (n *graphNotifications) enqueue(notifications []graphNotification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	n.pendingMu.Lock()
+	n.pending = append(n.pending, notifications...)
+	n.pendingMu.Unlock()
+
+	select {
+	case n.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (n *graphNotifications) dequeue() []graphNotification {
+	n.pendingMu.Lock()
+	defer n.pendingMu.Unlock()
+
+	notifications := n.pending
+	n.pending = nil
+
+	return notifications
+}
+
+// processQueue processes the queued notifications until the context is cancelled
+func (n *graphNotifications) processQueue(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.queued:
+		}
+
+		err := n.process(ctx, n.dequeue())
+		if err != nil {
+			log.Error(err, "Unable to process graph notifications")
+		}
+	}
+}
+
+// process synchronizes the groups once for all notifications and evicts the cached users that are, or were, members
+// of the changed groups. Added members are only known from members@delta, so every cached user is evicted when a
+// notification doesn't contain it or when notifications were missed.
+func (n *graphNotifications) process(ctx context.Context, notifications []graphNotification) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	changedGroups := make(map[string]struct{})
+	changedMembers := make(map[string]struct{})
+	renew := false
+	evictAll := false
+	for _, notification := range notifications {
+		if notification.LifecycleEvent != "" {
+			incrementGraphNotifications(ctx, "lifecycle")
+			log.Info("Received graph lifecycle notification", "subscriptionID", notification.SubscriptionID, "lifecycleEvent", notification.LifecycleEvent)
+			renew = renew || notification.LifecycleEvent != "missed"
+			evictAll = evictAll || notification.LifecycleEvent == "missed"
+			continue
+		}
+
+		incrementGraphNotifications(ctx, "change")
+
+		groupID := notification.ResourceData.ID
+		if groupID == "" {
+			continue
+		}
+
+		changedGroups[groupID] = struct{}{}
+
+		// A missing members@delta (basic or trimmed notifications) is decoded as nil, a delta without changes as empty
+		if notification.ResourceData.MembersDelta == nil {
+			evictAll = true
+			continue
+		}
+
+		for _, member := range notification.ResourceData.MembersDelta {
+			changedMembers[member.ID] = struct{}{}
+		}
+	}
+
+	if renew {
+		// Reauthorization and removed subscriptions are handled by renewing or recreating the subscription
+		err := n.ensureSubscription(ctx, true)
+		if err != nil {
+			log.Error(err, "Unable to renew graph subscription after lifecycle notification")
+		}
+	}
+
+	// Missed notifications are recovered by the synchronization, same as changed groups
+	if len(changedGroups) == 0 && !evictAll {
+		return nil
+	}
+
+	err := n.groups.syncAzureADGroupsCache(ctx, "notification")
+	if err != nil {
+		return err
+	}
+
+	evicted, err := evictCachedUsers(ctx, n.cache, func(user userModel) bool {
+		if evictAll {
+			return true
+		}
+
+		if _, ok := changedMembers[user.ObjectID]; ok {
+			return true
+		}
+
+		for _, group := range user.Groups {
+			if _, ok := changedGroups[group.ObjectID]; ok {
+				return true
+			}
+		}
+
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("Processed graph notifications", "groupCount", len(changedGroups), "memberCount", len(changedMembers), "evictedAll", evictAll, "evictedUsers", evicted)
+
+	return nil
+}
+
+// run creates the subscription and renews it before it expires, until the context is cancelled. The subscription is
+// created after the listener has started since Microsoft Graph validates the notification url when it's created.
+func (n *graphNotifications) run(ctx context.Context, interval time.Duration) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := n.ensureSubscription(ctx, false)
+		if err != nil {
+			log.Error(err, "Unable to create or renew graph subscription")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensureSubscription creates the subscription if there is none and renews it when half of its duration has passed,
+// or always if force is true. A subscription that can't be renewed is recreated.
+func (n *graphNotifications) ensureSubscription(ctx context.Context, force bool) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	expiration := now.Add(n.duration).UTC()
+
+	if n.subscription != nil {
+		if !force && n.subscription.ExpirationDateTime.Sub(now) > n.duration/2 {
+			return nil
+		}
+
+		subscription, status, err := n.graphRequest(ctx, http.MethodPatch, fmt.Sprintf("subscriptions/%s", n.subscription.ID), graphSubscription{ExpirationDateTime: expiration})
+		if err == nil {
+			n.subscription = subscription
+			log.Info("Renewed graph subscription", "subscriptionID", subscription.ID, "expiration", subscription.ExpirationDateTime)
+			return nil
+		}
+
+		if status != http.StatusNotFound {
+			return err
+		}
+
+		log.Info("Graph subscription not found, creating a new subscription", "subscriptionID", n.subscription.ID)
+		n.subscription = nil
+	}
+
+	subscription, _, err := n.graphRequest(ctx, http.MethodPost, "subscriptions", graphSubscription{
+		ChangeType:               graphSubscriptionChangeTypes,
+		NotificationURL:          n.notificationURL,
+		LifecycleNotificationURL: n.notificationURL,
+		Resource:                 graphSubscriptionResource,
+		ExpirationDateTime:       expiration,
+		ClientState:              n.clientState,
+	})
+	if err != nil {
+		return err
+	}
+
+	n.subscription = subscription
+	log.Info("Created graph subscription", "subscriptionID", subscription.ID, "expiration", subscription.ExpirationDateTime)
+
+	return nil
+}
+
+// close deletes the subscription, Microsoft Graph would otherwise keep sending notifications until it expires
+func (n *graphNotifications) close(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.subscription == nil {
+		return nil
+	}
+
+	_, status, err := n.graphRequest(ctx, http.MethodDelete, fmt.Sprintf("subscriptions/%s", n.subscription.ID), nil)
+	if err != nil && status != http.StatusNotFound {
+		return err
+	}
+
+	n.subscription = nil
+
+	return nil
+}
+
+// graphRequest sends a subscription request to Microsoft Graph, the status code is returned together with the error
+// for unexpected responses
+func (n *graphNotifications) graphRequest(ctx context.Context, method string, path string, body interface{}) (_ *graphSubscription, _ int, err error) {
+	ctx, end := startGraphRequest(ctx, "subscriptions")
+	defer func() { end(err) }()
+
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	reqURL := fmt.Sprintf("%s/%s/%s/%s", n.baseClient.Endpoint, n.baseClient.ApiVersion, n.baseClient.TenantId, path)
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if n.baseClient.Authorizer != nil {
+		token, err := n.baseClient.Authorizer.Token()
+		if err != nil {
+			return nil, 0, err
+		}
+		token.SetAuthHeader(req)
+	}
+
+	res, err := n.baseClient.HttpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, res.StatusCode, fmt.Errorf("unexpected status %d from graph subscription request: %s", res.StatusCode, resBody)
+	}
+
+	if method == http.MethodDelete {
+		return nil, res.StatusCode, nil
+	}
+
+	var subscription graphSubscription
+	err = json.Unmarshal(resBody, &subscription)
+	if err != nil {
+		return nil, res.StatusCode, err
+	}
+
+	return &subscription, res.StatusCode, nil
+}
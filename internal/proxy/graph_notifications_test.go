@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGraphNotifications(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	azureClient := &azure{groups: newGroups(ctx, memCache, groupsClient, &groupFilter{})}
+
+	cases := []struct {
+		cfg                 *config
+		expectedNil         bool
+		expectedErrContains string
+	}{
+		{
+			cfg:         &config{},
+			expectedNil: true,
+		},
+		{
+			cfg: &config{
+				GraphNotificationsURL:                  "http://proxy.example.com/graph/notifications",
+				GraphNotificationsClientState:          "ze-client-state",
+				GraphNotificationsSubscriptionDuration: 4320,
+			},
+			expectedErrContains: "needs to use https",
+		},
+		{
+			cfg: &config{
+				GraphNotificationsURL:                  "https://proxy.example.com/",
+				GraphNotificationsClientState:          "ze-client-state",
+				GraphNotificationsSubscriptionDuration: 4320,
+			},
+			expectedErrContains: "needs a path",
+		},
+		{
+			cfg: &config{
+				GraphNotificationsURL:                  "https://proxy.example.com/graph/notifications",
+				GraphNotificationsSubscriptionDuration: 4320,
+			},
+			expectedErrContains: "client state is required",
+		},
+		{
+			cfg: &config{
+				GraphNotificationsURL:                  "https://proxy.example.com/graph/notifications",
+				GraphNotificationsClientState:          "ze-client-state",
+				GraphNotificationsSubscriptionDuration: 1,
+			},
+			expectedErrContains: "subscription duration needs to be at least 2 minutes but was: 1",
+		},
+		{
+			cfg: &config{
+				GraphNotificationsURL:                  "https://proxy.example.com/graph/notifications",
+				GraphNotificationsClientState:          "ze-client-state",
+				GraphNotificationsSubscriptionDuration: 4320,
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		notifications, err := newGraphNotifications(c.cfg, memCache, azureClient)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		if c.expectedNil {
+			require.Nil(t, notifications)
+			continue
+		}
+
+		require.Equal(t, "/graph/notifications", notifications.path())
+		require.Equal(t, 72*time.Hour, notifications.duration)
+	}
+}
+
+func TestGraphNotifications(t *testing.T) {
+	ctx, cancel := context.WithCancel(logr.NewContext(context.Background(), logr.Discard()))
+	defer cancel()
+	fakeGraph := newTestFakeGraphGroupsServer(t)
+	fakeSubscriptions := newTestFakeGraphSubscriptions(t, fakeGraph)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	testConfigureGraphClient(t, &groupsClient.BaseClient, fakeGraph.server.URL)
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	groups := newGroups(ctx, memCache, groupsClient, &groupFilter{includePrefixes: []string{"k8s-"}})
+	fakeGraph.setGroups(map[string]string{
+		"a": "k8s-a",
+		"b": "k8s-b",
+		"c": "k8s-c",
+	})
+	fakeGraph.setLatestDeltaToken("token-1")
+	require.NoError(t, groups.syncAzureADGroupsCache(ctx, "initial"))
+
+	now := time.Now().UTC()
+	notifications := &graphNotifications{
+		cache:       memCache,
+		groups:      groups,
+		baseClient:  groupsClient.BaseClient,
+		clientState: "ze-client-state",
+		duration:    time.Hour,
+		now:         func() time.Time { return now },
+		queued:      make(chan struct{}, 1),
+	}
+	go notifications.processQueue(ctx)
+
+	receiver := httptest.NewServer(http.HandlerFunc(notifications.handler(ctx)))
+	defer receiver.Close()
+	notifications.notificationURL = receiver.URL + "/graph/notifications"
+
+	// The subscription is created after Microsoft Graph has validated the notification url
+	require.NoError(t, notifications.ensureSubscription(ctx, false))
+	subscription := fakeSubscriptions.get(t, notifications.subscription.ID)
+	require.Equal(t, "groups", subscription.Resource)
+	require.Equal(t, "created,updated,deleted", subscription.ChangeType)
+	require.Equal(t, "ze-client-state", subscription.ClientState)
+	require.Equal(t, now.Add(time.Hour).Truncate(time.Second), subscription.ExpirationDateTime.Truncate(time.Second))
+
+	users := map[string]userModel{
+		"sub-1": {Username: "user-1", ObjectID: "user-1", Groups: []groupModel{{Name: "k8s-a", ObjectID: "a"}}},
+		"sub-2": {Username: "user-2", ObjectID: "user-2", Groups: []groupModel{{Name: "k8s-b", ObjectID: "b"}}},
+		"sub-3": {Username: "user-3", ObjectID: "user-3"},
+		"sub-4": {Username: "user-4", ObjectID: "user-4", Groups: []groupModel{{Name: "k8s-c", ObjectID: "c"}}},
+	}
+	for key, user := range users {
+		require.NoError(t, memCache.setUser(ctx, key, user))
+	}
+
+	// Notifications with the wrong client state are rejected
+	res := fakeSubscriptions.notify(t, notifications.notificationURL, graphNotification{
+		ClientState:  "wrong-client-state",
+		ChangeType:   "updated",
+		ResourceData: graphNotificationResourceData{ID: "a"},
+	})
+	require.Equal(t, http.StatusForbidden, res)
+	testRequireCachedUsers(t, memCache, []string{"sub-1", "sub-2", "sub-3", "sub-4"})
+
+	// Group b is renamed and user-3 is added to group a, the groups are synchronized and the affected users evicted
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{
+		"token-1": {
+			Value: []graphDeltaGroup{
+				testNewDeltaGroup(t, "b", "k8s-b-renamed", false),
+			},
+			DeltaLink: fakeGraph.deltaURL("token-2"),
+		},
+	})
+
+	renamedGroup := graphNotificationResourceData{ID: "b"}
+	renamedGroup.MembersDelta = []struct {
+		ID string `json:"id"`
+	}{}
+
+	addedMember := graphNotificationResourceData{ID: "a"}
+	addedMember.MembersDelta = append(addedMember.MembersDelta, struct {
+		ID string `json:"id"`
+	}{ID: "user-3"})
+
+	// The notifications are acknowledged without waiting for the synchronization
+	groups.mu.Lock()
+	res = fakeSubscriptions.notify(t, notifications.notificationURL,
+		graphNotification{ClientState: "ze-client-state", ChangeType: "updated", ResourceData: renamedGroup},
+		graphNotification{ClientState: "ze-client-state", ChangeType: "updated", ResourceData: addedMember},
+	)
+	require.Equal(t, http.StatusAccepted, res)
+	testRequireCachedUsers(t, memCache, []string{"sub-1", "sub-2", "sub-3", "sub-4"})
+	groups.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		users, err := memCache.listUsers(ctx)
+		require.NoError(t, err)
+		return len(users) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	testRequireCachedGroups(t, memCache, map[string]string{"a": "k8s-a", "b": "k8s-b-renamed", "c": "k8s-c"}, []string{})
+	testRequireCachedUsers(t, memCache, []string{"sub-4"})
+	require.Contains(t, groups.deltaLink, "token-2")
+
+	// Every cached user is evicted when the added members aren't known, without members@delta or after missed
+	// notifications
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{
+		"token-2": {DeltaLink: fakeGraph.deltaURL("token-2")},
+	})
+
+	for _, notification := range []graphNotification{
+		{ClientState: "ze-client-state", ChangeType: "updated", ResourceData: graphNotificationResourceData{ID: "c"}},
+		{ClientState: "ze-client-state", LifecycleEvent: "missed"},
+	} {
+		for key, user := range users {
+			require.NoError(t, memCache.setUser(ctx, key, user))
+		}
+
+		res = fakeSubscriptions.notify(t, notifications.notificationURL, notification)
+		require.Equal(t, http.StatusAccepted, res)
+		require.Eventually(t, func() bool {
+			users, err := memCache.listUsers(ctx)
+			require.NoError(t, err)
+			return len(users) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// The subscription is renewed when half of the duration has passed
+	require.NoError(t, notifications.ensureSubscription(ctx, false))
+	require.Equal(t, 0, fakeSubscriptions.getRenewals())
+
+	now = now.Add(31 * time.Minute)
+	require.NoError(t, notifications.ensureSubscription(ctx, false))
+	require.Equal(t, 1, fakeSubscriptions.getRenewals())
+	require.Equal(t, now.Add(time.Hour).Truncate(time.Second), fakeSubscriptions.get(t, subscription.ID).ExpirationDateTime.Truncate(time.Second))
+
+	// A removed subscription is recreated when the lifecycle notification is received
+	fakeSubscriptions.remove(subscription.ID)
+	res = fakeSubscriptions.notify(t, notifications.notificationURL, graphNotification{
+		SubscriptionID: subscription.ID,
+		ClientState:    "ze-client-state",
+		LifecycleEvent: "subscriptionRemoved",
+	})
+	require.Equal(t, http.StatusAccepted, res)
+	require.Eventually(t, func() bool {
+		notifications.mu.Lock()
+		defer notifications.mu.Unlock()
+		return notifications.subscription.ID != subscription.ID
+	}, 5*time.Second, 10*time.Millisecond)
+	fakeSubscriptions.get(t, notifications.subscription.ID)
+
+	// The subscription is deleted when the proxy is stopped
+	require.NoError(t, notifications.close(ctx))
+	require.Nil(t, notifications.subscription)
+	require.Equal(t, 0, fakeSubscriptions.count())
+}
+
+func testRequireCachedUsers(t *testing.T, cache Cache, expectedKeys []string) {
+	t.Helper()
+
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	users, err := cache.listUsers(ctx)
+	require.NoError(t, err)
+
+	keys := []string{}
+	for key := range users {
+		keys = append(keys, key)
+	}
+
+	require.ElementsMatch(t, expectedKeys, keys)
+}
+
+// testFakeGraphSubscriptions adds the subscription endpoints to the fake Microsoft Graph, the notification url is
+// validated the same way as by Microsoft Graph when a subscription is created
+type testFakeGraphSubscriptions struct {
+	mu            sync.Mutex
+	subscriptions map[string]graphSubscription
+	nextID        int
+	renewals      int
+}
+
+func newTestFakeGraphSubscriptions(t *testing.T, fakeGraph *testFakeGraphGroupsServer) *testFakeGraphSubscriptions {
+	t.Helper()
+
+	fakeSubscriptions := &testFakeGraphSubscriptions{
+		subscriptions: map[string]graphSubscription{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/beta/ze-tenant/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+
+		var subscription graphSubscription
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&subscription))
+
+		validationToken := "ze-validation-token"
+		validationRes, err := http.Post(fmt.Sprintf("%s?validationToken=%s", subscription.NotificationURL, validationToken), "text/plain", http.NoBody)
+		require.NoError(t, err)
+		defer validationRes.Body.Close()
+
+		body, err := io.ReadAll(validationRes.Body)
+		require.NoError(t, err)
+		if validationRes.StatusCode != http.StatusOK || string(body) != validationToken {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fakeSubscriptions.mu.Lock()
+		fakeSubscriptions.nextID++
+		subscription.ID = fmt.Sprintf("subscription-%d", fakeSubscriptions.nextID)
+		fakeSubscriptions.subscriptions[subscription.ID] = subscription
+		fakeSubscriptions.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		require.NoError(t, json.NewEncoder(w).Encode(subscription))
+	})
+	mux.HandleFunc("/beta/ze-tenant/subscriptions/", func(w http.ResponseWriter, r *http.Request) {
+		fakeSubscriptions.mu.Lock()
+		defer fakeSubscriptions.mu.Unlock()
+
+		id := strings.TrimPrefix(r.URL.Path, "/beta/ze-tenant/subscriptions/")
+		subscription, ok := fakeSubscriptions.subscriptions[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPatch:
+			var renewal graphSubscription
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&renewal))
+
+			subscription.ExpirationDateTime = renewal.ExpirationDateTime
+			fakeSubscriptions.subscriptions[id] = subscription
+			fakeSubscriptions.renewals++
+
+			w.Header().Set("Content-Type", "application/json")
+			require.NoError(t, json.NewEncoder(w).Encode(subscription))
+		case http.MethodDelete:
+			delete(fakeSubscriptions.subscriptions, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.Handle("/", fakeGraph.server.Config.Handler)
+	fakeGraph.server.Config.Handler = mux
+
+	return fakeSubscriptions
+}
+
+// notify posts the notifications the same way as Microsoft Graph and returns the status code
+func (s *testFakeGraphSubscriptions) notify(t *testing.T, notificationURL string, notifications ...graphNotification) int {
+	t.Helper()
+
+	b, err := json.Marshal(graphNotificationsRequest{Value: notifications})
+	require.NoError(t, err)
+
+	res, err := http.Post(notificationURL, "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	return res.StatusCode
+}
+
+func (s *testFakeGraphSubscriptions) get(t *testing.T, id string) graphSubscription {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscription, ok := s.subscriptions[id]
+	require.True(t, ok, "expected subscription %q to exist", id)
+
+	return subscription
+}
+
+func (s *testFakeGraphSubscriptions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscriptions, id)
+}
+
+func (s *testFakeGraphSubscriptions) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscriptions)
+}
+
+func (s *testFakeGraphSubscriptions) getRenewals() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.renewals
+}
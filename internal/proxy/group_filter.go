@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// graphFilterMaxObjectIDs is the maximum number of values Microsoft Graph supports in an 'in' operator
+const graphFilterMaxObjectIDs = 15
+
+// groupFilter selects what Azure AD groups are synchronized to the cache and passed to the Kubernetes API.
+// A group is selected when there are no include rules or it matches at least one of them, and it doesn't match any
+// of the exclude rules.
+type groupFilter struct {
+	includePrefixes  []string
+	includeRegexes   []*regexp.Regexp
+	includeObjectIDs map[string]struct{}
+	excludePrefixes  []string
+	excludeRegexes   []*regexp.Regexp
+	excludeObjectIDs map[string]struct{}
+}
+
+func newGroupFilter(cfg *config) (*groupFilter, error) {
+	includePrefixes := append([]string{}, cfg.AzureADGroupIncludePrefixes...)
+	if cfg.AzureADGroupPrefix != "" {
+		includePrefixes = append(includePrefixes, cfg.AzureADGroupPrefix)
+	}
+
+	includeRegexes, err := compileGroupFilterRegexes(cfg.AzureADGroupIncludeRegexes)
+	if err != nil {
+		return nil, err
+	}
+
+	excludeRegexes, err := compileGroupFilterRegexes(cfg.AzureADGroupExcludeRegexes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &groupFilter{
+		includePrefixes:  includePrefixes,
+		includeRegexes:   includeRegexes,
+		includeObjectIDs: toObjectIDSet(cfg.AzureADGroupIncludeObjectIDs),
+		excludePrefixes:  cfg.AzureADGroupExcludePrefixes,
+		excludeRegexes:   excludeRegexes,
+		excludeObjectIDs: toObjectIDSet(cfg.AzureADGroupExcludeObjectIDs),
+	}, nil
+}
+
+func (f *groupFilter) matches(objectID string, displayName string) bool {
+	if f.hasIncludes() && !matchesGroupRules(objectID, displayName, f.includePrefixes, f.includeRegexes, f.includeObjectIDs) {
+		return false
+	}
+
+	return !matchesGroupRules(objectID, displayName, f.excludePrefixes, f.excludeRegexes, f.excludeObjectIDs)
+}
+
+// graphFilter returns the OData filter that can be pushed down to Microsoft Graph. Only include prefixes and object
+// IDs can be expressed as a filter, if any other include rule exists all groups are listed and filtered client side.
+// Exclude rules are always applied client side.
+func (f *groupFilter) graphFilter() string {
+	if len(f.includeRegexes) > 0 || len(f.includeObjectIDs) > graphFilterMaxObjectIDs {
+		return ""
+	}
+
+	filters := []string{}
+	for _, prefix := range f.includePrefixes {
+		filters = append(filters, fmt.Sprintf("startswith(displayName,'%s')", escapeODataString(prefix)))
+	}
+
+	if len(f.includeObjectIDs) > 0 {
+		objectIDs := []string{}
+		for objectID := range f.includeObjectIDs {
+			objectIDs = append(objectIDs, fmt.Sprintf("'%s'", escapeODataString(objectID)))
+		}
+		sort.Strings(objectIDs)
+		filters = append(filters, fmt.Sprintf("id in (%s)", strings.Join(objectIDs, ",")))
+	}
+
+	return strings.Join(filters, " or ")
+}
+
+func (f *groupFilter) hasIncludes() bool {
+	return len(f.includePrefixes) > 0 || len(f.includeRegexes) > 0 || len(f.includeObjectIDs) > 0
+}
+
+func matchesGroupRules(objectID string, displayName string, prefixes []string, regexes []*regexp.Regexp, objectIDs map[string]struct{}) bool {
+	if _, ok := objectIDs[strings.ToLower(objectID)]; ok {
+		return true
+	}
+
+	// Prefixes are compared case-insensitively, the same way as startswith() in the Microsoft Graph filter
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(strings.ToLower(displayName), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	for _, re := range regexes {
+		if re.MatchString(displayName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileGroupFilterRegexes(expressions []string) ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, expression := range expressions {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile group filter regular expression %q: %w", expression, err)
+		}
+		regexes = append(regexes, re)
+	}
+
+	return regexes, nil
+}
+
+func toObjectIDSet(objectIDs []string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, objectID := range objectIDs {
+		set[strings.ToLower(objectID)] = struct{}{}
+	}
+
+	return set
+}
+
+func escapeODataString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
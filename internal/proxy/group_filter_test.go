@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hamiltonMsgraph "github.com/manicminer/hamilton/msgraph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGroupFilter(t *testing.T) {
+	cases := []struct {
+		testDescription     string
+		config              *config
+		expectedGraphFilter string
+		expectedErrContains string
+	}{
+		{
+			testDescription:     "no filters",
+			config:              &config{},
+			expectedGraphFilter: "",
+		},
+		{
+			testDescription: "legacy group prefix",
+			config: &config{
+				AzureADGroupPrefix: "k8s-",
+			},
+			expectedGraphFilter: "startswith(displayName,'k8s-')",
+		},
+		{
+			testDescription: "multiple prefixes and object ids",
+			config: &config{
+				AzureADGroupPrefix:           "k8s-",
+				AzureADGroupIncludePrefixes:  []string{"platform-", "o'neil-"},
+				AzureADGroupIncludeObjectIDs: []string{"00000000-0000-0000-0000-000000000002", "00000000-0000-0000-0000-000000000001"},
+				AzureADGroupExcludePrefixes:  []string{"k8s-secret-"},
+			},
+			expectedGraphFilter: "startswith(displayName,'platform-') or startswith(displayName,'o''neil-') or startswith(displayName,'k8s-') or id in ('00000000-0000-0000-0000-000000000001','00000000-0000-0000-0000-000000000002')",
+		},
+		{
+			testDescription: "include regexes can't be pushed down",
+			config: &config{
+				AzureADGroupIncludePrefixes: []string{"platform-"},
+				AzureADGroupIncludeRegexes:  []string{"^team-.*-k8s$"},
+			},
+			expectedGraphFilter: "",
+		},
+		{
+			testDescription: "invalid include regex",
+			config: &config{
+				AzureADGroupIncludeRegexes: []string{"team-("},
+			},
+			expectedErrContains: "unable to compile group filter regular expression \"team-(\"",
+		},
+		{
+			testDescription: "invalid exclude regex",
+			config: &config{
+				AzureADGroupExcludeRegexes: []string{"["},
+			},
+			expectedErrContains: "unable to compile group filter regular expression \"[\"",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			filter, err := newGroupFilter(c.config)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, c.expectedGraphFilter, filter.graphFilter())
+		})
+	}
+}
+
+func TestGroupFilterMatches(t *testing.T) {
+	filter, err := newGroupFilter(&config{
+		AzureADGroupIncludePrefixes:  []string{"k8s-", "platform-"},
+		AzureADGroupIncludeRegexes:   []string{"^team-[a-z]+-admins$"},
+		AzureADGroupIncludeObjectIDs: []string{"AAAAAAAA-0000-0000-0000-000000000000"},
+		AzureADGroupExcludePrefixes:  []string{"k8s-secret-"},
+		AzureADGroupExcludeRegexes:   []string{"-break-glass$"},
+		AzureADGroupExcludeObjectIDs: []string{"bbbbbbbb-0000-0000-0000-000000000000"},
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		objectID      string
+		displayName   string
+		expectedMatch bool
+	}{
+		{objectID: "1", displayName: "k8s-developers", expectedMatch: true},
+		{objectID: "1", displayName: "K8S-admins", expectedMatch: true},
+		{objectID: "1", displayName: "Platform-Operators", expectedMatch: true},
+		{objectID: "2", displayName: "platform-operators", expectedMatch: true},
+		{objectID: "3", displayName: "team-blue-admins", expectedMatch: true},
+		{objectID: "aaaaaaaa-0000-0000-0000-000000000000", displayName: "unrelated-group", expectedMatch: true},
+		{objectID: "4", displayName: "unrelated-group", expectedMatch: false},
+		{objectID: "5", displayName: "team-blue-readers", expectedMatch: false},
+		{objectID: "6", displayName: "k8s-secret-admins", expectedMatch: false},
+		{objectID: "6", displayName: "K8s-Secret-admins", expectedMatch: false},
+		{objectID: "7", displayName: "platform-break-glass", expectedMatch: false},
+		{objectID: "BBBBBBBB-0000-0000-0000-000000000000", displayName: "k8s-excluded-by-id", expectedMatch: false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expectedMatch, filter.matches(c.objectID, c.displayName), "objectID=%s displayName=%s", c.objectID, c.displayName)
+	}
+
+	excludeOnlyFilter, err := newGroupFilter(&config{
+		AzureADGroupExcludePrefixes: []string{"secret-"},
+	})
+	require.NoError(t, err)
+	require.True(t, excludeOnlyFilter.matches("1", "any-group"))
+	require.False(t, excludeOnlyFilter.matches("2", "secret-group"))
+}
+
+func TestSyncAzureADGroupsCacheWithGroupFilter(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	fakeGraph := newTestFakeGraphGroupsServer(t)
+
+	groupsClient := hamiltonMsgraph.NewGroupsClient("ze-tenant")
+	testConfigureGraphClient(t, &groupsClient.BaseClient, fakeGraph.server.URL)
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	filter, err := newGroupFilter(&config{
+		AzureADGroupIncludePrefixes: []string{"k8s-"},
+		AzureADGroupIncludeRegexes:  []string{"^team-.*$"},
+		AzureADGroupExcludePrefixes: []string{"k8s-secret-"},
+	})
+	require.NoError(t, err)
+
+	groups := newGroups(ctx, memCache, groupsClient, filter)
+
+	fakeGraph.setGroups(map[string]string{
+		"a": "k8s-a",
+		"b": "k8s-secret-b",
+		"c": "team-c",
+		"d": "other-d",
+	})
+	fakeGraph.setLatestDeltaToken("token-1")
+
+	err = groups.syncAzureADGroupsCache(ctx, "initial")
+	require.NoError(t, err)
+	require.Empty(t, fakeGraph.getLastFilter())
+	testRequireCachedGroups(t, memCache, map[string]string{"a": "k8s-a", "c": "team-c"}, []string{"b", "d"})
+
+	fakeGraph.setDeltaPages(map[string]graphDeltaResponse{
+		"token-1": {
+			Value: []graphDeltaGroup{
+				testNewDeltaGroup(t, "a", "k8s-secret-a", false),
+				testNewDeltaGroup(t, "d", "team-d", false),
+			},
+			DeltaLink: fakeGraph.deltaURL("token-2"),
+		},
+	})
+
+	err = groups.syncAzureADGroupsCache(ctx, "ticker")
+	require.NoError(t, err)
+	testRequireCachedGroups(t, memCache, map[string]string{"c": "team-c", "d": "team-d"}, []string{"a", "b"})
+}
@@ -2,14 +2,17 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/xenitab/go-oidc-middleware/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -17,6 +20,7 @@ const (
 	impersonateUserHeader            = "Impersonate-User"
 	impersonateGroupHeader           = "Impersonate-Group"
 	impersonateUserExtraHeaderPrefix = "Impersonate-Extra-"
+	impersonateUIDHeader             = "Impersonate-Uid"
 )
 
 type handler struct {
@@ -24,137 +28,251 @@ type handler struct {
 	user   User
 	health Health
 
-	cfg             *config
-	groupIdentifier groupIdentifier
-	kubernetesToken string
+	cfg                *config
+	identityRewriter   *identityRewriter
+	impersonateExtras  impersonateExtras
+	rateLimiter        *rateLimiter
+	authPolicy         *authPolicy
+	authorizationRules *authorizationRules
+	jit                *jit
 }
 
 func newHandlers(ctx context.Context, cfg *config, cacheClient Cache, userClient User, healthClient Health) (*handler, error) {
-	groupIdentifier, err := getGroupIdentifier(cfg.GroupIdentifier)
+	identityRewriter, err := newIdentityRewriter(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	kubernetesToken, err := getStringFromFile(ctx, cfg.KubernetesAPITokenPath)
+	impersonateExtras, err := newImpersonateExtras(cfg.ImpersonateExtraClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimiter, err := newRateLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	authPolicy, err := newAuthPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizationRules, err := newAuthorizationRules(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	jitClient, err := newJIT(cfg, cacheClient)
 	if err != nil {
 		return nil, err
 	}
 
 	handlersClient := &handler{
-		cache:           cacheClient,
-		user:            userClient,
-		health:          healthClient,
-		cfg:             cfg,
-		groupIdentifier: groupIdentifier,
-		kubernetesToken: kubernetesToken,
+		cache:              cacheClient,
+		user:               userClient,
+		health:             healthClient,
+		cfg:                cfg,
+		identityRewriter:   identityRewriter,
+		impersonateExtras:  impersonateExtras,
+		rateLimiter:        rateLimiter,
+		authPolicy:         authPolicy,
+		authorizationRules: authorizationRules,
+		jit:                jitClient,
 	}
 
 	return handlersClient, nil
 }
 
 func (h *handler) readiness(ctx context.Context) func(http.ResponseWriter, *http.Request) {
-	log := logr.FromContextOrDiscard(ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, verbose := r.URL.Query()["verbose"]
+		report := h.health.ready(ctx, verbose)
+		writeHealthReport(ctx, w, r, "readyz", report)
+	}
+}
 
+func (h *handler) liveness(ctx context.Context) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ready, err := h.health.ready(ctx)
-		if !ready {
-			log.Error(err, "Ready check failed")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Set("Content-Type", "application/json")
-			if _, err := w.Write([]byte("{\"status\": \"error\"}")); err != nil {
-				log.Error(err, "Could not write response data")
+		report := h.health.live(ctx)
+		writeHealthReport(ctx, w, r, "healthz", report)
+	}
+}
+
+// writeHealthReport writes the result of every check as JSON, or as text when the verbose query parameter is used (the
+// same way as the Kubernetes API server)
+func writeHealthReport(ctx context.Context, w http.ResponseWriter, r *http.Request, endpoint string, report healthReport) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for _, result := range report.Checks {
+		if result.err != nil {
+			log.Error(result.err, "Health check failed", "endpoint", endpoint, "check", result.Name, "gating", result.Gating)
+		}
+	}
+
+	statusCode := http.StatusOK
+	if !report.ok() {
+		statusCode = http.StatusInternalServerError
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		var b strings.Builder
+		for _, result := range report.Checks {
+			switch {
+			case result.err == nil:
+				fmt.Fprintf(&b, "[+]%s ok\n", result.Name)
+			case result.Gating:
+				fmt.Fprintf(&b, "[-]%s failed: %s\n", result.Name, result.Error)
+			default:
+				fmt.Fprintf(&b, "[-]%s failed (not gating): %s\n", result.Name, result.Error)
 			}
-			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		if _, err := w.Write([]byte("{\"status\": \"ok\"}")); err != nil {
+		if report.ok() {
+			fmt.Fprintf(&b, "%s check passed\n", endpoint)
+		} else {
+			fmt.Fprintf(&b, "%s check failed\n", endpoint)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(statusCode)
+		if _, err := w.Write([]byte(b.String())); err != nil {
 			log.Error(err, "Could not write response data")
 		}
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		log.Error(err, "Could not marshal response data")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(b); err != nil {
+		log.Error(err, "Could not write response data")
 	}
 }
 
-func (h *handler) liveness(ctx context.Context) func(http.ResponseWriter, *http.Request) {
+func (h *handler) proxy(ctx context.Context, up *upstream) func(http.ResponseWriter, *http.Request) {
 	log := logr.FromContextOrDiscard(ctx)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		live, err := h.health.live(ctx)
-		if !live {
-			log.Error(err, "Live check failed")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Set("Content-Type", "application/json")
-			if _, err := w.Write([]byte("{\"status\": \"error\"}")); err != nil {
-				log.Error(err, "Could not write response data")
+		// The spans of the request stages are children of the span started by the tracing middleware
+		ctx := trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+
+		// Verify that client isn't sending impersonation headers
+		for h := range r.Header {
+			if strings.EqualFold(h, impersonateUserHeader) || strings.EqualFold(h, impersonateGroupHeader) || strings.EqualFold(h, impersonateUIDHeader) || strings.HasPrefix(strings.ToLower(h), strings.ToLower(impersonateUserExtraHeaderPrefix)) {
+				log.Error(errors.New("Client sending impersonation headers"), "Client sending impersonation headers")
+				setAuditDenialReason(r.Context(), "client sending impersonation headers")
+				http.Error(w, "User unauthorized", http.StatusForbidden)
+				return
 			}
-			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		if _, err := w.Write([]byte("{\"status\": \"ok\"}")); err != nil {
-			log.Error(err, "Could not write response data")
+		var user userModel
+		var externalClaims *externalAzureADClaims
+		found := false
+		identity, isAuthenticatedByProxy := getAuthIdentity(r.Context())
+		if isAuthenticatedByProxy {
+			// Users authenticated with a client certificate or break-glass credential aren't looked up in Azure AD
+			user = identity.user
+		} else {
+			var ok bool
+			user, externalClaims, found, ok = h.getAzureADUser(ctx, w, r)
+			if !ok {
+				return
+			}
 		}
-	}
-}
 
-func (h *handler) proxy(ctx context.Context, p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
-	log := logr.FromContextOrDiscard(ctx)
+		// Add the groups of the active just-in-time grants of the user, the grants don't apply to break-glass access
+		var grants []grantModel
+		if h.jit != nil && identity.method != breakGlassAuthMethod {
+			jitCtx, span := startSpan(ctx, "jit apply grants")
+			var err error
+			user, grants, err = h.jit.applyGrants(jitCtx, user)
+			endSpan(span, err)
+			if err != nil {
+				log.Error(err, "Unable to get just-in-time grants", "username", user.Username)
+				http.Error(w, "Unexpected error", http.StatusInternalServerError)
+				return
+			}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		externalClaims, ok := r.Context().Value(options.DefaultClaimsContextKeyName).(externalAzureADClaims)
-		if !ok {
-			log.Error(fmt.Errorf("unable to typecast claims"), "not able to typecast claims to externalAzureADClaims")
-			http.Error(w, "Unexpected error", http.StatusInternalServerError)
-			return
+			// The granted groups count against the max group count, the same way as the groups from Azure AD
+			if len(grants) > 0 && len(user.Groups) > h.cfg.AzureADMaxGroupCount-1 {
+				log.Error(errors.New("max groups reached"), "the user is member of more groups (including just-in-time grants) than allowed to be passed to the Kubernetes API", "groupCount", len(user.Groups), "username", user.Username, "config.AzureADMaxGroupCount", h.cfg.AzureADMaxGroupCount)
+				setAuditDenialReason(r.Context(), "too many groups")
+				http.Error(w, "Too many groups", http.StatusForbidden)
+				return
+			}
 		}
 
-		claims, err := toInternalAzureADClaims(&externalClaims)
+		// Render the values of the impersonation headers, break-glass access always impersonates the emergency group
+		impersonateUser, impersonateGroups, err := h.getImpersonation(user, identity.method)
+		if errors.Is(err, errEmptyImpersonateUser) {
+			log.Error(err, "Unable to render impersonated user", "username", user.Username)
+			setAuditDenialReason(r.Context(), "empty impersonated user")
+			http.Error(w, "User unauthorized", http.StatusForbidden)
+			return
+		}
 		if err != nil {
-			log.Error(err, "not able to convert rawClaims to azureClaims")
+			log.Error(err, "Unable to render impersonation", "username", user.Username)
 			http.Error(w, "Unexpected error", http.StatusInternalServerError)
 			return
 		}
 
-		// Use the token hash to get the user object from cache
-		user, found, err := h.cache.getUser(ctx, claims.sub)
+		impersonateExtraHeaders, err := h.impersonateExtras.headers(externalClaims, r)
 		if err != nil {
-			log.Error(err, "Unable to get cached user object")
+			log.Error(err, "Unable to get impersonate extra headers", "username", user.Username)
 			http.Error(w, "Unexpected error", http.StatusInternalServerError)
 			return
 		}
 
-		// Verify that client isn't sending impersonation headers
-		for h := range r.Header {
-			if strings.EqualFold(h, impersonateUserHeader) || strings.EqualFold(h, impersonateGroupHeader) || strings.HasPrefix(strings.ToLower(h), strings.ToLower(impersonateUserExtraHeaderPrefix)) {
-				log.Error(errors.New("Client sending impersonation headers"), "Client sending impersonation headers")
-				http.Error(w, "User unauthorized", http.StatusForbidden)
-				return
-			}
-		}
+		setAuditUser(r.Context(), user, impersonateUser, impersonateGroups)
+		setAuditJITGrants(r.Context(), grants)
 
-		// Get the user from the token if no cache was found
-		if !found {
-			// Get the user object
-			user, err = h.user.getUser(ctx, claims.username, claims.objectID)
+		// Require a compliant Azure AD authentication (like MFA) for the verbs and resources covered by the auth policy
+		info := parseRequestInfo(r)
+		_, authorizeSpan := startSpan(ctx, "proxy authorize", attribute.String("k8s.verb", info.Verb), attribute.String("k8s.resource", info.Resource))
+		if h.authPolicy != nil && externalClaims != nil && h.authPolicy.applies(info) {
+			err := h.authPolicy.check(externalClaims)
 			if err != nil {
-				log.Error(err, "Unable to get user")
-				http.Error(w, "Unable to get user", http.StatusForbidden)
+				endSpan(authorizeSpan, err)
+				h.requireReauthentication(ctx, w, r, user, err)
 				return
 			}
+		}
 
-			// Check if number of groups more than the configured limit
-			if len(user.Groups) > h.cfg.AzureADMaxGroupCount-1 {
-				log.Error(errors.New("max groups reached"), "the user is member of more groups than allowed to be passed to the Kubernetes API", "groupCount", len(user.Groups), "username", user.Username, "config.AzureADMaxGroupCount", h.cfg.AzureADMaxGroupCount)
-				http.Error(w, "Too many groups", http.StatusForbidden)
+		// Evaluate the authorization rules against the impersonated user and groups, the same identity RBAC will use
+		if h.authorizationRules != nil {
+			rule, allowed := h.authorizationRules.evaluate(info, impersonateUser, impersonateGroups)
+			if !allowed {
+				endSpan(authorizeSpan, fmt.Errorf("denied by authorization rule %q", rule.name))
+				h.denyByRule(ctx, w, r, info, impersonateUser, rule)
 				return
 			}
+		}
 
-			err = h.cache.setUser(ctx, claims.sub, user)
-			if err != nil {
-				log.Error(err, "Unable to set cache for user object")
-				http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		// Throttle the request if the proxy, the user or any of the groups are over the rate limit
+		allowed, tier, retryAfter := h.rateLimiter.allow(user)
+		if !allowed {
+			endSpan(authorizeSpan, fmt.Errorf("rate limited (%s)", tier))
+			h.throttle(ctx, w, r, user, tier, retryAfter)
+			return
+		}
+		endSpan(authorizeSpan, nil)
+
+		// Limit the number of concurrent long-running requests, the slot is released when the connection is closed
+		if isLongRunningRequest(r, info) {
+			release, ok, tier := h.rateLimiter.acquireLongRunning(user)
+			if !ok {
+				h.throttle(ctx, w, r, user, tier, longRunningRetryAfter)
+				return
 			}
+			defer release()
 		}
 
 		// Remove the Authorization header that is sent to the server
@@ -165,38 +283,184 @@ func (h *handler) proxy(ctx context.Context, p *httputil.ReverseProxy) func(http
 		r.Header.Del("Sec-WebSocket-Protocol")
 		r.Header.Add("Sec-WebSocket-Protocol", wsProtoString)
 
-		// Add a new Authorization header with the token from the token path
-		r.Header.Add(authorizationHeader, fmt.Sprintf("Bearer %s", h.kubernetesToken))
+		// Add a new Authorization header with the token of the upstream
+		kubernetesToken, err := up.kubernetesToken.token()
+		if err != nil {
+			log.Error(err, "Unable to get token for upstream", "upstream", up.name)
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+			return
+		}
+		r.Header.Add(authorizationHeader, fmt.Sprintf("Bearer %s", kubernetesToken))
 
 		// Add the impersonation header for the users
-		r.Header.Add(impersonateUserHeader, user.Username)
+		r.Header.Add(impersonateUserHeader, impersonateUser)
 
 		// Add a new impersonation header per group
-		for _, group := range user.Groups {
-			switch h.groupIdentifier {
-			case nameGroupIdentifier:
-				r.Header.Add(impersonateGroupHeader, group.Name)
-			case objectIDGroupIdentifier:
-				r.Header.Add(impersonateGroupHeader, group.ObjectID)
-			default:
-				log.Error(errors.New("unknown groups identifier"), "unknown groups identifier", "GroupIdentifier", h.cfg.GroupIdentifier)
-				http.Error(w, "Unexpected error", http.StatusInternalServerError)
-				return
+		for _, group := range impersonateGroups {
+			r.Header.Add(impersonateGroupHeader, group)
+		}
+
+		// Add the object id of the user as impersonated uid
+		if h.cfg.ImpersonateUID && user.ObjectID != "" {
+			r.Header.Add(impersonateUIDHeader, user.ObjectID)
+		}
+
+		// Add the configured claims as extra user information
+		for name, values := range impersonateExtraHeaders {
+			for _, value := range values {
+				r.Header.Add(name, value)
 			}
 		}
 
-		log.Info("Request", "path", r.URL.Path, "username", user.Username, "userType", user.Type, "groupCount", len(user.Groups), "cachedUser", found)
+		log.Info("Request", "upstream", up.name, "path", r.URL.Path, "username", user.Username, "userType", user.Type, "groupCount", len(user.Groups), "jitGrantCount", len(grants), "cachedUser", found)
+
+		incrementRequestCount(ctx, r)
+
+		up.reverseProxy.ServeHTTP(w, r)
+	}
+}
+
+// getAzureADUser returns the user of the Azure AD token validated by the OIDC handler (from the cache if found), the
+// claims of the token and if the user was cached. The last value is false if an error response has been written.
+func (h *handler) getAzureADUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (userModel, *externalAzureADClaims, bool, bool) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	externalClaims, ok := r.Context().Value(options.DefaultClaimsContextKeyName).(externalAzureADClaims)
+	if !ok {
+		log.Error(fmt.Errorf("unable to typecast claims"), "not able to typecast claims to externalAzureADClaims")
+		http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		return userModel{}, nil, false, false
+	}
+
+	claims, err := toInternalAzureADClaims(&externalClaims)
+	if err != nil {
+		log.Error(err, "not able to convert rawClaims to azureClaims")
+		http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		return userModel{}, nil, false, false
+	}
+
+	// Use the token hash to get the user object from cache
+	cacheCtx, span := startSpan(ctx, "cache get user")
+	user, found, err := h.cache.getUser(cacheCtx, claims.sub)
+	span.SetAttributes(attribute.Bool("cache.hit", found))
+	endSpan(span, err)
+	if err != nil {
+		log.Error(err, "Unable to get cached user object")
+		http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		return userModel{}, nil, false, false
+	}
+	incrementUserCacheRequests(ctx, found)
+
+	// Get the user from the token if no cache was found
+	if !found {
+		// Get the user object, using the groups claim if configured and the token contains all groups of the user
+		userCtx, span := startSpan(ctx, "user get user")
+		if h.cfg.AzureADGroupsFromToken && !claims.groupsOverage {
+			user, err = h.user.getUserFromGroupIDs(userCtx, claims.username, claims.objectID, claims.groups)
+		} else {
+			user, err = h.user.getUser(userCtx, claims.username, claims.objectID)
+		}
+		endSpan(span, err)
+		if err != nil {
+			log.Error(err, "Unable to get user")
+			setAuditDenialReason(r.Context(), "unable to get user")
+			http.Error(w, "Unable to get user", http.StatusForbidden)
+			return userModel{}, nil, false, false
+		}
+
+		// Check if number of groups more than the configured limit
+		if len(user.Groups) > h.cfg.AzureADMaxGroupCount-1 {
+			log.Error(errors.New("max groups reached"), "the user is member of more groups than allowed to be passed to the Kubernetes API", "groupCount", len(user.Groups), "username", user.Username, "config.AzureADMaxGroupCount", h.cfg.AzureADMaxGroupCount)
+			setAuditDenialReason(r.Context(), "too many groups")
+			http.Error(w, "Too many groups", http.StatusForbidden)
+			return userModel{}, nil, false, false
+		}
+
+		err = h.cache.setUser(ctx, claims.sub, user)
+		if err != nil {
+			log.Error(err, "Unable to set cache for user object")
+			http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		}
+	}
+
+	return user, &externalClaims, found, true
+}
+
+func (h *handler) getImpersonation(user userModel, method authMethodModel) (string, []string, error) {
+	if method == breakGlassAuthMethod {
+		groups := []string{}
+		for _, group := range user.Groups {
+			groups = append(groups, group.Name)
+		}
+
+		return user.Username, groups, nil
+	}
+
+	impersonateUser, err := h.identityRewriter.username(user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	impersonateGroups, err := h.identityRewriter.groups(user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return impersonateUser, impersonateGroups, nil
+}
+
+func (h *handler) requireReauthentication(ctx context.Context, w http.ResponseWriter, r *http.Request, user userModel, err error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	var policyErr *authPolicyError
+	if !errors.As(err, &policyErr) {
+		log.Error(err, "Unable to check auth policy", "username", user.Username)
+		http.Error(w, "Unexpected error", http.StatusInternalServerError)
+		return
+	}
 
-		incrementRequestCount(r)
+	incrementAuthPolicyRejections(ctx, policyErr.requirement)
+	setAuditDenialReason(r.Context(), fmt.Sprintf("auth policy not fulfilled (%s)", policyErr.requirement))
+	log.Info("Request requires re-authentication", "path", r.URL.Path, "username", user.Username, "requirement", policyErr.requirement, "reason", policyErr.message)
 
-		p.ServeHTTP(w, r)
+	err = writeAuthPolicyUnauthorized(w, policyErr)
+	if err != nil {
+		log.Error(err, "Could not write response data")
 	}
 }
 
-func (h *handler) error(ctx context.Context) func(w http.ResponseWriter, r *http.Request, err error) {
+func (h *handler) denyByRule(ctx context.Context, w http.ResponseWriter, r *http.Request, info requestInfo, username string, rule *authorizationRule) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	incrementAuthorizationRuleDenials(ctx, rule.name)
+	setAuditDenialReason(r.Context(), fmt.Sprintf("denied by authorization rule %q", rule.name))
+	log.Info("Request denied by authorization rule", "path", r.URL.Path, "verb", info.Verb, "username", username, "rule", rule.name)
+
+	err := writeAuthorizationRuleDenied(w, info, username, rule)
+	if err != nil {
+		log.Error(err, "Could not write response data")
+	}
+}
+
+func (h *handler) throttle(ctx context.Context, w http.ResponseWriter, r *http.Request, user userModel, tier string, retryAfter time.Duration) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	incrementThrottledRequests(ctx, tier)
+	setAuditDenialReason(r.Context(), fmt.Sprintf("rate limited (%s)", tier))
+	log.Info("Request throttled", "path", r.URL.Path, "username", user.Username, "tier", tier, "retryAfter", retryAfter)
+
+	err := writeTooManyRequests(w, tier, retryAfter)
+	if err != nil {
+		log.Error(err, "Could not write response data")
+	}
+}
+
+func (h *handler) error(ctx context.Context, upstreamName string) func(w http.ResponseWriter, r *http.Request, err error) {
 	log := logr.FromContextOrDiscard(ctx)
 
 	return func(w http.ResponseWriter, r *http.Request, err error) {
+		incrementUpstreamErrors(ctx, upstreamName)
+
 		if err == nil {
 			log.Error(err, "error nil")
 			http.Error(w, "", http.StatusInternalServerError)
@@ -205,7 +469,7 @@ func (h *handler) error(ctx context.Context) func(w http.ResponseWriter, r *http
 
 		switch err {
 		default:
-			log.Error(err, "Unexpected error")
+			log.Error(err, "Unexpected error", "upstream", upstreamName)
 			http.Error(w, "", http.StatusInternalServerError)
 		}
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
+	"github.com/xenitab/go-oidc-middleware/options"
 )
 
 var (
@@ -78,12 +79,12 @@ func TestReadinessHandler(t *testing.T) {
 	}{
 		{
 			healthClient:    newTestFakeHealthClient(t, true, nil, true, nil),
-			expectedString:  `{"status": "ok"}`,
+			expectedString:  `{"status":"ok","checks":[{"name":"impersonation/default","status":"ok","gating":true}]}`,
 			expectedResCode: http.StatusOK,
 		},
 		{
 			healthClient:    newTestFakeHealthClient(t, false, nil, false, nil),
-			expectedString:  `{"status": "error"}`,
+			expectedString:  `{"status":"error","checks":[{"name":"impersonation/default","status":"error","gating":true,"error":"fake not ready"}]}`,
 			expectedResCode: http.StatusInternalServerError,
 		},
 	}
@@ -129,12 +130,12 @@ func TestLivenessHandler(t *testing.T) {
 	}{
 		{
 			healthClient:    newTestFakeHealthClient(t, true, nil, true, nil),
-			expectedString:  `{"status": "ok"}`,
+			expectedString:  `{"status":"ok","checks":[{"name":"graph_token","status":"ok","gating":true}]}`,
 			expectedResCode: http.StatusOK,
 		},
 		{
 			healthClient:    newTestFakeHealthClient(t, false, nil, false, nil),
-			expectedString:  `{"status": "error"}`,
+			expectedString:  `{"status":"error","checks":[{"name":"graph_token","status":"error","gating":true,"error":"fake not live"}]}`,
 			expectedResCode: http.StatusInternalServerError,
 		},
 	}
@@ -152,6 +153,84 @@ func TestLivenessHandler(t *testing.T) {
 	}
 }
 
+func TestWriteHealthReport(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	okCheck := func(ctx context.Context) error { return nil }
+	errorCheck := func(ctx context.Context) error { return errors.New("fake error") }
+
+	cases := []struct {
+		testDescription     string
+		checks              []healthCheck
+		target              string
+		expectedString      string
+		expectedResCode     int
+		expectedContentType string
+	}{
+		{
+			testDescription: "json ok",
+			checks: []healthCheck{
+				{name: "upstream/default", model: upstreamHealthCheck, check: okCheck},
+				{name: "jwks", model: jwksHealthCheck, check: errorCheck},
+			},
+			target:              "/readyz",
+			expectedString:      `{"status":"ok","checks":[{"name":"upstream/default","status":"ok","gating":true}]}`,
+			expectedResCode:     http.StatusOK,
+			expectedContentType: "application/json",
+		},
+		{
+			testDescription: "json error",
+			checks: []healthCheck{
+				{name: "upstream/default", model: upstreamHealthCheck, check: errorCheck},
+			},
+			target:              "/readyz",
+			expectedString:      `{"status":"error","checks":[{"name":"upstream/default","status":"error","gating":true,"error":"fake error"}]}`,
+			expectedResCode:     http.StatusInternalServerError,
+			expectedContentType: "application/json",
+		},
+		{
+			testDescription: "verbose ok",
+			checks: []healthCheck{
+				{name: "upstream/default", model: upstreamHealthCheck, check: okCheck},
+				{name: "jwks", model: jwksHealthCheck, check: errorCheck},
+			},
+			target:              "/readyz?verbose",
+			expectedString:      "[+]upstream/default ok\n[-]jwks failed (not gating): fake error\nreadyz check passed\n",
+			expectedResCode:     http.StatusOK,
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+		{
+			testDescription: "verbose error",
+			checks: []healthCheck{
+				{name: "upstream/default", model: upstreamHealthCheck, check: errorCheck},
+				{name: "jwks", model: jwksHealthCheck, check: okCheck},
+			},
+			target:              "/readyz?verbose=true",
+			expectedString:      "[-]upstream/default failed: fake error\n[+]jwks ok\nreadyz check failed\n",
+			expectedResCode:     http.StatusInternalServerError,
+			expectedContentType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			healthClient := &health{
+				readinessChecks: c.checks,
+				readinessGates:  map[healthCheckModel]struct{}{upstreamHealthCheck: {}},
+			}
+			proxyHandlers := &handler{health: healthClient}
+
+			req := httptest.NewRequest(http.MethodGet, c.target, nil)
+			rr := httptest.NewRecorder()
+			proxyHandlers.readiness(ctx)(rr, req)
+
+			require.Equal(t, c.expectedResCode, rr.Code)
+			require.Equal(t, c.expectedContentType, rr.Header().Get("Content-Type"))
+			require.Equal(t, c.expectedString, rr.Body.String())
+		})
+	}
+}
+
 func TestAzadKubeProxyHandler(t *testing.T) {
 	clientID := testGetEnvOrSkip(t, "CLIENT_ID")
 	clientSecret := testGetEnvOrSkip(t, "CLIENT_SECRET")
@@ -470,12 +549,12 @@ func TestAzadKubeProxyHandler(t *testing.T) {
 		require.NoError(t, err)
 
 		kubernetesAPIUrl := testGetKubernetesAPIUrl(t, c.config.KubernetesAPIHost, c.config.KubernetesAPIPort, c.config.KubernetesAPITLS)
-		proxy := httputil.NewSingleHostReverseProxy(kubernetesAPIUrl)
-		proxy.ErrorHandler = proxyHandlers.error(ctx)
+		up := testNewUpstream(t, kubernetesAPIUrl.String())
+		up.reverseProxy.ErrorHandler = proxyHandlers.error(ctx, up.name)
 		rr := httptest.NewRecorder()
 		router := mux.NewRouter()
 
-		oidcHandler := newOIDCHandler(proxyHandlers.proxy(ctx, proxy), tenantID, clientID)
+		oidcHandler := newOIDCHandler(proxyHandlers.proxy(ctx, up), tenantID, clientID)
 		router.PathPrefix("/").Handler(oidcHandler)
 
 		router.ServeHTTP(rr, c.request)
@@ -489,6 +568,166 @@ func TestAzadKubeProxyHandler(t *testing.T) {
 	}
 }
 
+func TestProxyHandlerGroupsFromToken(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	testFakeHealthClient := newTestFakeHealthClient(t, true, nil, true, nil)
+
+	fakeBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeBackend.Close()
+	fakeBackendURL, err := url.Parse(fakeBackend.URL)
+	require.NoError(t, err)
+
+	kubernetesAPITokenPath, cleanupFn := testGetKubernetesAPITokenPath(t)
+	defer cleanupFn()
+
+	cases := []struct {
+		testDescription               string
+		groupsFromToken               bool
+		claims                        externalAzureADClaims
+		expectedGetUserCalls          int
+		expectedGetUserFromGroupCalls int
+	}{
+		{
+			testDescription:               "groups from token disabled",
+			groupsFromToken:               false,
+			claims:                        testNewExternalClaims(t, "ze-sub", "ze-username", []string{"ze-group"}),
+			expectedGetUserCalls:          1,
+			expectedGetUserFromGroupCalls: 0,
+		},
+		{
+			testDescription:               "groups from token enabled",
+			groupsFromToken:               true,
+			claims:                        testNewExternalClaims(t, "ze-sub", "ze-username", []string{"ze-group"}),
+			expectedGetUserCalls:          0,
+			expectedGetUserFromGroupCalls: 1,
+		},
+		{
+			testDescription: "groups from token enabled with group overage",
+			groupsFromToken: true,
+			claims: func() externalAzureADClaims {
+				claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+				claims.ClaimNames = testToPtr(t, map[string]string{"groups": "src1"})
+				return claims
+			}(),
+			expectedGetUserCalls:          1,
+			expectedGetUserFromGroupCalls: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			cfg := &config{
+				AzureADGroupsFromToken: c.groupsFromToken,
+				AzureADMaxGroupCount:   testFakeMaxGroups,
+				GroupIdentifier:        "NAME",
+				KubernetesAPITokenPath: kubernetesAPITokenPath,
+			}
+
+			memCacheClient, err := newMemoryCache(5 * time.Minute)
+			require.NoError(t, err)
+			userClient := newTestFakeUserClient(t, "", "", nil, nil)
+
+			proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, testFakeHealthClient)
+			require.NoError(t, err)
+
+			rr := httptest.NewRecorder()
+			proxyHandlers.proxy(ctx, testNewUpstream(t, fakeBackendURL.String()))(rr, testNewClaimsRequest(t, http.MethodGet, "/", c.claims))
+
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, c.expectedGetUserCalls, userClient.getUserCalls)
+			require.Equal(t, c.expectedGetUserFromGroupCalls, userClient.getUserFromGroupCalls)
+		})
+	}
+}
+
+func TestProxyHandlerMetrics(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	fakeBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeBackend.Close()
+
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "", "", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	up := testNewUpstream(t, fakeBackend.URL)
+	up.reverseProxy.ErrorHandler = proxyHandlers.error(ctx, up.name)
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+
+	// The user is cached by the first request
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodGet, "/", claims))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsUserCacheRequests, "miss"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsUserCacheRequests, "hit"))
+	require.Equal(t, float64(2), testMetricValue(t, metricsClient, metricsRequestsCount, "unknown"))
+
+	// Errors proxying the request to the upstream are counted per upstream
+	fakeBackend.Close()
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodGet, "/", claims))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsUpstreamErrors, defaultUpstreamName))
+}
+
+func testNewUpstream(t *testing.T, backendURL string) *upstream {
+	t.Helper()
+
+	u, err := url.Parse(backendURL)
+	require.NoError(t, err)
+
+	return &upstream{
+		name:            defaultUpstreamName,
+		isDefault:       true,
+		kubernetesURL:   u,
+		kubernetesToken: staticTokenSource("fake-token"),
+		reverseProxy:    httputil.NewSingleHostReverseProxy(u),
+	}
+}
+
+func testNewExternalClaims(t *testing.T, sub, username string, groups []string) externalAzureADClaims {
+	t.Helper()
+
+	claims := externalAzureADClaims{
+		Subject:  testToPtr(t, sub),
+		ObjectId: testToPtr(t, "00000000-0000-0000-0000-000000000000"),
+	}
+
+	if username != "" {
+		claims.PreferredUsername = testToPtr(t, username)
+	}
+
+	if groups != nil {
+		claims.Groups = testToPtr(t, groups)
+	}
+
+	return claims
+}
+
+func testNewClaimsRequest(t *testing.T, method, path string, claims externalAzureADClaims) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	ctx := context.WithValue(req.Context(), options.DefaultClaimsContextKeyName, claims)
+
+	return req.WithContext(ctx)
+}
+
 func testGetKubernetesAPITokenPath(t *testing.T) (string, func()) {
 	t.Helper()
 
@@ -502,10 +741,12 @@ func testGetKubernetesAPITokenPath(t *testing.T) (string, func()) {
 }
 
 type testFakeUserClient struct {
-	fakeError error
-	fakeUser  userModel
-	fakeGroup groupModel
-	t         *testing.T
+	fakeError             error
+	fakeUser              userModel
+	fakeGroup             groupModel
+	getUserCalls          int
+	getUserFromGroupCalls int
+	t                     *testing.T
 }
 
 func newTestFakeUserClient(t *testing.T, username string, objectID string, groups []groupModel, fakeError error) *testFakeUserClient {
@@ -537,6 +778,14 @@ func newTestFakeUserClient(t *testing.T, username string, objectID string, group
 func (client *testFakeUserClient) getUser(ctx context.Context, username, objectID string) (userModel, error) {
 	client.t.Helper()
 
+	client.getUserCalls++
+	return client.fakeUser, client.fakeError
+}
+
+func (client *testFakeUserClient) getUserFromGroupIDs(ctx context.Context, username, objectID string, groupIDs []string) (userModel, error) {
+	client.t.Helper()
+
+	client.getUserFromGroupCalls++
 	return client.fakeUser, client.fakeError
 }
 
@@ -600,6 +849,60 @@ func (c *testFakeCacheClient) setGroup(ctx context.Context, s string, g groupMod
 	return c.fakeError
 }
 
+func (c *testFakeCacheClient) deleteGroup(ctx context.Context, s string) error {
+	c.t.Helper()
+
+	return c.fakeError
+}
+
+func (c *testFakeCacheClient) deleteUser(ctx context.Context, s string) error {
+	c.t.Helper()
+
+	return c.fakeError
+}
+
+func (c *testFakeCacheClient) listUsers(ctx context.Context) (map[string]userModel, error) {
+	c.t.Helper()
+
+	return nil, c.fakeError
+}
+
+func (c *testFakeCacheClient) listGroups(ctx context.Context) ([]groupModel, error) {
+	c.t.Helper()
+
+	return nil, c.fakeError
+}
+
+func (c *testFakeCacheClient) getGrants(ctx context.Context, objectID string) ([]grantModel, error) {
+	c.t.Helper()
+
+	return nil, c.fakeError
+}
+
+func (c *testFakeCacheClient) listGrants(ctx context.Context) ([]grantModel, error) {
+	c.t.Helper()
+
+	return nil, c.fakeError
+}
+
+func (c *testFakeCacheClient) setGrant(ctx context.Context, g grantModel) error {
+	c.t.Helper()
+
+	return c.fakeError
+}
+
+func (c *testFakeCacheClient) deleteGrant(ctx context.Context, id string) (bool, error) {
+	c.t.Helper()
+
+	return false, c.fakeError
+}
+
+func (c *testFakeCacheClient) ping(ctx context.Context) error {
+	c.t.Helper()
+
+	return c.fakeError
+}
+
 type testFakeHealthClient struct {
 	isReady    bool
 	readyError error
@@ -620,16 +923,37 @@ func newTestFakeHealthClient(t *testing.T, isReady bool, readyError error, isLiv
 	}
 }
 
-func (client *testFakeHealthClient) ready(ctx context.Context) (bool, error) {
+func (client *testFakeHealthClient) ready(ctx context.Context, verbose bool) healthReport {
 	client.t.Helper()
 
-	return client.isReady, client.readyError
+	readyError := client.readyError
+	if !client.isReady && readyError == nil {
+		readyError = errors.New("fake not ready")
+	}
+
+	return testFakeHealthReport(client.t, "impersonation/default", readyError)
 }
 
-func (client *testFakeHealthClient) live(ctx context.Context) (bool, error) {
+func (client *testFakeHealthClient) live(ctx context.Context) healthReport {
 	client.t.Helper()
 
-	return client.isLive, client.liveError
+	liveError := client.liveError
+	if !client.isLive && liveError == nil {
+		liveError = errors.New("fake not live")
+	}
+
+	return testFakeHealthReport(client.t, "graph_token", liveError)
+}
+
+func testFakeHealthReport(t *testing.T, name string, err error) healthReport {
+	t.Helper()
+
+	return runHealthChecks(context.Background(), []healthCheck{
+		{
+			name:  name,
+			check: func(ctx context.Context) error { return err },
+		},
+	}, func(_ healthCheck) bool { return true })
 }
 
 func testGetEnvOrSkip(t *testing.T, envVar string) string {
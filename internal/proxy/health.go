@@ -2,7 +2,12 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	k8sapiauthorization "k8s.io/api/authorization/v1"
 	k8sapimachinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -10,90 +15,407 @@ import (
 	k8sclientrest "k8s.io/client-go/rest"
 )
 
+const healthCheckTimeout = 5 * time.Second
+
+// defaultReadinessChecks gate readiness when readiness-checks is empty, the proxy can't serve any request without them
+var defaultReadinessChecks = []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck, cacheHealthCheck}
+
 type Health interface {
-	ready(ctx context.Context) (bool, error)
-	live(ctx context.Context) (bool, error)
+	ready(ctx context.Context, verbose bool) healthReport
+	live(ctx context.Context) healthReport
 }
 
-type HealthValidator interface {
-	valid(ctx context.Context) bool
+// healthCheck is a component of the proxy that is checked, the checks done per upstream are named
+// <check>/<upstream> (like impersonation/default)
+type healthCheck struct {
+	name  string
+	model healthCheckModel
+	check func(ctx context.Context) error
+}
+
+type healthReport struct {
+	Status string              `json:"status"`
+	Checks []healthCheckResult `json:"checks"`
+}
+
+type healthCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Gating bool   `json:"gating"`
+	Error  string `json:"error,omitempty"`
+
+	err error
 }
 
 type health struct {
-	k8sClient         k8s.Interface
-	livenessValidator HealthValidator
+	readinessChecks []healthCheck
+	readinessGates  map[healthCheckModel]struct{}
+	livenessChecks  []healthCheck
 }
 
-func newHealthClient(ctx context.Context, cfg *config, livenessValidator HealthValidator) (*health, error) {
-	k8sTLSConfig := k8sclientrest.TLSClientConfig{Insecure: true}
-	if cfg.KubernetesAPIValidateCert {
-		kubernetesRootCAString, err := getStringFromFile(ctx, cfg.KubernetesAPICACertPath)
+// impersonateResource is a resource the proxy needs to be allowed to impersonate
+type impersonateResource struct {
+	apiGroup string
+	resource string
+}
+
+func newHealthClient(ctx context.Context, cfg *config, upstreams []*upstream, azureClient Azure, cacheClient Cache) (*health, error) {
+	readinessGates, err := getReadinessGates(cfg.ReadinessChecks)
+	if err != nil {
+		return nil, err
+	}
+
+	impersonateResources, err := getImpersonateResources(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	readinessChecks := []healthCheck{}
+	for _, up := range upstreams {
+		k8sClient, err := newUpstreamKubernetesClient(up)
 		if err != nil {
 			return nil, err
 		}
 
+		readinessChecks = append(readinessChecks, newUpstreamHealthChecks(up.name, k8sClient, impersonateResources)...)
+	}
+
+	jwks := &jwksHealthChecker{
+		httpClient: &http.Client{Timeout: healthCheckTimeout},
+		issuer:     getAzureADIssuer(cfg.AzureTenantID),
+	}
+
+	readinessChecks = append(readinessChecks,
+		healthCheck{name: getHealthCheckName(graphHealthCheck), model: graphHealthCheck, check: azureClient.validGraphPermissions},
+		healthCheck{name: getHealthCheckName(groupSyncHealthCheck), model: groupSyncHealthCheck, check: newGroupSyncHealthCheck(azureClient.lastGroupSync, 2*time.Duration(cfg.GroupSyncInterval)*time.Minute)},
+		healthCheck{name: getHealthCheckName(jwksHealthCheck), model: jwksHealthCheck, check: jwks.check},
+		healthCheck{name: getHealthCheckName(cacheHealthCheck), model: cacheHealthCheck, check: cacheClient.ping},
+	)
+
+	// The proxy is restarted when the Microsoft Graph token can't be renewed
+	livenessChecks := []healthCheck{
+		{
+			name: "graph_token",
+			check: func(ctx context.Context) error {
+				if !azureClient.valid(ctx) {
+					return fmt.Errorf("Microsoft Graph token not valid")
+				}
+
+				return nil
+			},
+		},
+	}
+
+	healthClient := &health{
+		readinessChecks: readinessChecks,
+		readinessGates:  readinessGates,
+		livenessChecks:  livenessChecks,
+	}
+
+	return healthClient, nil
+}
+
+// newUpstreamKubernetesClient returns a client for the upstream using the token of the proxy, the certificate of the
+// upstream is verified using its CA when certificate validation is enabled
+func newUpstreamKubernetesClient(up *upstream) (k8s.Interface, error) {
+	k8sTLSConfig := k8sclientrest.TLSClientConfig{Insecure: true}
+	if up.kubernetesValidateCert {
 		k8sTLSConfig = k8sclientrest.TLSClientConfig{
 			Insecure: false,
-			CAData:   []byte(kubernetesRootCAString),
+			CAData:   up.kubernetesRootCAData,
 		}
 	}
 
-	kubernetesAPIUrl, err := getKubernetesAPIUrl(cfg.KubernetesAPIHost, cfg.KubernetesAPIPort, cfg.KubernetesAPITLS)
-	if err != nil {
-		return nil, err
+	k8sRestConfig := &k8sclientrest.Config{
+		Host:            up.kubernetesURL.String(),
+		TLSClientConfig: k8sTLSConfig,
+		WrapTransport:   newTokenRoundTripper(up.kubernetesToken),
+		Timeout:         healthCheckTimeout,
 	}
 
-	kubernetesToken, err := getStringFromFile(ctx, cfg.KubernetesAPITokenPath)
-	if err != nil {
-		return nil, err
+	return k8s.NewForConfig(k8sRestConfig)
+}
+
+func getReadinessGates(readinessChecks []string) (map[healthCheckModel]struct{}, error) {
+	readinessGates := make(map[healthCheckModel]struct{})
+	if len(readinessChecks) == 0 {
+		for _, model := range defaultReadinessChecks {
+			readinessGates[model] = struct{}{}
+		}
+
+		return readinessGates, nil
 	}
 
-	k8sRestConfig := &k8sclientrest.Config{
-		Host:            kubernetesAPIUrl.String(),
-		BearerToken:     kubernetesToken,
-		TLSClientConfig: k8sTLSConfig,
+	for _, s := range readinessChecks {
+		model, err := getHealthCheck(s)
+		if err != nil {
+			return nil, err
+		}
+
+		readinessGates[model] = struct{}{}
 	}
 
-	k8sClient, err := k8s.NewForConfig(k8sRestConfig)
+	return readinessGates, nil
+}
+
+// getImpersonateResources returns the resources impersonated by the proxy, the uid and the user extras are only
+// required when they are configured
+func getImpersonateResources(cfg *config) ([]impersonateResource, error) {
+	resources := []impersonateResource{
+		{apiGroup: "", resource: "users"},
+		{apiGroup: "", resource: "groups"},
+		{apiGroup: "", resource: "serviceaccounts"},
+	}
+
+	if cfg.ImpersonateUID {
+		resources = append(resources, impersonateResource{apiGroup: "authentication.k8s.io", resource: "uids"})
+	}
+
+	extras, err := newImpersonateExtras(cfg.ImpersonateExtraClaims)
 	if err != nil {
 		return nil, err
 	}
 
-	healthClient := &health{
-		k8sClient:         k8sClient,
-		livenessValidator: livenessValidator,
+	for _, extra := range extras {
+		resources = append(resources, impersonateResource{apiGroup: "authentication.k8s.io", resource: fmt.Sprintf("userextras/%s", extra.key)})
 	}
 
-	return healthClient, nil
+	return resources, nil
+}
+
+func getHealthCheckName(model healthCheckModel) string {
+	return strings.ToLower(string(model))
 }
 
-func (h *health) ready(ctx context.Context) (bool, error) {
-	ready := false
+func newUpstreamHealthChecks(name string, k8sClient k8s.Interface, impersonateResources []impersonateResource) []healthCheck {
+	return []healthCheck{
+		{
+			name:  fmt.Sprintf("%s/%s", getHealthCheckName(upstreamHealthCheck), name),
+			model: upstreamHealthCheck,
+			check: func(ctx context.Context) error {
+				return upstreamReachable(ctx, k8sClient)
+			},
+		},
+		{
+			name:  fmt.Sprintf("%s/%s", getHealthCheckName(impersonationHealthCheck), name),
+			model: impersonationHealthCheck,
+			check: func(ctx context.Context) error {
+				return upstreamReady(ctx, k8sClient, impersonateResources)
+			},
+		},
+	}
+}
+
+// ready runs the readiness checks, the proxy is ready when all the checks gating readiness pass. The checks not gating
+// readiness (like the JWKS check calling Azure AD) are only run when verbose is true, to not run them on every probe.
+func (h *health) ready(ctx context.Context, verbose bool) healthReport {
+	isGating := func(check healthCheck) bool {
+		_, ok := h.readinessGates[check.model]
+		return ok
+	}
+
+	checks := h.readinessChecks
+	if !verbose {
+		checks = []healthCheck{}
+		for _, check := range h.readinessChecks {
+			if isGating(check) {
+				checks = append(checks, check)
+			}
+		}
+	}
+
+	return runHealthChecks(ctx, checks, isGating)
+}
+
+// live runs the liveness checks, all of them need to pass
+func (h *health) live(ctx context.Context) healthReport {
+	return runHealthChecks(ctx, h.livenessChecks, func(_ healthCheck) bool {
+		return true
+	})
+}
 
+// runHealthChecks runs the checks concurrently, the results are returned in the same order as the checks
+func runHealthChecks(ctx context.Context, checks []healthCheck, isGating func(check healthCheck) bool) healthReport {
+	results := make([]healthCheckResult, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			result := healthCheckResult{
+				Name:   check.name,
+				Status: "ok",
+				Gating: isGating(check),
+			}
+
+			err := check.check(checkCtx)
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+				result.err = err
+			}
+
+			results[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := healthReport{
+		Status: "ok",
+		Checks: results,
+	}
+
+	for _, result := range results {
+		if result.Gating && result.err != nil {
+			report.Status = "error"
+		}
+	}
+
+	return report
+}
+
+func (report healthReport) ok() bool {
+	return report.Status == "ok"
+}
+
+// upstreamReachable requests the version of the upstream. Discovery().ServerVersion() doesn't use the context, so the
+// request is made using the rest client of the discovery client (the fake clients don't have one).
+func upstreamReachable(ctx context.Context, k8sClient k8s.Interface) error {
+	restClient := k8sClient.Discovery().RESTClient()
+	if restClient == nil {
+		_, err := k8sClient.Discovery().ServerVersion()
+		return err
+	}
+
+	return restClient.Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// upstreamReady checks that the proxy is allowed to impersonate the resources in the upstream
+func upstreamReady(ctx context.Context, k8sClient k8s.Interface, impersonateResources []impersonateResource) error {
 	selfSubjectRulesReview := &k8sapiauthorization.SelfSubjectRulesReview{Spec: k8sapiauthorization.SelfSubjectRulesReviewSpec{Namespace: "default"}}
 	createOptions := k8sapimachinerymetav1.CreateOptions{}
-	res, err := h.k8sClient.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, selfSubjectRulesReview, createOptions)
+	res, err := k8sClient.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, selfSubjectRulesReview, createOptions)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	for _, rule := range res.Status.ResourceRules {
-		if sliceContains(rule.Verbs, "impersonate") {
-			if sliceContains(rule.Resources, "users") && sliceContains(rule.Resources, "groups") && sliceContains(rule.Resources, "serviceaccounts") {
-				ready = true
-			}
+	missing := []string{}
+	for _, required := range impersonateResources {
+		if !impersonateAllowed(res.Status.ResourceRules, required) {
+			missing = append(missing, required.resource)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Impersonate rule not found for: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// impersonateAllowed checks if any of the rules allows impersonating the resource, using the same wildcards as RBAC
+func impersonateAllowed(rules []k8sapiauthorization.ResourceRule, required impersonateResource) bool {
+	for _, rule := range rules {
+		if !sliceContains(rule.Verbs, "impersonate") && !sliceContains(rule.Verbs, "*") {
+			continue
+		}
+
+		if !sliceContains(rule.APIGroups, required.apiGroup) && !sliceContains(rule.APIGroups, "*") {
+			continue
+		}
+
+		if sliceContains(rule.Resources, required.resource) || sliceContains(rule.Resources, "*") {
+			return true
+		}
+
+		resource, _, isSubresource := strings.Cut(required.resource, "/")
+		if isSubresource && sliceContains(rule.Resources, fmt.Sprintf("%s/*", resource)) {
+			return true
 		}
 	}
 
-	if !ready {
-		err := fmt.Errorf("Impersonate rule not found: %q", res)
-		return false, err
+	return false
+}
+
+// newGroupSyncHealthCheck returns a check that fails when the groups haven't been synchronized within maxAge
+func newGroupSyncHealthCheck(lastGroupSync func() time.Time, maxAge time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		lastSync := lastGroupSync()
+		if lastSync.IsZero() {
+			return fmt.Errorf("groups haven't been synchronized")
+		}
+
+		age := time.Since(lastSync)
+		if age > maxAge {
+			return fmt.Errorf("groups last synchronized %s ago, more than %s", age.Round(time.Second), maxAge)
+		}
+
+		return nil
 	}
+}
 
-	return true, nil
+// jwksHealthChecker verifies that the signing keys of the Azure AD tokens can be downloaded, using the OpenID Connect
+// discovery document of the issuer the same way the OIDC handler does
+type jwksHealthChecker struct {
+	httpClient *http.Client
+	issuer     string
 }
 
-func (h *health) live(ctx context.Context) (bool, error) {
-	valid := h.livenessValidator.valid(ctx)
-	return valid, nil
+func (c *jwksHealthChecker) check(ctx context.Context) error {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+
+	err := c.getJSON(ctx, fmt.Sprintf("%s/.well-known/openid-configuration", strings.TrimSuffix(c.issuer, "/")), &discovery)
+	if err != nil {
+		return err
+	}
+
+	if discovery.JWKSURI == "" {
+		return fmt.Errorf("jwks_uri missing in the discovery document of %s", c.issuer)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+
+	err = c.getJSON(ctx, discovery.JWKSURI, &jwks)
+	if err != nil {
+		return err
+	}
+
+	if len(jwks.Keys) == 0 {
+		return fmt.Errorf("no keys found in %s", discovery.JWKSURI)
+	}
+
+	return nil
+}
+
+func (c *jwksHealthChecker) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from %s: %d", url, res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("unable to decode response from %s: %w", url, err)
+	}
+
+	return nil
 }
@@ -2,10 +2,16 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/stretchr/testify/require"
@@ -18,66 +24,171 @@ import (
 func TestNewHealthClient(t *testing.T) {
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
-	tmpDir, err := os.MkdirTemp("", "")
+	kubernetesURL, err := url.Parse("https://fake-url:443")
+	require.NoError(t, err)
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
 	require.NoError(t, err)
-	defer os.RemoveAll(tmpDir)
-	tokenPath := filepath.Clean(fmt.Sprintf("%s/kubernetes-token", tmpDir))
-	caPath := filepath.Clean(fmt.Sprintf("%s/kubernetes-ca", tmpDir))
-	testCreateTemporaryFile(t, tokenPath, "fake-token")
-	testCreateTemporaryFile(t, caPath, "fake-ca-string")
 
 	cases := []struct {
-		config              *config
+		testDescription     string
+		cfg                 *config
+		upstreams           []*upstream
+		expectedChecks      []string
+		expectedGates       []healthCheckModel
 		expectedErrContains string
 	}{
 		{
-			config: &config{
-				KubernetesAPITLS:          true,
-				KubernetesAPIValidateCert: true,
-				KubernetesAPIHost:         "fake-url",
-				KubernetesAPITokenPath:    tokenPath,
-				KubernetesAPICACertPath:   caPath,
+			testDescription: "invalid ca",
+			cfg:             &config{},
+			upstreams: []*upstream{
+				{
+					name:                   defaultUpstreamName,
+					kubernetesURL:          kubernetesURL,
+					kubernetesValidateCert: true,
+					kubernetesRootCAData:   []byte("fake-ca-string"),
+					kubernetesToken:        staticTokenSource("fake-token"),
+				},
 			},
 			expectedErrContains: "unable to load root certificates: unable to parse bytes as PEM block",
 		},
 		{
-			config: &config{
-				KubernetesAPITLS:          true,
-				KubernetesAPIValidateCert: false,
-				KubernetesAPIHost:         "fake-url",
-				KubernetesAPITokenPath:    tokenPath,
+			testDescription:     "unknown readiness check",
+			cfg:                 &config{ReadinessChecks: []string{"UPSTREAM", "DUMMY"}},
+			expectedErrContains: "Unknown health check 'DUMMY'",
+		},
+		{
+			testDescription:     "invalid impersonate extra",
+			cfg:                 &config{ImpersonateExtraClaims: []string{"dummy"}},
+			expectedErrContains: "unknown claim \"dummy\"",
+		},
+		{
+			testDescription: "default readiness checks",
+			cfg:             &config{},
+			upstreams: []*upstream{
+				{
+					name:                   defaultUpstreamName,
+					kubernetesURL:          kubernetesURL,
+					kubernetesValidateCert: false,
+					kubernetesToken:        staticTokenSource("fake-token"),
+				},
+				{
+					name:                   "other",
+					kubernetesURL:          kubernetesURL,
+					kubernetesValidateCert: false,
+					kubernetesToken:        staticTokenSource("fake-token"),
+				},
+			},
+			expectedChecks: []string{"upstream/default", "impersonation/default", "upstream/other", "impersonation/other", "graph", "group_sync", "jwks", "cache"},
+			expectedGates:  []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck, cacheHealthCheck},
+		},
+		{
+			testDescription: "configured readiness checks",
+			cfg:             &config{ReadinessChecks: []string{"GRAPH", "GROUP_SYNC", "JWKS"}},
+			upstreams: []*upstream{
+				{
+					name:                   defaultUpstreamName,
+					kubernetesURL:          kubernetesURL,
+					kubernetesValidateCert: false,
+					kubernetesToken:        staticTokenSource("fake-token"),
+				},
 			},
-			expectedErrContains: "",
+			expectedChecks: []string{"upstream/default", "impersonation/default", "graph", "group_sync", "jwks", "cache"},
+			expectedGates:  []healthCheckModel{graphHealthCheck, groupSyncHealthCheck, jwksHealthCheck},
 		},
 	}
 
 	for _, c := range cases {
-		validator := &testFakeValidator{t}
-		_, err := newHealthClient(ctx, c.config, validator)
-		if c.expectedErrContains != "" {
-			require.ErrorContains(t, err, c.expectedErrContains)
-			continue
-		}
+		t.Run(c.testDescription, func(t *testing.T) {
+			client, err := newHealthClient(ctx, c.cfg, c.upstreams, &testFakeAzureClient{t: t}, memCacheClient)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
 
-		require.NoError(t, err)
+			checkNames := []string{}
+			for _, check := range client.readinessChecks {
+				checkNames = append(checkNames, check.name)
+			}
+			require.Equal(t, c.expectedChecks, checkNames)
+
+			require.Len(t, client.readinessGates, len(c.expectedGates))
+			for _, model := range c.expectedGates {
+				require.Contains(t, client.readinessGates, model)
+			}
+		})
+	}
+}
+
+func TestGetImpersonateResources(t *testing.T) {
+	cases := []struct {
+		testDescription   string
+		cfg               *config
+		expectedResources []impersonateResource
+	}{
+		{
+			testDescription: "users, groups and service accounts",
+			cfg:             &config{},
+			expectedResources: []impersonateResource{
+				{apiGroup: "", resource: "users"},
+				{apiGroup: "", resource: "groups"},
+				{apiGroup: "", resource: "serviceaccounts"},
+			},
+		},
+		{
+			testDescription: "uids and user extras",
+			cfg: &config{
+				ImpersonateUID:         true,
+				ImpersonateExtraClaims: []string{"tid", "ip=client-ip"},
+			},
+			expectedResources: []impersonateResource{
+				{apiGroup: "", resource: "users"},
+				{apiGroup: "", resource: "groups"},
+				{apiGroup: "", resource: "serviceaccounts"},
+				{apiGroup: "authentication.k8s.io", resource: "uids"},
+				{apiGroup: "authentication.k8s.io", resource: "userextras/tid"},
+				{apiGroup: "authentication.k8s.io", resource: "userextras/ip"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			resources, err := getImpersonateResources(c.cfg)
+			require.NoError(t, err)
+			require.Equal(t, c.expectedResources, resources)
+		})
 	}
 }
 
 func TestReady(t *testing.T) {
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
-	fakeClient := &health{
-		k8sClient: k8sfake.NewSimpleClientset(),
+	impersonateResources := []impersonateResource{
+		{apiGroup: "", resource: "users"},
+		{apiGroup: "", resource: "groups"},
+		{apiGroup: "", resource: "serviceaccounts"},
+		{apiGroup: "authentication.k8s.io", resource: "uids"},
+		{apiGroup: "authentication.k8s.io", resource: "userextras/tid"},
 	}
 
-	fakeClient.k8sClient.(*k8sfake.Clientset).Fake.PrependReactor("create", "selfsubjectrulesreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+	fakeK8sClient := k8sfake.NewSimpleClientset()
+	fakeK8sClient.Fake.PrependReactor("create", "selfsubjectrulesreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
 		object := &k8sapiauthorization.SelfSubjectRulesReview{
 			Status: k8sapiauthorization.SubjectRulesReviewStatus{
 				ResourceRules: []k8sapiauthorization.ResourceRule{
 					{
 						Verbs:     []string{"impersonate"},
+						APIGroups: []string{""},
 						Resources: []string{"users", "groups", "serviceaccounts"},
 					},
+					{
+						Verbs:     []string{"impersonate"},
+						APIGroups: []string{"authentication.k8s.io"},
+						Resources: []string{"uids", "userextras/tid"},
+					},
 				},
 			},
 		}
@@ -85,78 +196,334 @@ func TestReady(t *testing.T) {
 	})
 
 	cases := []struct {
-		clientFunc          func(h *health) Health
-		expectedErrContains string
-		expectedReady       bool
+		testDescription string
+		checks          []healthCheck
+		gates           []healthCheckModel
+		expectedResults map[string]string
+		expectedReady   bool
 	}{
 		{
-			clientFunc: func(h *health) Health {
-				return h
-			},
-			expectedErrContains: "",
-			expectedReady:       true,
+			testDescription: "impersonation allowed",
+			checks:          newUpstreamHealthChecks(defaultUpstreamName, fakeK8sClient, impersonateResources),
+			gates:           []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck},
+			expectedResults: map[string]string{"upstream/default": "", "impersonation/default": ""},
+			expectedReady:   true,
 		},
 		{
-			clientFunc: func(h *health) Health {
-				return &health{
-					k8sClient: k8sfake.NewSimpleClientset(),
+			testDescription: "impersonation not allowed",
+			checks:          newUpstreamHealthChecks(defaultUpstreamName, k8sfake.NewSimpleClientset(), impersonateResources),
+			gates:           []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck},
+			expectedResults: map[string]string{"upstream/default": "", "impersonation/default": "Impersonate rule not found for: users, groups, serviceaccounts, uids, userextras/tid"},
+			expectedReady:   false,
+		},
+		{
+			testDescription: "impersonation not allowed in one upstream",
+			checks: append(
+				newUpstreamHealthChecks(defaultUpstreamName, fakeK8sClient, impersonateResources),
+				newUpstreamHealthChecks("other", k8sfake.NewSimpleClientset(), impersonateResources)...,
+			),
+			gates:           []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck},
+			expectedResults: map[string]string{"upstream/default": "", "impersonation/default": "", "upstream/other": "", "impersonation/other": "Impersonate rule not found"},
+			expectedReady:   false,
+		},
+		{
+			testDescription: "failing check not gating readiness",
+			checks: append(
+				newUpstreamHealthChecks(defaultUpstreamName, fakeK8sClient, impersonateResources),
+				healthCheck{name: "graph", model: graphHealthCheck, check: func(ctx context.Context) error { return errors.New("fake graph error") }},
+			),
+			gates:           []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck},
+			expectedResults: map[string]string{"upstream/default": "", "impersonation/default": "", "graph": "fake graph error"},
+			expectedReady:   true,
+		},
+		{
+			testDescription: "failing check gating readiness",
+			checks: append(
+				newUpstreamHealthChecks(defaultUpstreamName, fakeK8sClient, impersonateResources),
+				healthCheck{name: "graph", model: graphHealthCheck, check: func(ctx context.Context) error { return errors.New("fake graph error") }},
+			),
+			gates:           []healthCheckModel{upstreamHealthCheck, impersonationHealthCheck, graphHealthCheck},
+			expectedResults: map[string]string{"upstream/default": "", "impersonation/default": "", "graph": "fake graph error"},
+			expectedReady:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			gates := make(map[healthCheckModel]struct{})
+			for _, model := range c.gates {
+				gates[model] = struct{}{}
+			}
+
+			client := &health{
+				readinessChecks: c.checks,
+				readinessGates:  gates,
+			}
+
+			report := client.ready(ctx, true)
+			require.Equal(t, c.expectedReady, report.ok())
+			require.Len(t, report.Checks, len(c.expectedResults))
+
+			for i, result := range report.Checks {
+				require.Equal(t, c.checks[i].name, result.Name)
+
+				expectedErrContains := c.expectedResults[result.Name]
+				if expectedErrContains != "" {
+					require.Equal(t, "error", result.Status)
+					require.ErrorContains(t, result.err, expectedErrContains)
+					continue
 				}
-			},
-			expectedErrContains: "Impersonate rule not found",
-			expectedReady:       false,
+
+				require.Equal(t, "ok", result.Status)
+				require.NoError(t, result.err)
+			}
+
+			// Only the checks gating readiness are run without verbose
+			report = client.ready(ctx, false)
+			require.Equal(t, c.expectedReady, report.ok())
+			for _, result := range report.Checks {
+				require.True(t, result.Gating, result.Name)
+			}
+		})
+	}
+}
+
+func TestImpersonateAllowed(t *testing.T) {
+	cases := []struct {
+		testDescription string
+		rule            k8sapiauthorization.ResourceRule
+		required        impersonateResource
+		expectedAllowed bool
+	}{
+		{
+			testDescription: "exact",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"impersonate"}, APIGroups: []string{""}, Resources: []string{"users"}},
+			required:        impersonateResource{apiGroup: "", resource: "users"},
+			expectedAllowed: true,
+		},
+		{
+			testDescription: "wrong verb",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"users"}},
+			required:        impersonateResource{apiGroup: "", resource: "users"},
+			expectedAllowed: false,
+		},
+		{
+			testDescription: "wrong api group",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"impersonate"}, APIGroups: []string{""}, Resources: []string{"uids"}},
+			required:        impersonateResource{apiGroup: "authentication.k8s.io", resource: "uids"},
+			expectedAllowed: false,
+		},
+		{
+			testDescription: "wildcards",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			required:        impersonateResource{apiGroup: "authentication.k8s.io", resource: "uids"},
+			expectedAllowed: true,
+		},
+		{
+			testDescription: "user extras wildcard",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"impersonate"}, APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"userextras/*"}},
+			required:        impersonateResource{apiGroup: "authentication.k8s.io", resource: "userextras/tid"},
+			expectedAllowed: true,
+		},
+		{
+			testDescription: "other user extra",
+			rule:            k8sapiauthorization.ResourceRule{Verbs: []string{"impersonate"}, APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"userextras/scopes"}},
+			required:        impersonateResource{apiGroup: "authentication.k8s.io", resource: "userextras/tid"},
+			expectedAllowed: false,
 		},
 	}
 
 	for _, c := range cases {
-		client := c.clientFunc(fakeClient)
+		t.Run(c.testDescription, func(t *testing.T) {
+			allowed := impersonateAllowed([]k8sapiauthorization.ResourceRule{c.rule}, c.required)
+			require.Equal(t, c.expectedAllowed, allowed)
+		})
+	}
+}
 
-		ready, err := client.ready(ctx)
-		if c.expectedErrContains != "" {
-			require.ErrorContains(t, err, c.expectedErrContains)
-			continue
-		}
+func TestGroupSyncHealthCheck(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cases := []struct {
+		testDescription     string
+		lastSync            time.Time
+		expectedErrContains string
+	}{
+		{
+			testDescription:     "never synchronized",
+			lastSync:            time.Time{},
+			expectedErrContains: "groups haven't been synchronized",
+		},
+		{
+			testDescription:     "stale",
+			lastSync:            time.Now().Add(-11 * time.Minute),
+			expectedErrContains: "more than 10m0s",
+		},
+		{
+			testDescription: "fresh",
+			lastSync:        time.Now().Add(-1 * time.Minute),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			check := newGroupSyncHealthCheck(func() time.Time { return c.lastSync }, 10*time.Minute)
+			err := check(ctx)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
 
-		require.NoError(t, err)
-		require.Equal(t, c.expectedReady, ready)
+			require.NoError(t, err)
+		})
 	}
 }
 
+func TestJWKSHealthChecker(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cases := []struct {
+		testDescription     string
+		discovery           string
+		keys                string
+		expectedErrContains string
+	}{
+		{
+			testDescription: "keys",
+			discovery:       `{"jwks_uri":"{{ .URL }}/keys"}`,
+			keys:            `{"keys":[{"kid":"ze-kid"}]}`,
+		},
+		{
+			testDescription:     "no keys",
+			discovery:           `{"jwks_uri":"{{ .URL }}/keys"}`,
+			keys:                `{"keys":[]}`,
+			expectedErrContains: "no keys found",
+		},
+		{
+			testDescription:     "jwks_uri missing",
+			discovery:           `{}`,
+			expectedErrContains: "jwks_uri missing",
+		},
+		{
+			testDescription:     "invalid discovery document",
+			discovery:           `not-json`,
+			expectedErrContains: "unable to decode response",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			mux.HandleFunc("/ze-tenant/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, strings.ReplaceAll(c.discovery, "{{ .URL }}", server.URL))
+			})
+			mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, c.keys)
+			})
+
+			checker := &jwksHealthChecker{
+				httpClient: server.Client(),
+				issuer:     fmt.Sprintf("%s/ze-tenant/v2.0", server.URL),
+			}
+
+			err := checker.check(ctx)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+
+	checker := &jwksHealthChecker{
+		httpClient: http.DefaultClient,
+		issuer:     "http://127.0.0.1:0/ze-tenant/v2.0",
+	}
+	require.Error(t, checker.check(ctx))
+}
+
+func TestUpstreamReachable(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var hang atomic.Bool
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/version", r.URL.Path)
+		if hang.Load() {
+			<-r.Context().Done()
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major": "1", "minor": "27", "gitVersion": "v1.27.2"}`))
+	}))
+	defer fakeAPIServer.Close()
+
+	kubernetesURL, err := url.Parse(fakeAPIServer.URL)
+	require.NoError(t, err)
+
+	k8sClient, err := newUpstreamKubernetesClient(&upstream{
+		name:            defaultUpstreamName,
+		kubernetesURL:   kubernetesURL,
+		kubernetesToken: staticTokenSource("ze-token"),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, upstreamReachable(ctx, k8sClient))
+
+	// A hanging upstream doesn't block the check past the deadline of the context
+	hang.Store(true)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	require.Error(t, upstreamReachable(timeoutCtx, k8sClient))
+	require.Less(t, time.Since(start), healthCheckTimeout)
+}
+
 func TestLive(t *testing.T) {
 	ctx := logr.NewContext(context.Background(), logr.Discard())
 
-	tmpDir, err := os.MkdirTemp("", "")
+	kubernetesURL, err := url.Parse("https://fake-url:443")
 	require.NoError(t, err)
-	defer os.RemoveAll(tmpDir)
-	tokenPath := filepath.Clean(fmt.Sprintf("%s/kubernetes-token", tmpDir))
-	caPath := filepath.Clean(fmt.Sprintf("%s/kubernetes-ca", tmpDir))
-	testCreateTemporaryFile(t, tokenPath, "fake-token")
-	testCreateTemporaryFile(t, caPath, "fake-ca-string")
-
-	validator := &testFakeValidator{t}
-	fakeConfig := &config{
-		KubernetesAPIValidateCert: false,
-		KubernetesAPITLS:          true,
-		KubernetesAPIHost:         "fake-url",
-		KubernetesAPITokenPath:    tokenPath,
-		KubernetesAPICACertPath:   caPath,
-	}
-	client, err := newHealthClient(ctx, fakeConfig, validator)
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
 	require.NoError(t, err)
 
-	live, err := client.live(ctx)
+	upstreams := []*upstream{
+		{
+			name:            defaultUpstreamName,
+			kubernetesURL:   kubernetesURL,
+			kubernetesToken: staticTokenSource("fake-token"),
+		},
+	}
+	client, err := newHealthClient(ctx, &config{}, upstreams, &testFakeAzureClient{t: t}, memCacheClient)
 	require.NoError(t, err)
-	require.True(t, live)
-}
 
-type testFakeValidator struct {
-	t *testing.T
+	report := client.live(ctx)
+	require.True(t, report.ok())
+	require.Equal(t, []healthCheckResult{{Name: "graph_token", Status: "ok", Gating: true}}, report.Checks)
 }
 
-// Valid ...
-func (client *testFakeValidator) valid(ctx context.Context) bool {
-	client.t.Helper()
+// testRunHealthChecks runs the readiness checks of a kind and returns the first error
+func testRunHealthChecks(t *testing.T, ctx context.Context, client *health, model healthCheckModel) error {
+	t.Helper()
+
+	for _, check := range client.readinessChecks {
+		if check.model != model {
+			continue
+		}
+
+		err := check.check(ctx)
+		if err != nil {
+			return err
+		}
+	}
 
-	return true
+	return nil
 }
 
 func testCreateTemporaryFile(t *testing.T, path string, content string) {
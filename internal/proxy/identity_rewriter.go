@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultImpersonateUserTemplate = "{{ .Username }}"
+	nameGroupTemplate              = "{{ .Name }}"
+	objectIDGroupTemplate          = "{{ .ObjectID }}"
+)
+
+// errEmptyImpersonateUser is returned when the user template renders an empty username for a user, the request is
+// denied instead of being forwarded without an impersonated user
+var errEmptyImpersonateUser = errors.New("impersonate user template renders an empty username")
+
+var identityTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimSpace":  strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// identityRewriter renders the values of the Impersonate-User and Impersonate-Group headers using Go templates.
+// The user template is executed with the userModel and every group template is executed once per groupModel, making
+// it possible to emit more than one value per group (for example both the name and the object id).
+type identityRewriter struct {
+	userTemplate   *template.Template
+	groupTemplates []*template.Template
+}
+
+func newIdentityRewriter(cfg *config) (*identityRewriter, error) {
+	userTemplateString := cfg.ImpersonateUserTemplate
+	if userTemplateString == "" {
+		userTemplateString = defaultImpersonateUserTemplate
+	}
+
+	groupTemplateStrings := cfg.ImpersonateGroupTemplates
+	if len(groupTemplateStrings) == 0 {
+		groupIdentifier, err := getGroupIdentifier(cfg.GroupIdentifier)
+		if err != nil {
+			return nil, err
+		}
+
+		switch groupIdentifier {
+		case nameGroupIdentifier:
+			groupTemplateStrings = []string{nameGroupTemplate}
+		case objectIDGroupIdentifier:
+			groupTemplateStrings = []string{objectIDGroupTemplate}
+		}
+	}
+
+	userTemplate, err := parseIdentityTemplate("impersonate-user", userTemplateString)
+	if err != nil {
+		return nil, err
+	}
+
+	groupTemplates := []*template.Template{}
+	for i, groupTemplateString := range groupTemplateStrings {
+		groupTemplate, err := parseIdentityTemplate(fmt.Sprintf("impersonate-group-%d", i), groupTemplateString)
+		if err != nil {
+			return nil, err
+		}
+		groupTemplates = append(groupTemplates, groupTemplate)
+	}
+
+	rewriter := &identityRewriter{
+		userTemplate:   userTemplate,
+		groupTemplates: groupTemplates,
+	}
+
+	err = rewriter.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return rewriter, nil
+}
+
+// validate executes the templates with example data to catch errors (like unknown fields) during startup
+func (r *identityRewriter) validate() error {
+	exampleUser := userModel{
+		Username: "user@example.com",
+		ObjectID: "00000000-0000-0000-0000-000000000000",
+		Groups: []groupModel{
+			{
+				Name:     "example-group",
+				ObjectID: "00000000-0000-0000-0000-000000000001",
+			},
+		},
+		Type: normalUserModelType,
+	}
+
+	_, err := r.username(exampleUser)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.groups(exampleUser)
+	return err
+}
+
+// username returns errEmptyImpersonateUser if the template renders an empty username, the templates are only validated
+// with example data so it can still happen for a real user
+func (r *identityRewriter) username(user userModel) (string, error) {
+	username, err := executeIdentityTemplate(r.userTemplate, user)
+	if err != nil {
+		return "", err
+	}
+
+	if username == "" {
+		return "", fmt.Errorf("%w: %q", errEmptyImpersonateUser, r.userTemplate.Root.String())
+	}
+
+	return username, nil
+}
+
+// groups returns the unique, non-empty, values rendered by the group templates
+func (r *identityRewriter) groups(user userModel) ([]string, error) {
+	groups := []string{}
+	seen := make(map[string]struct{})
+
+	for _, group := range user.Groups {
+		for _, groupTemplate := range r.groupTemplates {
+			value, err := executeIdentityTemplate(groupTemplate, group)
+			if err != nil {
+				return nil, err
+			}
+
+			if value == "" {
+				continue
+			}
+
+			if _, ok := seen[value]; ok {
+				continue
+			}
+
+			seen[value] = struct{}{}
+			groups = append(groups, value)
+		}
+	}
+
+	return groups, nil
+}
+
+func parseIdentityTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(identityTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s template %q: %w", name, text, err)
+	}
+
+	return tmpl, nil
+}
+
+func executeIdentityTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("unable to execute %s template: %w", tmpl.Name(), err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIdentityRewriter(t *testing.T) {
+	cases := []struct {
+		testDescription     string
+		config              *config
+		expectedErrContains string
+	}{
+		{
+			testDescription: "default name group identifier",
+			config:          &config{GroupIdentifier: "NAME"},
+		},
+		{
+			testDescription: "default object id group identifier",
+			config:          &config{GroupIdentifier: "OBJECTID"},
+		},
+		{
+			testDescription:     "unknown group identifier",
+			config:              &config{GroupIdentifier: "FAKE"},
+			expectedErrContains: "Unknown group identifier 'FAKE'",
+		},
+		{
+			testDescription: "group templates ignore the group identifier",
+			config: &config{
+				GroupIdentifier:           "FAKE",
+				ImpersonateGroupTemplates: []string{"aad:{{ .Name | lower }}"},
+			},
+		},
+		{
+			testDescription: "invalid user template syntax",
+			config: &config{
+				GroupIdentifier:         "NAME",
+				ImpersonateUserTemplate: "{{ .Username",
+			},
+			expectedErrContains: "unable to parse impersonate-user template",
+		},
+		{
+			testDescription: "unknown user template field",
+			config: &config{
+				GroupIdentifier:         "NAME",
+				ImpersonateUserTemplate: "{{ .Email }}",
+			},
+			expectedErrContains: "unable to execute impersonate-user template",
+		},
+		{
+			testDescription: "empty username",
+			config: &config{
+				GroupIdentifier:         "NAME",
+				ImpersonateUserTemplate: "{{ if false }}{{ .Username }}{{ end }}",
+			},
+			expectedErrContains: "renders an empty username",
+		},
+		{
+			testDescription: "unknown group template function",
+			config: &config{
+				GroupIdentifier:           "NAME",
+				ImpersonateGroupTemplates: []string{"{{ .Name | title }}"},
+			},
+			expectedErrContains: "unable to parse impersonate-group-0 template",
+		},
+		{
+			testDescription: "unknown group template field",
+			config: &config{
+				GroupIdentifier:           "NAME",
+				ImpersonateGroupTemplates: []string{"{{ .Name }}", "{{ .Username }}"},
+			},
+			expectedErrContains: "unable to execute impersonate-group-1 template",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			_, err := newIdentityRewriter(c.config)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestIdentityRewriter(t *testing.T) {
+	user := userModel{
+		Username: "User@Example.com",
+		ObjectID: "00000000-0000-0000-0000-000000000000",
+		Groups: []groupModel{
+			{Name: "k8s-Admins", ObjectID: "00000000-0000-0000-0000-000000000001"},
+			{Name: "k8s-readers", ObjectID: "00000000-0000-0000-0000-000000000002"},
+			{Name: "K8S-ADMINS", ObjectID: "00000000-0000-0000-0000-000000000003"},
+		},
+		Type: normalUserModelType,
+	}
+
+	cases := []struct {
+		testDescription  string
+		config           *config
+		expectedUsername string
+		expectedGroups   []string
+	}{
+		{
+			testDescription:  "defaults using name",
+			config:           &config{GroupIdentifier: "NAME"},
+			expectedUsername: "User@Example.com",
+			expectedGroups:   []string{"k8s-Admins", "k8s-readers", "K8S-ADMINS"},
+		},
+		{
+			testDescription:  "defaults using object id",
+			config:           &config{GroupIdentifier: "OBJECTID"},
+			expectedUsername: "User@Example.com",
+			expectedGroups:   []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002", "00000000-0000-0000-0000-000000000003"},
+		},
+		{
+			testDescription: "prefixing, stripping and lowercasing (with duplicates removed)",
+			config: &config{
+				ImpersonateUserTemplate:   "aad:{{ .Username | lower }}",
+				ImpersonateGroupTemplates: []string{"aad:{{ .Name | lower | trimPrefix \"k8s-\" }}"},
+			},
+			expectedUsername: "aad:user@example.com",
+			expectedGroups:   []string{"aad:admins", "aad:readers"},
+		},
+		{
+			testDescription: "both name and object id",
+			config: &config{
+				ImpersonateUserTemplate:   "{{ .ObjectID }}",
+				ImpersonateGroupTemplates: []string{"{{ .Name }}", "{{ .ObjectID }}"},
+			},
+			expectedUsername: "00000000-0000-0000-0000-000000000000",
+			expectedGroups:   []string{"k8s-Admins", "00000000-0000-0000-0000-000000000001", "k8s-readers", "00000000-0000-0000-0000-000000000002", "K8S-ADMINS", "00000000-0000-0000-0000-000000000003"},
+		},
+		{
+			testDescription: "empty values are skipped",
+			config: &config{
+				ImpersonateGroupTemplates: []string{"{{ if ne .Name \"k8s-readers\" }}{{ .Name | upper | replace \"-\" \"_\" }}{{ end }}"},
+			},
+			expectedUsername: "User@Example.com",
+			expectedGroups:   []string{"K8S_ADMINS"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			rewriter, err := newIdentityRewriter(c.config)
+			require.NoError(t, err)
+
+			username, err := rewriter.username(user)
+			require.NoError(t, err)
+			require.Equal(t, c.expectedUsername, username)
+
+			groups, err := rewriter.groups(user)
+			require.NoError(t, err)
+			require.Equal(t, c.expectedGroups, groups)
+		})
+	}
+}
+
+func TestIdentityRewriterEmptyUsername(t *testing.T) {
+	// The template is valid for the example data, but renders an empty username for users without an email domain
+	rewriter, err := newIdentityRewriter(&config{
+		GroupIdentifier:         "NAME",
+		ImpersonateUserTemplate: "{{ if ne .Username (trimSuffix \"@example.com\" .Username) }}{{ .Username }}{{ end }}",
+	})
+	require.NoError(t, err)
+
+	username, err := rewriter.username(userModel{Username: "ze-user@example.com"})
+	require.NoError(t, err)
+	require.Equal(t, "ze-user@example.com", username)
+
+	_, err = rewriter.username(userModel{Username: "ze-user"})
+	require.ErrorIs(t, err, errEmptyImpersonateUser)
+}
+
+func TestProxyHandlerIdentityRewriting(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var receivedHeaders http.Header
+	fakeBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeBackend.Close()
+
+	kubernetesAPITokenPath, cleanupFn := testGetKubernetesAPITokenPath(t)
+	defer cleanupFn()
+
+	cfg := &config{
+		AzureADMaxGroupCount:      testFakeMaxGroups,
+		ImpersonateUserTemplate:   "aad:{{ .Username }}",
+		ImpersonateGroupTemplates: []string{"aad:{{ .Name | trimPrefix \"k8s-\" }}", "{{ .ObjectID }}"},
+		KubernetesAPITokenPath:    kubernetesAPITokenPath,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "", []groupModel{{Name: "k8s-admins", ObjectID: "ze-group-id"}}, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, testNewUpstream(t, fakeBackend.URL))(rr, testNewClaimsRequest(t, http.MethodGet, "/", testNewExternalClaims(t, "ze-sub", "ze-username", nil)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Equal(t, []string{"aad:ze-username"}, receivedHeaders.Values(impersonateUserHeader))
+	require.Equal(t, []string{"aad:admins", "ze-group-id"}, receivedHeaders.Values(impersonateGroupHeader))
+
+	// The request is denied when the user template renders an empty username
+	cfg.ImpersonateUserTemplate = "{{ if ne .Username \"ze-username\" }}{{ .Username }}{{ end }}"
+	proxyHandlers, err = newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	receivedHeaders = nil
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, testNewUpstream(t, fakeBackend.URL))(rr, testNewClaimsRequest(t, http.MethodGet, "/", testNewExternalClaims(t, "ze-sub", "ze-username", nil)))
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Nil(t, receivedHeaders)
+}
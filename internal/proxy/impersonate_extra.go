@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	clientIPExtraSource     = "client-ip"
+	forwardedForExtraSource = "forwarded-for"
+)
+
+// impersonateExtra maps a token claim (by its json name) or a request property to an Impersonate-Extra-<key> header
+type impersonateExtra struct {
+	key    string
+	source string
+}
+
+type impersonateExtras []impersonateExtra
+
+func newImpersonateExtras(mappings []string) (impersonateExtras, error) {
+	knownClaims := getExternalAzureADClaimNames()
+
+	extras := impersonateExtras{}
+	seenKeys := make(map[string]struct{})
+	for _, mapping := range mappings {
+		key, source, found := strings.Cut(mapping, "=")
+		if !found {
+			source = key
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		source = strings.TrimSpace(source)
+
+		if key == "" || source == "" {
+			return nil, fmt.Errorf("invalid impersonate extra mapping %q, expected <key>=<claim> or <claim>", mapping)
+		}
+
+		_, isClaim := knownClaims[source]
+		if !isClaim && source != clientIPExtraSource && source != forwardedForExtraSource {
+			return nil, fmt.Errorf("unknown claim %q in impersonate extra mapping %q. Supported claims are: %s, %s or %s", source, mapping, strings.Join(sortedKeys(knownClaims), ", "), clientIPExtraSource, forwardedForExtraSource)
+		}
+
+		if _, ok := seenKeys[key]; ok {
+			return nil, fmt.Errorf("duplicate impersonate extra key %q", key)
+		}
+		seenKeys[key] = struct{}{}
+
+		extras = append(extras, impersonateExtra{
+			key:    key,
+			source: source,
+		})
+	}
+
+	return extras, nil
+}
+
+// headers returns the Impersonate-Extra-<key> headers. Claims that are missing from the token are skipped.
+func (e impersonateExtras) headers(claims *externalAzureADClaims, r *http.Request) (http.Header, error) {
+	headers := http.Header{}
+	if len(e) == 0 {
+		return headers, nil
+	}
+
+	claimValues := map[string]interface{}{}
+	if claims != nil {
+		b, err := json.Marshal(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(b, &claimValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, extra := range e {
+		values := []string{}
+
+		switch extra.source {
+		case clientIPExtraSource:
+			values = append(values, getClientIP(r))
+		case forwardedForExtraSource:
+			values = append(values, r.Header.Values("X-Forwarded-For")...)
+		default:
+			values = append(values, claimToStrings(claimValues[extra.source])...)
+		}
+
+		headerName := impersonateUserExtraHeaderPrefix + url.PathEscape(extra.key)
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			headers.Add(headerName, value)
+		}
+	}
+
+	return headers, nil
+}
+
+func claimToStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		// Space separated claims (like scp) are sent as multiple values
+		return strings.Fields(v)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, claimToStrings(item)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func getExternalAzureADClaimNames() map[string]struct{} {
+	names := make(map[string]struct{})
+	claimsType := reflect.TypeOf(externalAzureADClaims{})
+	for i := 0; i < claimsType.NumField(); i++ {
+		name, _, _ := strings.Cut(claimsType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = struct{}{}
+		}
+	}
+
+	return names
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
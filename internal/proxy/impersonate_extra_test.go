@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewImpersonateExtras(t *testing.T) {
+	cases := []struct {
+		mappings              []string
+		expectedExtras        impersonateExtras
+		expectedErrorContains string
+	}{
+		{
+			mappings:       nil,
+			expectedExtras: impersonateExtras{},
+		},
+		{
+			mappings: []string{"tid", "Tenant-Object-ID=oid", "client-ip"},
+			expectedExtras: impersonateExtras{
+				{key: "tid", source: "tid"},
+				{key: "tenant-object-id", source: "oid"},
+				{key: "client-ip", source: "client-ip"},
+			},
+		},
+		{
+			mappings:              []string{"fake=does-not-exist"},
+			expectedErrorContains: "unknown claim \"does-not-exist\"",
+		},
+		{
+			mappings:              []string{"=tid"},
+			expectedErrorContains: "invalid impersonate extra mapping",
+		},
+		{
+			mappings:              []string{"tid", "tid=oid"},
+			expectedErrorContains: "duplicate impersonate extra key \"tid\"",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		extras, err := newImpersonateExtras(c.mappings)
+		if c.expectedErrorContains != "" {
+			require.ErrorContains(t, err, c.expectedErrorContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedExtras, extras)
+	}
+}
+
+func TestImpersonateExtrasHeaders(t *testing.T) {
+	extras, err := newImpersonateExtras([]string{"tid", "scp", "amr", "azp", "auth/time=iat", "client-ip", "forwarded-for", "groups"})
+	require.NoError(t, err)
+
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+	claims.TenantId = testToPtr(t, "ze-tenant-id")
+	claims.Scope = testToPtr(t, "user_impersonation other_scope")
+	claims.Amr = testToPtr(t, []string{"pwd", "mfa"})
+	claims.Azp = testToPtr(t, "ze-client-id")
+	claims.IssuedAt = testToPtr(t, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Add("X-Forwarded-For", "192.168.0.1")
+
+	headers, err := extras.headers(&claims, req)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"ze-tenant-id"}, headers.Values("Impersonate-Extra-Tid"))
+	require.Equal(t, []string{"user_impersonation", "other_scope"}, headers.Values("Impersonate-Extra-Scp"))
+	require.Equal(t, []string{"pwd", "mfa"}, headers.Values("Impersonate-Extra-Amr"))
+	require.Equal(t, []string{"ze-client-id"}, headers.Values("Impersonate-Extra-Azp"))
+	require.Equal(t, []string{"2023-06-01T12:00:00Z"}, headers.Values("Impersonate-Extra-Auth%2Ftime"))
+	require.Equal(t, []string{"10.0.0.1"}, headers.Values("Impersonate-Extra-Client-Ip"))
+	require.Equal(t, []string{"192.168.0.1"}, headers.Values("Impersonate-Extra-Forwarded-For"))
+
+	// Claims missing from the token are not sent
+	require.Empty(t, headers.Values("Impersonate-Extra-Groups"))
+}
+
+func TestProxyHandlerImpersonateExtra(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var receivedHeaders http.Header
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	kubernetesAPITokenPath, cleanupFn := testGetKubernetesAPITokenPath(t)
+	defer cleanupFn()
+
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+	claims.TenantId = testToPtr(t, "ze-tenant-id")
+	claims.Amr = testToPtr(t, []string{"pwd", "mfa"})
+
+	cases := []struct {
+		impersonateUID      bool
+		requestHeaders      map[string]string
+		expectedResCode     int
+		expectedUIDs        []string
+		expectedExtraTid    []string
+		expectedExtraAmr    []string
+		expectedExtraObject []string
+	}{
+		{
+			impersonateUID:      true,
+			expectedResCode:     http.StatusOK,
+			expectedUIDs:        []string{"ze-object-id"},
+			expectedExtraTid:    []string{"ze-tenant-id"},
+			expectedExtraAmr:    []string{"pwd", "mfa"},
+			expectedExtraObject: []string{"00000000-0000-0000-0000-000000000000"},
+		},
+		{
+			impersonateUID:      false,
+			expectedResCode:     http.StatusOK,
+			expectedUIDs:        nil,
+			expectedExtraTid:    []string{"ze-tenant-id"},
+			expectedExtraAmr:    []string{"pwd", "mfa"},
+			expectedExtraObject: []string{"00000000-0000-0000-0000-000000000000"},
+		},
+		{
+			impersonateUID:  true,
+			requestHeaders:  map[string]string{impersonateUIDHeader: "fake-uid"},
+			expectedResCode: http.StatusForbidden,
+		},
+		{
+			impersonateUID:  true,
+			requestHeaders:  map[string]string{"Impersonate-Extra-Tid": "fake-tenant-id"},
+			expectedResCode: http.StatusForbidden,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+		receivedHeaders = nil
+
+		cfg := &config{
+			AzureADMaxGroupCount:   testFakeMaxGroups,
+			GroupIdentifier:        "NAME",
+			ImpersonateExtraClaims: []string{"tid", "amr", "object-id=oid"},
+			ImpersonateUID:         c.impersonateUID,
+			KubernetesAPITokenPath: kubernetesAPITokenPath,
+		}
+
+		memCacheClient, err := newMemoryCache(5 * time.Minute)
+		require.NoError(t, err)
+		userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+		proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+		require.NoError(t, err)
+
+		req := testNewClaimsRequest(t, http.MethodGet, "/", claims)
+		for k, v := range c.requestHeaders {
+			req.Header.Add(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		proxyHandlers.proxy(ctx, testNewUpstream(t, fakeAPIServer.URL))(rr, req)
+		require.Equal(t, c.expectedResCode, rr.Code)
+
+		if c.expectedResCode != http.StatusOK {
+			require.Nil(t, receivedHeaders)
+			continue
+		}
+
+		require.Equal(t, c.expectedUIDs, receivedHeaders.Values(impersonateUIDHeader))
+		require.Equal(t, c.expectedExtraTid, receivedHeaders.Values("Impersonate-Extra-Tid"))
+		require.Equal(t, c.expectedExtraAmr, receivedHeaders.Values("Impersonate-Extra-Amr"))
+		require.Equal(t, c.expectedExtraObject, receivedHeaders.Values("Impersonate-Extra-Object-Id"))
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// jitGrantRequest is the body of a request to create a just-in-time grant
+type jitGrantRequest struct {
+	ObjectID  string    `json:"objectID"`
+	Group     string    `json:"group"`
+	Reason    string    `json:"reason"`
+	GrantedBy string    `json:"grantedBy"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// jitValidationError is returned when a grant request is invalid
+type jitValidationError struct {
+	message string
+}
+
+func (e *jitValidationError) Error() string {
+	return e.message
+}
+
+// jit gives users temporary membership in a group without changing Azure AD. The grants are stored in the cache and
+// are removed by it when they expire, the groups of the active grants are added to the user at request time. The jit
+// client is kept when the config is reloaded, only the allowed groups and the max duration are updated.
+type jit struct {
+	cache Cache
+	now   func() time.Time
+
+	mu            sync.RWMutex
+	allowedGroups map[string]struct{}
+	maxDuration   time.Duration
+}
+
+// newJIT returns nil if just-in-time grants aren't enabled
+func newJIT(cfg *config, cacheClient Cache) (*jit, error) {
+	if !cfg.JITEnabled {
+		return nil, nil
+	}
+
+	if cfg.AdminAPIToken == "" {
+		return nil, fmt.Errorf("the admin api token is required to manage just-in-time grants")
+	}
+
+	if len(cfg.JITAllowedGroups) == 0 {
+		return nil, fmt.Errorf("the groups allowed to be granted are required to manage just-in-time grants")
+	}
+
+	if cfg.JITMaxDuration < 1 {
+		return nil, fmt.Errorf("jit max duration needs to be at least 1 minute but was: %d", cfg.JITMaxDuration)
+	}
+
+	return &jit{
+		cache:         cacheClient,
+		allowedGroups: newAllowlist(cfg.JITAllowedGroups),
+		maxDuration:   time.Duration(cfg.JITMaxDuration) * time.Minute,
+		now:           time.Now,
+	}, nil
+}
+
+// update applies the allowed groups and the max duration of next, to the grants created after the update
+func (j *jit) update(next *jit) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.allowedGroups = next.allowedGroups
+	j.maxDuration = next.maxDuration
+}
+
+func (j *jit) getLimits() (map[string]struct{}, time.Duration) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.allowedGroups, j.maxDuration
+}
+
+func (j *jit) create(ctx context.Context, req jitGrantRequest) (grantModel, error) {
+	allowedGroups, maxDuration := j.getLimits()
+
+	if req.ObjectID == "" {
+		return grantModel{}, &jitValidationError{"objectID is required"}
+	}
+
+	if req.Group == "" {
+		return grantModel{}, &jitValidationError{"group is required"}
+	}
+
+	if _, ok := allowedGroups[req.Group]; !ok {
+		return grantModel{}, &jitValidationError{fmt.Sprintf("group %q isn't allowed to be granted", req.Group)}
+	}
+
+	if req.Reason == "" {
+		return grantModel{}, &jitValidationError{"reason is required"}
+	}
+
+	now := j.now()
+	if !req.ExpiresAt.After(now) {
+		return grantModel{}, &jitValidationError{"expiresAt needs to be in the future"}
+	}
+
+	if req.ExpiresAt.Sub(now) > maxDuration {
+		return grantModel{}, &jitValidationError{fmt.Sprintf("expiresAt can't be more than %s from now", maxDuration)}
+	}
+
+	id, err := newGrantID()
+	if err != nil {
+		return grantModel{}, err
+	}
+
+	grant := grantModel{
+		ID:        id,
+		ObjectID:  req.ObjectID,
+		Group:     req.Group,
+		Reason:    req.Reason,
+		GrantedBy: req.GrantedBy,
+		CreatedAt: now.UTC(),
+		ExpiresAt: req.ExpiresAt.UTC(),
+	}
+
+	err = j.cache.setGrant(ctx, grant)
+	if err != nil {
+		return grantModel{}, err
+	}
+
+	return grant, nil
+}
+
+// list returns the active grants, of every user if objectID is empty
+func (j *jit) list(ctx context.Context, objectID string) ([]grantModel, error) {
+	var grants []grantModel
+	var err error
+	if objectID == "" {
+		grants, err = j.cache.listGrants(ctx)
+	} else {
+		grants, err = j.cache.getGrants(ctx, objectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return j.active(grants), nil
+}
+
+// revoke deletes the grant and returns it, false is returned if no active grant has the id
+func (j *jit) revoke(ctx context.Context, id string) (grantModel, bool, error) {
+	grants, err := j.list(ctx, "")
+	if err != nil {
+		return grantModel{}, false, err
+	}
+
+	for _, grant := range grants {
+		if grant.ID != id {
+			continue
+		}
+
+		deleted, err := j.cache.deleteGrant(ctx, id)
+		if err != nil {
+			return grantModel{}, false, err
+		}
+
+		return grant, deleted, nil
+	}
+
+	return grantModel{}, false, nil
+}
+
+// applyGrants adds the groups of the active grants of the user, the groups are added to a copy since the user may
+// be shared with the cache
+func (j *jit) applyGrants(ctx context.Context, user userModel) (userModel, []grantModel, error) {
+	if user.ObjectID == "" {
+		return user, nil, nil
+	}
+
+	grants, err := j.list(ctx, user.ObjectID)
+	if err != nil {
+		return userModel{}, nil, err
+	}
+
+	if len(grants) == 0 {
+		return user, nil, nil
+	}
+
+	groups := make([]groupModel, 0, len(user.Groups)+len(grants))
+	groups = append(groups, user.Groups...)
+	seen := make(map[string]struct{})
+	for _, group := range user.Groups {
+		seen[group.Name] = struct{}{}
+	}
+
+	for _, grant := range grants {
+		if _, ok := seen[grant.Group]; ok {
+			continue
+		}
+		seen[grant.Group] = struct{}{}
+
+		groups = append(groups, groupModel{
+			Name:     grant.Group,
+			ObjectID: grant.Group,
+		})
+	}
+
+	user.Groups = groups
+
+	return user, grants, nil
+}
+
+// active filters out grants that have expired but haven't been removed from the cache yet
+func (j *jit) active(grants []grantModel) []grantModel {
+	now := j.now()
+	active := []grantModel{}
+	for _, grant := range grants {
+		if grant.ExpiresAt.After(now) {
+			active = append(active, grant)
+		}
+	}
+
+	return active
+}
+
+func newGrantID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate grant id: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewJIT(t *testing.T) {
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	cases := []struct {
+		cfg                 *config
+		expectedNil         bool
+		expectedErrContains string
+	}{
+		{
+			cfg:         &config{},
+			expectedNil: true,
+		},
+		{
+			cfg: &config{
+				JITEnabled:     true,
+				JITMaxDuration: 60,
+			},
+			expectedErrContains: "the admin api token is required",
+		},
+		{
+			cfg: &config{
+				AdminAPIToken:  "ze-admin-token",
+				JITEnabled:     true,
+				JITMaxDuration: 60,
+			},
+			expectedErrContains: "the groups allowed to be granted are required",
+		},
+		{
+			cfg: &config{
+				AdminAPIToken:    "ze-admin-token",
+				JITAllowedGroups: []string{"cluster-admins"},
+				JITEnabled:       true,
+				JITMaxDuration:   0,
+			},
+			expectedErrContains: "jit max duration needs to be at least 1 minute but was: 0",
+		},
+		{
+			cfg: &config{
+				AdminAPIToken:    "ze-admin-token",
+				JITAllowedGroups: []string{"cluster-admins"},
+				JITEnabled:       true,
+				JITMaxDuration:   60,
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		jitClient, err := newJIT(c.cfg, memCacheClient)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		if c.expectedNil {
+			require.Nil(t, jitClient)
+			continue
+		}
+
+		require.Equal(t, time.Hour, jitClient.maxDuration)
+	}
+}
+
+func TestJITCreate(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	now := time.Now().UTC()
+	jitClient := testNewJIT(t, now)
+
+	cases := []struct {
+		req                 jitGrantRequest
+		expectedErrContains string
+	}{
+		{
+			req:                 jitGrantRequest{Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(time.Hour)},
+			expectedErrContains: "objectID is required",
+		},
+		{
+			req:                 jitGrantRequest{ObjectID: "ze-object-id", Reason: "incident", ExpiresAt: now.Add(time.Hour)},
+			expectedErrContains: "group is required",
+		},
+		{
+			req:                 jitGrantRequest{ObjectID: "ze-object-id", Group: "system:masters", Reason: "incident", ExpiresAt: now.Add(time.Hour)},
+			expectedErrContains: `group "system:masters" isn't allowed to be granted`,
+		},
+		{
+			req:                 jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", ExpiresAt: now.Add(time.Hour)},
+			expectedErrContains: "reason is required",
+		},
+		{
+			req:                 jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", Reason: "incident", ExpiresAt: now},
+			expectedErrContains: "expiresAt needs to be in the future",
+		},
+		{
+			req:                 jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(5 * time.Hour)},
+			expectedErrContains: "expiresAt can't be more than 4h0m0s from now",
+		},
+		{
+			req: jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", Reason: "incident", GrantedBy: "ze-admin", ExpiresAt: now.Add(time.Hour)},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		grant, err := jitClient.create(ctx, c.req)
+		if c.expectedErrContains != "" {
+			var validationErr *jitValidationError
+			require.ErrorAs(t, err, &validationErr)
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Len(t, grant.ID, 32)
+		require.Equal(t, grantModel{
+			ID:        grant.ID,
+			ObjectID:  "ze-object-id",
+			Group:     "cluster-admins",
+			Reason:    "incident",
+			GrantedBy: "ze-admin",
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+		}, grant)
+	}
+}
+
+func TestJITListAndRevoke(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	now := time.Now().UTC()
+	jitClient := testNewJIT(t, now)
+
+	first, err := jitClient.create(ctx, jitGrantRequest{ObjectID: "user-1", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, err)
+	second, err := jitClient.create(ctx, jitGrantRequest{ObjectID: "user-2", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(2 * time.Hour)})
+	require.NoError(t, err)
+
+	grants, err := jitClient.list(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{first, second}, grants)
+
+	grants, err = jitClient.list(ctx, "user-2")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{second}, grants)
+
+	// Grants that have expired but are still cached aren't active
+	jitClient.now = func() time.Time { return now.Add(90 * time.Minute) }
+	grants, err = jitClient.list(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []grantModel{second}, grants)
+
+	_, revoked, err := jitClient.revoke(ctx, first.ID)
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	grant, revoked, err := jitClient.revoke(ctx, second.ID)
+	require.NoError(t, err)
+	require.True(t, revoked)
+	require.Equal(t, second, grant)
+
+	grants, err = jitClient.list(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, grants)
+}
+
+func TestJITApplyGrants(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	now := time.Now().UTC()
+	jitClient := testNewJIT(t, now)
+
+	grant, err := jitClient.create(ctx, jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", Reason: "incident", ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = jitClient.create(ctx, jitGrantRequest{ObjectID: "ze-object-id", Group: "developers", Reason: "incident", ExpiresAt: now.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	_, err = jitClient.create(ctx, jitGrantRequest{ObjectID: "other-object-id", Group: "other", Reason: "incident", ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, err)
+
+	groups := []groupModel{{Name: "developers", ObjectID: "ze-developers-id"}}
+	user := userModel{Username: "ze-username", ObjectID: "ze-object-id", Groups: groups}
+
+	grantedUser, grants, err := jitClient.applyGrants(ctx, user)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	require.Equal(t, grant, grants[0])
+	require.Equal(t, []groupModel{
+		{Name: "developers", ObjectID: "ze-developers-id"},
+		{Name: "cluster-admins", ObjectID: "cluster-admins"},
+	}, grantedUser.Groups)
+
+	// The groups of the original user aren't modified
+	require.Equal(t, []groupModel{{Name: "developers", ObjectID: "ze-developers-id"}}, groups)
+
+	noGrantsUser := userModel{Username: "no-grants", ObjectID: "no-grants-id", Groups: groups}
+	grantedUser, grants, err = jitClient.applyGrants(ctx, noGrantsUser)
+	require.NoError(t, err)
+	require.Empty(t, grants)
+	require.Equal(t, noGrantsUser, grantedUser)
+}
+
+func TestProxyHandlerJITGrants(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var receivedHeaders http.Header
+	fakeBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeBackend.Close()
+
+	cfg := &config{
+		AdminAPIToken:        "ze-admin-token",
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+		JITAllowedGroups:     []string{"cluster-admins"},
+		JITEnabled:           true,
+		JITMaxDuration:       60,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", []groupModel{{Name: "developers", ObjectID: "ze-developers-id"}}, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	grant, err := proxyHandlers.jit.create(ctx, jitGrantRequest{ObjectID: "ze-object-id", Group: "cluster-admins", Reason: "incident", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	sink := &testFakeAuditSink{}
+	auditClient := &audit{
+		workers:      []*auditSinkWorker{newAuditSinkWorker(ctx, "fake", sink, 10, 10)},
+		backpressure: dropAuditBackpressure,
+	}
+
+	handler := auditClient.middleware(http.HandlerFunc(proxyHandlers.proxy(ctx, testNewUpstream(t, fakeBackend.URL))))
+	req := testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", testNewExternalClaims(t, "ze-sub", "ze-username", nil))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, []string{"developers", "cluster-admins"}, receivedHeaders.Values(impersonateGroupHeader))
+
+	// The granted groups count against the max group count
+	cfg.AzureADMaxGroupCount = 2
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", testNewExternalClaims(t, "ze-sub", "ze-username", nil)))
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Contains(t, rr.Body.String(), "Too many groups")
+	cfg.AzureADMaxGroupCount = testFakeMaxGroups
+
+	// The granted group isn't added to the cached user
+	cachedUser, found, err := memCacheClient.getUser(ctx, "ze-sub")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, cachedUser.Groups, 1)
+
+	// The group is removed when the grant is revoked
+	_, revoked, err := proxyHandlers.jit.revoke(ctx, grant.ID)
+	require.NoError(t, err)
+	require.True(t, revoked)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", testNewExternalClaims(t, "ze-sub", "ze-username", nil)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, []string{"developers"}, receivedHeaders.Values(impersonateGroupHeader))
+
+	require.NoError(t, auditClient.close(ctx))
+
+	events := sink.getEvents()
+	require.Len(t, events, 3)
+	require.Equal(t, []string{grant.ID}, events[0].User.JITGrants)
+	require.Equal(t, "too many groups", events[1].DenialReason)
+	require.Empty(t, events[2].User.JITGrants)
+}
+
+func testNewJIT(t *testing.T, now time.Time) *jit {
+	t.Helper()
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+
+	return &jit{
+		cache:         memCacheClient,
+		allowedGroups: newAllowlist([]string{"cluster-admins", "developers", "other"}),
+		maxDuration:   4 * time.Hour,
+		now:           func() time.Time { return now },
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const certificateReloadInterval = 10 * time.Second
+
+// certificateReloader serves the listener certificate using tls.Config.GetCertificate and reloads it when the
+// certificate or key file changes, for example when cert-manager renews the certificate
+type certificateReloader struct {
+	certificatePath string
+	keyPath         string
+	log             logr.Logger
+	metrics         Metrics
+
+	mu             sync.RWMutex
+	certificate    *tls.Certificate
+	certificatePEM []byte
+	keyPEM         []byte
+}
+
+func newCertificateReloader(ctx context.Context, certificatePath string, keyPath string) (*certificateReloader, error) {
+	if certificatePath == "" || keyPath == "" {
+		return nil, fmt.Errorf("both the TLS certificate path and key path are required when TLS is enabled")
+	}
+
+	reloader := &certificateReloader{
+		certificatePath: certificatePath,
+		keyPath:         keyPath,
+		log:             logr.FromContextOrDiscard(ctx),
+		metrics:         metricsFromContext(ctx),
+	}
+
+	_, err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (reloader *certificateReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+// reload reads the certificate and key files and replaces the certificate if any of them changed. The current
+// certificate is kept if the new files can't be parsed, for example if only one of them has been written yet.
+func (reloader *certificateReloader) reload() (bool, error) {
+	certificatePEM, err := os.ReadFile(reloader.certificatePath) // #nosec
+	if err != nil {
+		return false, fmt.Errorf("unable to read TLS certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(reloader.keyPath) // #nosec
+	if err != nil {
+		return false, fmt.Errorf("unable to read TLS key: %w", err)
+	}
+
+	reloader.mu.RLock()
+	unchanged := bytes.Equal(certificatePEM, reloader.certificatePEM) && bytes.Equal(keyPEM, reloader.keyPEM)
+	reloader.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.X509KeyPair(certificatePEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse TLS certificate and key: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("unable to parse TLS certificate: %w", err)
+	}
+	certificate.Leaf = leaf
+
+	reloader.mu.Lock()
+	reloader.certificate = &certificate
+	reloader.certificatePEM = certificatePEM
+	reloader.keyPEM = keyPEM
+	reloader.mu.Unlock()
+
+	reloader.metrics.set(metricsTLSCertificateExpiry, float64(leaf.NotAfter.Unix()))
+
+	return true, nil
+}
+
+// run checks the certificate and key files for changes until the context is cancelled
+func (reloader *certificateReloader) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := reloader.reload()
+			if err != nil {
+				reloader.log.Error(err, "Unable to reload TLS certificate, using the previous certificate", "certificate-file-path", reloader.certificatePath, "key-file-path", reloader.keyPath)
+				continue
+			}
+
+			if reloaded {
+				reloader.mu.RLock()
+				notAfter := reloader.certificate.Leaf.NotAfter
+				reloader.mu.RUnlock()
+				reloader.log.Info("Reloaded TLS certificate", "certificate-file-path", reloader.certificatePath, "notAfter", notAfter)
+			}
+		}
+	}
+}
+
+// getListenerTLSConfig returns the TLS config used by the main and metrics listeners
+func getListenerTLSConfig(cfg *config, reloader *certificateReloader) (*tls.Config, error) {
+	minVersion, err := getTLSVersion(cfg.ListenerTLSConfigMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := getTLSCipherSuites(cfg.ListenerTLSConfigCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	curvePreferences, err := getTLSCurvePreferences(cfg.ListenerTLSConfigCurvePreferences)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:       minVersion,
+		CipherSuites:     cipherSuites,
+		CurvePreferences: curvePreferences,
+		GetCertificate:   reloader.getCertificate,
+	}, nil
+}
+
+func getTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("Unknown TLS version '%s'. Supported versions are: 1.0, 1.1, 1.2 or 1.3", s)
+	}
+}
+
+// getTLSCipherSuites returns the ids of the cipher suites, only the cipher suites without known security issues are
+// supported. Cipher suites can't be configured for TLS 1.3.
+func getTLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	supported := make(map[string]uint16)
+	supportedNames := []string{}
+	for _, cipherSuite := range tls.CipherSuites() {
+		supported[cipherSuite.Name] = cipherSuite.ID
+		supportedNames = append(supportedNames, cipherSuite.Name)
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher suite '%s'. Supported cipher suites are: %s", name, strings.Join(supportedNames, ", "))
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func getTLSCurvePreferences(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	curves := []tls.CurveID{}
+	for _, name := range names {
+		switch name {
+		case "X25519":
+			curves = append(curves, tls.X25519)
+		case "P256":
+			curves = append(curves, tls.CurveP256)
+		case "P384":
+			curves = append(curves, tls.CurveP384)
+		case "P521":
+			curves = append(curves, tls.CurveP521)
+		default:
+			return nil, fmt.Errorf("Unknown TLS curve '%s'. Supported curves are: X25519, P256, P384 or P521", name)
+		}
+	}
+
+	return curves, nil
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateReloader(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	tmpDir := t.TempDir()
+	certificatePath := filepath.Join(tmpDir, "tls.crt")
+	keyPath := filepath.Join(tmpDir, "tls.key")
+
+	firstNotAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	testWriteCertificateFiles(t, certificatePath, keyPath, "first", firstNotAfter)
+
+	reloader, err := newCertificateReloader(ctx, certificatePath, keyPath)
+	require.NoError(t, err)
+	testRequireServedCertificate(t, reloader, "first")
+	require.Equal(t, float64(firstNotAfter.Unix()), testMetricValue(t, metricsClient, metricsTLSCertificateExpiry))
+
+	// Nothing is reloaded when the files haven't changed
+	reloaded, err := reloader.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	secondNotAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	testWriteCertificateFiles(t, certificatePath, keyPath, "second", secondNotAfter)
+
+	reloaded, err = reloader.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	testRequireServedCertificate(t, reloader, "second")
+	require.Equal(t, float64(secondNotAfter.Unix()), testMetricValue(t, metricsClient, metricsTLSCertificateExpiry))
+
+	// The previous certificate is kept when the certificate doesn't match the key, like when only one of the files
+	// has been written
+	certificatePEM, _ := testGenerateCertificate(t, "third", secondNotAfter)
+	testCreateTemporaryFile(t, certificatePath, string(certificatePEM))
+
+	_, err = reloader.reload()
+	require.ErrorContains(t, err, "unable to parse TLS certificate and key")
+	testRequireServedCertificate(t, reloader, "second")
+}
+
+func TestNewCertificateReloader(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tmpDir := t.TempDir()
+
+	_, err := newCertificateReloader(ctx, "", "")
+	require.ErrorContains(t, err, "both the TLS certificate path and key path are required")
+
+	_, err = newCertificateReloader(ctx, filepath.Join(tmpDir, "tls.crt"), filepath.Join(tmpDir, "tls.key"))
+	require.ErrorContains(t, err, "unable to read TLS certificate")
+}
+
+func TestCertificateReloaderRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(logr.NewContext(context.Background(), logr.Discard()))
+	defer cancel()
+
+	tmpDir := t.TempDir()
+	certificatePath := filepath.Join(tmpDir, "tls.crt")
+	keyPath := filepath.Join(tmpDir, "tls.key")
+	testWriteCertificateFiles(t, certificatePath, keyPath, "first", time.Now().Add(time.Hour))
+
+	reloader, err := newCertificateReloader(ctx, certificatePath, keyPath)
+	require.NoError(t, err)
+
+	tlsConfig, err := getListenerTLSConfig(&config{ListenerTLSConfigMinVersion: "1.2"}, reloader)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+
+	go reloader.run(ctx, 10*time.Millisecond)
+
+	require.Equal(t, "first", testGetServerCertificateCommonName(t, listener.Addr().String()))
+
+	testWriteCertificateFiles(t, certificatePath, keyPath, "second", time.Now().Add(time.Hour))
+
+	require.Eventually(t, func() bool {
+		return testGetServerCertificateCommonName(t, listener.Addr().String()) == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGetListenerTLSConfig(t *testing.T) {
+	reloader := &certificateReloader{}
+
+	cases := []struct {
+		cfg                      *config
+		expectedMinVersion       uint16
+		expectedCipherSuites     []uint16
+		expectedCurvePreferences []tls.CurveID
+		expectedErrContains      string
+	}{
+		{
+			cfg: &config{
+				ListenerTLSConfigMinVersion: "1.2",
+			},
+			expectedMinVersion: tls.VersionTLS12,
+		},
+		{
+			cfg: &config{
+				ListenerTLSConfigMinVersion:       "1.3",
+				ListenerTLSConfigCipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+				ListenerTLSConfigCurvePreferences: []string{"X25519", "P256"},
+			},
+			expectedMinVersion:       tls.VersionTLS13,
+			expectedCipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			expectedCurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		},
+		{
+			cfg: &config{
+				ListenerTLSConfigMinVersion: "1.4",
+			},
+			expectedErrContains: "Unknown TLS version '1.4'",
+		},
+		{
+			cfg: &config{
+				ListenerTLSConfigMinVersion:   "1.2",
+				ListenerTLSConfigCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+			},
+			expectedErrContains: "Unknown TLS cipher suite 'TLS_RSA_WITH_RC4_128_SHA'",
+		},
+		{
+			cfg: &config{
+				ListenerTLSConfigMinVersion:       "1.2",
+				ListenerTLSConfigCurvePreferences: []string{"P224"},
+			},
+			expectedErrContains: "Unknown TLS curve 'P224'",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		tlsConfig, err := getListenerTLSConfig(c.cfg, reloader)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedMinVersion, tlsConfig.MinVersion)
+		require.Equal(t, c.expectedCipherSuites, tlsConfig.CipherSuites)
+		require.Equal(t, c.expectedCurvePreferences, tlsConfig.CurvePreferences)
+		require.NotNil(t, tlsConfig.GetCertificate)
+	}
+}
+
+func testRequireServedCertificate(t *testing.T, reloader *certificateReloader, expectedCommonName string) {
+	t.Helper()
+
+	certificate, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, expectedCommonName, certificate.Leaf.Subject.CommonName)
+}
+
+func testGetServerCertificateCommonName(t *testing.T, addr string) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) // #nosec
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func testWriteCertificateFiles(t *testing.T, certificatePath string, keyPath string, commonName string, notAfter time.Time) {
+	t.Helper()
+
+	certificatePEM, keyPEM := testGenerateCertificate(t, commonName, notAfter)
+	testCreateTemporaryFile(t, certificatePath, string(certificatePEM))
+	testCreateTemporaryFile(t, keyPath, string(keyPEM))
+}
+
+func testGenerateCertificate(t *testing.T, commonName string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+
+	return certificatePEM, keyPEM
+}
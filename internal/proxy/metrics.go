@@ -7,8 +7,33 @@ import (
 	"github.com/gorilla/mux"
 )
 
+type metricsContextKey struct{}
+
+type metricKind int
+
+const (
+	counterMetricKind metricKind = iota
+	gaugeMetricKind
+	histogramMetricKind
+)
+
+// metricDefinition describes a metric, every metrics backend creates its own instrument for each definition
+type metricDefinition struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+}
+
+// Metrics records the metrics of the proxy, the label values are given in the same order as the labels of the
+// definition
 type Metrics interface {
 	metricsHandler(ctx context.Context, router *mux.Router) (*mux.Router, error)
+	add(metric *metricDefinition, value float64, labelValues ...string)
+	set(metric *metricDefinition, value float64, labelValues ...string)
+	observe(metric *metricDefinition, value float64, labelValues ...string)
+	close(ctx context.Context) error
 }
 
 func newMetricsClient(ctx context.Context, cfg *config) (Metrics, error) {
@@ -24,7 +49,25 @@ func newMetricsClient(ctx context.Context, cfg *config) (Metrics, error) {
 	case prometheusMetrics:
 		client := newPrometheusClient(ctx)
 		return &client, nil
+	case otlpMetrics:
+		return newOTLPClient(ctx, cfg)
 	default:
 		return nil, fmt.Errorf("Unexpected metrics: %s", cfg.Metrics)
 	}
 }
+
+// newMetricsContext returns a context with the metrics client, used by the components of the proxy the same way as
+// the logger
+func newMetricsContext(ctx context.Context, metricsClient Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey{}, metricsClient)
+}
+
+// metricsFromContext returns the metrics client of the context, metrics are discarded if there is none
+func metricsFromContext(ctx context.Context) Metrics {
+	metricsClient, ok := ctx.Value(metricsContextKey{}).(Metrics)
+	if !ok {
+		return &noneClient{}
+	}
+
+	return metricsClient
+}
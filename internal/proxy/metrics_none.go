@@ -7,6 +7,7 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// noneClient discards all metrics
 type noneClient struct{}
 
 func newNoneClient(ctx context.Context) noneClient {
@@ -19,3 +20,13 @@ func newNoneClient(ctx context.Context) noneClient {
 func (client *noneClient) metricsHandler(ctx context.Context, router *mux.Router) (*mux.Router, error) {
 	return router, nil
 }
+
+func (client *noneClient) add(metric *metricDefinition, value float64, labelValues ...string) {}
+
+func (client *noneClient) set(metric *metricDefinition, value float64, labelValues ...string) {}
+
+func (client *noneClient) observe(metric *metricDefinition, value float64, labelValues ...string) {}
+
+func (client *noneClient) close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+)
+
+// otlpClient pushes the proxy metrics to an OTLP collector at the configured interval
+type otlpClient struct {
+	provider   *sdkmetric.MeterProvider
+	counters   map[*metricDefinition]metric.Float64Counter
+	histograms map[*metricDefinition]metric.Float64Histogram
+	gauges     map[*metricDefinition]*otlpGauge
+}
+
+// otlpGauge keeps the last value per label values, since gauges can only be observed using a callback
+type otlpGauge struct {
+	mu     sync.Mutex
+	values map[string]otlpGaugeValue
+}
+
+type otlpGaugeValue struct {
+	attributes []attribute.KeyValue
+	value      float64
+}
+
+func newOTLPClient(ctx context.Context, cfg *config) (*otlpClient, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	exporter, err := newOTLPMetricsExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MetricsOTLPInterval < 1 {
+		return nil, fmt.Errorf("metrics-otlp-interval needs to be at least 1 second: %d", cfg.MetricsOTLPInterval)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(time.Duration(cfg.MetricsOTLPInterval)*time.Second))
+
+	client, err := newOTLPClientWithReader(cfg, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Using metrics: otlp", "endpoint", cfg.MetricsOTLPEndpoint, "protocol", cfg.MetricsOTLPProtocol, "interval", cfg.MetricsOTLPInterval)
+
+	return client, nil
+}
+
+func newOTLPMetricsExporter(ctx context.Context, cfg *config) (sdkmetric.Exporter, error) {
+	protocol, err := getOTLPProtocol(cfg.MetricsOTLPProtocol)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointURL, err := parseOTLPEndpoint(cfg.MetricsOTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := parseOTLPHeaders(cfg.MetricsOTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if endpointURL.Scheme == "https" {
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if cfg.MetricsOTLPCACertificatePath != "" {
+			rootCAs, err := getCertificate(ctx, cfg.MetricsOTLPCACertificatePath)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+	}
+
+	// The exporters don't connect until the first metrics are exported
+	switch protocol {
+	case grpcOTLPProtocol:
+		options := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(endpointURL.Host),
+			otlpmetricgrpc.WithHeaders(headers),
+		}
+		if tlsConfig == nil {
+			options = append(options, otlpmetricgrpc.WithInsecure())
+		} else {
+			options = append(options, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+
+		return otlpmetricgrpc.New(ctx, options...)
+	case httpOTLPProtocol:
+		options := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(endpointURL.Host),
+			otlpmetrichttp.WithHeaders(headers),
+		}
+		if endpointURL.Path != "" && endpointURL.Path != "/" {
+			options = append(options, otlpmetrichttp.WithURLPath(endpointURL.Path))
+		}
+		if tlsConfig == nil {
+			options = append(options, otlpmetrichttp.WithInsecure())
+		} else {
+			options = append(options, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
+		}
+
+		return otlpmetrichttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("Unexpected OTLP protocol: %s", cfg.MetricsOTLPProtocol)
+	}
+}
+
+// newOTLPClientWithReader creates the instruments of the proxy metrics, the histograms use the buckets of the
+// metric definitions
+func newOTLPClientWithReader(cfg *config, reader sdkmetric.Reader) (*otlpClient, error) {
+	options := []sdkmetric.Option{
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", tracingServiceName),
+			attribute.String("service.version", cfg.version),
+		)),
+	}
+
+	for _, m := range proxyMetricDefinitions {
+		if m.kind != histogramMetricKind {
+			continue
+		}
+
+		options = append(options, sdkmetric.WithView(sdkmetric.NewView(
+			sdkmetric.Instrument{Name: m.name},
+			sdkmetric.Stream{Aggregation: aggregation.ExplicitBucketHistogram{Boundaries: m.buckets}},
+		)))
+	}
+
+	client := &otlpClient{
+		provider:   sdkmetric.NewMeterProvider(options...),
+		counters:   make(map[*metricDefinition]metric.Float64Counter),
+		histograms: make(map[*metricDefinition]metric.Float64Histogram),
+		gauges:     make(map[*metricDefinition]*otlpGauge),
+	}
+
+	meter := client.provider.Meter(tracerName)
+	for _, m := range proxyMetricDefinitions {
+		switch m.kind {
+		case counterMetricKind:
+			counter, err := meter.Float64Counter(m.name, metric.WithDescription(m.help))
+			if err != nil {
+				return nil, fmt.Errorf("unable to create counter %s: %w", m.name, err)
+			}
+			client.counters[m] = counter
+		case gaugeMetricKind:
+			gauge := &otlpGauge{
+				values: make(map[string]otlpGaugeValue),
+			}
+			_, err := meter.Float64ObservableGauge(m.name, metric.WithDescription(m.help), metric.WithFloat64Callback(gauge.observe))
+			if err != nil {
+				return nil, fmt.Errorf("unable to create gauge %s: %w", m.name, err)
+			}
+			client.gauges[m] = gauge
+		case histogramMetricKind:
+			histogram, err := meter.Float64Histogram(m.name, metric.WithDescription(m.help))
+			if err != nil {
+				return nil, fmt.Errorf("unable to create histogram %s: %w", m.name, err)
+			}
+			client.histograms[m] = histogram
+		}
+	}
+
+	return client, nil
+}
+
+// metricsHandler doesn't add any routes, the metrics are pushed to the collector
+func (client *otlpClient) metricsHandler(ctx context.Context, router *mux.Router) (*mux.Router, error) {
+	return router, nil
+}
+
+// add increases a counter, or changes a gauge by the value (that can be negative)
+func (client *otlpClient) add(m *metricDefinition, value float64, labelValues ...string) {
+	if counter, ok := client.counters[m]; ok {
+		counter.Add(context.Background(), value, metric.WithAttributes(getOTLPAttributes(m, labelValues)...))
+		return
+	}
+
+	if gauge, ok := client.gauges[m]; ok {
+		gauge.update(getOTLPAttributes(m, labelValues), func(current float64) float64 { return current + value })
+	}
+}
+
+func (client *otlpClient) set(m *metricDefinition, value float64, labelValues ...string) {
+	if gauge, ok := client.gauges[m]; ok {
+		gauge.update(getOTLPAttributes(m, labelValues), func(_ float64) float64 { return value })
+	}
+}
+
+func (client *otlpClient) observe(m *metricDefinition, value float64, labelValues ...string) {
+	if histogram, ok := client.histograms[m]; ok {
+		histogram.Record(context.Background(), value, metric.WithAttributes(getOTLPAttributes(m, labelValues)...))
+	}
+}
+
+// close exports the metrics a last time
+func (client *otlpClient) close(ctx context.Context) error {
+	return client.provider.Shutdown(ctx)
+}
+
+func (gauge *otlpGauge) update(attributes []attribute.KeyValue, fn func(current float64) float64) {
+	attributeSet := attribute.NewSet(attributes...)
+	key := attributeSet.Encoded(attribute.DefaultEncoder())
+
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+
+	gauge.values[key] = otlpGaugeValue{
+		attributes: attributes,
+		value:      fn(gauge.values[key].value),
+	}
+}
+
+func (gauge *otlpGauge) observe(_ context.Context, observer metric.Float64Observer) error {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+
+	for _, v := range gauge.values {
+		observer.Observe(v.value, metric.WithAttributes(v.attributes...))
+	}
+
+	return nil
+}
+
+func getOTLPAttributes(m *metricDefinition, labelValues []string) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, 0, len(m.labels))
+	for i, label := range m.labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+
+		attributes = append(attributes, attribute.String(label, value))
+	}
+
+	return attributes
+}
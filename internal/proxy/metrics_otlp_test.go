@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewOTLPClient(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	cases := []struct {
+		testDescription     string
+		cfg                 *config
+		expectedErrContains string
+	}{
+		{
+			testDescription:     "unknown protocol",
+			cfg:                 &config{MetricsOTLPEndpoint: "http://127.0.0.1:4317", MetricsOTLPProtocol: "DUMMY", MetricsOTLPInterval: 60},
+			expectedErrContains: "Unknown OTLP protocol 'DUMMY'",
+		},
+		{
+			testDescription:     "missing endpoint",
+			cfg:                 &config{MetricsOTLPProtocol: "GRPC", MetricsOTLPInterval: 60},
+			expectedErrContains: "OTLP endpoint needs to be an http or https URL",
+		},
+		{
+			testDescription:     "invalid header",
+			cfg:                 &config{MetricsOTLPEndpoint: "http://127.0.0.1:4317", MetricsOTLPHeaders: []string{"X-Scope-OrgID"}, MetricsOTLPProtocol: "GRPC", MetricsOTLPInterval: 60},
+			expectedErrContains: "OTLP header needs to be formatted as <key>=<value>",
+		},
+		{
+			testDescription:     "invalid interval",
+			cfg:                 &config{MetricsOTLPEndpoint: "http://127.0.0.1:4317", MetricsOTLPProtocol: "GRPC", MetricsOTLPInterval: 0},
+			expectedErrContains: "metrics-otlp-interval needs to be at least 1 second",
+		},
+		{
+			testDescription:     "missing ca certificate",
+			cfg:                 &config{MetricsOTLPEndpoint: "https://127.0.0.1:4318", MetricsOTLPCACertificatePath: filepath.Join(t.TempDir(), "ca.crt"), MetricsOTLPProtocol: "HTTP", MetricsOTLPInterval: 60},
+			expectedErrContains: "no such file or directory",
+		},
+		{
+			testDescription: "grpc",
+			cfg:             &config{MetricsOTLPEndpoint: "http://127.0.0.1:4317", MetricsOTLPProtocol: "GRPC", MetricsOTLPInterval: 60},
+		},
+		{
+			testDescription: "http",
+			cfg:             &config{MetricsOTLPEndpoint: "https://127.0.0.1:4318/v1/metrics", MetricsOTLPProtocol: "HTTP", MetricsOTLPInterval: 60},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			client, err := newOTLPClient(ctx, c.cfg)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, client)
+		})
+	}
+}
+
+func TestOTLPClientGRPC(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	collector := newTestFakeOTLPCollector(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, &testFakeOTLPGRPCService{collector: collector})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	client, err := newOTLPClient(ctx, &config{
+		MetricsOTLPEndpoint: fmt.Sprintf("http://%s", listener.Addr().String()),
+		MetricsOTLPHeaders:  []string{"X-Scope-OrgID=ze-tenant"},
+		MetricsOTLPProtocol: "GRPC",
+		MetricsOTLPInterval: 60,
+	})
+	require.NoError(t, err)
+
+	testRecordOTLPMetrics(t, client)
+	require.NoError(t, client.close(ctx))
+
+	testRequireOTLPMetrics(t, collector)
+}
+
+func TestOTLPClientHTTP(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	collector := newTestFakeOTLPCollector(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		collector.export(r.Header.Get("X-Scope-OrgID"), req)
+
+		res, err := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(res)
+	}))
+	defer server.Close()
+
+	// The collector certificate is verified using the configured CA certificate
+	caCertificatePath := filepath.Join(t.TempDir(), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caCertificatePath, caPEM, 0600))
+
+	client, err := newOTLPClient(ctx, &config{
+		MetricsOTLPCACertificatePath: caCertificatePath,
+		MetricsOTLPEndpoint:          fmt.Sprintf("%s/v1/metrics", server.URL),
+		MetricsOTLPHeaders:           []string{"X-Scope-OrgID=ze-tenant"},
+		MetricsOTLPProtocol:          "HTTP",
+		MetricsOTLPInterval:          60,
+	})
+	require.NoError(t, err)
+
+	testRecordOTLPMetrics(t, client)
+	require.NoError(t, client.close(ctx))
+
+	testRequireOTLPMetrics(t, collector)
+}
+
+func testRecordOTLPMetrics(t *testing.T, client *otlpClient) {
+	t.Helper()
+
+	client.add(metricsThrottledRequests, 1, "user")
+	client.add(metricsThrottledRequests, 2, "user")
+	client.add(metricsRequestsInFlight, 2)
+	client.add(metricsRequestsInFlight, -1)
+	client.set(metricsGroupCount, 42)
+	client.observe(metricsRequestDuration, 0.1, "get", "200")
+	client.observe(metricsRequestDuration, 0.2, "get", "200")
+}
+
+func testRequireOTLPMetrics(t *testing.T, collector *testFakeOTLPCollector) {
+	t.Helper()
+
+	values, headers := collector.get()
+	require.Equal(t, []string{"ze-tenant"}, headers)
+	require.Equal(t, float64(3), values[`azad_kube_proxy_throttled_requests_total{tier="user"}`])
+	require.Equal(t, float64(1), values[`azad_kube_proxy_requests_in_flight{}`])
+	require.Equal(t, float64(42), values[`azad_kube_proxy_groups{}`])
+	require.Equal(t, float64(2), values[`azad_kube_proxy_request_duration_seconds{code="200",verb="get"}`])
+}
+
+// testFakeOTLPCollector stores the last value of every data point, formatted as name{key="value"}. The value of a
+// histogram is the number of observations.
+type testFakeOTLPCollector struct {
+	mu      sync.Mutex
+	values  map[string]float64
+	headers []string
+}
+
+func newTestFakeOTLPCollector(t *testing.T) *testFakeOTLPCollector {
+	t.Helper()
+
+	return &testFakeOTLPCollector{
+		values: make(map[string]float64),
+	}
+}
+
+func (collector *testFakeOTLPCollector) export(header string, req *colmetricpb.ExportMetricsServiceRequest) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	collector.headers = append(collector.headers, header)
+
+	for _, resourceMetrics := range req.GetResourceMetrics() {
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, m := range scopeMetrics.GetMetrics() {
+				collector.exportMetric(m)
+			}
+		}
+	}
+}
+
+func (collector *testFakeOTLPCollector) exportMetric(m *metricpb.Metric) {
+	numberDataPoints := append(m.GetSum().GetDataPoints(), m.GetGauge().GetDataPoints()...)
+	for _, dataPoint := range numberDataPoints {
+		collector.values[testOTLPKey(m.GetName(), dataPoint.GetAttributes())] = dataPoint.GetAsDouble()
+	}
+
+	for _, dataPoint := range m.GetHistogram().GetDataPoints() {
+		collector.values[testOTLPKey(m.GetName(), dataPoint.GetAttributes())] = float64(dataPoint.GetCount())
+	}
+}
+
+func (collector *testFakeOTLPCollector) get() (map[string]float64, []string) {
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	return collector.values, collector.headers
+}
+
+type testFakeOTLPGRPCService struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	collector *testFakeOTLPCollector
+}
+
+func (service *testFakeOTLPGRPCService) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	header := ""
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok && len(md.Get("x-scope-orgid")) > 0 {
+		header = md.Get("x-scope-orgid")[0]
+	}
+
+	service.collector.export(header, req)
+
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func testOTLPKey(name string, attributes []*commonpb.KeyValue) string {
+	labels := []string{}
+	for _, attr := range attributes {
+		labels = append(labels, fmt.Sprintf("%s=%q", attr.GetKey(), attr.GetValue().GetStringValue()))
+	}
+	sort.Strings(labels)
+
+	return fmt.Sprintf("%s{%s}", name, strings.Join(labels, ","))
+}
@@ -5,19 +5,83 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type prometheusClient struct{}
+// prometheusClient registers the proxy metrics, together with the go and process metrics, in its own registry
+type prometheusClient struct {
+	registry   *prometheus.Registry
+	counters   map[*metricDefinition]*prometheus.CounterVec
+	gauges     map[*metricDefinition]*prometheus.GaugeVec
+	histograms map[*metricDefinition]*prometheus.HistogramVec
+}
 
 func newPrometheusClient(ctx context.Context) prometheusClient {
 	log := logr.FromContextOrDiscard(ctx)
 	log.Info("Using metrics: prometheus")
 
-	return prometheusClient{}
+	client := prometheusClient{
+		registry:   prometheus.NewRegistry(),
+		counters:   make(map[*metricDefinition]*prometheus.CounterVec),
+		gauges:     make(map[*metricDefinition]*prometheus.GaugeVec),
+		histograms: make(map[*metricDefinition]*prometheus.HistogramVec),
+	}
+
+	client.registry.MustRegister(collectors.NewGoCollector())
+	client.registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	for _, metric := range proxyMetricDefinitions {
+		switch metric.kind {
+		case counterMetricKind:
+			counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: metric.name, Help: metric.help}, metric.labels)
+			client.registry.MustRegister(counter)
+			client.counters[metric] = counter
+		case gaugeMetricKind:
+			gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: metric.name, Help: metric.help}, metric.labels)
+			client.registry.MustRegister(gauge)
+			client.gauges[metric] = gauge
+		case histogramMetricKind:
+			histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: metric.name, Help: metric.help, Buckets: metric.buckets}, metric.labels)
+			client.registry.MustRegister(histogram)
+			client.histograms[metric] = histogram
+		}
+	}
+
+	return client
 }
 
 func (client *prometheusClient) metricsHandler(ctx context.Context, router *mux.Router) (*mux.Router, error) {
-	router.Handle("/metrics", promhttp.Handler())
+	router.Handle("/metrics", promhttp.HandlerFor(client.registry, promhttp.HandlerOpts{}))
 	return router, nil
 }
+
+// add increases a counter, or changes a gauge by the value (that can be negative)
+func (client *prometheusClient) add(metric *metricDefinition, value float64, labelValues ...string) {
+	if counter, ok := client.counters[metric]; ok {
+		counter.WithLabelValues(labelValues...).Add(value)
+		return
+	}
+
+	if gauge, ok := client.gauges[metric]; ok {
+		gauge.WithLabelValues(labelValues...).Add(value)
+	}
+}
+
+func (client *prometheusClient) set(metric *metricDefinition, value float64, labelValues ...string) {
+	if gauge, ok := client.gauges[metric]; ok {
+		gauge.WithLabelValues(labelValues...).Set(value)
+	}
+}
+
+func (client *prometheusClient) observe(metric *metricDefinition, value float64, labelValues ...string) {
+	if histogram, ok := client.histograms[metric]; ok {
+		histogram.WithLabelValues(labelValues...).Observe(value)
+	}
+}
+
+// close doesn't do anything, the metrics are scraped
+func (client *prometheusClient) close(ctx context.Context) error {
+	return nil
+}
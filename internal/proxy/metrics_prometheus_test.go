@@ -19,6 +19,8 @@ func TestPrometheusMetricsHandler(t *testing.T) {
 	client := newPrometheusClient(ctx)
 	require.NoError(t, err)
 
+	client.add(metricsThrottledRequests, 1, "user")
+
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
 	router, err = client.metricsHandler(ctx, router)
@@ -26,4 +28,87 @@ func TestPrometheusMetricsHandler(t *testing.T) {
 	router.ServeHTTP(rr, req)
 	require.Equal(t, http.StatusOK, rr.Code)
 	require.Contains(t, rr.Body.String(), "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.")
+	require.Contains(t, rr.Body.String(), `azad_kube_proxy_throttled_requests_total{tier="user"} 1`)
+}
+
+func TestPrometheusClient(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	client := newPrometheusClient(ctx)
+
+	client.add(metricsGraphRequests, 1, "list_groups")
+	client.add(metricsGraphRequests, 2, "list_groups")
+	require.Equal(t, float64(3), testMetricValue(t, &client, metricsGraphRequests, "list_groups"))
+
+	client.add(metricsRequestsInFlight, 2)
+	client.add(metricsRequestsInFlight, -1)
+	require.Equal(t, float64(1), testMetricValue(t, &client, metricsRequestsInFlight))
+
+	client.set(metricsGroupCount, 42)
+	require.Equal(t, float64(42), testMetricValue(t, &client, metricsGroupCount))
+
+	client.observe(metricsRequestDuration, 0.1, "get", "200")
+	client.observe(metricsRequestDuration, 0.2, "get", "200")
+	client.observe(metricsRequestDuration, 0.3, "list", "403")
+	require.Equal(t, float64(2), testMetricValue(t, &client, metricsRequestDuration, "get", "200"))
+	require.Equal(t, float64(1), testMetricValue(t, &client, metricsRequestDuration, "list", "403"))
+
+	// Recording a metric with the wrong kind is ignored
+	client.set(metricsGraphRequests, 10, "list_groups")
+	client.observe(metricsGroupCount, 1)
+	require.Equal(t, float64(3), testMetricValue(t, &client, metricsGraphRequests, "list_groups"))
+	require.Equal(t, float64(42), testMetricValue(t, &client, metricsGroupCount))
+}
+
+// testNewMetricsContext returns a context with a prometheus client, so that the metrics recorded by a test don't
+// depend on other tests
+func testNewMetricsContext(t *testing.T, ctx context.Context) (context.Context, *prometheusClient) {
+	t.Helper()
+
+	client := newPrometheusClient(ctx)
+	return newMetricsContext(ctx, &client), &client
+}
+
+// testMetricValue returns the value of a counter or gauge, or the number of observations of a histogram
+func testMetricValue(t *testing.T, client *prometheusClient, metric *metricDefinition, labelValues ...string) float64 {
+	t.Helper()
+
+	require.Len(t, labelValues, len(metric.labels))
+
+	metricFamilies, err := client.registry.Gather()
+	require.NoError(t, err)
+
+	for _, metricFamily := range metricFamilies {
+		if metricFamily.GetName() != metric.name {
+			continue
+		}
+
+		for _, m := range metricFamily.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+
+			matches := true
+			for i, labelName := range metric.labels {
+				if labels[labelName] != labelValues[i] {
+					matches = false
+				}
+			}
+
+			if !matches {
+				continue
+			}
+
+			switch metric.kind {
+			case counterMetricKind:
+				return m.GetCounter().GetValue()
+			case gaugeMetricKind:
+				return m.GetGauge().GetValue()
+			case histogramMetricKind:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return 0
 }
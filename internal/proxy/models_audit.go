@@ -0,0 +1,38 @@
+package proxy
+
+import "fmt"
+
+type auditSinkModel string
+
+var stdoutAuditSink auditSinkModel = "STDOUT"
+var fileAuditSink auditSinkModel = "FILE"
+var webhookAuditSink auditSinkModel = "WEBHOOK"
+
+func getAuditSink(s string) (auditSinkModel, error) {
+	switch s {
+	case "STDOUT":
+		return stdoutAuditSink, nil
+	case "FILE":
+		return fileAuditSink, nil
+	case "WEBHOOK":
+		return webhookAuditSink, nil
+	default:
+		return "", fmt.Errorf("Unknown audit sink '%s'. Supported sinks are: STDOUT, FILE or WEBHOOK", s)
+	}
+}
+
+type auditBackpressureModel string
+
+var dropAuditBackpressure auditBackpressureModel = "DROP"
+var blockAuditBackpressure auditBackpressureModel = "BLOCK"
+
+func getAuditBackpressure(s string) (auditBackpressureModel, error) {
+	switch s {
+	case "DROP":
+		return dropAuditBackpressure, nil
+	case "BLOCK":
+		return blockAuditBackpressure, nil
+	default:
+		return "", fmt.Errorf("Unknown audit backpressure '%s'. Supported values are: DROP or BLOCK", s)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAuditSink(t *testing.T) {
+	cases := []struct {
+		auditSinkString     string
+		expectedAuditSink   auditSinkModel
+		expectedErrContains string
+	}{
+		{
+			auditSinkString:     "STDOUT",
+			expectedAuditSink:   stdoutAuditSink,
+			expectedErrContains: "",
+		},
+		{
+			auditSinkString:     "FILE",
+			expectedAuditSink:   fileAuditSink,
+			expectedErrContains: "",
+		},
+		{
+			auditSinkString:     "WEBHOOK",
+			expectedAuditSink:   webhookAuditSink,
+			expectedErrContains: "",
+		},
+		{
+			auditSinkString:     "DUMMY",
+			expectedAuditSink:   "",
+			expectedErrContains: "Unknown audit sink 'DUMMY'. Supported sinks are: STDOUT, FILE or WEBHOOK",
+		},
+	}
+
+	for _, c := range cases {
+		resAuditSink, err := getAuditSink(c.auditSinkString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedAuditSink, resAuditSink)
+	}
+}
+
+func TestGetAuditBackpressure(t *testing.T) {
+	cases := []struct {
+		auditBackpressureString   string
+		expectedAuditBackpressure auditBackpressureModel
+		expectedErrContains       string
+	}{
+		{
+			auditBackpressureString:   "DROP",
+			expectedAuditBackpressure: dropAuditBackpressure,
+			expectedErrContains:       "",
+		},
+		{
+			auditBackpressureString:   "BLOCK",
+			expectedAuditBackpressure: blockAuditBackpressure,
+			expectedErrContains:       "",
+		},
+		{
+			auditBackpressureString:   "",
+			expectedAuditBackpressure: "",
+			expectedErrContains:       "Unknown audit backpressure ''. Supported values are: DROP or BLOCK",
+		},
+	}
+
+	for _, c := range cases {
+		resAuditBackpressure, err := getAuditBackpressure(c.auditBackpressureString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedAuditBackpressure, resAuditBackpressure)
+	}
+}
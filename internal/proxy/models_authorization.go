@@ -0,0 +1,19 @@
+package proxy
+
+import "fmt"
+
+type authorizationRuleEffectModel string
+
+var allowAuthorizationRuleEffect authorizationRuleEffectModel = "ALLOW"
+var denyAuthorizationRuleEffect authorizationRuleEffectModel = "DENY"
+
+func getAuthorizationRuleEffect(s string) (authorizationRuleEffectModel, error) {
+	switch s {
+	case "ALLOW":
+		return allowAuthorizationRuleEffect, nil
+	case "DENY":
+		return denyAuthorizationRuleEffect, nil
+	default:
+		return "", fmt.Errorf("Unknown authorization rule effect '%s'. Supported effects are: ALLOW or DENY", s)
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAuthorizationRuleEffect(t *testing.T) {
+	cases := []struct {
+		effectString        string
+		expectedEffect      authorizationRuleEffectModel
+		expectedErrContains string
+	}{
+		{
+			effectString:        "ALLOW",
+			expectedEffect:      allowAuthorizationRuleEffect,
+			expectedErrContains: "",
+		},
+		{
+			effectString:        "DENY",
+			expectedEffect:      denyAuthorizationRuleEffect,
+			expectedErrContains: "",
+		},
+		{
+			effectString:        "deny",
+			expectedEffect:      "",
+			expectedErrContains: "Unknown authorization rule effect 'deny'. Supported effects are: ALLOW or DENY",
+		},
+	}
+
+	for _, c := range cases {
+		resEffect, err := getAuthorizationRuleEffect(c.effectString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedEffect, resEffect)
+	}
+}
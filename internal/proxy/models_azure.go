@@ -0,0 +1,28 @@
+package proxy
+
+import "fmt"
+
+type groupMembershipModel string
+
+var directGroupMembership groupMembershipModel = "DIRECT"
+var transitiveGroupMembership groupMembershipModel = "TRANSITIVE"
+
+func getGroupMembership(s string) (groupMembershipModel, error) {
+	switch s {
+	case "DIRECT":
+		return directGroupMembership, nil
+	case "TRANSITIVE":
+		return transitiveGroupMembership, nil
+	default:
+		return "", fmt.Errorf("Unknown group membership '%s'. Supported memberships are: DIRECT or TRANSITIVE", s)
+	}
+}
+
+// graphSegment returns the Microsoft Graph navigation property used to list the group memberships
+func (m groupMembershipModel) graphSegment() string {
+	if m == directGroupMembership {
+		return "memberOf"
+	}
+
+	return "transitiveMemberOf"
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetGroupMembership(t *testing.T) {
+	cases := []struct {
+		groupMembershipString   string
+		expectedGroupMembership groupMembershipModel
+		expectedGraphSegment    string
+		expectedErrContains     string
+	}{
+		{
+			groupMembershipString:   "DIRECT",
+			expectedGroupMembership: directGroupMembership,
+			expectedGraphSegment:    "memberOf",
+			expectedErrContains:     "",
+		},
+		{
+			groupMembershipString:   "TRANSITIVE",
+			expectedGroupMembership: transitiveGroupMembership,
+			expectedGraphSegment:    "transitiveMemberOf",
+			expectedErrContains:     "",
+		},
+		{
+			groupMembershipString:   "",
+			expectedGroupMembership: "",
+			expectedErrContains:     "Unknown group membership ''. Supported memberships are: DIRECT or TRANSITIVE",
+		},
+		{
+			groupMembershipString:   "DUMMY",
+			expectedGroupMembership: "",
+			expectedErrContains:     "Unknown group membership 'DUMMY'. Supported memberships are: DIRECT or TRANSITIVE",
+		},
+	}
+
+	for _, c := range cases {
+		resGroupMembership, err := getGroupMembership(c.groupMembershipString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedGroupMembership, resGroupMembership)
+		require.Equal(t, c.expectedGraphSegment, resGroupMembership.graphSegment())
+	}
+}
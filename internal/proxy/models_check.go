@@ -0,0 +1,19 @@
+package proxy
+
+import "fmt"
+
+type checkOutputModel string
+
+var tableCheckOutput checkOutputModel = "TABLE"
+var jsonCheckOutput checkOutputModel = "JSON"
+
+func getCheckOutput(s string) (checkOutputModel, error) {
+	switch s {
+	case "TABLE":
+		return tableCheckOutput, nil
+	case "JSON":
+		return jsonCheckOutput, nil
+	default:
+		return "", fmt.Errorf("Unknown check output '%s'. Supported outputs are: TABLE or JSON", s)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCheckOutput(t *testing.T) {
+	cases := []struct {
+		checkOutputString   string
+		expectedCheckOutput checkOutputModel
+		expectedErrContains string
+	}{
+		{
+			checkOutputString:   "TABLE",
+			expectedCheckOutput: tableCheckOutput,
+			expectedErrContains: "",
+		},
+		{
+			checkOutputString:   "JSON",
+			expectedCheckOutput: jsonCheckOutput,
+			expectedErrContains: "",
+		},
+		{
+			checkOutputString:   "",
+			expectedCheckOutput: "",
+			expectedErrContains: "Unknown check output ''. Supported outputs are: TABLE or JSON",
+		},
+		{
+			checkOutputString:   "DUMMY",
+			expectedCheckOutput: "",
+			expectedErrContains: "Unknown check output 'DUMMY'. Supported outputs are: TABLE or JSON",
+		},
+	}
+
+	for _, c := range cases {
+		resCheckOutput, err := getCheckOutput(c.checkOutputString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedCheckOutput, resCheckOutput)
+	}
+}
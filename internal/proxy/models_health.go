@@ -0,0 +1,31 @@
+package proxy
+
+import "fmt"
+
+type healthCheckModel string
+
+var upstreamHealthCheck healthCheckModel = "UPSTREAM"
+var impersonationHealthCheck healthCheckModel = "IMPERSONATION"
+var graphHealthCheck healthCheckModel = "GRAPH"
+var groupSyncHealthCheck healthCheckModel = "GROUP_SYNC"
+var jwksHealthCheck healthCheckModel = "JWKS"
+var cacheHealthCheck healthCheckModel = "CACHE"
+
+func getHealthCheck(s string) (healthCheckModel, error) {
+	switch s {
+	case "UPSTREAM":
+		return upstreamHealthCheck, nil
+	case "IMPERSONATION":
+		return impersonationHealthCheck, nil
+	case "GRAPH":
+		return graphHealthCheck, nil
+	case "GROUP_SYNC":
+		return groupSyncHealthCheck, nil
+	case "JWKS":
+		return jwksHealthCheck, nil
+	case "CACHE":
+		return cacheHealthCheck, nil
+	default:
+		return "", fmt.Errorf("Unknown health check '%s'. Supported checks are: UPSTREAM, IMPERSONATION, GRAPH, GROUP_SYNC, JWKS or CACHE", s)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetHealthCheck(t *testing.T) {
+	cases := []struct {
+		healthCheckString   string
+		expectedHealthCheck healthCheckModel
+		expectedErrContains string
+	}{
+		{
+			healthCheckString:   "UPSTREAM",
+			expectedHealthCheck: upstreamHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "IMPERSONATION",
+			expectedHealthCheck: impersonationHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "GRAPH",
+			expectedHealthCheck: graphHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "GROUP_SYNC",
+			expectedHealthCheck: groupSyncHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "JWKS",
+			expectedHealthCheck: jwksHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "CACHE",
+			expectedHealthCheck: cacheHealthCheck,
+			expectedErrContains: "",
+		},
+		{
+			healthCheckString:   "",
+			expectedHealthCheck: "",
+			expectedErrContains: "Unknown health check ''. Supported checks are: UPSTREAM, IMPERSONATION, GRAPH, GROUP_SYNC, JWKS or CACHE",
+		},
+		{
+			healthCheckString:   "DUMMY",
+			expectedHealthCheck: "",
+			expectedErrContains: "Unknown health check 'DUMMY'. Supported checks are: UPSTREAM, IMPERSONATION, GRAPH, GROUP_SYNC, JWKS or CACHE",
+		},
+	}
+
+	for _, c := range cases {
+		resHealthCheck, err := getHealthCheck(c.healthCheckString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedHealthCheck, resHealthCheck)
+	}
+}
@@ -6,6 +6,7 @@ type metricsModel string
 
 var noneMetrics metricsModel = "NONE"
 var prometheusMetrics metricsModel = "PROMETHEUS"
+var otlpMetrics metricsModel = "OTLP"
 
 func getMetrics(s string) (metricsModel, error) {
 	switch s {
@@ -13,7 +14,25 @@ func getMetrics(s string) (metricsModel, error) {
 		return noneMetrics, nil
 	case "PROMETHEUS":
 		return prometheusMetrics, nil
+	case "OTLP":
+		return otlpMetrics, nil
 	default:
-		return "", fmt.Errorf("Unknown metrics '%s'. Supported engines are: NONE or PROMETHEUS", s)
+		return "", fmt.Errorf("Unknown metrics '%s'. Supported engines are: NONE, PROMETHEUS or OTLP", s)
+	}
+}
+
+type otlpProtocolModel string
+
+var grpcOTLPProtocol otlpProtocolModel = "GRPC"
+var httpOTLPProtocol otlpProtocolModel = "HTTP"
+
+func getOTLPProtocol(s string) (otlpProtocolModel, error) {
+	switch s {
+	case "GRPC":
+		return grpcOTLPProtocol, nil
+	case "HTTP":
+		return httpOTLPProtocol, nil
+	default:
+		return "", fmt.Errorf("Unknown OTLP protocol '%s'. Supported protocols are: GRPC or HTTP", s)
 	}
 }
@@ -22,15 +22,20 @@ func TestGetMetrics(t *testing.T) {
 			expectedMetrics:     prometheusMetrics,
 			expectedErrContains: "",
 		},
+		{
+			metricsString:       "OTLP",
+			expectedMetrics:     otlpMetrics,
+			expectedErrContains: "",
+		},
 		{
 			metricsString:       "",
 			expectedMetrics:     "",
-			expectedErrContains: "Unknown metrics ''. Supported engines are: NONE or PROMETHEUS",
+			expectedErrContains: "Unknown metrics ''. Supported engines are: NONE, PROMETHEUS or OTLP",
 		},
 		{
 			metricsString:       "DUMMY",
 			expectedMetrics:     "",
-			expectedErrContains: "Unknown metrics 'DUMMY'. Supported engines are: NONE or PROMETHEUS",
+			expectedErrContains: "Unknown metrics 'DUMMY'. Supported engines are: NONE, PROMETHEUS or OTLP",
 		},
 	}
 
@@ -45,3 +50,38 @@ func TestGetMetrics(t *testing.T) {
 		require.Equal(t, c.expectedMetrics, resMetrics)
 	}
 }
+
+func TestGetOTLPProtocol(t *testing.T) {
+	cases := []struct {
+		protocolString      string
+		expectedProtocol    otlpProtocolModel
+		expectedErrContains string
+	}{
+		{
+			protocolString:      "GRPC",
+			expectedProtocol:    grpcOTLPProtocol,
+			expectedErrContains: "",
+		},
+		{
+			protocolString:      "HTTP",
+			expectedProtocol:    httpOTLPProtocol,
+			expectedErrContains: "",
+		},
+		{
+			protocolString:      "DUMMY",
+			expectedProtocol:    "",
+			expectedErrContains: "Unknown OTLP protocol 'DUMMY'. Supported protocols are: GRPC or HTTP",
+		},
+	}
+
+	for _, c := range cases {
+		resProtocol, err := getOTLPProtocol(c.protocolString)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedProtocol, resProtocol)
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type userModelType string
@@ -11,6 +12,20 @@ var normalUserModelType userModelType = "NormalUser"
 
 var servicePrincipalUserModelType userModelType = "ServicePrincipal"
 
+var clientCertificateUserModelType userModelType = "ClientCertificate"
+
+var breakGlassUserModelType userModelType = "BreakGlass"
+
+type authMethodModel string
+
+var azureADAuthMethod authMethodModel = "AZURE_AD"
+
+var clientCertificateAuthMethod authMethodModel = "CLIENT_CERTIFICATE"
+
+var breakGlassAuthMethod authMethodModel = "BREAK_GLASS"
+
+var adminTokenAuthMethod authMethodModel = "ADMIN_TOKEN"
+
 type userModel struct {
 	Username string
 	ObjectID string
@@ -55,3 +70,22 @@ func (i groupModel) MarshalBinary() ([]byte, error) {
 func (i *groupModel) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data, &i)
 }
+
+// grantModel is a just-in-time grant that adds a group to the user with the object id until it expires
+type grantModel struct {
+	ID        string    `json:"id"`
+	ObjectID  string    `json:"objectID"`
+	Group     string    `json:"group"`
+	Reason    string    `json:"reason"`
+	GrantedBy string    `json:"grantedBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (i grantModel) MarshalBinary() ([]byte, error) {
+	return json.Marshal(i)
+}
+
+func (i *grantModel) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, &i)
+}
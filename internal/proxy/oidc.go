@@ -1,47 +1,115 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/xenitab/go-oidc-middleware/oidchttp"
 	"github.com/xenitab/go-oidc-middleware/options"
+	"go.opentelemetry.io/otel/trace"
 )
 
+type oidcSpanContextKey struct{}
+
+// oidcSpan is the span of the token validation, it's ended once: when the token is valid or when the request has been
+// rejected by the OIDC middleware
+type oidcSpan struct {
+	span   trace.Span
+	parent trace.Span
+	valid  bool
+}
+
+var errOIDCTokenRejected = errors.New("token rejected")
+
 func newOIDCHandler(h http.HandlerFunc, tenantID string, clientID string) http.Handler {
-	oidcHandler := oidchttp.New(h,
+	// The span of the token validation ends when the token is valid, the request is handled with the parent span
+	validated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if s, ok := ctx.Value(oidcSpanContextKey{}).(*oidcSpan); ok {
+			s.valid = true
+			endSpan(s.span, nil)
+			ctx = trace.ContextWithSpan(ctx, s.parent)
+		}
+
+		h(w, r.WithContext(ctx))
+	})
+
+	oidcHandler := oidchttp.New(validated,
 		newAzureADClaimsValidationFn(tenantID),
-		options.WithIssuer(fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenantID)),
+		options.WithIssuer(getAzureADIssuer(tenantID)),
 		options.WithRequiredTokenType("JWT"),
 		options.WithRequiredAudience(clientID),
 		options.WithFallbackSignatureAlgorithm("RS256"),
 		options.WithLazyLoadJwks(true),
 	)
 
-	return oidcHandler
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &oidcSpan{parent: trace.SpanFromContext(r.Context())}
+		ctx, span := startSpan(r.Context(), "oidc validate token")
+		s.span = span
+		ctx = context.WithValue(ctx, oidcSpanContextKey{}, s)
+
+		oidcHandler.ServeHTTP(w, r.WithContext(ctx))
+
+		if !s.valid {
+			endSpan(span, errOIDCTokenRejected)
+		}
+	})
+}
+
+// getAzureADIssuer returns the issuer of the Azure AD v2.0 tokens of the tenant
+func getAzureADIssuer(tenantID string) string {
+	return fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenantID)
 }
 
 type externalAzureADClaims struct {
-	Aio               *string    `json:"aio"`
-	Audience          *[]string  `json:"aud"`
-	Azpacr            *string    `json:"azpacr"`
-	Azp               *string    `json:"azp"`
-	ExpiresAt         *time.Time `json:"exp"`
-	Groups            *[]string  `json:"groups"`
-	Idp               *string    `json:"idp"`
-	IssuedAt          *time.Time `json:"iat"`
-	Issuer            *string    `json:"iss"`
-	Name              *string    `json:"name"`
-	NotBefore         *time.Time `json:"nbf"`
-	ObjectId          *string    `json:"oid"`
-	PreferredUsername *string    `json:"preferred_username"`
-	Rh                *string    `json:"rh"`
-	Scope             *string    `json:"scp"`
-	Subject           *string    `json:"sub"`
-	TenantId          *string    `json:"tid"`
-	TokenVersion      *string    `json:"ver"`
-	Uti               *string    `json:"uti"`
+	ClaimNames        *map[string]string `json:"_claim_names"`
+	Acrs              *[]string          `json:"acrs"`
+	Aio               *string            `json:"aio"`
+	Amr               *[]string          `json:"amr"`
+	Audience          *[]string          `json:"aud"`
+	AuthTime          *numericDate       `json:"auth_time"`
+	Azpacr            *string            `json:"azpacr"`
+	Azp               *string            `json:"azp"`
+	ExpiresAt         *time.Time         `json:"exp"`
+	Groups            *[]string          `json:"groups"`
+	HasGroups         *bool              `json:"hasgroups"`
+	Idp               *string            `json:"idp"`
+	Idtyp             *string            `json:"idtyp"`
+	IssuedAt          *time.Time         `json:"iat"`
+	Issuer            *string            `json:"iss"`
+	Name              *string            `json:"name"`
+	NotBefore         *time.Time         `json:"nbf"`
+	ObjectId          *string            `json:"oid"`
+	PreferredUsername *string            `json:"preferred_username"`
+	Rh                *string            `json:"rh"`
+	Scope             *string            `json:"scp"`
+	Subject           *string            `json:"sub"`
+	TenantId          *string            `json:"tid"`
+	TokenVersion      *string            `json:"ver"`
+	Uti               *string            `json:"uti"`
+}
+
+// numericDate is a JWT NumericDate (seconds since the epoch). The registered claims (exp, iat and nbf) are parsed as time
+// by the jwt library, other date claims like auth_time are passed as numbers.
+type numericDate time.Time
+
+func (d numericDate) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(time.Time(d).Unix(), 10)), nil
+}
+
+func (d *numericDate) UnmarshalJSON(b []byte) error {
+	seconds, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse numeric date %q: %w", string(b), err)
+	}
+
+	*d = numericDate(time.Unix(int64(seconds), 0).UTC())
+	return nil
 }
 
 func newAzureADClaimsValidationFn(requiredTenantId string) options.ClaimsValidationFn[externalAzureADClaims] {
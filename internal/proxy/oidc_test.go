@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -37,3 +39,42 @@ func testToPtr[P any](t *testing.T, v P) *P {
 	t.Helper()
 	return &v
 }
+
+func TestNumericDate(t *testing.T) {
+	cases := []struct {
+		json                string
+		expectedTime        time.Time
+		expectedErrContains string
+	}{
+		{
+			json:         `{"auth_time": 1685620800}`,
+			expectedTime: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			json:         `{"auth_time": 1.6856208e+09}`,
+			expectedTime: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			json:                `{"auth_time": "2023-06-01T12:00:00Z"}`,
+			expectedErrContains: "unable to parse numeric date",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		var claims externalAzureADClaims
+		err := json.Unmarshal([]byte(c.json), &claims)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, c.expectedTime, time.Time(*claims.AuthTime))
+
+		b, err := json.Marshal(claims)
+		require.NoError(t, err)
+		require.Contains(t, string(b), `"auth_time":1685620800`)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
@@ -23,59 +22,109 @@ type proxy struct {
 	user          User
 	azure         Azure
 	MetricsClient Metrics
-	health        Health
-	cors          Cors
-
-	cfg              *config
-	kubernetesURL    *url.URL
-	kubernetesRootCA *x509.CertPool
+	audit         Audit
+
+	cfg                   *config
+	upstreams             []*upstream
+	certificateReloader   *certificateReloader
+	listenerTLSConfig     *tls.Config
+	clientCertificateAuth *clientCertificateAuth
+	breakGlass            *breakGlass
+	graphNotifications    *graphNotifications
+	tracing               *tracing
 }
 
 func New(ctx context.Context, cfg *config) (*proxy, error) {
-	cacheClient, err := newMemoryCache(time.Duration(cfg.GroupSyncInterval) * time.Minute)
+	// The metrics client is passed to the other components through the context, like the logger
+	metricsClient, err := newMetricsClient(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
+	ctx = newMetricsContext(ctx, metricsClient)
 
-	azureClient, err := newAzureClient(ctx, cfg.AzureClientID, cfg.AzureClientSecret, cfg.AzureTenantID, cfg.AzureADGroupPrefix, cacheClient)
+	tracing, err := newTracing(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if tracing != nil {
+		ctx = newTracingContext(ctx, tracing.provider)
+	}
 
-	userClient := newUser(cfg, azureClient)
+	cacheClient, err := newCacheClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	metricsClient, err := newMetricsClient(ctx, cfg)
+	groupMembership, err := getGroupMembership(cfg.AzureADGroupMembership)
+	if err != nil {
+		return nil, err
+	}
+
+	groupFilter, err := newGroupFilter(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	healthClient, err := newHealthClient(ctx, cfg, azureClient)
+	azureClient, err := newAzureClient(ctx, cfg.AzureClientID, cfg.AzureClientSecret, cfg.AzureTenantID, groupFilter, groupMembership, cacheClient)
 	if err != nil {
 		return nil, err
 	}
 
-	corsClient := newCors(cfg)
+	userClient := newUser(cfg, azureClient, cacheClient)
 
-	kubernetesURL, err := getKubernetesAPIUrl(cfg.KubernetesAPIHost, cfg.KubernetesAPIPort, cfg.KubernetesAPITLS)
+	upstreams, err := newUpstreams(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	kubernetesRootCA, err := getCertificate(ctx, cfg.KubernetesAPICACertPath)
+	auditClient, err := newAuditClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var reloader *certificateReloader
+	var listenerTLSConfig *tls.Config
+	if cfg.ListenerTLSConfigEnabled {
+		reloader, err = newCertificateReloader(ctx, cfg.ListenerTLSConfigCertificatePath, cfg.ListenerTLSConfigKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		listenerTLSConfig, err = getListenerTLSConfig(cfg, reloader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clientCertificateAuth, err := newClientCertificateAuth(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	breakGlass, err := newBreakGlass(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	graphNotifications, err := newGraphNotifications(cfg, cacheClient, azureClient)
 	if err != nil {
 		return nil, err
 	}
 
 	p := proxy{
-		cache:            cacheClient,
-		user:             userClient,
-		azure:            azureClient,
-		MetricsClient:    metricsClient,
-		health:           healthClient,
-		cors:             corsClient,
-		cfg:              cfg,
-		kubernetesURL:    kubernetesURL,
-		kubernetesRootCA: kubernetesRootCA,
+		cache:                 cacheClient,
+		user:                  userClient,
+		azure:                 azureClient,
+		MetricsClient:         metricsClient,
+		audit:                 auditClient,
+		cfg:                   cfg,
+		upstreams:             upstreams,
+		certificateReloader:   reloader,
+		listenerTLSConfig:     listenerTLSConfig,
+		clientCertificateAuth: clientCertificateAuth,
+		breakGlass:            breakGlass,
+		graphNotifications:    graphNotifications,
+		tracing:               tracing,
 	}
 
 	return &p, nil
@@ -83,6 +132,10 @@ func New(ctx context.Context, cfg *config) (*proxy, error) {
 
 func (p *proxy) Start(ctx context.Context) error {
 	log := logr.FromContextOrDiscard(ctx)
+	ctx = newMetricsContext(ctx, p.MetricsClient)
+	if p.tracing != nil {
+		ctx = newTracingContext(ctx, p.tracing.provider)
+	}
 
 	// Signal handler
 	stopChan := make(chan os.Signal, 2)
@@ -105,14 +158,34 @@ func (p *proxy) Start(ctx context.Context) error {
 	}
 	defer stopGroupSync()
 
-	// Configure reverse proxy and http server
-	proxyHandlers, err := newHandlers(ctx, p.cfg, p.cache, p.user, p.health)
+	// Reload the listener certificate when it is renewed
+	if p.certificateReloader != nil {
+		go p.certificateReloader.run(ctx, certificateReloadInterval)
+	}
+
+	// Configure reverse proxy and http server, the handlers are replaced when the config is reloaded
+	proxyHandlers, err := newReloadableHandlers(ctx, p.cfg, p.cache, p.user, p.azure, p.upstreams)
 	if err != nil {
 		return err
 	}
+
+	// Reload the config on SIGHUP or when the config file changes
+	configReloader, err := newConfigReloader(ctx, p.cfg, proxyHandlers.apply)
+	if err != nil {
+		return err
+	}
+	if configReloader != nil {
+		go configReloader.run(ctx, configReloadInterval)
+	}
+
 	log.Info("Initializing reverse proxy", "ListenerAddress", p.cfg.ListenerAddress, "MetricsListenerAddress", p.cfg.MetricsListenerAddress, "ListenerTLSConfigEnabled", p.cfg.ListenerTLSConfigEnabled)
-	proxy := p.getReverseProxy(ctx)
-	proxy.ErrorHandler = proxyHandlers.error(ctx)
+	for _, up := range p.upstreams {
+		log.Info("Configuring upstream", "name", up.name, "url", up.kubernetesURL.String(), "default", up.isDefault, "hosts", up.hosts, "pathPrefix", up.pathPrefix)
+		up.reverseProxy = up.getReverseProxy(proxyHandlers.error(ctx, up.name))
+		if p.tracing != nil {
+			up.reverseProxy.Transport = p.tracing.transport(up.reverseProxy.Transport)
+		}
+	}
 
 	// Setup metrics router
 	metricsRouter := mux.NewRouter()
@@ -120,6 +193,10 @@ func (p *proxy) Start(ctx context.Context) error {
 	metricsRouter.HandleFunc("/readyz", proxyHandlers.readiness(ctx)).Methods("GET")
 	metricsRouter.HandleFunc("/healthz", proxyHandlers.liveness(ctx)).Methods("GET")
 
+	// The admin api has its own authentication and every request to it is audited, it is enabled when an admin api
+	// token is configured (which can be changed by reloading the config)
+	metricsRouter.PathPrefix(adminAPIPathPrefix).Handler(p.audit.middleware(proxyHandlers.adminAPIHandler()))
+
 	metricsRouter, err = p.MetricsClient.metricsHandler(ctx, metricsRouter)
 	if err != nil {
 		return err
@@ -140,11 +217,24 @@ func (p *proxy) Start(ctx context.Context) error {
 	// Setup http router
 	router := mux.NewRouter()
 
-	oidcHandler := newOIDCHandler(proxyHandlers.proxy(ctx, proxy), p.cfg.AzureTenantID, p.cfg.AzureClientID)
+	// Every upstream has its own OIDC handler since the audience (client id) can differ between upstreams
+	upstreamRouter := newUpstreamRouter(p.upstreams, func(up *upstream) http.Handler {
+		return newAuthHandler(ctx, p.clientCertificateAuth, p.breakGlass, proxyHandlers.proxy(ctx, up), p.cfg.AzureTenantID, up.clientID)
+	})
+
+	// Microsoft Graph change notifications are verified using the client state instead of a token
+	if p.graphNotifications != nil {
+		router.HandleFunc(p.graphNotifications.path(), p.graphNotifications.handler(ctx)).Methods(http.MethodPost)
+	}
 
-	router.PathPrefix("/").Handler(oidcHandler)
+	router.PathPrefix("/").Handler(upstreamRouter)
 
-	router.Use(p.cors.middleware)
+	if p.tracing != nil {
+		router.Use(p.tracing.middleware)
+	}
+	router.Use(requestMetricsMiddleware(ctx))
+	router.Use(proxyHandlers.corsMiddleware)
+	router.Use(p.audit.middleware)
 
 	httpServer := p.getHTTPServer(router)
 
@@ -158,6 +248,12 @@ func (p *proxy) Start(ctx context.Context) error {
 		return nil
 	})
 
+	// The graph subscription is created after the listener has started, since Microsoft Graph validates the url
+	if p.graphNotifications != nil {
+		go p.graphNotifications.processQueue(ctx)
+		go p.graphNotifications.run(ctx, graphSubscriptionCheckInterval)
+	}
+
 	log.Info("Server started")
 
 	// Blocks until signal is sent
@@ -201,6 +297,46 @@ func (p *proxy) Start(ctx context.Context) error {
 		return fmt.Errorf("error groups error: %w", err)
 	}
 
+	// Delete the graph subscription, the shutdown context may already be cancelled at this point
+	if p.graphNotifications != nil {
+		graphCtx, graphCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer graphCancel()
+
+		err = p.graphNotifications.close(graphCtx)
+		if err != nil {
+			log.Error(err, "graph subscription deletion failed")
+		}
+	}
+
+	// Flush the buffered audit events, the shutdown context may already be cancelled at this point
+	auditCtx, auditCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer auditCancel()
+
+	err = p.audit.close(auditCtx)
+	if err != nil {
+		log.Error(err, "audit shutdown failed")
+	}
+
+	// Export the metrics a last time (if pushed), the shutdown context may already be cancelled at this point
+	metricsCtx, metricsCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer metricsCancel()
+
+	err = p.MetricsClient.close(metricsCtx)
+	if err != nil {
+		log.Error(err, "metrics shutdown failed")
+	}
+
+	// Export the remaining spans, the shutdown context may already be cancelled at this point
+	if p.tracing != nil {
+		tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer tracingCancel()
+
+		err = p.tracing.close(tracingCtx)
+		if err != nil {
+			log.Error(err, "tracing shutdown failed")
+		}
+	}
+
 	log.Info("Server exited properly")
 
 	return nil
@@ -208,7 +344,8 @@ func (p *proxy) Start(ctx context.Context) error {
 
 func (p *proxy) listenAndServe(httpServer *http.Server) error {
 	if p.cfg.ListenerTLSConfigEnabled {
-		return httpServer.ListenAndServeTLS(p.cfg.ListenerTLSConfigCertificatePath, p.cfg.ListenerTLSConfigKeyPath)
+		// The certificate is served by the certificate reloader through GetCertificate
+		return httpServer.ListenAndServeTLS("", "")
 	}
 
 	return httpServer.ListenAndServe()
@@ -216,32 +353,65 @@ func (p *proxy) listenAndServe(httpServer *http.Server) error {
 
 func (p *proxy) getHTTPServer(handler http.Handler) *http.Server {
 	addr := fmt.Sprintf("%s:%d", p.cfg.ListenerAddress, p.cfg.ListenerPort)
-	return &http.Server{
+	httpServer := &http.Server{
 		Addr:              addr,
 		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
+
+	if p.listenerTLSConfig != nil {
+		httpServer.TLSConfig = p.listenerTLSConfig.Clone()
+
+		// Client certificates are optional, requests without a client certificate are authenticated using Azure AD
+		clientCAs := p.getClientCAs()
+		if clientCAs != nil {
+			httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			httpServer.TLSConfig.ClientCAs = clientCAs
+		}
+	}
+
+	return httpServer
+}
+
+// getClientCAs returns the pool used to verify client certificates in the TLS handshake, both the client certificate
+// authorities and the break-glass certificates themselves are trusted
+func (p *proxy) getClientCAs() *x509.CertPool {
+	var clientCAs *x509.CertPool
+	if p.clientCertificateAuth != nil {
+		clientCAs = p.clientCertificateAuth.clientCAs.Clone()
+	}
+
+	if p.breakGlass == nil {
+		return clientCAs
+	}
+
+	for _, credential := range p.breakGlass.credentials {
+		if credential.certificate == nil {
+			continue
+		}
+
+		if clientCAs == nil {
+			clientCAs = x509.NewCertPool()
+		}
+		clientCAs.AddCert(credential.certificate)
+	}
+
+	return clientCAs
 }
 
 func (p *proxy) getHTTPMetricsServer(handler http.Handler) *http.Server {
 	addr := fmt.Sprintf("%s:%d", p.cfg.MetricsListenerAddress, p.cfg.MetricsListenerPort)
-	return &http.Server{
+	httpServer := &http.Server{
 		Addr:              addr,
 		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
-}
 
-func (p *proxy) getReverseProxy(ctx context.Context) *httputil.ReverseProxy {
-	reverseProxy := httputil.NewSingleHostReverseProxy(p.kubernetesURL)
-	reverseProxy.Transport = p.getProxyTransport()
-	return reverseProxy
-}
-
-func (p *proxy) getProxyTransport() *http.Transport {
-	return &http.Transport{
-		TLSClientConfig: getProxyTLSClientConfig(p.cfg.KubernetesAPIValidateCert, p.kubernetesRootCA),
+	if p.listenerTLSConfig != nil {
+		httpServer.TLSConfig = p.listenerTLSConfig.Clone()
 	}
+
+	return httpServer
 }
 
 func getProxyTLSClientConfig(validateCertificate bool, rootCA *x509.CertPool) *tls.Config {
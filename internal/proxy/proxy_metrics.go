@@ -1,25 +1,293 @@
 package proxy
 
 import (
+	"context"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/gorilla/mux"
 )
 
 var (
-	metricsRequestsCount = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "azad_kube_proxy_request_count",
-		Help: "Total number of successful requests to azad-kube-proxy",
-	}, []string{"kubectl_version"})
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+	// metricsVerbs are the verb label values, the Kubernetes API verbs and the lowercased http methods of non-resource
+	// requests. Any other verb is recorded as other, since the requests are measured before they are authenticated.
+	metricsVerbs = map[string]struct{}{
+		"get":              {},
+		"list":             {},
+		"watch":            {},
+		"create":           {},
+		"update":           {},
+		"patch":            {},
+		"delete":           {},
+		"deletecollection": {},
+		"proxy":            {},
+		"post":             {},
+		"put":              {},
+		"head":             {},
+		"options":          {},
+	}
+
+	metricsRequestsCount = &metricDefinition{
+		name:   "azad_kube_proxy_request_count",
+		help:   "Total number of successful requests to azad-kube-proxy",
+		kind:   counterMetricKind,
+		labels: []string{"kubectl_version"},
+	}
+	metricsRequestDuration = &metricDefinition{
+		name:    "azad_kube_proxy_request_duration_seconds",
+		help:    "Duration of the requests to azad-kube-proxy by verb and status code, long-running requests are excluded",
+		kind:    histogramMetricKind,
+		labels:  []string{"verb", "code"},
+		buckets: durationBuckets,
+	}
+	metricsRequestsInFlight = &metricDefinition{
+		name: "azad_kube_proxy_requests_in_flight",
+		help: "Number of requests currently served by azad-kube-proxy, long-running requests are excluded",
+		kind: gaugeMetricKind,
+	}
+	metricsLongRunningRequests = &metricDefinition{
+		name: "azad_kube_proxy_long_running_requests",
+		help: "Number of open long-running requests (watches, exec, attach, port-forward and followed logs)",
+		kind: gaugeMetricKind,
+	}
+	metricsUserCacheRequests = &metricDefinition{
+		name:   "azad_kube_proxy_user_cache_requests_total",
+		help:   "Total number of user cache lookups by result (hit or miss)",
+		kind:   counterMetricKind,
+		labels: []string{"result"},
+	}
+	metricsGraphRequests = &metricDefinition{
+		name:   "azad_kube_proxy_graph_requests_total",
+		help:   "Total number of requests to Microsoft Graph by operation",
+		kind:   counterMetricKind,
+		labels: []string{"operation"},
+	}
+	metricsGraphRequestErrors = &metricDefinition{
+		name:   "azad_kube_proxy_graph_request_errors_total",
+		help:   "Total number of failed requests to Microsoft Graph by operation",
+		kind:   counterMetricKind,
+		labels: []string{"operation"},
+	}
+	metricsGraphRequestDuration = &metricDefinition{
+		name:    "azad_kube_proxy_graph_request_duration_seconds",
+		help:    "Duration of the requests to Microsoft Graph by operation",
+		kind:    histogramMetricKind,
+		labels:  []string{"operation"},
+		buckets: durationBuckets,
+	}
+	metricsGroupSyncDuration = &metricDefinition{
+		name:    "azad_kube_proxy_group_sync_duration_seconds",
+		help:    "Duration of the group synchronizations by type (full or delta)",
+		kind:    histogramMetricKind,
+		labels:  []string{"type"},
+		buckets: durationBuckets,
+	}
+	metricsGroupSyncErrors = &metricDefinition{
+		name: "azad_kube_proxy_group_sync_errors_total",
+		help: "Total number of failed group synchronizations",
+		kind: counterMetricKind,
+	}
+	metricsGroupSyncLastSuccess = &metricDefinition{
+		name: "azad_kube_proxy_group_sync_last_success_timestamp_seconds",
+		help: "The time of the last successful group synchronization as a unix timestamp",
+		kind: gaugeMetricKind,
+	}
+	metricsGroupCount = &metricDefinition{
+		name: "azad_kube_proxy_groups",
+		help: "Number of groups synchronized to the cache",
+		kind: gaugeMetricKind,
+	}
+	metricsUpstreamErrors = &metricDefinition{
+		name:   "azad_kube_proxy_upstream_errors_total",
+		help:   "Total number of requests that failed to be proxied to an upstream",
+		kind:   counterMetricKind,
+		labels: []string{"upstream"},
+	}
+	metricsAuditEventsDropped = &metricDefinition{
+		name:   "azad_kube_proxy_audit_events_dropped_total",
+		help:   "Total number of audit events dropped because the sink buffer was full",
+		kind:   counterMetricKind,
+		labels: []string{"sink"},
+	}
+	metricsAuditSinkErrors = &metricDefinition{
+		name:   "azad_kube_proxy_audit_sink_errors_total",
+		help:   "Total number of failed writes of audit event batches to a sink",
+		kind:   counterMetricKind,
+		labels: []string{"sink"},
+	}
+	metricsThrottledRequests = &metricDefinition{
+		name:   "azad_kube_proxy_throttled_requests_total",
+		help:   "Total number of requests throttled by azad-kube-proxy",
+		kind:   counterMetricKind,
+		labels: []string{"tier"},
+	}
+	metricsAuthPolicyRejections = &metricDefinition{
+		name:   "azad_kube_proxy_auth_policy_rejections_total",
+		help:   "Total number of requests rejected because the token didn't fulfill the auth policy",
+		kind:   counterMetricKind,
+		labels: []string{"requirement"},
+	}
+	metricsAuthorizationRuleDenials = &metricDefinition{
+		name:   "azad_kube_proxy_authorization_rule_denials_total",
+		help:   "Total number of requests denied by an authorization rule",
+		kind:   counterMetricKind,
+		labels: []string{"rule"},
+	}
+	metricsBreakGlassRequests = &metricDefinition{
+		name:   "azad_kube_proxy_break_glass_requests_total",
+		help:   "Total number of requests using a break-glass credential, including expired credentials",
+		kind:   counterMetricKind,
+		labels: []string{"credential"},
+	}
+	metricsGraphNotifications = &metricDefinition{
+		name:   "azad_kube_proxy_graph_notifications_total",
+		help:   "Total number of Microsoft Graph notifications received, by type (change, lifecycle or invalid_client_state)",
+		kind:   counterMetricKind,
+		labels: []string{"type"},
+	}
+	metricsTLSCertificateExpiry = &metricDefinition{
+		name: "azad_kube_proxy_tls_certificate_expiry_timestamp_seconds",
+		help: "The expiry (not after) of the listener TLS certificate as a unix timestamp",
+		kind: gaugeMetricKind,
+	}
+	metricsConfigReloads = &metricDefinition{
+		name:   "azad_kube_proxy_config_reloads_total",
+		help:   "Total number of config reloads, by result (success or error)",
+		kind:   counterMetricKind,
+		labels: []string{"result"},
+	}
+
+	// proxyMetricDefinitions contains all metrics of the proxy, every metric has to be added here to be recorded
+	proxyMetricDefinitions = []*metricDefinition{
+		metricsRequestsCount,
+		metricsRequestDuration,
+		metricsRequestsInFlight,
+		metricsLongRunningRequests,
+		metricsUserCacheRequests,
+		metricsGraphRequests,
+		metricsGraphRequestErrors,
+		metricsGraphRequestDuration,
+		metricsGroupSyncDuration,
+		metricsGroupSyncErrors,
+		metricsGroupSyncLastSuccess,
+		metricsGroupCount,
+		metricsUpstreamErrors,
+		metricsAuditEventsDropped,
+		metricsAuditSinkErrors,
+		metricsThrottledRequests,
+		metricsAuthPolicyRejections,
+		metricsAuthorizationRuleDenials,
+		metricsBreakGlassRequests,
+		metricsGraphNotifications,
+		metricsTLSCertificateExpiry,
+		metricsConfigReloads,
+	}
 )
 
-func incrementRequestCount(req *http.Request) {
+// requestMetricsMiddleware records the duration and number of in-flight requests, long-running requests are only
+// counted while they are open since their duration depends on the client
+func requestMetricsMiddleware(ctx context.Context) mux.MiddlewareFunc {
+	metricsClient := metricsFromContext(ctx)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := parseRequestInfo(r)
+			if isLongRunningRequest(r, info) {
+				metricsClient.add(metricsLongRunningRequests, 1)
+				defer metricsClient.add(metricsLongRunningRequests, -1)
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			metricsClient.add(metricsRequestsInFlight, 1)
+			defer metricsClient.add(metricsRequestsInFlight, -1)
+
+			start := time.Now()
+			aw := &auditResponseWriter{ResponseWriter: w}
+
+			next.ServeHTTP(aw, r)
+
+			metricsClient.observe(metricsRequestDuration, time.Since(start).Seconds(), getMetricsVerb(info.Verb), strconv.Itoa(aw.getStatusCode()))
+		})
+	}
+}
+
+func getMetricsVerb(verb string) string {
+	if _, ok := metricsVerbs[verb]; ok {
+		return verb
+	}
+
+	return "other"
+}
+
+func incrementRequestCount(ctx context.Context, req *http.Request) {
 	kubectlVersion := userAgentToKubectlVersion(req.Header.Get("User-Agent"))
-	metricsRequestsCount.With(prometheus.Labels{
-		"kubectl_version": kubectlVersion,
-	}).Inc()
+	metricsFromContext(ctx).add(metricsRequestsCount, 1, kubectlVersion)
+}
+
+func incrementUserCacheRequests(ctx context.Context, found bool) {
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+
+	metricsFromContext(ctx).add(metricsUserCacheRequests, 1, result)
+}
+
+// observeGraphRequest records a request to Microsoft Graph, it is used with defer and the named error of the caller
+func observeGraphRequest(ctx context.Context, operation string, start time.Time, err error) {
+	metricsClient := metricsFromContext(ctx)
+
+	metricsClient.add(metricsGraphRequests, 1, operation)
+	metricsClient.observe(metricsGraphRequestDuration, time.Since(start).Seconds(), operation)
+	if err != nil {
+		metricsClient.add(metricsGraphRequestErrors, 1, operation)
+	}
+}
+
+func observeGroupSync(ctx context.Context, syncType string, start time.Time, groupCount int) {
+	metricsClient := metricsFromContext(ctx)
+
+	metricsClient.observe(metricsGroupSyncDuration, time.Since(start).Seconds(), syncType)
+	metricsClient.set(metricsGroupSyncLastSuccess, float64(time.Now().Unix()))
+	metricsClient.set(metricsGroupCount, float64(groupCount))
+}
+
+func incrementGroupSyncErrors(ctx context.Context) {
+	metricsFromContext(ctx).add(metricsGroupSyncErrors, 1)
+}
+
+func incrementUpstreamErrors(ctx context.Context, upstreamName string) {
+	metricsFromContext(ctx).add(metricsUpstreamErrors, 1, upstreamName)
+}
+
+func incrementThrottledRequests(ctx context.Context, tier string) {
+	metricsFromContext(ctx).add(metricsThrottledRequests, 1, tier)
+}
+
+func incrementAuthPolicyRejections(ctx context.Context, requirement string) {
+	metricsFromContext(ctx).add(metricsAuthPolicyRejections, 1, requirement)
+}
+
+func incrementAuthorizationRuleDenials(ctx context.Context, rule string) {
+	metricsFromContext(ctx).add(metricsAuthorizationRuleDenials, 1, rule)
+}
+
+func incrementBreakGlassRequests(ctx context.Context, credential string) {
+	metricsFromContext(ctx).add(metricsBreakGlassRequests, 1, credential)
+}
+
+func incrementGraphNotifications(ctx context.Context, notificationType string) {
+	metricsFromContext(ctx).add(metricsGraphNotifications, 1, notificationType)
+}
+
+func incrementConfigReloads(ctx context.Context, result string) {
+	metricsFromContext(ctx).add(metricsConfigReloads, 1, result)
 }
 
 func userAgentToKubectlVersion(userAgent string) string {
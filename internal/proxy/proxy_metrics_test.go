@@ -1,11 +1,78 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/stretchr/testify/require"
 )
 
+func TestRequestMetricsMiddleware(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	inFlight := float64(-1)
+	longRunning := float64(-1)
+	handler := requestMetricsMiddleware(ctx)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = testMetricValue(t, metricsClient, metricsRequestsInFlight)
+		longRunning = testMetricValue(t, metricsClient, metricsLongRunningRequests)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods", nil))
+	require.Equal(t, float64(1), inFlight)
+	require.Equal(t, float64(0), longRunning)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/v1/namespaces/default/pods/ze-pod", nil))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsRequestDuration, "list", "200"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsRequestDuration, "delete", "403"))
+
+	// Unknown http methods are recorded as other, to not create a series for every method sent by clients
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("ZE-METHOD", "/version", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("ZE-OTHER-METHOD", "/api/v1/namespaces/default/pods", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/version", nil))
+	require.Equal(t, float64(2), testMetricValue(t, metricsClient, metricsRequestDuration, "other", "200"))
+	require.Equal(t, float64(0), testMetricValue(t, metricsClient, metricsRequestDuration, "ze-method", "200"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsRequestDuration, "post", "200"))
+
+	// Long-running requests are only counted while they are open
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?watch=true", nil))
+	require.Equal(t, float64(0), inFlight)
+	require.Equal(t, float64(1), longRunning)
+	require.Equal(t, float64(0), testMetricValue(t, metricsClient, metricsRequestDuration, "watch", "200"))
+
+	require.Equal(t, float64(0), testMetricValue(t, metricsClient, metricsRequestsInFlight))
+	require.Equal(t, float64(0), testMetricValue(t, metricsClient, metricsLongRunningRequests))
+}
+
+func TestObserveGraphRequest(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	observeGraphRequest(ctx, "list_groups", time.Now(), nil)
+	observeGraphRequest(ctx, "list_groups", time.Now(), errors.New("fake error"))
+
+	require.Equal(t, float64(2), testMetricValue(t, metricsClient, metricsGraphRequests, "list_groups"))
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequestErrors, "list_groups"))
+	require.Equal(t, float64(2), testMetricValue(t, metricsClient, metricsGraphRequestDuration, "list_groups"))
+}
+
+func TestMetricsFromContext(t *testing.T) {
+	// Metrics are discarded when the context doesn't contain a metrics client
+	require.IsType(t, &noneClient{}, metricsFromContext(context.Background()))
+	incrementThrottledRequests(context.Background(), "user")
+
+	ctx, metricsClient := testNewMetricsContext(t, context.Background())
+	require.Equal(t, metricsClient, metricsFromContext(ctx))
+}
+
 func TestUserAgentToKubectlVersion(t *testing.T) {
 	cases := []struct {
 		userAgent       string
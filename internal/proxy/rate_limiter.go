@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	globalRateLimitTier       = "global"
+	userRateLimitTier         = "user"
+	groupRateLimitTier        = "group"
+	longRunningRateLimitTier  = "long-running"
+	longRunningUserLimitTier  = "long-running-user"
+	rateLimiterIdleExpiration = 10 * time.Minute
+	longRunningRetryAfter     = 5 * time.Second
+)
+
+// rateLimiter throttles requests using token buckets per tier (global, per user and per group) and caps the number of
+// concurrent long-running requests (watch, exec, attach, port-forward and proxy). A tier with a qps of 0 (or a cap of
+// 0) is disabled. The rate limiter is kept when the config is reloaded, only its limits are updated.
+type rateLimiter struct {
+	global *rateLimiterStore
+	users  *rateLimiterStore
+	groups *rateLimiterStore
+
+	mu                    sync.Mutex
+	maxLongRunning        int
+	maxLongRunningPerUser int
+	longRunning           int
+	longRunningPerUser    map[string]int
+}
+
+func newRateLimiter(cfg *config) (*rateLimiter, error) {
+	tiers := []struct {
+		name  string
+		qps   float64
+		burst int
+	}{
+		{globalRateLimitTier, cfg.RateLimitGlobalQPS, cfg.RateLimitGlobalBurst},
+		{userRateLimitTier, cfg.RateLimitUserQPS, cfg.RateLimitUserBurst},
+		{groupRateLimitTier, cfg.RateLimitGroupQPS, cfg.RateLimitGroupBurst},
+	}
+
+	for _, tier := range tiers {
+		if tier.qps < 0 {
+			return nil, fmt.Errorf("rate limit qps for tier %s can't be negative: %f", tier.name, tier.qps)
+		}
+
+		if tier.qps > 0 && tier.burst < 1 {
+			return nil, fmt.Errorf("rate limit burst for tier %s needs to be at least 1 but was: %d", tier.name, tier.burst)
+		}
+	}
+
+	if cfg.MaxLongRunningRequests < 0 || cfg.MaxLongRunningRequestsPerUser < 0 {
+		return nil, fmt.Errorf("max long running requests can't be negative")
+	}
+
+	return &rateLimiter{
+		global:                newRateLimiterStore(cfg.RateLimitGlobalQPS, cfg.RateLimitGlobalBurst),
+		users:                 newRateLimiterStore(cfg.RateLimitUserQPS, cfg.RateLimitUserBurst),
+		groups:                newRateLimiterStore(cfg.RateLimitGroupQPS, cfg.RateLimitGroupBurst),
+		maxLongRunning:        cfg.MaxLongRunningRequests,
+		maxLongRunningPerUser: cfg.MaxLongRunningRequestsPerUser,
+		longRunningPerUser:    make(map[string]int),
+	}, nil
+}
+
+// update applies the limits of next, the token buckets and the long-running requests that are open are kept. The
+// long-running requests above a lowered cap are kept open, new ones are rejected until they are below the cap.
+func (l *rateLimiter) update(next *rateLimiter) {
+	l.global.update(next.global.qps, next.global.burst)
+	l.users.update(next.users.qps, next.users.burst)
+	l.groups.update(next.groups.qps, next.groups.burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxLongRunning = next.maxLongRunning
+	l.maxLongRunningPerUser = next.maxLongRunningPerUser
+}
+
+// allow takes a token from every tier the request belongs to. If any tier is out of tokens, the tokens already taken
+// are returned and the throttling tier is returned together with the time until a token is available.
+func (l *rateLimiter) allow(user userModel) (bool, string, time.Duration) {
+	now := time.Now()
+	reservations := []*rate.Reservation{}
+	cancelAll := func() {
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+	}
+
+	reserve := func(limiter *rate.Limiter) (bool, time.Duration) {
+		if limiter == nil {
+			return true, 0
+		}
+
+		reservation := limiter.ReserveN(now, 1)
+		if !reservation.OK() {
+			return false, time.Second
+		}
+
+		delay := reservation.DelayFrom(now)
+		if delay > 0 {
+			reservation.CancelAt(now)
+			return false, delay
+		}
+
+		reservations = append(reservations, reservation)
+		return true, 0
+	}
+
+	// The global tier is a store with a single token bucket, to be enabled and disabled the same way as the other tiers
+	if ok, delay := reserve(l.global.get(globalRateLimitTier, now)); !ok {
+		cancelAll()
+		return false, globalRateLimitTier, delay
+	}
+
+	if ok, delay := reserve(l.users.get(getRateLimitUserKey(user), now)); !ok {
+		cancelAll()
+		return false, userRateLimitTier, delay
+	}
+
+	for _, group := range user.Groups {
+		if ok, delay := reserve(l.groups.get(group.ObjectID, now)); !ok {
+			cancelAll()
+			return false, groupRateLimitTier, delay
+		}
+	}
+
+	return true, "", 0
+}
+
+// acquireLongRunning reserves a slot for a long-running request. The returned release function has to be called when
+// the request is done.
+func (l *rateLimiter) acquireLongRunning(user userModel) (func(), bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxLongRunning > 0 && l.longRunning >= l.maxLongRunning {
+		return nil, false, longRunningRateLimitTier
+	}
+
+	userKey := getRateLimitUserKey(user)
+
+	if l.maxLongRunningPerUser > 0 && l.longRunningPerUser[userKey] >= l.maxLongRunningPerUser {
+		return nil, false, longRunningUserLimitTier
+	}
+
+	l.longRunning++
+	l.longRunningPerUser[userKey]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.longRunning--
+			l.longRunningPerUser[userKey]--
+			if l.longRunningPerUser[userKey] <= 0 {
+				delete(l.longRunningPerUser, userKey)
+			}
+		})
+	}
+
+	return release, true, ""
+}
+
+// getRateLimitUserKey returns the key of the user in the rate limiter. Users authenticated with a client certificate
+// don't have an object id and are identified by the username instead.
+func getRateLimitUserKey(user userModel) string {
+	if user.ObjectID != "" {
+		return user.ObjectID
+	}
+
+	return user.Username
+}
+
+// isLongRunningRequest returns true for requests that keep the connection open, like watches and streaming subresources
+func isLongRunningRequest(r *http.Request, info requestInfo) bool {
+	if strings.EqualFold(r.Header.Get("Connection"), "upgrade") || r.Header.Get("Upgrade") != "" {
+		return true
+	}
+
+	if info.Verb == "watch" || info.Verb == "proxy" {
+		return true
+	}
+
+	switch info.Subresource {
+	case "exec", "attach", "portforward", "proxy":
+		return true
+	case "log":
+		return r.URL.Query().Get("follow") == "true"
+	default:
+		return false
+	}
+}
+
+// writeTooManyRequests writes a Kubernetes Status (like the API server does when throttling) with a Retry-After header
+func writeTooManyRequests(w http.ResponseWriter, tier string, retryAfter time.Duration) error {
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+
+	status := k8sapierrors.NewTooManyRequests(fmt.Sprintf("Too many requests, rate limited by azad-kube-proxy (%s), please try again later.", tier), retryAfterSeconds).ErrStatus
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	return writeKubernetesStatus(w, status)
+}
+
+// rateLimiterStore keeps one token bucket per key, buckets that haven't been used for a while are removed
+type rateLimiterStore struct {
+	mu        sync.Mutex
+	qps       float64
+	burst     int
+	limiters  map[string]*rateLimiterEntry
+	lastSweep time.Time
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiterStore(qps float64, burst int) *rateLimiterStore {
+	return &rateLimiterStore{
+		qps:       qps,
+		burst:     burst,
+		limiters:  make(map[string]*rateLimiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *rateLimiterStore) get(key string, now time.Time) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.qps <= 0 {
+		return nil
+	}
+
+	if now.Sub(s.lastSweep) > rateLimiterIdleExpiration {
+		for k, entry := range s.limiters {
+			if now.Sub(entry.lastSeen) > rateLimiterIdleExpiration {
+				delete(s.limiters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.limiters[key]
+	if !ok {
+		entry = &rateLimiterEntry{
+			limiter: rate.NewLimiter(rate.Limit(s.qps), s.burst),
+		}
+		s.limiters[key] = entry
+	}
+	entry.lastSeen = now
+
+	return entry.limiter
+}
+
+// update changes the limits of the existing token buckets, without refilling them. The buckets are removed when the
+// tier is disabled.
+func (s *rateLimiterStore) update(qps float64, burst int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.qps = qps
+	s.burst = burst
+
+	if qps <= 0 {
+		s.limiters = make(map[string]*rateLimiterEntry)
+		return
+	}
+
+	for _, entry := range s.limiters {
+		entry.limiter.SetLimit(rate.Limit(qps))
+		entry.limiter.SetBurst(burst)
+	}
+}
@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	k8sapimachinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	cases := []struct {
+		cfg                 *config
+		expectedErrContains string
+	}{
+		{
+			cfg: &config{},
+		},
+		{
+			cfg: &config{
+				RateLimitGlobalQPS:   10,
+				RateLimitGlobalBurst: 10,
+				RateLimitUserQPS:     1,
+				RateLimitUserBurst:   1,
+			},
+		},
+		{
+			cfg: &config{
+				RateLimitUserQPS: -1,
+			},
+			expectedErrContains: "rate limit qps for tier user can't be negative",
+		},
+		{
+			cfg: &config{
+				RateLimitGroupQPS:   1,
+				RateLimitGroupBurst: 0,
+			},
+			expectedErrContains: "rate limit burst for tier group needs to be at least 1",
+		},
+		{
+			cfg: &config{
+				MaxLongRunningRequestsPerUser: -1,
+			},
+			expectedErrContains: "max long running requests can't be negative",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		_, err := newRateLimiter(c.cfg)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	userA := userModel{ObjectID: "user-a", Groups: []groupModel{{ObjectID: "group-a"}}}
+	userB := userModel{ObjectID: "user-b", Groups: []groupModel{{ObjectID: "group-a"}}}
+	userC := userModel{ObjectID: "user-c", Groups: []groupModel{{ObjectID: "group-b"}}}
+
+	t.Run("disabled", func(t *testing.T) {
+		limiter, err := newRateLimiter(&config{})
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			allowed, _, _ := limiter.allow(userA)
+			require.True(t, allowed)
+		}
+	})
+
+	t.Run("user", func(t *testing.T) {
+		limiter, err := newRateLimiter(&config{
+			RateLimitUserQPS:   0.001,
+			RateLimitUserBurst: 2,
+		})
+		require.NoError(t, err)
+
+		testRequireAllowed(t, limiter, userA, true, "")
+		testRequireAllowed(t, limiter, userA, true, "")
+		testRequireAllowed(t, limiter, userA, false, userRateLimitTier)
+
+		// Another user has its own bucket
+		testRequireAllowed(t, limiter, userB, true, "")
+	})
+
+	t.Run("group", func(t *testing.T) {
+		limiter, err := newRateLimiter(&config{
+			RateLimitGroupQPS:   0.001,
+			RateLimitGroupBurst: 2,
+		})
+		require.NoError(t, err)
+
+		testRequireAllowed(t, limiter, userA, true, "")
+		testRequireAllowed(t, limiter, userB, true, "")
+		testRequireAllowed(t, limiter, userA, false, groupRateLimitTier)
+		testRequireAllowed(t, limiter, userB, false, groupRateLimitTier)
+
+		// Members of another group are not affected
+		testRequireAllowed(t, limiter, userC, true, "")
+	})
+
+	t.Run("global", func(t *testing.T) {
+		limiter, err := newRateLimiter(&config{
+			RateLimitGlobalQPS:   0.001,
+			RateLimitGlobalBurst: 1,
+		})
+		require.NoError(t, err)
+
+		testRequireAllowed(t, limiter, userA, true, "")
+		testRequireAllowed(t, limiter, userC, false, globalRateLimitTier)
+	})
+
+	t.Run("tokens are returned when a later tier throttles", func(t *testing.T) {
+		limiter, err := newRateLimiter(&config{
+			RateLimitGlobalQPS:   0.001,
+			RateLimitGlobalBurst: 2,
+			RateLimitUserQPS:     0.001,
+			RateLimitUserBurst:   1,
+		})
+		require.NoError(t, err)
+
+		testRequireAllowed(t, limiter, userA, true, "")
+		testRequireAllowed(t, limiter, userA, false, userRateLimitTier)
+		testRequireAllowed(t, limiter, userA, false, userRateLimitTier)
+
+		// The throttled requests of user A didn't consume the global tokens
+		testRequireAllowed(t, limiter, userB, true, "")
+	})
+}
+
+func TestRateLimiterAcquireLongRunning(t *testing.T) {
+	limiter, err := newRateLimiter(&config{
+		MaxLongRunningRequests:        3,
+		MaxLongRunningRequestsPerUser: 2,
+	})
+	require.NoError(t, err)
+
+	userA := userModel{ObjectID: "user-a"}
+	userB := userModel{ObjectID: "user-b"}
+
+	releaseA1, ok, _ := limiter.acquireLongRunning(userA)
+	require.True(t, ok)
+	_, ok, _ = limiter.acquireLongRunning(userA)
+	require.True(t, ok)
+
+	_, ok, tier := limiter.acquireLongRunning(userA)
+	require.False(t, ok)
+	require.Equal(t, longRunningUserLimitTier, tier)
+
+	_, ok, _ = limiter.acquireLongRunning(userB)
+	require.True(t, ok)
+
+	_, ok, tier = limiter.acquireLongRunning(userB)
+	require.False(t, ok)
+	require.Equal(t, longRunningRateLimitTier, tier)
+
+	// Releasing more than once doesn't free more than one slot
+	releaseA1()
+	releaseA1()
+
+	_, ok, _ = limiter.acquireLongRunning(userB)
+	require.True(t, ok)
+
+	_, ok, _ = limiter.acquireLongRunning(userB)
+	require.False(t, ok)
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	limiter, err := newRateLimiter(&config{
+		RateLimitUserQPS:       0.001,
+		RateLimitUserBurst:     2,
+		MaxLongRunningRequests: 2,
+	})
+	require.NoError(t, err)
+
+	userA := userModel{ObjectID: "user-a"}
+	userB := userModel{ObjectID: "user-b"}
+
+	testRequireAllowed(t, limiter, userA, true, "")
+	testRequireAllowed(t, limiter, userA, true, "")
+
+	releaseB1, ok, _ := limiter.acquireLongRunning(userB)
+	require.True(t, ok)
+	releaseB2, ok, _ := limiter.acquireLongRunning(userB)
+	require.True(t, ok)
+
+	next, err := newRateLimiter(&config{
+		RateLimitGlobalQPS:     0.001,
+		RateLimitGlobalBurst:   4,
+		RateLimitUserQPS:       0.001,
+		RateLimitUserBurst:     3,
+		MaxLongRunningRequests: 1,
+	})
+	require.NoError(t, err)
+	limiter.update(next)
+
+	// The bucket of user A isn't refilled, new buckets use the new burst
+	testRequireAllowed(t, limiter, userA, false, userRateLimitTier)
+	testRequireAllowed(t, limiter, userB, true, "")
+	testRequireAllowed(t, limiter, userB, true, "")
+	testRequireAllowed(t, limiter, userB, true, "")
+	testRequireAllowed(t, limiter, userB, false, userRateLimitTier)
+
+	// The open long-running requests are counted against the new cap
+	releaseB1()
+	_, ok, tier := limiter.acquireLongRunning(userA)
+	require.False(t, ok)
+	require.Equal(t, longRunningRateLimitTier, tier)
+
+	releaseB2()
+	_, ok, _ = limiter.acquireLongRunning(userA)
+	require.True(t, ok)
+
+	// The tiers can be disabled
+	next, err = newRateLimiter(&config{})
+	require.NoError(t, err)
+	limiter.update(next)
+
+	testRequireAllowed(t, limiter, userA, true, "")
+	testRequireAllowed(t, limiter, userB, true, "")
+}
+
+func TestIsLongRunningRequest(t *testing.T) {
+	cases := []struct {
+		method   string
+		target   string
+		headers  map[string]string
+		expected bool
+	}{
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods",
+			expected: false,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods?watch=true",
+			expected: true,
+		},
+		{
+			method:   http.MethodPost,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/exec",
+			expected: true,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/log",
+			expected: false,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/log?follow=true",
+			expected: true,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/api/v1/namespaces/default/pods/ze-pod/portforward",
+			headers:  map[string]string{"Connection": "Upgrade", "Upgrade": "SPDY/3.1"},
+			expected: true,
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(c.method, c.target, nil)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+
+		require.Equal(t, c.expected, isLongRunningRequest(req, parseRequestInfo(req)))
+	}
+}
+
+func TestWriteTooManyRequests(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := writeTooManyRequests(rr, userRateLimitTier, 1500*time.Millisecond)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "2", rr.Header().Get("Retry-After"))
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var status k8sapimachinerymetav1.Status
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	require.Equal(t, "Status", status.Kind)
+	require.Equal(t, "v1", status.APIVersion)
+	require.Equal(t, k8sapimachinerymetav1.StatusFailure, status.Status)
+	require.Equal(t, k8sapimachinerymetav1.StatusReasonTooManyRequests, status.Reason)
+	require.Equal(t, int32(http.StatusTooManyRequests), status.Code)
+	require.Equal(t, int32(2), status.Details.RetryAfterSeconds)
+	require.Contains(t, status.Message, "(user)")
+}
+
+func TestProxyHandlerRateLimit(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	requestCount := 0
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	kubernetesAPITokenPath, cleanupFn := testGetKubernetesAPITokenPath(t)
+	defer cleanupFn()
+
+	cfg := &config{
+		AzureADMaxGroupCount:   testFakeMaxGroups,
+		GroupIdentifier:        "NAME",
+		KubernetesAPITokenPath: kubernetesAPITokenPath,
+		RateLimitUserQPS:       0.001,
+		RateLimitUserBurst:     1,
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	reverseProxy := testNewUpstream(t, fakeAPIServer.URL)
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, reverseProxy)(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", claims))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, reverseProxy)(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", claims))
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	require.Equal(t, 1, requestCount)
+}
+
+func testRequireAllowed(t *testing.T, limiter *rateLimiter, user userModel, expectedAllowed bool, expectedTier string) {
+	t.Helper()
+
+	allowed, tier, retryAfter := limiter.allow(user)
+	require.Equal(t, expectedAllowed, allowed)
+	require.Equal(t, expectedTier, tier)
+
+	if !expectedAllowed {
+		require.Greater(t, retryAfter, time.Duration(0))
+	}
+}
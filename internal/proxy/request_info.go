@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requestInfo contains the Kubernetes attributes of a request, parsed the same way as the Kubernetes API server does
+// for authorization (see k8s.io/apiserver/pkg/endpoints/request).
+type requestInfo struct {
+	IsResourceRequest bool   `json:"isResourceRequest"`
+	Path              string `json:"path"`
+	Verb              string `json:"verb"`
+	APIGroup          string `json:"apiGroup,omitempty"`
+	APIVersion        string `json:"apiVersion,omitempty"`
+	Namespace         string `json:"namespace,omitempty"`
+	Resource          string `json:"resource,omitempty"`
+	Subresource       string `json:"subresource,omitempty"`
+	Name              string `json:"name,omitempty"`
+}
+
+func parseRequestInfo(r *http.Request) requestInfo {
+	info := requestInfo{
+		IsResourceRequest: false,
+		Path:              r.URL.Path,
+		Verb:              strings.ToLower(r.Method),
+	}
+
+	parts := splitPath(r.URL.Path)
+	if len(parts) < 2 {
+		return info
+	}
+
+	switch parts[0] {
+	case "api":
+		info.APIVersion = parts[1]
+		parts = parts[2:]
+	case "apis":
+		if len(parts) < 3 {
+			return info
+		}
+		info.APIGroup = parts[1]
+		info.APIVersion = parts[2]
+		parts = parts[3:]
+	default:
+		return info
+	}
+
+	// Discovery requests like /api/v1 or /apis/apps/v1 are non-resource requests
+	if len(parts) == 0 {
+		info.APIGroup = ""
+		info.APIVersion = ""
+		return info
+	}
+
+	info.IsResourceRequest = true
+
+	switch r.Method {
+	case http.MethodPost:
+		info.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		info.Verb = "get"
+	case http.MethodPut:
+		info.Verb = "update"
+	case http.MethodPatch:
+		info.Verb = "patch"
+	case http.MethodDelete:
+		info.Verb = "delete"
+	default:
+		info.Verb = ""
+	}
+
+	// The deprecated special verb paths (/api/v1/watch/... and /api/v1/proxy/...) are still supported by the Kubernetes API
+	if parts[0] == "watch" || parts[0] == "proxy" {
+		info.Verb = parts[0]
+		parts = parts[1:]
+		if len(parts) == 0 {
+			return info
+		}
+	}
+
+	if parts[0] == "namespaces" {
+		if len(parts) > 1 {
+			info.Namespace = parts[1]
+
+			// The namespace itself and its subresources use /api/v1/namespaces/<name>[/status|/finalize], everything
+			// else below it is a namespaced resource
+			if len(parts) > 2 && parts[2] != "status" && parts[2] != "finalize" {
+				parts = parts[2:]
+			}
+		}
+	}
+
+	info.Resource = parts[0]
+	if len(parts) > 1 {
+		info.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		info.Subresource = parts[2]
+	}
+
+	if info.Name == "" {
+		switch info.Verb {
+		case "get":
+			info.Verb = "list"
+			if isWatchQuery(r) {
+				info.Verb = "watch"
+			}
+		case "delete":
+			info.Verb = "deletecollection"
+		}
+	}
+
+	return info
+}
+
+func isWatchQuery(r *http.Request) bool {
+	value := strings.ToLower(r.URL.Query().Get("watch"))
+	return value == "true" || value == "1"
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestInfo(t *testing.T) {
+	cases := []struct {
+		method              string
+		target              string
+		expectedRequestInfo requestInfo
+	}{
+		{
+			method: http.MethodGet,
+			target: "/version",
+			expectedRequestInfo: requestInfo{
+				Path: "/version",
+				Verb: "get",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/apis/apps/v1",
+			expectedRequestInfo: requestInfo{
+				Path: "/apis/apps/v1",
+				Verb: "get",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/api/v1/namespaces/default/pods",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods",
+				Verb:              "list",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/api/v1/namespaces/default/pods?watch=true",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods",
+				Verb:              "watch",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/api/v1/watch/namespaces/default/pods",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/watch/namespaces/default/pods",
+				Verb:              "watch",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+			},
+		},
+		{
+			method: http.MethodPost,
+			target: "/api/v1/namespaces/default/pods/ze-pod/exec?command=sh",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods/ze-pod/exec",
+				Verb:              "create",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+				Subresource:       "exec",
+				Name:              "ze-pod",
+			},
+		},
+		{
+			method: http.MethodPatch,
+			target: "/apis/apps/v1/namespaces/default/deployments/ze-deployment",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/apps/v1/namespaces/default/deployments/ze-deployment",
+				Verb:              "patch",
+				APIGroup:          "apps",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "deployments",
+				Name:              "ze-deployment",
+			},
+		},
+		{
+			method: http.MethodDelete,
+			target: "/apis/apps/v1/namespaces/default/deployments",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/apps/v1/namespaces/default/deployments",
+				Verb:              "deletecollection",
+				APIGroup:          "apps",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "deployments",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/api/v1/namespaces/default",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default",
+				Verb:              "get",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "namespaces",
+				Name:              "default",
+			},
+		},
+		{
+			method: http.MethodPut,
+			target: "/api/v1/namespaces/default/finalize",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/finalize",
+				Verb:              "update",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "namespaces",
+				Subresource:       "finalize",
+				Name:              "default",
+			},
+		},
+		{
+			method: http.MethodGet,
+			target: "/apis/rbac.authorization.k8s.io/v1/clusterroles/admin",
+			expectedRequestInfo: requestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/rbac.authorization.k8s.io/v1/clusterroles/admin",
+				Verb:              "get",
+				APIGroup:          "rbac.authorization.k8s.io",
+				APIVersion:        "v1",
+				Resource:          "clusterroles",
+				Name:              "admin",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(c.method, c.target, nil)
+		require.Equal(t, c.expectedRequestInfo, parseRequestInfo(req))
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// tokenFileCheckInterval is how often the token file is read again, client-go uses one minute for BearerTokenFile
+	// but a shorter interval is used since reading the file is cheap
+	tokenFileCheckInterval = 10 * time.Second
+	// tokenExpiryLeeway is how long before the expiry of the token it is read from the file again, even if the check
+	// interval hasn't passed
+	tokenExpiryLeeway = 1 * time.Minute
+	// tokenExpiryCheckInterval is how often the token file is read again when the token is close to expiry, until the
+	// file has been rotated
+	tokenExpiryCheckInterval = 5 * time.Second
+)
+
+// tokenSource provides the token the proxy uses to authenticate to the Kubernetes API
+type tokenSource interface {
+	token() (string, error)
+}
+
+// fileTokenSource reads the token from a file and reloads it when the file changes or the token gets close to expiry.
+// Projected service account tokens are rotated by the kubelet, which replaces the file.
+type fileTokenSource struct {
+	path          string
+	checkInterval time.Duration
+	log           logr.Logger
+	now           func() time.Time
+
+	mu          sync.RWMutex
+	cachedToken string
+	expiry      time.Time
+	lastChecked time.Time
+}
+
+func newFileTokenSource(ctx context.Context, path string) (*fileTokenSource, error) {
+	s := &fileTokenSource{
+		path:          path,
+		checkInterval: tokenFileCheckInterval,
+		log:           logr.FromContextOrDiscard(ctx),
+		now:           time.Now,
+	}
+
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// token returns the cached token, the token file is read again at most once per check interval. If the file can't be
+// read the previous token is returned, as long as it hasn't expired.
+func (s *fileTokenSource) token() (string, error) {
+	s.mu.RLock()
+	if !s.shouldCheck() {
+		token := s.cachedToken
+		s.mu.RUnlock()
+		return token, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.shouldCheck() {
+		return s.cachedToken, nil
+	}
+
+	s.lastChecked = s.now()
+	err := s.load()
+	if err != nil {
+		if !s.expiry.IsZero() && !s.now().Before(s.expiry) {
+			return "", fmt.Errorf("unable to reload expired token from %q: %w", s.path, err)
+		}
+
+		s.log.Error(err, "Unable to reload token, using the previous token", "file-path", s.path)
+	}
+
+	return s.cachedToken, nil
+}
+
+// shouldCheck needs to be called with the lock held
+func (s *fileTokenSource) shouldCheck() bool {
+	now := s.now()
+	sinceLastChecked := now.Sub(s.lastChecked)
+	if sinceLastChecked >= s.checkInterval {
+		return true
+	}
+
+	closeToExpiry := !s.expiry.IsZero() && now.Add(tokenExpiryLeeway).After(s.expiry)
+
+	return closeToExpiry && sinceLastChecked >= tokenExpiryCheckInterval
+}
+
+func (s *fileTokenSource) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastChecked = s.now()
+
+	return s.load()
+}
+
+// load needs to be called with the write lock held
+func (s *fileTokenSource) load() error {
+	b, err := os.ReadFile(s.path) // #nosec
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("token file %q is empty", s.path)
+	}
+
+	if token != s.cachedToken && s.cachedToken != "" {
+		s.log.Info("Reloaded token", "file-path", s.path)
+	}
+
+	s.cachedToken = token
+	s.expiry = getTokenExpiry(token)
+
+	return nil
+}
+
+// getTokenExpiry returns the expiry of a JWT without validating it, or the zero time if the token isn't a JWT or
+// doesn't expire
+func getTokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
+
+// tokenRoundTripper adds the token of the token source to requests, used for the Kubernetes client the same way
+// client-go uses BearerTokenFile
+type tokenRoundTripper struct {
+	source tokenSource
+	next   http.RoundTripper
+}
+
+func newTokenRoundTripper(source tokenSource) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &tokenRoundTripper{
+			source: source,
+			next:   next,
+		}
+	}
+}
+
+func (rt *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(authorizationHeader) != "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	token, err := rt.source.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(authorizationHeader, fmt.Sprintf("Bearer %s", token))
+
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	testCreateTemporaryFile(t, tokenPath, "first-token\n")
+
+	source, err := newFileTokenSource(ctx, tokenPath)
+	require.NoError(t, err)
+	now := source.lastChecked
+	source.now = func() time.Time { return now }
+
+	testRequireToken(t, source, "first-token")
+
+	// The file isn't checked again until the check interval has passed
+	testRotateTokenFile(t, tokenPath, "second-token")
+	testRequireToken(t, source, "first-token")
+
+	now = now.Add(tokenFileCheckInterval)
+	testRequireToken(t, source, "second-token")
+
+	// The previous token is used if the file can't be read
+	require.NoError(t, os.Remove(tokenPath))
+	now = now.Add(tokenFileCheckInterval)
+	testRequireToken(t, source, "second-token")
+
+	testCreateTemporaryFile(t, tokenPath, "")
+	now = now.Add(tokenFileCheckInterval)
+	testRequireToken(t, source, "second-token")
+
+	testRotateTokenFile(t, tokenPath, "third-token")
+	now = now.Add(tokenFileCheckInterval)
+	testRequireToken(t, source, "third-token")
+}
+
+func TestFileTokenSourceExpiry(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	now := time.Now()
+	firstToken := testNewUnsignedJWT(t, now.Add(10*time.Minute))
+	secondToken := testNewUnsignedJWT(t, now.Add(time.Hour))
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	testCreateTemporaryFile(t, tokenPath, firstToken)
+
+	source, err := newFileTokenSource(ctx, tokenPath)
+	require.NoError(t, err)
+	source.now = func() time.Time { return now }
+	source.checkInterval = time.Hour
+
+	require.Equal(t, now.Add(10*time.Minute).Unix(), source.expiry.Unix())
+	testRequireToken(t, source, firstToken)
+
+	// The token is read again when it's close to expiry, even if the check interval hasn't passed
+	testRotateTokenFile(t, tokenPath, secondToken)
+	now = now.Add(5 * time.Minute)
+	testRequireToken(t, source, firstToken)
+
+	now = now.Add(4*time.Minute + 30*time.Second)
+	testRequireToken(t, source, secondToken)
+
+	// Close to expiry the file is still read at most once per expiry check interval, until it has been rotated
+	thirdToken := testNewUnsignedJWT(t, now.Add(2*time.Hour))
+	now = now.Add(50 * time.Minute)
+	testRequireToken(t, source, secondToken)
+
+	testRotateTokenFile(t, tokenPath, thirdToken)
+	now = now.Add(tokenExpiryCheckInterval / 2)
+	testRequireToken(t, source, secondToken)
+
+	now = now.Add(tokenExpiryCheckInterval / 2)
+	testRequireToken(t, source, thirdToken)
+
+	// An expired token isn't returned if the file can't be read
+	require.NoError(t, os.Remove(tokenPath))
+	now = now.Add(2 * time.Hour)
+	_, err = source.token()
+	require.ErrorContains(t, err, "unable to reload expired token")
+}
+
+func TestNewFileTokenSource(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tmpDir := t.TempDir()
+
+	_, err := newFileTokenSource(ctx, filepath.Join(tmpDir, "does-not-exist"))
+	require.ErrorContains(t, err, "no such file or directory")
+
+	emptyTokenPath := filepath.Join(tmpDir, "empty-token")
+	testCreateTemporaryFile(t, emptyTokenPath, " \n")
+	_, err = newFileTokenSource(ctx, emptyTokenPath)
+	require.ErrorContains(t, err, "is empty")
+}
+
+func TestGetTokenExpiry(t *testing.T) {
+	expiry := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		token          string
+		expectedExpiry time.Time
+	}{
+		{
+			token:          testNewUnsignedJWT(t, expiry),
+			expectedExpiry: expiry,
+		},
+		{
+			token:          "fake-token",
+			expectedExpiry: time.Time{},
+		},
+		{
+			token:          "a.b.c",
+			expectedExpiry: time.Time{},
+		},
+		{
+			token:          fmt.Sprintf("e30.%s.c", base64.RawURLEncoding.EncodeToString([]byte("{\"sub\":\"ze-sub\"}"))),
+			expectedExpiry: time.Time{},
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		require.True(t, c.expectedExpiry.Equal(getTokenExpiry(c.token)))
+	}
+}
+
+func TestTokenRoundTripper(t *testing.T) {
+	var receivedAuthorization []string
+	fakeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAuthorization = append(receivedAuthorization, r.Header.Get(authorizationHeader))
+	}))
+	defer fakeServer.Close()
+
+	client := &http.Client{
+		Transport: newTokenRoundTripper(staticTokenSource("fake-token"))(http.DefaultTransport),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fakeServer.URL, nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	// The Authorization header of the request is not overwritten and the original request is not modified
+	require.Empty(t, req.Header.Get(authorizationHeader))
+	req.Header.Set(authorizationHeader, "Bearer other-token")
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	require.Equal(t, []string{"Bearer fake-token", "Bearer other-token"}, receivedAuthorization)
+}
+
+func TestProxyHandlerTokenRotation(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var receivedAuthorization []string
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAuthorization = append(receivedAuthorization, r.Header.Get(authorizationHeader))
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	testCreateTemporaryFile(t, tokenPath, "first-token")
+
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+	}
+
+	host, port := testSplitServerHostPort(t, fakeAPIServer)
+	up, err := newUpstream(ctx, cfg, upstreamConfig{
+		Name:                      defaultUpstreamName,
+		Default:                   true,
+		KubernetesAPIHost:         host,
+		KubernetesAPIPort:         port,
+		KubernetesAPITLS:          testToPtr(t, false),
+		KubernetesAPIValidateCert: testToPtr(t, false),
+		KubernetesAPITokenPath:    tokenPath,
+	})
+	require.NoError(t, err)
+	up.kubernetesToken.(*fileTokenSource).checkInterval = 0
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+	up.reverseProxy = up.getReverseProxy(proxyHandlers.error(ctx, up.name))
+
+	healthClient, err := newHealthClient(ctx, cfg, []*upstream{up}, &testFakeAzureClient{t: t}, memCacheClient)
+	require.NoError(t, err)
+
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+
+	rr := httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", claims))
+	require.Equal(t, http.StatusOK, rr.Code)
+	_ = testRunHealthChecks(t, ctx, healthClient, impersonationHealthCheck)
+
+	testRotateTokenFile(t, tokenPath, "second-token")
+
+	rr = httptest.NewRecorder()
+	proxyHandlers.proxy(ctx, up)(rr, testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", claims))
+	require.Equal(t, http.StatusOK, rr.Code)
+	_ = testRunHealthChecks(t, ctx, healthClient, impersonationHealthCheck)
+
+	require.Equal(t, []string{"Bearer first-token", "Bearer first-token", "Bearer second-token", "Bearer second-token"}, receivedAuthorization)
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) token() (string, error) {
+	return string(s), nil
+}
+
+func testRequireToken(t *testing.T, source tokenSource, expectedToken string) {
+	t.Helper()
+
+	token, err := source.token()
+	require.NoError(t, err)
+	require.Equal(t, expectedToken, token)
+}
+
+// testRotateTokenFile replaces the token file the same way the kubelet does for projected tokens, by writing a new
+// file and renaming it
+func testRotateTokenFile(t *testing.T, path string, token string) {
+	t.Helper()
+
+	tmpPath := fmt.Sprintf("%s.tmp", path)
+	testCreateTemporaryFile(t, tmpPath, token)
+	require.NoError(t, os.Rename(tmpPath, path))
+}
+
+func testNewUnsignedJWT(t *testing.T, expiry time.Time) string {
+	t.Helper()
+
+	header := base64.RawURLEncoding.EncodeToString([]byte("{\"alg\":\"none\"}"))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("{\"sub\":\"ze-sub\",\"exp\":%d}", expiry.Unix())))
+
+	return fmt.Sprintf("%s.%s.", header, payload)
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/xenitab/azad-kube-proxy"
+	tracingServiceName = "azad-kube-proxy"
+)
+
+type tracingContextKey struct{}
+
+// tracing exports the spans of the proxy using OTLP/HTTP, the trace context is propagated to the Kubernetes API
+// using the traceparent header
+type tracing struct {
+	provider    *sdktrace.TracerProvider
+	propagators propagation.TextMapPropagator
+}
+
+func newTracing(ctx context.Context, cfg *config) (*tracing, error) {
+	if cfg.TracingOTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	if cfg.TracingSampleRatio < 0 || cfg.TracingSampleRatio > 1 {
+		return nil, fmt.Errorf("tracing-sample-ratio needs to be between 0 and 1: %v", cfg.TracingSampleRatio)
+	}
+
+	exporterOptions, err := getOTLPTraceOptions(cfg.TracingOTLPEndpoint, cfg.TracingOTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	// The exporter doesn't connect until the first spans are exported
+	exporter, err := otlptracehttp.New(ctx, exporterOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP trace exporter: %w", err)
+	}
+
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Using tracing: otlp", "endpoint", cfg.TracingOTLPEndpoint, "sampleRatio", cfg.TracingSampleRatio)
+
+	return newTracingWithSpanProcessor(cfg, sdktrace.NewBatchSpanProcessor(exporter)), nil
+}
+
+// newTracingWithSpanProcessor creates the tracer provider, requests with a sampled traceparent are always traced
+func newTracingWithSpanProcessor(cfg *config, spanProcessor sdktrace.SpanProcessor) *tracing {
+	res := resource.NewSchemaless(
+		attribute.String("service.name", tracingServiceName),
+		attribute.String("service.version", cfg.version),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(spanProcessor),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracingSampleRatio))),
+	)
+
+	return &tracing{
+		provider:    provider,
+		propagators: propagation.TraceContext{},
+	}
+}
+
+// getOTLPTraceOptions converts the endpoint url (like http://otel-collector:4318/v1/traces) and the headers
+// (formatted as <key>=<value>) to exporter options
+func getOTLPTraceOptions(endpoint string, headers []string) ([]otlptracehttp.Option, error) {
+	endpointURL, err := parseOTLPEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpointURL.Host),
+	}
+
+	if endpointURL.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	if endpointURL.Path != "" && endpointURL.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpointURL.Path))
+	}
+
+	headerValues, err := parseOTLPHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(headerValues) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(headerValues))
+	}
+
+	return options, nil
+}
+
+// parseOTLPEndpoint parses the endpoint of an OTLP collector, the scheme (http or https) decides if TLS is used
+func parseOTLPEndpoint(endpoint string) (*url.URL, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse OTLP endpoint: %w", err)
+	}
+
+	if endpointURL.Host == "" || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+		return nil, fmt.Errorf("OTLP endpoint needs to be an http or https URL: %s", endpoint)
+	}
+
+	return endpointURL, nil
+}
+
+func parseOTLPHeaders(headers []string) (map[string]string, error) {
+	headerValues := make(map[string]string)
+	for _, header := range headers {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("OTLP header needs to be formatted as <key>=<value>: %s", header)
+		}
+
+		headerValues[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return headerValues, nil
+}
+
+// middleware starts the server span of every request, continuing the trace of the client if it sends a traceparent
+func (t *tracing) middleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, tracingServiceName,
+		otelhttp.WithTracerProvider(t.provider),
+		otelhttp.WithPropagators(t.propagators),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return fmt.Sprintf("%s %s", r.Method, getRouteTemplate(r))
+		}),
+	)
+}
+
+// transport creates a span for the round trip to the upstream and adds the traceparent header to the request
+func (t *tracing) transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithTracerProvider(t.provider),
+		otelhttp.WithPropagators(t.propagators),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return fmt.Sprintf("upstream %s", r.Method)
+		}),
+	)
+}
+
+// close exports the remaining spans
+func (t *tracing) close(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// newTracingContext returns a context with the tracer provider, used by the components of the proxy to start spans
+// without a parent (like the group synchronization)
+func newTracingContext(ctx context.Context, provider trace.TracerProvider) context.Context {
+	return context.WithValue(ctx, tracingContextKey{}, provider)
+}
+
+// startSpan starts a span using the tracer provider of the context, or the tracer provider of the current span. The
+// span isn't recorded if tracing is disabled.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider, ok := ctx.Value(tracingContextKey{}).(trace.TracerProvider)
+	if !ok {
+		provider = trace.SpanFromContext(ctx).TracerProvider()
+	}
+
+	return provider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan records the error (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startGraphRequest starts the span of a request to Microsoft Graph, the returned function ends the span and records
+// the metrics of the request
+func startGraphRequest(ctx context.Context, operation string) (context.Context, func(err error)) {
+	start := time.Now()
+	spanCtx, span := startSpan(ctx, fmt.Sprintf("graph %s", operation), attribute.String("graph.operation", operation))
+
+	return spanCtx, func(err error) {
+		observeGraphRequest(ctx, operation, start, err)
+		endSpan(span, err)
+	}
+}
+
+func getRouteTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "/"
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "/"
+	}
+
+	return template
+}
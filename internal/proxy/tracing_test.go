@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewTracing(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	var mu sync.Mutex
+	var receivedPaths []string
+	var receivedHeaders []string
+	fakeCollector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		receivedPaths = append(receivedPaths, r.URL.Path)
+		receivedHeaders = append(receivedHeaders, r.Header.Get("X-Scope-OrgID"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fakeCollector.Close()
+
+	cases := []struct {
+		testDescription     string
+		cfg                 *config
+		expectedNil         bool
+		expectedErrContains string
+	}{
+		{
+			testDescription: "disabled",
+			cfg:             &config{TracingSampleRatio: 1},
+			expectedNil:     true,
+		},
+		{
+			testDescription:     "invalid sample ratio",
+			cfg:                 &config{TracingOTLPEndpoint: fakeCollector.URL, TracingSampleRatio: 1.5},
+			expectedErrContains: "tracing-sample-ratio needs to be between 0 and 1",
+		},
+		{
+			testDescription:     "endpoint without scheme",
+			cfg:                 &config{TracingOTLPEndpoint: "otel-collector:4318", TracingSampleRatio: 1},
+			expectedErrContains: "OTLP endpoint needs to be an http or https URL",
+		},
+		{
+			testDescription:     "invalid header",
+			cfg:                 &config{TracingOTLPEndpoint: fakeCollector.URL, TracingOTLPHeaders: []string{"X-Scope-OrgID"}, TracingSampleRatio: 1},
+			expectedErrContains: "OTLP header needs to be formatted as <key>=<value>",
+		},
+		{
+			testDescription: "valid",
+			cfg:             &config{TracingOTLPEndpoint: fakeCollector.URL + "/v1/traces", TracingOTLPHeaders: []string{"X-Scope-OrgID=ze-tenant"}, TracingSampleRatio: 1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.testDescription, func(t *testing.T) {
+			tr, err := newTracing(ctx, c.cfg)
+			if c.expectedErrContains != "" {
+				require.ErrorContains(t, err, c.expectedErrContains)
+				return
+			}
+
+			require.NoError(t, err)
+			if c.expectedNil {
+				require.Nil(t, tr)
+				return
+			}
+
+			// The remaining spans are exported when tracing is closed
+			_, span := startSpan(newTracingContext(ctx, tr.provider), "ze-span")
+			span.End()
+
+			require.NoError(t, tr.close(ctx))
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, []string{"/v1/traces"}, receivedPaths)
+			require.Equal(t, []string{"ze-tenant"}, receivedHeaders)
+		})
+	}
+}
+
+func TestTracingProxyHandler(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	exporter := tracetest.NewInMemoryExporter()
+	tr := newTracingWithSpanProcessor(&config{TracingSampleRatio: 1}, sdktrace.NewSimpleSpanProcessor(exporter))
+	ctx = newTracingContext(ctx, tr.provider)
+
+	var receivedTraceparent string
+	fakeAPIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedTraceparent = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte("{\"fake\": true}"))
+	}))
+	defer fakeAPIServer.Close()
+
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	up := testNewUpstream(t, fakeAPIServer.URL)
+	up.reverseProxy.Transport = tr.transport(http.DefaultTransport)
+
+	// The trace of the client is continued
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := testNewClaimsRequest(t, http.MethodGet, "/api/v1/namespaces/default/pods", testNewExternalClaims(t, "ze-sub", "ze-username", nil))
+	req.Header.Set("traceparent", "00-"+clientTraceID+"-00f067aa0ba902b7-01")
+
+	rr := httptest.NewRecorder()
+	tr.middleware(http.HandlerFunc(proxyHandlers.proxy(ctx, up))).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	spans := testSpansByName(t, exporter)
+	require.Contains(t, spans, "GET /")
+	require.Contains(t, spans, "cache get user")
+	require.Contains(t, spans, "user get user")
+	require.Contains(t, spans, "proxy authorize")
+	require.Contains(t, spans, "upstream GET")
+
+	serverSpan := spans["GET /"]
+	require.Equal(t, clientTraceID, serverSpan.SpanContext.TraceID().String())
+	for _, name := range []string{"cache get user", "user get user", "proxy authorize", "upstream GET"} {
+		require.Equal(t, serverSpan.SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+	}
+
+	// The traceparent sent to the Kubernetes API contains the span of the upstream round trip
+	upstreamSpan := spans["upstream GET"]
+	require.Equal(t, "00-"+clientTraceID+"-"+upstreamSpan.SpanContext.SpanID().String()+"-01", receivedTraceparent)
+}
+
+func TestTracingOIDCHandler(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tr := newTracingWithSpanProcessor(&config{TracingSampleRatio: 1}, sdktrace.NewSimpleSpanProcessor(exporter))
+
+	called := false
+	oidcHandler := newOIDCHandler(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}, "ze-tenant", "ze-client")
+
+	rr := httptest.NewRecorder()
+	tr.middleware(oidcHandler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.False(t, called)
+
+	spans := testSpansByName(t, exporter)
+	require.Contains(t, spans, "oidc validate token")
+	require.Equal(t, spans["GET /"].SpanContext.SpanID(), spans["oidc validate token"].Parent.SpanID())
+	require.Equal(t, codes.Error, spans["oidc validate token"].Status.Code)
+	require.Equal(t, "token rejected", spans["oidc validate token"].Status.Description)
+}
+
+func TestStartGraphRequest(t *testing.T) {
+	ctx, metricsClient := testNewMetricsContext(t, logr.NewContext(context.Background(), logr.Discard()))
+
+	exporter := tracetest.NewInMemoryExporter()
+	tr := newTracingWithSpanProcessor(&config{TracingSampleRatio: 1}, sdktrace.NewSimpleSpanProcessor(exporter))
+	ctx = newTracingContext(ctx, tr.provider)
+
+	graphCtx, end := startGraphRequest(ctx, "list_groups")
+	require.True(t, trace.SpanFromContext(graphCtx).IsRecording())
+	end(errors.New("fake error"))
+
+	spans := testSpansByName(t, exporter)
+	require.Contains(t, spans, "graph list_groups")
+	require.Equal(t, codes.Error, spans["graph list_groups"].Status.Code)
+	require.Equal(t, float64(1), testMetricValue(t, metricsClient, metricsGraphRequestErrors, "list_groups"))
+
+	// Spans aren't recorded without a tracer provider
+	graphCtx, end = startGraphRequest(context.Background(), "list_groups")
+	require.False(t, trace.SpanFromContext(graphCtx).IsRecording())
+	end(nil)
+}
+
+func testSpansByName(t *testing.T, exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	t.Helper()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	return spans
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8sapimachineryschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultUpstreamName = "default"
+
+// upstreamsConfig is the format of the file configured with --upstreams-config-path
+type upstreamsConfig struct {
+	Upstreams []upstreamConfig `json:"upstreams"`
+}
+
+type upstreamConfig struct {
+	Name                      string   `json:"name"`
+	Default                   bool     `json:"default"`
+	Hosts                     []string `json:"hosts"`
+	PathPrefix                string   `json:"pathPrefix"`
+	ClientID                  string   `json:"clientID"`
+	KubernetesAPIHost         string   `json:"kubernetesAPIHost"`
+	KubernetesAPIPort         int      `json:"kubernetesAPIPort"`
+	KubernetesAPITLS          *bool    `json:"kubernetesAPITLS"`
+	KubernetesAPIValidateCert *bool    `json:"kubernetesAPIValidateCert"`
+	KubernetesAPICACertPath   string   `json:"kubernetesAPICACertPath"`
+	KubernetesAPITokenPath    string   `json:"kubernetesAPITokenPath"`
+}
+
+// upstream is a Kubernetes cluster the proxy forwards requests to. Every upstream has its own credentials, CA and
+// Azure AD application (audience).
+type upstream struct {
+	name       string
+	isDefault  bool
+	hosts      []string
+	pathPrefix string
+	clientID   string
+
+	kubernetesURL          *url.URL
+	kubernetesValidateCert bool
+	kubernetesRootCA       *x509.CertPool
+	kubernetesRootCAData   []byte
+	kubernetesToken        tokenSource
+
+	reverseProxy *httputil.ReverseProxy
+}
+
+// newUpstreams returns the upstreams from the upstreams config file, or a single default upstream based on the
+// kubernetes-api-* flags if no file is configured
+func newUpstreams(ctx context.Context, cfg *config) ([]*upstream, error) {
+	if cfg.UpstreamsConfigPath == "" {
+		tls := cfg.KubernetesAPITLS
+		validateCert := cfg.KubernetesAPIValidateCert
+		up, err := newUpstream(ctx, cfg, upstreamConfig{
+			Name:                      defaultUpstreamName,
+			Default:                   true,
+			KubernetesAPIHost:         cfg.KubernetesAPIHost,
+			KubernetesAPIPort:         cfg.KubernetesAPIPort,
+			KubernetesAPITLS:          &tls,
+			KubernetesAPIValidateCert: &validateCert,
+			KubernetesAPICACertPath:   cfg.KubernetesAPICACertPath,
+			KubernetesAPITokenPath:    cfg.KubernetesAPITokenPath,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return []*upstream{up}, nil
+	}
+
+	b, err := os.ReadFile(cfg.UpstreamsConfigPath) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("unable to read upstreams config: %w", err)
+	}
+
+	var upstreamsCfg upstreamsConfig
+	err = yaml.UnmarshalStrict(b, &upstreamsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse upstreams config %q: %w", cfg.UpstreamsConfigPath, err)
+	}
+
+	if len(upstreamsCfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams configured in %q", cfg.UpstreamsConfigPath)
+	}
+
+	names := make(map[string]struct{})
+	hosts := make(map[string]string)
+	defaultCount := 0
+	upstreams := []*upstream{}
+	for _, upstreamCfg := range upstreamsCfg.Upstreams {
+		up, err := newUpstream(ctx, cfg, upstreamCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := names[up.name]; ok {
+			return nil, fmt.Errorf("duplicate upstream name %q", up.name)
+		}
+		names[up.name] = struct{}{}
+
+		for _, host := range up.hosts {
+			key := host + up.pathPrefix
+			if other, ok := hosts[key]; ok {
+				return nil, fmt.Errorf("upstream %q and %q both use host %q with path prefix %q", other, up.name, host, up.pathPrefix)
+			}
+			hosts[key] = up.name
+		}
+
+		if up.isDefault {
+			defaultCount++
+		}
+
+		upstreams = append(upstreams, up)
+	}
+
+	if defaultCount > 1 {
+		return nil, fmt.Errorf("only one upstream can be the default, found: %d", defaultCount)
+	}
+
+	return upstreams, nil
+}
+
+func newUpstream(ctx context.Context, cfg *config, upstreamCfg upstreamConfig) (*upstream, error) {
+	if upstreamCfg.Name == "" {
+		return nil, fmt.Errorf("upstream name is required")
+	}
+
+	if upstreamCfg.KubernetesAPIHost == "" {
+		return nil, fmt.Errorf("upstream %q: kubernetesAPIHost is required", upstreamCfg.Name)
+	}
+
+	if upstreamCfg.KubernetesAPITokenPath == "" {
+		return nil, fmt.Errorf("upstream %q: kubernetesAPITokenPath is required", upstreamCfg.Name)
+	}
+
+	pathPrefix := strings.TrimSuffix(upstreamCfg.PathPrefix, "/")
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		return nil, fmt.Errorf("upstream %q: pathPrefix needs to start with a slash: %s", upstreamCfg.Name, upstreamCfg.PathPrefix)
+	}
+
+	if !upstreamCfg.Default && len(upstreamCfg.Hosts) == 0 && pathPrefix == "" {
+		return nil, fmt.Errorf("upstream %q: hosts or pathPrefix is required for upstreams that aren't the default", upstreamCfg.Name)
+	}
+
+	hosts := []string{}
+	for _, host := range upstreamCfg.Hosts {
+		hosts = append(hosts, normalizeHost(host))
+	}
+
+	port := upstreamCfg.KubernetesAPIPort
+	if port == 0 {
+		port = 443
+	}
+
+	tls := true
+	if upstreamCfg.KubernetesAPITLS != nil {
+		tls = *upstreamCfg.KubernetesAPITLS
+	}
+
+	validateCert := true
+	if upstreamCfg.KubernetesAPIValidateCert != nil {
+		validateCert = *upstreamCfg.KubernetesAPIValidateCert
+	}
+
+	clientID := upstreamCfg.ClientID
+	if clientID == "" {
+		clientID = cfg.AzureClientID
+	}
+
+	kubernetesURL, err := getKubernetesAPIUrl(upstreamCfg.KubernetesAPIHost, port, tls)
+	if err != nil {
+		return nil, err
+	}
+
+	kubernetesToken, err := newFileTokenSource(ctx, upstreamCfg.KubernetesAPITokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: unable to read token: %w", upstreamCfg.Name, err)
+	}
+
+	var kubernetesRootCAData []byte
+	var kubernetesRootCA *x509.CertPool
+	if validateCert {
+		if upstreamCfg.KubernetesAPICACertPath == "" {
+			return nil, fmt.Errorf("upstream %q: kubernetesAPICACertPath is required when the certificate is validated", upstreamCfg.Name)
+		}
+
+		kubernetesRootCAString, err := getStringFromFile(ctx, upstreamCfg.KubernetesAPICACertPath)
+		if err != nil {
+			return nil, err
+		}
+		kubernetesRootCAData = []byte(kubernetesRootCAString)
+
+		kubernetesRootCA, err = getCertificate(ctx, upstreamCfg.KubernetesAPICACertPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &upstream{
+		name:                   upstreamCfg.Name,
+		isDefault:              upstreamCfg.Default,
+		hosts:                  hosts,
+		pathPrefix:             pathPrefix,
+		clientID:               clientID,
+		kubernetesURL:          kubernetesURL,
+		kubernetesValidateCert: validateCert,
+		kubernetesRootCA:       kubernetesRootCA,
+		kubernetesRootCAData:   kubernetesRootCAData,
+		kubernetesToken:        kubernetesToken,
+	}, nil
+}
+
+func (up *upstream) getReverseProxy(errorHandler func(http.ResponseWriter, *http.Request, error)) *httputil.ReverseProxy {
+	reverseProxy := httputil.NewSingleHostReverseProxy(up.kubernetesURL)
+	reverseProxy.Transport = &http.Transport{
+		TLSClientConfig: getProxyTLSClientConfig(up.kubernetesValidateCert, up.kubernetesRootCA),
+	}
+	reverseProxy.ErrorHandler = errorHandler
+
+	return reverseProxy
+}
+
+// matches returns if the request matches the upstream and the length of the matched path prefix
+func (up *upstream) matches(host string, path string) (bool, int) {
+	if len(up.hosts) > 0 && !sliceContains(up.hosts, host) {
+		return false, 0
+	}
+
+	if up.pathPrefix != "" && path != up.pathPrefix && !strings.HasPrefix(path, up.pathPrefix+"/") {
+		return false, 0
+	}
+
+	return true, len(up.pathPrefix)
+}
+
+// upstreamRouter selects the upstream based on the Host header and path prefix. Upstreams matching the host are
+// preferred over upstreams without hosts, and the longest matching path prefix wins. Requests not matching any
+// upstream are sent to the default upstream (if configured).
+type upstreamRouter struct {
+	upstreams       []*upstream
+	defaultUpstream *upstream
+	handlers        map[string]http.Handler
+}
+
+func newUpstreamRouter(upstreams []*upstream, handlerFn func(up *upstream) http.Handler) *upstreamRouter {
+	router := &upstreamRouter{
+		upstreams: upstreams,
+		handlers:  make(map[string]http.Handler),
+	}
+
+	for _, up := range upstreams {
+		if up.isDefault {
+			router.defaultUpstream = up
+		}
+		router.handlers[up.name] = handlerFn(up)
+	}
+
+	return router
+}
+
+func (router *upstreamRouter) match(r *http.Request) *upstream {
+	host := normalizeHost(r.Host)
+
+	var match *upstream
+	matchHost := false
+	matchPrefixLength := -1
+	for _, up := range router.upstreams {
+		ok, prefixLength := up.matches(host, r.URL.Path)
+		if !ok {
+			continue
+		}
+
+		upMatchHost := len(up.hosts) > 0
+		if match == nil || (upMatchHost && !matchHost) || (upMatchHost == matchHost && prefixLength > matchPrefixLength) {
+			match = up
+			matchHost = upMatchHost
+			matchPrefixLength = prefixLength
+		}
+	}
+
+	if match == nil {
+		return router.defaultUpstream
+	}
+
+	return match
+}
+
+func (router *upstreamRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logr.FromContextOrDiscard(r.Context())
+
+	up := router.match(r)
+	if up == nil {
+		setAuditDenialReason(r.Context(), "no matching upstream")
+		status := k8sapierrors.NewNotFound(k8sapimachineryschema.GroupResource{}, r.URL.Path).ErrStatus
+		status.Message = fmt.Sprintf("no upstream cluster configured for host %q and path %q", r.Host, r.URL.Path)
+		err := writeKubernetesStatus(w, status)
+		if err != nil {
+			log.Error(err, "Could not write response data")
+		}
+		return
+	}
+
+	if up.pathPrefix != "" {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, up.pathPrefix)
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, up.pathPrefix)
+			if r.URL.RawPath == "" {
+				r.URL.RawPath = "/"
+			}
+		}
+	}
+
+	setAuditUpstream(r.Context(), up.name, r)
+
+	router.handlers[up.name].ServeHTTP(w, r)
+}
+
+func normalizeHost(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
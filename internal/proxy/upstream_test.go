@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUpstreams(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	tmpDir := t.TempDir()
+	tokenPath := filepath.Join(tmpDir, "token")
+	testCreateTemporaryFile(t, tokenPath, "fake-token")
+
+	cases := []struct {
+		upstreamsConfig     string
+		cfg                 *config
+		expectedNames       []string
+		expectedErrContains string
+	}{
+		{
+			cfg: &config{
+				AzureClientID:             "ze-client-id",
+				KubernetesAPIHost:         "kubernetes.default",
+				KubernetesAPIPort:         443,
+				KubernetesAPITLS:          true,
+				KubernetesAPIValidateCert: false,
+				KubernetesAPITokenPath:    tokenPath,
+			},
+			expectedNames: []string{defaultUpstreamName},
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  hosts: ["prod.example.com"]
+  clientID: prod-client-id
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+- name: dev
+  default: true
+  pathPrefix: /dev/
+  kubernetesAPIHost: dev-api
+  kubernetesAPIPort: 6443
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:           &config{AzureClientID: "ze-client-id"},
+			expectedNames: []string{"prod", "dev"},
+		},
+		{
+			upstreamsConfig:     "upstreams: []",
+			cfg:                 &config{},
+			expectedErrContains: "no upstreams configured",
+		},
+		{
+			upstreamsConfig:     "upstreams:\n- name: prod\n  fake: true",
+			cfg:                 &config{},
+			expectedErrContains: "unable to parse upstreams config",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  default: true
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+- name: prod
+  pathPrefix: /prod
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "duplicate upstream name \"prod\"",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  hosts: ["k8s.example.com"]
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+- name: dev
+  hosts: ["K8S.example.com:443"]
+  kubernetesAPIHost: dev-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "upstream \"prod\" and \"dev\" both use host \"k8s.example.com\"",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  default: true
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+- name: dev
+  default: true
+  kubernetesAPIHost: dev-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "only one upstream can be the default",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "hosts or pathPrefix is required",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  pathPrefix: prod
+  kubernetesAPIHost: prod-api
+  kubernetesAPIValidateCert: false
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "pathPrefix needs to start with a slash",
+		},
+		{
+			upstreamsConfig: fmt.Sprintf(`
+upstreams:
+- name: prod
+  default: true
+  kubernetesAPIHost: prod-api
+  kubernetesAPITokenPath: %[1]s
+`, tokenPath),
+			cfg:                 &config{},
+			expectedErrContains: "kubernetesAPICACertPath is required when the certificate is validated",
+		},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		if c.upstreamsConfig != "" {
+			c.cfg.UpstreamsConfigPath = filepath.Join(tmpDir, fmt.Sprintf("upstreams-%d.yaml", i))
+			testCreateTemporaryFile(t, c.cfg.UpstreamsConfigPath, c.upstreamsConfig)
+		}
+
+		upstreams, err := newUpstreams(ctx, c.cfg)
+		if c.expectedErrContains != "" {
+			require.ErrorContains(t, err, c.expectedErrContains)
+			continue
+		}
+
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, up := range upstreams {
+			names = append(names, up.name)
+			token, err := up.kubernetesToken.token()
+			require.NoError(t, err)
+			require.Equal(t, "fake-token", token)
+		}
+		require.Equal(t, c.expectedNames, names)
+	}
+
+	t.Run("upstream defaults", func(t *testing.T) {
+		up, err := newUpstream(ctx, &config{AzureClientID: "ze-client-id"}, upstreamConfig{
+			Name:                      "dev",
+			PathPrefix:                "/dev/",
+			Hosts:                     []string{"Dev.Example.com:8443"},
+			KubernetesAPIHost:         "dev-api",
+			KubernetesAPIValidateCert: testToPtr(t, false),
+			KubernetesAPITokenPath:    tokenPath,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "https://dev-api:443", up.kubernetesURL.String())
+		require.Equal(t, "ze-client-id", up.clientID)
+		require.Equal(t, "/dev", up.pathPrefix)
+		require.Equal(t, []string{"dev.example.com"}, up.hosts)
+	})
+}
+
+func TestUpstreamRouterMatch(t *testing.T) {
+	upstreams := []*upstream{
+		{name: "default", isDefault: true},
+		{name: "prod", hosts: []string{"prod.example.com"}},
+		{name: "prod-eu", hosts: []string{"prod.example.com"}, pathPrefix: "/eu"},
+		{name: "dev", pathPrefix: "/dev"},
+		{name: "dev-eu", pathPrefix: "/dev/eu"},
+	}
+
+	router := newUpstreamRouter(upstreams, func(up *upstream) http.Handler {
+		return http.NotFoundHandler()
+	})
+
+	cases := []struct {
+		host             string
+		path             string
+		expectedUpstream string
+	}{
+		{host: "proxy.example.com", path: "/api/v1/pods", expectedUpstream: "default"},
+		{host: "prod.example.com", path: "/api/v1/pods", expectedUpstream: "prod"},
+		{host: "PROD.example.com:443", path: "/api/v1/pods", expectedUpstream: "prod"},
+		{host: "prod.example.com", path: "/eu/api/v1/pods", expectedUpstream: "prod-eu"},
+		{host: "prod.example.com", path: "/dev/api/v1/pods", expectedUpstream: "prod"},
+		{host: "proxy.example.com", path: "/dev/api/v1/pods", expectedUpstream: "dev"},
+		{host: "proxy.example.com", path: "/dev", expectedUpstream: "dev"},
+		{host: "proxy.example.com", path: "/dev/eu/api/v1/pods", expectedUpstream: "dev-eu"},
+		{host: "proxy.example.com", path: "/development/api/v1/pods", expectedUpstream: "default"},
+	}
+
+	for i, c := range cases {
+		t.Logf("Test iteration %d", i)
+
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Host = c.host
+
+		up := router.match(req)
+		require.NotNil(t, up)
+		require.Equal(t, c.expectedUpstream, up.name)
+	}
+
+	t.Run("no default upstream", func(t *testing.T) {
+		router := newUpstreamRouter(upstreams[1:], func(up *upstream) http.Handler {
+			return http.NotFoundHandler()
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		req.Host = "proxy.example.com"
+
+		require.Nil(t, router.match(req))
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusNotFound, rr.Code)
+		require.Contains(t, rr.Body.String(), "no upstream cluster configured")
+	})
+}
+
+func TestProxyHandlerMultipleUpstreams(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+
+	type receivedRequest struct {
+		path          string
+		authorization string
+	}
+
+	var received []receivedRequest
+	newFakeAPIServer := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = append(received, receivedRequest{
+				path:          fmt.Sprintf("%s:%s", name, r.URL.Path),
+				authorization: r.Header.Get("Authorization"),
+			})
+			_, _ = w.Write([]byte("{\"fake\": true}"))
+		}))
+	}
+
+	prodAPIServer := newFakeAPIServer("prod")
+	defer prodAPIServer.Close()
+	devAPIServer := newFakeAPIServer("dev")
+	defer devAPIServer.Close()
+
+	tmpDir := t.TempDir()
+	upstreamConfigs := []upstreamConfig{}
+	for _, s := range []struct {
+		name       string
+		server     *httptest.Server
+		hosts      []string
+		pathPrefix string
+	}{
+		{name: "prod", server: prodAPIServer, hosts: []string{"prod.example.com"}},
+		{name: "dev", server: devAPIServer, pathPrefix: "/dev"},
+	} {
+		tokenPath := filepath.Join(tmpDir, fmt.Sprintf("%s-token", s.name))
+		testCreateTemporaryFile(t, tokenPath, fmt.Sprintf("%s-token", s.name))
+
+		caPath := filepath.Join(tmpDir, fmt.Sprintf("%s-ca.crt", s.name))
+		caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+		testCreateTemporaryFile(t, caPath, string(caPEM))
+
+		host, port := testSplitServerHostPort(t, s.server)
+		upstreamConfigs = append(upstreamConfigs, upstreamConfig{
+			Name:                    s.name,
+			Hosts:                   s.hosts,
+			PathPrefix:              s.pathPrefix,
+			KubernetesAPIHost:       host,
+			KubernetesAPIPort:       port,
+			KubernetesAPICACertPath: caPath,
+			KubernetesAPITokenPath:  tokenPath,
+		})
+	}
+
+	cfg := &config{
+		AzureADMaxGroupCount: testFakeMaxGroups,
+		GroupIdentifier:      "NAME",
+	}
+
+	memCacheClient, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	userClient := newTestFakeUserClient(t, "ze-username", "ze-object-id", nil, nil)
+
+	proxyHandlers, err := newHandlers(ctx, cfg, memCacheClient, userClient, newTestFakeHealthClient(t, true, nil, true, nil))
+	require.NoError(t, err)
+
+	upstreams := []*upstream{}
+	for _, upstreamCfg := range upstreamConfigs {
+		up, err := newUpstream(ctx, cfg, upstreamCfg)
+		require.NoError(t, err)
+		up.reverseProxy = up.getReverseProxy(proxyHandlers.error(ctx, up.name))
+		upstreams = append(upstreams, up)
+	}
+
+	router := newUpstreamRouter(upstreams, func(up *upstream) http.Handler {
+		return http.HandlerFunc(proxyHandlers.proxy(ctx, up))
+	})
+
+	claims := testNewExternalClaims(t, "ze-sub", "ze-username", nil)
+
+	req := testNewClaimsRequest(t, http.MethodGet, "/api/v1/pods", claims)
+	req.Host = "prod.example.com"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	req = testNewClaimsRequest(t, http.MethodGet, "/dev/api/v1/pods", claims)
+	req.Host = "proxy.example.com"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	require.Equal(t, []receivedRequest{
+		{path: "prod:/api/v1/pods", authorization: "Bearer prod-token"},
+		{path: "dev:/api/v1/pods", authorization: "Bearer dev-token"},
+	}, received)
+}
+
+func testSplitServerHostPort(t *testing.T, server *httptest.Server) (string, int) {
+	t.Helper()
+
+	host, portString, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	port, err := strconv.Atoi(portString)
+	require.NoError(t, err)
+
+	return host, port
+}
@@ -6,26 +6,28 @@ import (
 
 type User interface {
 	getUser(ctx context.Context, username, objectID string) (userModel, error)
+	getUserFromGroupIDs(ctx context.Context, username, objectID string, groupIDs []string) (userModel, error)
 }
 
 type user struct {
 	azure Azure
+	cache Cache
 
 	cfg *config
 }
 
-func newUser(cfg *config, azureClient Azure) User {
+func newUser(cfg *config, azureClient Azure, cacheClient Cache) User {
 	return &user{
 		azure: azureClient,
+		cache: cacheClient,
 		cfg:   cfg,
 	}
 }
 
 func (u *user) getUser(ctx context.Context, username, objectID string) (userModel, error) {
-	userType := normalUserModelType
-	if username == "" {
+	userType := getUserModelType(username)
+	if userType == servicePrincipalUserModelType {
 		username = objectID
-		userType = servicePrincipalUserModelType
 	}
 
 	groups, err := u.azure.getUserGroups(ctx, objectID, userType)
@@ -42,3 +44,40 @@ func (u *user) getUser(ctx context.Context, username, objectID string) (userMode
 
 	return user, nil
 }
+
+// getUserFromGroupIDs resolves the group object IDs (from the groups claim of the token) using the group cache
+// instead of asking Microsoft Graph. Groups not found in the cache (not synchronized / filtered) are ignored.
+func (u *user) getUserFromGroupIDs(ctx context.Context, username, objectID string, groupIDs []string) (userModel, error) {
+	userType := getUserModelType(username)
+	if userType == servicePrincipalUserModelType {
+		username = objectID
+	}
+
+	var groups []groupModel
+	for _, groupID := range groupIDs {
+		group, found, err := u.cache.getGroup(ctx, groupID)
+		if err != nil {
+			return userModel{}, err
+		}
+		if found {
+			groups = append(groups, group)
+		}
+	}
+
+	user := userModel{
+		Username: username,
+		ObjectID: objectID,
+		Groups:   groups,
+		Type:     userType,
+	}
+
+	return user, nil
+}
+
+func getUserModelType(username string) userModelType {
+	if username == "" {
+		return servicePrincipalUserModelType
+	}
+
+	return normalUserModelType
+}
@@ -30,21 +30,21 @@ func TestGetUser(t *testing.T) {
 		expectedErrContains string
 	}{
 		{
-			userClient:          newUser(cfg, azureClient),
+			userClient:          newUser(cfg, azureClient, nil),
 			username:            "",
 			objectID:            "00000000-0000-0000-0000-000000000000",
 			expectedUserType:    servicePrincipalUserModelType,
 			expectedErrContains: "",
 		},
 		{
-			userClient:          newUser(cfg, azureClient),
+			userClient:          newUser(cfg, azureClient, nil),
 			username:            "username",
 			objectID:            "00000000-0000-0000-0000-000000000000",
 			expectedUserType:    normalUserModelType,
 			expectedErrContains: "",
 		},
 		{
-			userClient:          newUser(cfg, azureClientError),
+			userClient:          newUser(cfg, azureClientError, nil),
 			username:            "username",
 			objectID:            "00000000-0000-0000-0000-000000000000",
 			expectedUserType:    normalUserModelType,
@@ -64,6 +64,46 @@ func TestGetUser(t *testing.T) {
 	}
 }
 
+func TestGetUserFromGroupIDs(t *testing.T) {
+	ctx := logr.NewContext(context.Background(), logr.Discard())
+	cfg := &config{}
+	azureClient := &testFakeAzureClient{
+		fakeError: errors.New("Graph should not be called"),
+		t:         t,
+	}
+
+	memCache, err := newMemoryCache(5 * time.Minute)
+	require.NoError(t, err)
+	err = memCache.setGroup(ctx, "00000000-0000-0000-0000-000000000001", groupModel{Name: "group1", ObjectID: "00000000-0000-0000-0000-000000000001"})
+	require.NoError(t, err)
+	err = memCache.setGroup(ctx, "00000000-0000-0000-0000-000000000002", groupModel{Name: "group2", ObjectID: "00000000-0000-0000-0000-000000000002"})
+	require.NoError(t, err)
+
+	userClient := newUser(cfg, azureClient, memCache)
+
+	t.Run("normal user", func(t *testing.T) {
+		user, err := userClient.getUserFromGroupIDs(ctx, "username", "00000000-0000-0000-0000-000000000000", []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000003"})
+		require.NoError(t, err)
+		require.Equal(t, normalUserModelType, user.Type)
+		require.Equal(t, "username", user.Username)
+		require.Equal(t, []groupModel{{Name: "group1", ObjectID: "00000000-0000-0000-0000-000000000001"}}, user.Groups)
+	})
+
+	t.Run("service principal", func(t *testing.T) {
+		user, err := userClient.getUserFromGroupIDs(ctx, "", "00000000-0000-0000-0000-000000000000", []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"})
+		require.NoError(t, err)
+		require.Equal(t, servicePrincipalUserModelType, user.Type)
+		require.Equal(t, "00000000-0000-0000-0000-000000000000", user.Username)
+		require.Len(t, user.Groups, 2)
+	})
+
+	t.Run("cache error", func(t *testing.T) {
+		errorUserClient := newUser(cfg, azureClient, newTestFakeCacheClient(t, "", "", nil, false, errors.New("cache error")))
+		_, err := errorUserClient.getUserFromGroupIDs(ctx, "username", "00000000-0000-0000-0000-000000000000", []string{"00000000-0000-0000-0000-000000000001"})
+		require.ErrorContains(t, err, "cache error")
+	})
+}
+
 type testFakeAzureClient struct {
 	fakeError error
 	t         *testing.T
@@ -80,7 +120,32 @@ func (client *testFakeAzureClient) startSyncGroups(ctx context.Context, syncInte
 	return nil, nil, nil
 }
 
+func (client *testFakeAzureClient) syncGroups(ctx context.Context, syncReason string) error {
+	client.t.Helper()
+	return client.fakeError
+}
+
+func (client *testFakeAzureClient) lastGroupSync() time.Time {
+	client.t.Helper()
+	return time.Now()
+}
+
 func (client *testFakeAzureClient) valid(ctx context.Context) bool {
 	client.t.Helper()
 	return true
 }
+
+func (client *testFakeAzureClient) validCredentials(ctx context.Context) error {
+	client.t.Helper()
+	return client.fakeError
+}
+
+func (client *testFakeAzureClient) validGraphPermissions(ctx context.Context) error {
+	client.t.Helper()
+	return client.fakeError
+}
+
+func (client *testFakeAzureClient) validGraphAccess(ctx context.Context) error {
+	client.t.Helper()
+	return client.fakeError
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/go-logr/logr"
+	k8sapimachinerymetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func getCertificate(ctx context.Context, path string) (*x509.CertPool, error) {
@@ -144,3 +146,19 @@ func sliceContains(s []string, str string) bool {
 	}
 	return false
 }
+
+// writeKubernetesStatus writes a Kubernetes Status as the response, the same way the Kubernetes API does for errors
+func writeKubernetesStatus(w http.ResponseWriter, status k8sapimachinerymetav1.Status) error {
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	_, err = w.Write(b)
+	return err
+}